@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entity types recorded in the audit log.
+const (
+	auditEntityProduct       = "product"
+	auditEntityVariant       = "variant"
+	auditEntityReview        = "review"
+	auditEntityImage         = "image"
+	auditEntityCategory      = "category"
+	auditEntityPriceSchedule = "price_schedule"
+	auditEntityPriceOverride = "price_override"
+	auditEntityExchangeRate  = "exchange_rate"
+)
+
+// productAuditFields returns the audited fields of a product keyed by column name.
+func productAuditFields(p *dbProduct) map[string]interface{} {
+	if p == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"name":        p.Name,
+		"description": p.Description,
+		"price_cents": p.PriceCents,
+		"currency":    p.Currency,
+		"category":    p.Category,
+		"category_id": p.CategoryID,
+		"in_stock":    p.InStock,
+		"quantity":    p.Quantity,
+	}
+}
+
+// variantAuditFields returns the audited fields of a variant keyed by column name.
+func variantAuditFields(v *dbVariant) map[string]interface{} {
+	if v == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"sku":         v.SKU,
+		"name":        v.Name,
+		"price_cents": v.PriceCents,
+		"quantity":    v.Quantity,
+		"in_stock":    v.InStock,
+		"attributes":  v.Attributes,
+		"sort_order":  v.SortOrder,
+	}
+}
+
+// reviewAuditFields returns the audited fields of a review keyed by column name.
+func reviewAuditFields(r *dbReview) map[string]interface{} {
+	if r == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"author":            r.Author,
+		"rating":            r.Rating,
+		"comment":           r.Comment,
+		"status":            r.Status,
+		"moderation_reason": r.ModerationReason,
+		"reply":             r.Reply,
+	}
+}
+
+// imageAuditFields returns the audited fields of an image keyed by column name.
+func imageAuditFields(img *dbImage) map[string]interface{} {
+	if img == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"variant_id": img.VariantID,
+		"filename":   img.Filename,
+		"checksum":   img.Checksum,
+		"alt_text":   img.AltText,
+		"sort_order": img.SortOrder,
+		"is_primary": img.IsPrimary,
+	}
+}
+
+// categoryAuditFields returns the audited fields of a category keyed by column name.
+func categoryAuditFields(c *dbCategory) map[string]interface{} {
+	if c == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"slug":        c.Slug,
+		"name":        c.Name,
+		"description": c.Description,
+		"parent_id":   c.ParentID,
+	}
+}
+
+// priceScheduleAuditFields returns the audited fields of a price schedule keyed by column name.
+func priceScheduleAuditFields(ps *dbPriceSchedule) map[string]interface{} {
+	if ps == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"variant_id":           ps.VariantID,
+		"price_cents":          ps.PriceCents,
+		"starts_at":            ps.StartsAt,
+		"ends_at":              ps.EndsAt,
+		"status":               ps.Status,
+		"previous_price_cents": ps.PreviousPriceCents,
+		"note":                 ps.Note,
+	}
+}
+
+// priceOverrideAuditFields returns the audited fields of a price override keyed by column name.
+func priceOverrideAuditFields(po *dbPriceOverride) map[string]interface{} {
+	if po == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"variant_id":  po.VariantID,
+		"currency":    po.Currency,
+		"price_cents": po.PriceCents,
+	}
+}
+
+// stockAuditFields returns the stock fields for a given quantity. Purchases
+// audit these instead of a full snapshot: the decrement is atomic, so the
+// quantity before it is derived from the result rather than read separately.
+func stockAuditFields(quantity int) map[string]interface{} {
+	return map[string]interface{}{
+		"quantity": quantity,
+		"in_stock": quantity > 0,
+	}
+}
+
+// diffFields compares two field sets and returns the fields whose values differ,
+// sorted by field name. A nil before or after set represents a missing entity.
+func diffFields(before, after map[string]interface{}) []FieldChange {
+	names := make(map[string]struct{})
+	for k := range before {
+		names[k] = struct{}{}
+	}
+	for k := range after {
+		names[k] = struct{}{}
+	}
+
+	changes := []FieldChange{}
+	for name := range names {
+		oldVal, hadOld := before[name]
+		newVal, hasNew := after[name]
+		if hadOld && hasNew && reflect.DeepEqual(oldVal, newVal) {
+			continue
+		}
+		changes = append(changes, FieldChange{Field: name, Old: oldVal, New: newVal})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// auditAttempts is how many times an audit entry is written before it is
+// given up as lost.
+const auditAttempts = 3
+
+// auditFailures counts audit entries that could not be recorded, with the
+// most recent error, so /health can report that the trail has gaps.
+type auditFailures struct {
+	mu      sync.Mutex
+	count   int
+	lastErr error
+}
+
+func (f *auditFailures) add(err error) {
+	f.mu.Lock()
+	f.count++
+	f.lastErr = err
+	f.mu.Unlock()
+}
+
+func (f *auditFailures) get() (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.count, f.lastErr
+}
+
+// audit records a mutation in the audit log. The change it describes has
+// already been committed, so a failure cannot roll it back; instead the write
+// is retried, and an entry that still cannot be stored is logged in full as
+// JSON (so it can be replayed) and reported by /health.
+func (s *Server) audit(r *http.Request, entityType string, entityID, productID int, action string, before, after map[string]interface{}) {
+	s.auditAs(clientIdentity(r), entityType, entityID, productID, action, before, after)
+}
+
+// auditAs records a mutation made by actor rather than by a client request,
+// such as a change applied by a background worker.
+func (s *Server) auditAs(actor, entityType string, entityID, productID int, action string, before, after map[string]interface{}) {
+	entry := AuditEntry{
+		ProductID:  productID,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Action:     action,
+		Actor:      actor,
+		Changes:    diffFields(before, after),
+	}
+
+	var err error
+	for attempt := 1; attempt <= auditAttempts; attempt++ {
+		if err = s.store.LogAudit(entry); err == nil {
+			return
+		}
+		time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+	}
+	s.auditFailures.add(err)
+	entry.CreatedAt = time.Now().UTC()
+	lost, _ := json.Marshal(entry)
+	log.Printf("ERROR: audit entry lost after %d attempts: %v: %s", auditAttempts, err, lost)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Permissions guard groups of routes. Each role grants a fixed set of them.
+type permission string
+
+const (
+	permPublic    permission = ""          // no credentials needed
+	permRead      permission = "read"      // catalog, reviews, search and stats
+	permReview    permission = "review"    // posting reviews
+	permCatalog   permission = "catalog"   // product and variant changes, import, deleted products
+	permInventory permission = "inventory" // purchases and orders
+	permModerate  permission = "moderate"  // the review queue, moderating and deleting reviews
+	permAdmin     permission = "admin"     // API keys, exchange rates, the audit log and purges
+)
+
+var rolePermissions = map[string][]permission{
+	RoleViewer:    {permRead, permReview},
+	RoleEditor:    {permRead, permReview, permCatalog},
+	RoleInventory: {permRead, permReview, permInventory},
+	RoleModerator: {permRead, permReview, permModerate},
+	RoleAdmin:     {permRead, permReview, permCatalog, permInventory, permModerate, permAdmin},
+}
+
+// validRole reports whether role can be assigned to an API key.
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// allows reports whether role grants p.
+func allows(role string, p permission) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredPermission maps a request to the permission needed to serve it.
+func requiredPermission(r *http.Request) permission {
+	path := r.URL.Path
+
+	switch {
+	case r.Method == http.MethodOptions,
+		path == "/health",
+		strings.HasPrefix(path, "/static/"),
+		strings.HasPrefix(path, "/media/"):
+		return permPublic
+	case strings.HasPrefix(path, "/admin/"), path == "/audit":
+		return permAdmin
+	case path == "/orders", strings.HasPrefix(path, "/orders/"):
+		return permInventory
+	case path == "/reviews":
+		return permModerate
+	}
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if path == "/products" && r.URL.Query().Get("deleted") != "" {
+			return permCatalog
+		}
+		if strings.HasSuffix(strings.TrimSuffix(path, "/"), "/reviews") {
+			if status := r.URL.Query().Get("status"); status != "" && status != ReviewApproved {
+				return permModerate
+			}
+		}
+		return permRead
+	}
+	if r.Method == http.MethodDelete && strings.HasPrefix(path, "/products/") {
+		if hard, _ := strconv.ParseBool(r.URL.Query().Get("hard")); hard {
+			return permAdmin
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(path, "/purchase"):
+		return permInventory
+	case strings.Contains(path, "/reviews"):
+		path = strings.TrimSuffix(path, "/")
+		switch {
+		case r.Method == http.MethodPost && (strings.HasSuffix(path, "/reviews") || strings.HasSuffix(path, "/vote")):
+			return permReview
+		case strings.HasSuffix(path, "/reply"):
+			return permCatalog
+		}
+		return permModerate
+	}
+	return permCatalog
+}
+
+type principalKey struct{}
+
+// principalFromContext returns the API key that authenticated the request, if any.
+func principalFromContext(ctx context.Context) *APIKey {
+	k, _ := ctx.Value(principalKey{}).(*APIKey)
+	return k
+}
+
+// apiKeyFromRequest extracts a key from "Authorization: Bearer" or X-API-Key.
+func apiKeyFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if scheme, token, ok := strings.Cut(auth, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// authMiddleware authenticates the caller's API key and checks that its role
+// grants the permission the route requires. A key that is presented must be
+// valid even on routes that would otherwise allow anonymous access.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required := requiredPermission(r)
+
+		var principal *APIKey
+		if key := apiKeyFromRequest(r); key != "" {
+			k, err := s.store.AuthenticateAPIKey(key)
+			if errors.Is(err, errNotFound) {
+				unauthorized(w, r, "invalid API key")
+				return
+			}
+			if err != nil {
+				log.Printf("ERROR: failed to authenticate API key: %v", err)
+				writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to authenticate")
+				return
+			}
+			principal = k
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, k))
+		}
+
+		switch {
+		case required == permPublic:
+		case principal == nil:
+			if required != permRead || !s.config.AnonymousReads {
+				unauthorized(w, r, "API key required")
+				return
+			}
+		case !allows(principal.Role, required):
+			writeError(w, r, http.StatusForbidden, codeForbidden, "this API key's role does not permit this request")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="product-catalog"`)
+	writeError(w, r, http.StatusUnauthorized, codeUnauthorized, msg)
+}
+
+// ensureAdminKey makes sure the deployment can be administered. A configured
+// bootstrap key is registered; otherwise, if no admin key exists yet, one is
+// generated and logged once.
+func (s *Server) ensureAdminKey() error {
+	if s.config.BootstrapAdminKey != "" {
+		return s.store.EnsureAPIKey("bootstrap", s.config.BootstrapAdminKey, RoleAdmin)
+	}
+
+	n, err := s.store.CountActiveAdminKeys()
+	if err != nil || n > 0 {
+		return err
+	}
+	key, _, err := s.store.CreateAPIKey("bootstrap", RoleAdmin)
+	if err != nil {
+		return err
+	}
+	log.Printf("No admin API key found; generated one (shown only once): %s", key)
+	return nil
+}
+
+// handleCreateAPIKey handles POST /admin/keys
+func (s *Server) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		writeValidationError(w, r, validationError{{Field: "name", Message: "is required"}})
+		return
+	}
+	if !validRole(req.Role) {
+		writeValidationError(w, r, validationError{{Field: "role", Message: "must be one of viewer, editor, inventory, moderator, admin"}})
+		return
+	}
+
+	key, k, err := s.store.CreateAPIKey(req.Name, req.Role)
+	if err != nil {
+		log.Printf("ERROR: failed to create API key: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to create API key")
+		return
+	}
+	log.Printf("API key %d (%s, %s) issued by %s", k.ID, k.Name, k.Role, clientDisplayName(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreatedAPIKey{APIKey: *k, Key: key})
+}
+
+// handleListAPIKeys handles GET /admin/keys
+func (s *Server) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.store.ListAPIKeys()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list API keys")
+		return
+	}
+	if keys == nil {
+		keys = []APIKey{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// handleRevokeAPIKey handles DELETE /admin/keys/:id
+func (s *Server) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPath(r, "/admin/keys/")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid key ID")
+		return
+	}
+
+	if err := s.store.RevokeAPIKey(id); err != nil {
+		if errors.Is(err, errNotFound) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "API key not found")
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to revoke API key")
+		return
+	}
+	log.Printf("API key %d revoked by %s", id, clientDisplayName(r))
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequiredPermissionByRole(t *testing.T) {
+	roles := []string{RoleViewer, RoleEditor, RoleInventory, RoleModerator, RoleAdmin}
+	const (
+		everyone = "anonymous viewer editor inventory moderator admin"
+		keyed    = "viewer editor inventory moderator admin"
+		editors  = "editor admin"
+		stock    = "inventory admin"
+		mods     = "moderator admin"
+		admins   = "admin"
+	)
+	tests := []struct {
+		method, target string
+		allowed        string
+	}{
+		{"GET", "/health", everyone},
+		{"OPTIONS", "/products", everyone},
+		{"GET", "/static/app.js", everyone},
+		{"GET", "/products", everyone},
+		{"GET", "/products/1", everyone},
+		{"GET", "/search?q=desk", everyone},
+		{"GET", "/reviews/leaderboard", everyone},
+		{"GET", "/products/1/reviews", everyone},
+		{"GET", "/products/1/reviews?status=approved", everyone},
+		{"GET", "/products/1/reviews?status=pending", mods},
+		{"GET", "/products/1/reviews/?status=rejected", mods},
+		{"HEAD", "/products/1/reviews?status=flagged", mods},
+		{"GET", "/products/1/reviews?status=bogus", mods},
+		{"GET", "/products?deleted=only", editors},
+		{"POST", "/products", editors},
+		{"PATCH", "/products/1", editors},
+		{"DELETE", "/products/1", editors},
+		{"POST", "/products/1/restore", editors},
+		{"DELETE", "/products/1?hard=true", admins},
+		{"POST", "/products/1/variants", editors},
+		{"POST", "/products/reprice", editors},
+		{"POST", "/products/1/purchase", stock},
+		{"GET", "/orders", stock},
+		{"POST", "/orders", stock},
+		{"POST", "/orders/1/cancel", stock},
+		{"POST", "/products/1/reviews", keyed},
+		{"POST", "/products/1/reviews/2/vote", keyed},
+		{"PUT", "/products/1/reviews/2/reply", editors},
+		{"DELETE", "/products/1/reviews/2/reply", editors},
+		{"GET", "/reviews", mods},
+		{"POST", "/products/1/reviews/2/approve", mods},
+		{"DELETE", "/products/1/reviews/2", mods},
+		{"GET", "/admin/keys", admins},
+		{"PUT", "/admin/exchange-rates/EUR", admins},
+		{"GET", "/audit", admins},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			required := requiredPermission(httptest.NewRequest(tt.method, tt.target, nil))
+			var got []string
+			// Anonymous callers are limited to public routes and, by
+			// default, reads.
+			if required == permPublic || required == permRead {
+				got = append(got, "anonymous")
+			}
+			for _, role := range roles {
+				if required == permPublic || allows(role, required) {
+					got = append(got, role)
+				}
+			}
+			if strings.Join(got, " ") != tt.allowed {
+				t.Errorf("allowed %q (needs %q), want %q", strings.Join(got, " "), required, tt.allowed)
+			}
+		})
+	}
+}
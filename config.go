@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds runtime settings read from the environment.
+type Config struct {
+	// ReservationTTL is how long an unconfirmed order holds its stock.
+	ReservationTTL time.Duration
+	// ReservationSweepInterval is how often expired reservations are released.
+	ReservationSweepInterval time.Duration
+	// IdempotencyRetention is how long stored responses for Idempotency-Key
+	// requests are kept and replayed.
+	IdempotencyRetention time.Duration
+	// AnonymousReads lets requests without an API key use read-only endpoints.
+	AnonymousReads bool
+	// BootstrapAdminKey, when set, is registered as an admin API key at startup.
+	BootstrapAdminKey string
+	// PriceScheduleInterval is how often due price schedules are applied and
+	// ended sales reverted.
+	PriceScheduleInterval time.Duration
+	// DeletedProductRetention is how long soft-deleted products can still be
+	// restored before they are purged.
+	DeletedProductRetention time.Duration
+	// ReviewBannedWords are words that get a review rejected when they appear
+	// in its author or comment.
+	ReviewBannedWords []string
+	// ReviewAuthorLimit and ReviewClientLimit cap how many reviews one author
+	// name and one client address may post per ReviewVelocityWindow. Zero
+	// disables a limit.
+	ReviewAuthorLimit    int
+	ReviewClientLimit    int
+	ReviewVelocityWindow time.Duration
+	// Reviews whose spam score is at most ReviewApproveScore are approved
+	// automatically, and those scoring at least ReviewRejectScore rejected;
+	// the rest wait for a moderator.
+	ReviewApproveScore int
+	ReviewRejectScore  int
+	// RatingPriorWeight is how many catalog-average reviews are blended into
+	// each product's weighted rating, so products with few reviews rank
+	// near the catalog average until they collect more.
+	RatingPriorWeight int
+	// ImageDir is the directory uploaded images and thumbnails are stored in.
+	ImageDir string
+	// TrustedProxies are the networks of reverse proxies whose X-Forwarded-For
+	// header is believed. Requests from anywhere else are identified by their
+	// connection's address alone.
+	TrustedProxies []*net.IPNet
+}
+
+// loadConfig reads the configuration from environment variables, falling back
+// to defaults for anything unset.
+func loadConfig() (Config, error) {
+	var cfg Config
+	var err error
+
+	if cfg.ReservationTTL, err = envDuration("ORDER_RESERVATION_TTL", 15*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.ReservationSweepInterval, err = envDuration("ORDER_SWEEP_INTERVAL", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.IdempotencyRetention, err = envDuration("IDEMPOTENCY_RETENTION", 24*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.PriceScheduleInterval, err = envDuration("PRICE_SCHEDULE_INTERVAL", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.DeletedProductRetention, err = envDuration("DELETED_PRODUCT_RETENTION", 30*24*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.ReviewAuthorLimit, err = envInt("REVIEW_AUTHOR_LIMIT", 5); err != nil {
+		return cfg, err
+	}
+	if cfg.ReviewClientLimit, err = envInt("REVIEW_CLIENT_LIMIT", 20); err != nil {
+		return cfg, err
+	}
+	if cfg.ReviewVelocityWindow, err = envDuration("REVIEW_VELOCITY_WINDOW", time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.ReviewApproveScore, err = envInt("REVIEW_APPROVE_SCORE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.ReviewRejectScore, err = envInt("REVIEW_REJECT_SCORE", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.ReviewRejectScore <= cfg.ReviewApproveScore {
+		return cfg, fmt.Errorf("REVIEW_REJECT_SCORE must be greater than REVIEW_APPROVE_SCORE")
+	}
+	cfg.ReviewBannedWords = envList("REVIEW_BANNED_WORDS")
+	if cfg.RatingPriorWeight, err = envInt("RATING_PRIOR_WEIGHT", 10); err != nil {
+		return cfg, err
+	}
+	if cfg.RatingPriorWeight < 0 {
+		return cfg, fmt.Errorf("RATING_PRIOR_WEIGHT must not be negative")
+	}
+	if cfg.AnonymousReads, err = envBool("AUTH_ANONYMOUS_READS", true); err != nil {
+		return cfg, err
+	}
+	if cfg.TrustedProxies, err = envNetworks("TRUSTED_PROXIES"); err != nil {
+		return cfg, err
+	}
+	cfg.BootstrapAdminKey = os.Getenv("BOOTSTRAP_ADMIN_KEY")
+	cfg.ImageDir = os.Getenv("IMAGE_DIR")
+	if cfg.ImageDir == "" {
+		cfg.ImageDir = "media"
+	}
+
+	return cfg, nil
+}
+
+// envBool parses a boolean ("true", "false", "1", "0") from an environment variable.
+func envBool(name string, def bool) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false, got %q", name, v)
+	}
+	return b, nil
+}
+
+// envInt parses a non-negative integer from an environment variable.
+func envInt(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %q", name, v)
+	}
+	return n, nil
+}
+
+// envList splits a comma-separated environment variable, dropping empty items.
+func envList(name string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envNetworks parses a comma-separated list of CIDR networks or single IP
+// addresses from an environment variable.
+func envNetworks(name string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range envList(name) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("%s must list IP addresses or CIDR networks, got %q", name, item)
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s must list IP addresses or CIDR networks, got %q", name, item)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// envDuration parses a Go duration (e.g. "90s", "15m") from an environment variable.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration, got %q", name, v)
+	}
+	return d, nil
+}
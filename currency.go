@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// BaseCurrency is the currency exchange rates are quoted against.
+const BaseCurrency = "USD"
+
+// supportedCurrencies are the currencies prices may be stored and shown in.
+// All of them have two-digit minor units.
+var supportedCurrencies = []string{"USD", "EUR", "GBP"}
+
+var errNoExchangeRate = errors.New("no exchange rate")
+
+// normalizeCurrency upper-cases a currency code and reports whether it is
+// supported.
+func normalizeCurrency(code string) (string, bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	for _, c := range supportedCurrencies {
+		if c == code {
+			return code, true
+		}
+	}
+	return code, false
+}
+
+// parseRate parses a positive decimal exchange rate exactly.
+func parseRate(s string) (*big.Rat, bool) {
+	rate, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok || rate.Sign() <= 0 {
+		return nil, false
+	}
+	return rate, true
+}
+
+// roundHalfEven rounds x to the nearest integer, breaking ties towards the
+// even neighbour (banker's rounding) so that conversions do not drift upward
+// on average.
+func roundHalfEven(x *big.Rat) int64 {
+	num, den := x.Num(), x.Denom()
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	// QuoRem truncates towards zero; compare twice the remainder with the
+	// denominator to decide whether to move away from zero.
+	twice := new(big.Int).Abs(r)
+	twice.Lsh(twice, 1)
+	switch cmp := twice.Cmp(den); {
+	case cmp > 0, cmp == 0 && q.Bit(0) == 1:
+		if num.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q.Int64()
+}
+
+// priceOwner identifies a product (VariantID 0) or one of its variants.
+type priceOwner struct {
+	ProductID int
+	VariantID int
+}
+
+func ownerOf(productID int, variantID *int) priceOwner {
+	if variantID == nil {
+		return priceOwner{ProductID: productID}
+	}
+	return priceOwner{ProductID: productID, VariantID: *variantID}
+}
+
+// currencyConverter shows prices in the currency a request asked for: an
+// override for that currency if the product or variant has one, otherwise
+// the stored price converted at the stored exchange rates.
+type currencyConverter struct {
+	currency  string
+	rates     map[string]*big.Rat
+	overrides map[priceOwner]int
+}
+
+// convert returns cents, stored in currency from, in the converter's currency.
+func (c *currencyConverter) convert(owner priceOwner, cents int, from string) (int, error) {
+	if price, ok := c.overrides[owner]; ok {
+		return price, nil
+	}
+	if from == c.currency {
+		return cents, nil
+	}
+	fromRate, ok := c.rates[from]
+	if !ok {
+		return 0, fmt.Errorf("cannot convert %s to %s: %w for %s", from, c.currency, errNoExchangeRate, from)
+	}
+	amount := new(big.Rat).SetInt64(int64(cents))
+	amount.Mul(amount, c.rates[c.currency])
+	amount.Quo(amount, fromRate)
+	return int(roundHalfEven(amount)), nil
+}
+
+// product converts a product's price in place.
+func (c *currencyConverter) product(p *dbProduct) error {
+	cents, err := c.convert(ownerOf(p.ID, nil), p.PriceCents, p.Currency)
+	if err != nil {
+		return err
+	}
+	p.PriceCents, p.Currency = cents, c.currency
+	return nil
+}
+
+// variant converts a variant's price in place.
+func (c *currencyConverter) variant(v *dbVariant) error {
+	cents, err := c.convert(ownerOf(v.ProductID, &v.ID), v.PriceCents, v.Currency)
+	if err != nil {
+		return err
+	}
+	v.PriceCents, v.Currency = cents, c.currency
+	return nil
+}
+
+// requestedCurrency returns the currency a request asks prices to be shown
+// in: the currency query parameter, else the first entry of the
+// Accept-Currency header, else "" for stored currencies.
+func requestedCurrency(r *http.Request) string {
+	if c := r.URL.Query().Get("currency"); c != "" {
+		return c
+	}
+	header := r.Header.Get("Accept-Currency")
+	if header == "" {
+		return ""
+	}
+	first := strings.Split(header, ",")[0]
+	return strings.TrimSpace(strings.Split(first, ";")[0])
+}
+
+// currencyConverter returns a converter for the currency the request asks
+// for, with the overrides of the given products loaded, or nil if it asks for
+// none. It writes a 400 and returns false for an unsupported currency or one
+// without an exchange rate.
+func (s *Server) currencyConverter(w http.ResponseWriter, r *http.Request, productIDs []int) (*currencyConverter, bool) {
+	w.Header().Add("Vary", "Accept-Currency")
+	requested := requestedCurrency(r)
+	if requested == "" {
+		return nil, true
+	}
+	currency, ok := normalizeCurrency(requested)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter,
+			"currency must be one of "+strings.Join(supportedCurrencies, ", "))
+		return nil, false
+	}
+
+	rates, err := s.store.ExchangeRates()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load exchange rates")
+		return nil, false
+	}
+	if _, ok := rates[currency]; !ok {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "no exchange rate for "+currency)
+		return nil, false
+	}
+	overrides, err := s.store.PriceOverridesIn(currency, productIDs)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load price overrides")
+		return nil, false
+	}
+	return &currencyConverter{currency: currency, rates: rates, overrides: overrides}, true
+}
+
+// convertPrices rewrites the prices of products and variants into the
+// currency the request asks for, if any. It writes an error response and
+// returns false if they cannot be converted.
+func (s *Server) convertPrices(w http.ResponseWriter, r *http.Request, products []*dbProduct, variants []*dbVariant) bool {
+	var productIDs []int
+	for _, p := range products {
+		productIDs = append(productIDs, p.ID)
+	}
+	for _, v := range variants {
+		productIDs = append(productIDs, v.ProductID)
+	}
+	conv, ok := s.currencyConverter(w, r, productIDs)
+	if !ok || conv == nil {
+		return ok
+	}
+
+	for _, p := range products {
+		if err := conv.product(p); err != nil {
+			writeConversionError(w, r, err)
+			return false
+		}
+	}
+	for _, v := range variants {
+		if err := conv.variant(v); err != nil {
+			writeConversionError(w, r, err)
+			return false
+		}
+	}
+	return true
+}
+
+// writeConversionError reports a price that could not be converted.
+func writeConversionError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errNoExchangeRate) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+		return
+	}
+	writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to convert prices")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoundHalfEven(t *testing.T) {
+	tests := []struct {
+		num, den int64
+		want     int64
+	}{
+		{0, 1, 0},
+		{1, 3, 0},
+		{2, 3, 1},
+		{5, 2, 2},
+		{7, 2, 4},
+		{9, 2, 4},
+		{-5, 2, -2},
+		{-7, 2, -4},
+		{-2, 3, -1},
+		{2500001, 1000000, 3},
+		{2499999, 1000000, 2},
+		{9215, 10, 922},
+	}
+	for _, tt := range tests {
+		if got := roundHalfEven(big.NewRat(tt.num, tt.den)); got != tt.want {
+			t.Errorf("roundHalfEven(%d/%d) = %d, want %d", tt.num, tt.den, got, tt.want)
+		}
+	}
+}
+
+func TestCurrencyConverterConvert(t *testing.T) {
+	rates := map[string]*big.Rat{"USD": big.NewRat(1, 1)}
+	for currency, rate := range map[string]string{"EUR": "0.9215", "GBP": "0.79"} {
+		rates[currency], _ = parseRate(rate)
+	}
+	variantID := 7
+	toEUR := &currencyConverter{currency: "EUR", rates: rates, overrides: map[priceOwner]int{
+		ownerOf(1, nil):        999,
+		ownerOf(2, &variantID): 1500,
+	}}
+
+	tests := []struct {
+		name  string
+		owner priceOwner
+		cents int
+		from  string
+		want  int
+	}{
+		{"same currency", ownerOf(3, nil), 1234, "EUR", 1234},
+		{"tie rounds to even", ownerOf(3, nil), 1000, "USD", 922},    // 921.5
+		{"tie below even stays", ownerOf(3, nil), 3000, "USD", 2764}, // 2764.5
+		{"cross rate", ownerOf(3, nil), 1000, "GBP", 1166},           // 1166.46
+		{"product override", ownerOf(1, nil), 5000, "USD", 999},
+		{"variant override", ownerOf(2, &variantID), 5000, "USD", 1500},
+		{"product override is not the variant's", ownerOf(1, &variantID), 1000, "USD", 922},
+		{"variant override is not the product's", ownerOf(2, nil), 1000, "USD", 922},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := toEUR.convert(tt.owner, tt.cents, tt.from)
+			if err != nil {
+				t.Fatalf("convert: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("convert(%d %s) = %d, want %d", tt.cents, tt.from, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := toEUR.convert(ownerOf(3, nil), 100, "CHF"); !errors.Is(err, errNoExchangeRate) {
+		t.Errorf("convert from a currency without a rate: got %v, want errNoExchangeRate", err)
+	}
+}
+
+func TestConvertPricesUsesOverridesPerCurrency(t *testing.T) {
+	st := newTestStore(t)
+	s := &Server{store: st}
+	for currency, rate := range map[string]string{"EUR": "0.5", "GBP": "0.25"} {
+		if err := st.SetExchangeRate(currency, rate); err != nil {
+			t.Fatalf("set rate: %v", err)
+		}
+	}
+	productID, err := st.CreateProduct("Overridden", "", 1000, "USD", nil, true, 1)
+	if err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	if _, err := st.SetPriceOverride(productID, nil, "EUR", 777); err != nil {
+		t.Fatalf("set override: %v", err)
+	}
+
+	tests := []struct {
+		currency string
+		want     int
+	}{
+		{"EUR", 777},  // the override
+		{"GBP", 250},  // converted
+		{"USD", 1000}, // stored
+		{"", 1000},    // stored, not converted
+	}
+	for _, tt := range tests {
+		t.Run(tt.currency, func(t *testing.T) {
+			p, err := st.GetProduct(productID)
+			if err != nil {
+				t.Fatalf("get product: %v", err)
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/products/1?currency="+tt.currency, nil)
+			if !s.convertPrices(w, r, []*dbProduct{p}, nil) {
+				t.Fatalf("convert prices: %d %s", w.Code, w.Body)
+			}
+			if p.PriceCents != tt.want {
+				t.Errorf("price = %d, want %d", p.PriceCents, tt.want)
+			}
+		})
+	}
+}
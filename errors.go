@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const problemContentType = "application/problem+json"
+
+// Machine-readable error codes. Clients should branch on these rather than on
+// the human-readable detail, which may change.
+const (
+	codeInvalidID           = "invalid_id"
+	codeInvalidBody         = "invalid_body"
+	codeInvalidParameter    = "invalid_parameter"
+	codeValidationFailed    = "validation_failed"
+	codeNotFound            = "not_found"
+	codeMethodNotAllowed    = "method_not_allowed"
+	codeUnsupportedMedia    = "unsupported_media_type"
+	codePayloadTooLarge     = "payload_too_large"
+	codeUnauthorized        = "unauthorized"
+	codeForbidden           = "forbidden"
+	codeConflict            = "conflict"
+	codeInsufficientStock   = "insufficient_stock"
+	codeInvalidTransition   = "invalid_transition"
+	codePreconditionFailed  = "precondition_failed"
+	codeIdempotencyMismatch = "idempotency_key_reused"
+	codeIdempotencyInFlight = "idempotency_request_in_progress"
+	codeRateLimited         = "rate_limited"
+	codeInternal            = "internal_error"
+)
+
+// Problem is the body of every error response: an RFC 7807 problem details
+// object extended with a stable code, field errors and the request ID.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes one invalid field in a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError collects the field errors found while validating a request.
+type validationError []FieldError
+
+func (v validationError) Error() string {
+	msgs := make([]string, len(v))
+	for i, fe := range v {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// add records a field error.
+func (v *validationError) add(field, message string) {
+	*v = append(*v, FieldError{Field: field, Message: message})
+}
+
+// err returns v as an error, or nil if no field errors were recorded.
+func (v validationError) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// writeError sends a problem+json response.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	writeProblem(w, r, Problem{Status: status, Code: code, Detail: detail})
+}
+
+// writeValidationError sends a 400 listing every field error in err. Other
+// errors are reported with err's message alone.
+func writeValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	var verr validationError
+	if !errors.As(err, &verr) {
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, err.Error())
+		return
+	}
+	writeProblem(w, r, Problem{
+		Status: http.StatusBadRequest,
+		Code:   codeValidationFailed,
+		Detail: "request has invalid fields",
+		Errors: verr,
+	})
+}
+
+// methodNotAllowed sends a 405 for a route that exists but does not accept
+// the request's method.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, r.Method+" is not supported on "+r.URL.Path)
+}
+
+// notFound sends a 404 for an unknown route.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, codeNotFound, "no such resource: "+r.URL.Path)
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, p Problem) {
+	p.Type = "about:blank"
+	p.Title = http.StatusText(p.Status)
+	p.Instance = r.URL.Path
+	p.RequestID = requestIDFromContext(r.Context())
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+type requestIDKey struct{}
+
+// requestIDFromContext returns the ID assigned by requestIDMiddleware.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDMiddleware tags every request with an ID, echoed in X-Request-ID
+// and in error bodies so reports can be matched to logs. A well-formed
+// X-Request-ID from the client or a proxy is kept.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			buf := make([]byte, 8)
+			rand.Read(buf)
+			id = hex.EncodeToString(buf)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// productETag returns the entity tag for a product's current version.
+func productETag(p *dbProduct) string {
+	return fmt.Sprintf(`"product-%d-v%d"`, p.ID, p.Version)
+}
+
+// variantETag returns the entity tag for a variant's current version.
+func variantETag(v *dbVariant) string {
+	return fmt.Sprintf(`"variant-%d-v%d"`, v.ID, v.Version)
+}
+
+// etagListMatches reports whether a comma-separated If-Match or If-None-Match
+// header value matches etag. "*" matches any current representation. With
+// weak set, W/ prefixes are ignored (RFC 9110 weak comparison); otherwise a
+// weak tag never matches.
+func etagListMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch enforces an If-Match precondition for a write to the resource
+// currently tagged etag. It writes 412 and returns false when the client's
+// copy is stale; a request without If-Match is allowed through.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, etag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" || etagListMatches(header, etag, false) {
+		return true
+	}
+	w.Header().Set("ETag", etag)
+	writeError(w, r, http.StatusPreconditionFailed, codePreconditionFailed, "resource has been modified; fetch it again and retry")
+	return false
+}
+
+// writeNotModified sets the ETag header and, when If-None-Match already names
+// etag, answers 304 Not Modified and returns true.
+func writeNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if header := r.Header.Get("If-None-Match"); header != "" && etagListMatches(header, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// writeVersionConflict reports a write that lost a race with another change
+// made after its preconditions were checked.
+func writeVersionConflict(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusConflict
+	if r.Header.Get("If-Match") != "" {
+		status = http.StatusPreconditionFailed
+		writeError(w, r, status, codePreconditionFailed, "resource has been modified; fetch it again and retry")
+		return
+	}
+	writeError(w, r, status, codeConflict, "resource has been modified; fetch it again and retry")
+}
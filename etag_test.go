@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testETag = `"product-1-v3"`
+
+func TestCheckIfMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifMatch string
+		ok      bool
+	}{
+		{"no precondition", "", true},
+		{"current", testETag, true},
+		{"any", "*", true},
+		{"current in a list", `"product-1-v2", "product-1-v3"`, true},
+		{"stale", `"product-1-v2"`, false},
+		{"other product", `"product-2-v3"`, false},
+		{"weak current", `W/"product-1-v3"`, false},
+		{"unquoted", `product-1-v3`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPatch, "/products/1", nil)
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			if got := checkIfMatch(w, r, testETag); got != tt.ok {
+				t.Fatalf("checkIfMatch = %v, want %v", got, tt.ok)
+			}
+			if tt.ok {
+				return
+			}
+			if w.Code != http.StatusPreconditionFailed {
+				t.Errorf("status = %d, want 412", w.Code)
+			}
+			if got := w.Header().Get("ETag"); got != testETag {
+				t.Errorf("ETag = %s, want the current %s", got, testETag)
+			}
+		})
+	}
+}
+
+func TestWriteNotModified(t *testing.T) {
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		notModified bool
+	}{
+		{"no precondition", "", false},
+		{"current", testETag, true},
+		{"weak current", `W/"product-1-v3"`, true},
+		{"any", "*", true},
+		{"current in a list", `"product-1-v1",W/"product-1-v3"`, true},
+		{"stale", `"product-1-v2"`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/products/1", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			if got := writeNotModified(w, r, testETag); got != tt.notModified {
+				t.Fatalf("writeNotModified = %v, want %v", got, tt.notModified)
+			}
+			if tt.notModified && w.Code != http.StatusNotModified {
+				t.Errorf("status = %d, want 304", w.Code)
+			}
+			if got := w.Header().Get("ETag"); got != testETag {
+				t.Errorf("ETag = %s, want %s", got, testETag)
+			}
+		})
+	}
+}
@@ -2,29 +2,47 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
-	"math"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// toAPIProduct converts a database product to the API representation.
-func toAPIProduct(p *dbProduct) Product {
+// toAPIProduct converts a database product to the API representation, with
+// its price written in the given format.
+func toAPIProduct(p *dbProduct, format moneyFormat) Product {
 	return Product{
 		ID:          p.ID,
 		Name:        p.Name,
 		Description: p.Description,
-		Price:       float64(p.PriceCents) * 100,
+		Price:       newMoney(p.PriceCents, p.Currency, format),
+		Currency:    p.Currency,
 		Category:    p.Category,
+		CategoryID:  p.CategoryID,
 		InStock:     p.InStock,
 		Quantity:    p.Quantity,
 		CreatedAt:   p.CreatedAt,
 		UpdatedAt:   p.UpdatedAt,
 		DeletedAt:   p.DeletedAt,
+		Version:     p.Version,
 	}
 }
 
+// productPointers returns pointers to the elements of products, for
+// functions that update several products in place.
+func productPointers(products []dbProduct) []*dbProduct {
+	ptrs := make([]*dbProduct, len(products))
+	for i := range products {
+		ptrs[i] = &products[i]
+	}
+	return ptrs
+}
+
 func getIDFromPath(r *http.Request, prefix string) (int, error) {
 	path := strings.TrimPrefix(r.URL.Path, prefix)
 	path = strings.TrimSuffix(path, "/")
@@ -33,43 +51,157 @@ func getIDFromPath(r *http.Request, prefix string) (int, error) {
 }
 
 // handleListProducts handles GET /products
+//
+// Results are paged: limit (default 50, max 200) and the opaque cursor from the
+// previous response's X-Next-Cursor header select the page. sort accepts name,
+// price, created_at or quantity, prefixed with "-" for descending order.
+// Filters: category, min_price, max_price, in_stock and updated_since (RFC 3339).
+// deleted=only or deleted=include lists soft-deleted products, which are
+// otherwise left out. Price filters and the price sort use prices as shown in
+// the requested currency, or in the base currency if none is requested.
 func (s *Server) handleListProducts(w http.ResponseWriter, r *http.Request) {
-	category := r.URL.Query().Get("category")
+	q, err := parseProductQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+		return
+	}
+	if currency, ok := normalizeCurrency(requestedCurrency(r)); ok {
+		q.PriceCurrency = currency
+	}
 
-	products, err := s.store.ListProducts(category)
+	products, next, total, err := s.store.QueryProducts(q)
+	if errors.Is(err, errNoExchangeRate) {
+		writeConversionError(w, r, err)
+		return
+	}
 	if err != nil {
-		http.Error(w, "failed to list products", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list products")
+		return
+	}
+	if !s.convertPrices(w, r, productPointers(products), nil) {
 		return
 	}
 
 	apiProducts := make([]Product, len(products))
 	for i, p := range products {
-		apiProducts[i] = toAPIProduct(&p)
+		apiProducts[i] = toAPIProduct(&p, moneyFormatOf(r))
 	}
+	s.attachPrimaryImages(apiProducts)
+
+	nextCursor := ""
+	if next != nil {
+		nextCursor = encodeCursor(*next)
+	}
+	setPageHeaders(w, r, total, nextCursor)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(apiProducts)
 }
 
+// parseProductQuery builds a ProductQuery from GET /products query parameters.
+func parseProductQuery(values url.Values) (ProductQuery, error) {
+	q := ProductQuery{
+		Category: values.Get("category"),
+		Sort:     "created_at",
+	}
+
+	switch deleted := values.Get("deleted"); deleted {
+	case "", DeletedOnly, DeletedInclude:
+		q.Deleted = deleted
+	default:
+		return q, fmt.Errorf("deleted must be only or include")
+	}
+
+	limit, err := parseLimit(values)
+	if err != nil {
+		return q, err
+	}
+	q.Limit = limit
+
+	if sort := values.Get("sort"); sort != "" {
+		q.Desc = strings.HasPrefix(sort, "-")
+		q.Sort = strings.TrimPrefix(sort, "-")
+		if _, ok := productSortColumns[q.Sort]; !ok {
+			return q, fmt.Errorf("sort must be one of name, price, created_at, quantity")
+		}
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		c, err := decodeCursor(cursor)
+		if err != nil {
+			return q, err
+		}
+		q.After = c
+	}
+
+	for _, bound := range []struct {
+		param string
+		dest  **int
+	}{
+		{"min_price", &q.MinPriceCents},
+		{"max_price", &q.MaxPriceCents},
+	} {
+		v := values.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		price, err := parseMoney(v)
+		if err != nil || price.Cents < 0 {
+			return q, fmt.Errorf("%s must be a non-negative number", bound.param)
+		}
+		*bound.dest = &price.Cents
+	}
+
+	if v := values.Get("in_stock"); v != "" {
+		inStock, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("in_stock must be true or false")
+		}
+		q.InStock = &inStock
+	}
+
+	if v := values.Get("updated_since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("updated_since must be an RFC 3339 timestamp")
+		}
+		q.UpdatedSince = &since
+	}
+
+	return q, nil
+}
+
 // handleCreateProduct handles POST /products
 func (s *Server) handleCreateProduct(w http.ResponseWriter, r *http.Request) {
 	var req CreateProductRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+		return
+	}
+
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
 		return
 	}
 
-	if req.Price < 0 {
-		log.Printf("ERROR: invalid price: %.2f", req.Price)
-		http.Error(w, `{"error":"price must be non-negative"}`, http.StatusBadRequest)
+	categoryID, ok := s.resolveCategory(w, r, req.Category)
+	if !ok {
 		return
 	}
 
-	priceCents := int(math.Round(req.Price * 100))
+	if req.Currency == "" {
+		req.Currency = BaseCurrency
+	}
 
-	id, err := s.store.CreateProduct(req.Name, req.Description, priceCents, req.Category, req.InStock, req.Quantity)
+	id, err := s.store.CreateProduct(req.Name, req.Description, req.Price.Cents, req.Currency, categoryID, req.InStock, req.Quantity)
 	if err != nil {
 		log.Printf("ERROR: failed to create product: %v", err)
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, "failed to create product")
+		return
+	}
+
+	if created, err := s.store.GetProduct(id); err == nil {
+		s.audit(r, auditEntityProduct, id, id, "create", nil, productAuditFields(created))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -81,98 +213,386 @@ func (s *Server) handleCreateProduct(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleGetProduct(w http.ResponseWriter, r *http.Request) {
 	id, err := getIDFromPath(r, "/products/")
 	if err != nil {
-		http.Error(w, "invalid product ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
 		return
 	}
 
 	product, err := s.store.GetProduct(id)
 	if err != nil {
-		http.Error(w, "product not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
 		return
 	}
 
-	apiProduct := toAPIProduct(product)
+	// A converted price depends on exchange rates as well as the product's
+	// version, so only the stored representation is tagged.
+	if requestedCurrency(r) == "" && writeNotModified(w, r, productETag(product)) {
+		return
+	}
+	if !s.convertPrices(w, r, []*dbProduct{product}, nil) {
+		return
+	}
+
+	apiProducts := []Product{toAPIProduct(product, moneyFormatOf(r))}
+	s.attachPrimaryImages(apiProducts)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(apiProduct)
+	json.NewEncoder(w).Encode(apiProducts[0])
 }
 
 // handleUpdateProduct handles PUT /products/:id
 func (s *Server) handleUpdateProduct(w http.ResponseWriter, r *http.Request) {
 	id, err := getIDFromPath(r, "/products/")
 	if err != nil {
-		http.Error(w, "invalid product ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
+		return
+	}
+
+	before, err := s.store.GetProduct(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+	if !checkIfMatch(w, r, productETag(before)) {
 		return
 	}
 
-	var update Product
+	var update CreateProductRequest
 	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+		return
+	}
+	if err := update.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	categoryID, ok := s.resolveCategory(w, r, update.Category)
+	if !ok {
 		return
 	}
 
-	priceCents := int(math.Round(update.Price * 100))
+	if update.Currency == "" {
+		update.Currency = before.Currency
+	}
 
-	err = s.store.UpdateProduct(id, update.Name, update.Description, priceCents, update.Category, update.InStock, update.Quantity)
+	err = s.store.UpdateProduct(id, before.Version, update.Name, update.Description, update.Price.Cents, update.Currency, categoryID, update.InStock, update.Quantity)
+	switch {
+	case errors.Is(err, errVersionConflict):
+		writeVersionConflict(w, r)
+		return
+	case errors.Is(err, errNotFound):
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to update product")
+		return
+	}
+
+	product, err := s.store.GetProduct(id)
 	if err != nil {
-		http.Error(w, "failed to update product", http.StatusInternalServerError)
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+
+	s.audit(r, auditEntityProduct, id, id, "update", productAuditFields(before), productAuditFields(product))
+
+	w.Header().Set("ETag", productETag(product))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toAPIProduct(product, moneyFormatOf(r)))
+}
+
+// handlePatchProduct handles PATCH /products/:id with a JSON merge patch.
+func (s *Server) handlePatchProduct(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPath(r, "/products/")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
+		return
+	}
+	if !isMergePatch(r) {
+		writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMedia, "Content-Type must be "+mergePatchContentType)
+		return
+	}
+
+	before, err := s.store.GetProduct(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+	if !checkIfMatch(w, r, productETag(before)) {
+		return
+	}
+
+	current := CreateProductRequest{
+		Name:        before.Name,
+		Description: before.Description,
+		Price:       Money{Cents: before.PriceCents},
+		Currency:    before.Currency,
+		Category:    before.Category,
+		InStock:     before.InStock,
+		Quantity:    before.Quantity,
+	}
+	var req CreateProductRequest
+	if err := decodeMergePatch(r, current, productPatchFields, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	categoryID, ok := s.resolveCategory(w, r, req.Category)
+	if !ok {
+		return
+	}
+
+	err = s.store.UpdateProduct(id, before.Version, req.Name, req.Description, req.Price.Cents, req.Currency, categoryID, req.InStock, req.Quantity)
+	switch {
+	case errors.Is(err, errVersionConflict):
+		writeVersionConflict(w, r)
+		return
+	case errors.Is(err, errNotFound):
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to update product")
 		return
 	}
 
 	product, err := s.store.GetProduct(id)
 	if err != nil {
-		http.Error(w, "product not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
 		return
 	}
 
+	s.audit(r, auditEntityProduct, id, id, "update", productAuditFields(before), productAuditFields(product))
+
+	w.Header().Set("ETag", productETag(product))
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(toAPIProduct(product))
+	json.NewEncoder(w).Encode(toAPIProduct(product, moneyFormatOf(r)))
 }
 
 // handleDeleteProduct handles DELETE /products/:id
+//
+// The product is soft-deleted and can be restored until the retention job
+// purges it. With ?hard=true (admins only) it is purged at once, together with
+// its variants, reviews and images; this also works on an already deleted
+// product.
 func (s *Server) handleDeleteProduct(w http.ResponseWriter, r *http.Request) {
 	id, err := getIDFromPath(r, "/products/")
 	if err != nil {
-		http.Error(w, "invalid product ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
+		return
+	}
+
+	hard, err := hardDeleteRequested(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+		return
+	}
+	if hard {
+		s.handlePurgeProduct(w, r, id)
 		return
 	}
 
-	err = s.store.DeleteProduct(id)
+	before, err := s.store.GetProduct(id)
 	if err != nil {
-		http.Error(w, "product not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
 		return
 	}
 
+	if !checkIfMatch(w, r, productETag(before)) {
+		return
+	}
+
+	err = s.store.DeleteProduct(id, before.Version)
+	switch {
+	case errors.Is(err, errVersionConflict):
+		writeVersionConflict(w, r)
+		return
+	case err != nil:
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+
+	s.audit(r, auditEntityProduct, id, id, "delete", productAuditFields(before), nil)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// handlePurchaseProduct handles POST /products/:id/purchase
-func (s *Server) handlePurchaseProduct(w http.ResponseWriter, r *http.Request) {
+// hardDeleteRequested reports whether a DELETE asks for a permanent purge.
+func hardDeleteRequested(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("hard")
+	if v == "" {
+		return false, nil
+	}
+	hard, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("hard must be true or false")
+	}
+	return hard, nil
+}
+
+// handlePurgeProduct handles DELETE /products/:id?hard=true
+func (s *Server) handlePurgeProduct(w http.ResponseWriter, r *http.Request, id int) {
+	before, err := s.store.GetProduct(id)
+	if err != nil {
+		before, err = s.store.GetDeletedProduct(id)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+
+	if !checkIfMatch(w, r, productETag(before)) {
+		return
+	}
+
+	images, err := s.store.PurgeProduct(id)
+	switch {
+	case errors.Is(err, errNotFound):
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	case err != nil:
+		log.Printf("ERROR: failed to purge product %d: %v", id, err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to purge product")
+		return
+	}
+	for i := range images {
+		removeImageFiles(s.config.ImageDir, &images[i])
+	}
+
+	s.audit(r, auditEntityProduct, id, id, "purge", productAuditFields(before), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRestoreProduct handles POST /products/:id/restore
+func (s *Server) handleRestoreProduct(w http.ResponseWriter, r *http.Request) {
 	pathPart := strings.TrimPrefix(r.URL.Path, "/products/")
-	idStr := strings.Split(pathPart, "/")[0]
-	id, err := strconv.Atoi(idStr)
+	id, err := strconv.Atoi(strings.Split(pathPart, "/")[0])
 	if err != nil {
-		http.Error(w, "invalid product ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
+		return
+	}
+
+	before, err := s.store.GetDeletedProduct(id)
+	if errors.Is(err, errNotFound) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "deleted product not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load product")
+		return
+	}
+
+	if !checkIfMatch(w, r, productETag(before)) {
+		return
+	}
+
+	err = s.store.RestoreProduct(id, before.Version)
+	switch {
+	case errors.Is(err, errVersionConflict):
+		writeVersionConflict(w, r)
+		return
+	case errors.Is(err, errNotFound):
+		writeError(w, r, http.StatusNotFound, codeNotFound, "deleted product not found")
+		return
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to restore product")
 		return
 	}
 
 	product, err := s.store.GetProduct(id)
 	if err != nil {
-		http.Error(w, "product not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+
+	s.audit(r, auditEntityProduct, id, id, "restore", nil, productAuditFields(product))
+
+	w.Header().Set("ETag", productETag(product))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toAPIProduct(product, moneyFormatOf(r)))
+}
+
+// productRetentionActor is the audit actor for purges made by the retention job.
+const productRetentionActor = "system:product-retention"
+
+// purgeDeletedProducts permanently removes products that have been
+// soft-deleted for longer than the configured retention period.
+func (s *Server) purgeDeletedProducts() {
+	products, err := s.store.ExpiredDeletedProducts(time.Now().Add(-s.config.DeletedProductRetention))
+	if err != nil {
+		log.Printf("ERROR: failed to list expired deleted products: %v", err)
 		return
 	}
 
-	if product.Quantity <= 0 {
-		http.Error(w, `{"error":"out of stock"}`, http.StatusConflict)
+	purged := 0
+	for i := range products {
+		p := &products[i]
+		images, err := s.store.PurgeProduct(p.ID)
+		if err != nil {
+			log.Printf("ERROR: failed to purge product %d: %v", p.ID, err)
+			continue
+		}
+		for j := range images {
+			removeImageFiles(s.config.ImageDir, &images[j])
+		}
+		s.auditAs(productRetentionActor, auditEntityProduct, p.ID, p.ID, "purge", productAuditFields(p), nil)
+		purged++
+	}
+	if purged > 0 {
+		log.Printf("Purged %d deleted product(s)", purged)
+	}
+}
+
+// handlePurchaseProduct handles POST /products/:id/purchase
+func (s *Server) handlePurchaseProduct(w http.ResponseWriter, r *http.Request) {
+	pathPart := strings.TrimPrefix(r.URL.Path, "/products/")
+	idStr := strings.Split(pathPart, "/")[0]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
 		return
 	}
 
-	err = s.store.DecrementQuantity(id)
+	quantity, err := decodePurchaseQuantity(r)
 	if err != nil {
-		http.Error(w, "purchase failed", http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, err.Error())
+		return
+	}
+
+	remaining, err := s.store.DecrementQuantity(id, quantity)
+	switch {
+	case errors.Is(err, errNotFound):
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	case errors.Is(err, errInsufficientStock):
+		writeError(w, r, http.StatusConflict, codeInsufficientStock, "insufficient stock")
+		return
+	case err != nil:
+		log.Printf("ERROR: purchase of product %d failed: %v", id, err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "purchase failed")
 		return
 	}
 
+	s.audit(r, auditEntityProduct, id, id, "purchase", stockAuditFields(remaining+quantity), stockAuditFields(remaining))
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "purchased"})
+	json.NewEncoder(w).Encode(PurchaseResult{Status: "purchased", Quantity: quantity, Remaining: remaining})
+}
+
+// decodePurchaseQuantity reads the optional purchase body, defaulting to one unit.
+func decodePurchaseQuantity(r *http.Request) (int, error) {
+	req := PurchaseRequest{Quantity: 1}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			return 0, fmt.Errorf("invalid request body")
+		}
+	}
+	if req.Quantity <= 0 {
+		return 0, fmt.Errorf("quantity must be positive")
+	}
+	return req.Quantity, nil
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// toAPICategory converts a database category to the API representation.
+func toAPICategory(c *dbCategory) Category {
+	return Category{
+		ID:          c.ID,
+		Slug:        c.Slug,
+		Name:        c.Name,
+		Description: c.Description,
+		ParentID:    c.ParentID,
+		Path:        c.Path,
+		CreatedAt:   c.CreatedAt,
+		UpdatedAt:   c.UpdatedAt,
+	}
+}
+
+// lookupCategoryID returns the ID of the category a product's category field
+// refers to: nil for an empty reference, errNotFound for an unknown one.
+func (s *Server) lookupCategoryID(ref string) (*int, error) {
+	if ref == "" {
+		return nil, nil
+	}
+	c, err := s.store.GetCategoryBySlug(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &c.ID, nil
+}
+
+// resolveCategory is lookupCategoryID for handlers: an unknown category is
+// reported as a validation error on the category field. It returns false if
+// a response has been written.
+func (s *Server) resolveCategory(w http.ResponseWriter, r *http.Request, ref string) (*int, bool) {
+	id, err := s.lookupCategoryID(ref)
+	if errors.Is(err, errNotFound) {
+		writeValidationError(w, r, validationError{{Field: "category", Message: "must be the slug of an existing category"}})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to look up category: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to look up category")
+		return nil, false
+	}
+	return id, true
+}
+
+// writeCategoryError maps the errors of category writes to responses.
+func writeCategoryError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errSlugTaken):
+		writeError(w, r, http.StatusConflict, codeConflict, "a category with this slug already exists")
+	case errors.Is(err, errParentNotFound):
+		writeValidationError(w, r, validationError{{Field: "parent_id", Message: "must be an existing category"}})
+	case errors.Is(err, errCategoryCycle):
+		writeValidationError(w, r, validationError{{Field: "parent_id", Message: "cannot be the category itself or one of its subcategories"}})
+	case errors.Is(err, errCategoryHasChildren):
+		writeError(w, r, http.StatusConflict, codeConflict, "category has subcategories; move or delete them first")
+	case errors.Is(err, errCategoryHasProducts):
+		writeError(w, r, http.StatusConflict, codeConflict, "category has products; move them to another category first")
+	default:
+		log.Printf("ERROR: category write failed: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to save category")
+	}
+}
+
+// handleListCategories handles GET /categories
+func (s *Server) handleListCategories(w http.ResponseWriter, r *http.Request) {
+	categories, err := s.store.ListCategories()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list categories")
+		return
+	}
+
+	apiCategories := make([]Category, len(categories))
+	for i, c := range categories {
+		apiCategories[i] = toAPICategory(&c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiCategories)
+}
+
+// handleCreateCategory handles POST /categories
+func (s *Server) handleCreateCategory(w http.ResponseWriter, r *http.Request) {
+	var req CreateCategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	id, err := s.store.CreateCategory(req.Slug, req.Name, req.Description, req.ParentID)
+	if err != nil {
+		writeCategoryError(w, r, err)
+		return
+	}
+
+	created, err := s.store.GetCategory(id)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load category")
+		return
+	}
+	s.audit(r, auditEntityCategory, id, 0, "create", nil, categoryAuditFields(created))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(toAPICategory(created))
+}
+
+// handleGetCategory handles GET /categories/:id
+func (s *Server) handleGetCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPath(r, "/categories/")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid category ID")
+		return
+	}
+
+	c, err := s.store.GetCategory(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "category not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toAPICategory(c))
+}
+
+// handleUpdateCategory handles PUT /categories/:id
+func (s *Server) handleUpdateCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPath(r, "/categories/")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid category ID")
+		return
+	}
+
+	before, err := s.store.GetCategory(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "category not found")
+		return
+	}
+
+	var req CreateCategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	err = s.store.UpdateCategory(id, req.Slug, req.Name, req.Description, req.ParentID)
+	if errors.Is(err, errNotFound) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "category not found")
+		return
+	}
+	if err != nil {
+		writeCategoryError(w, r, err)
+		return
+	}
+
+	c, err := s.store.GetCategory(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "category not found")
+		return
+	}
+	s.audit(r, auditEntityCategory, id, 0, "update", categoryAuditFields(before), categoryAuditFields(c))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toAPICategory(c))
+}
+
+// handleDeleteCategory handles DELETE /categories/:id
+func (s *Server) handleDeleteCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPath(r, "/categories/")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid category ID")
+		return
+	}
+
+	before, err := s.store.GetCategory(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "category not found")
+		return
+	}
+
+	if err := s.store.DeleteCategory(id); err != nil {
+		if errors.Is(err, errNotFound) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "category not found")
+			return
+		}
+		writeCategoryError(w, r, err)
+		return
+	}
+	s.audit(r, auditEntityCategory, id, 0, "delete", categoryAuditFields(before), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"net/http"
 	"strconv"
 	"strings"
@@ -14,12 +13,18 @@ import (
 )
 
 // handleExportCSV handles GET /products/export
+//
+// Prices are exact decimals in the price column, or integer cents in a
+// price_minor column when the request asks for the minor money format.
 func (s *Server) handleExportCSV(w http.ResponseWriter, r *http.Request) {
 	category := r.URL.Query().Get("category")
 
 	products, err := s.store.ListProducts(category)
 	if err != nil {
-		http.Error(w, "failed to list products", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list products")
+		return
+	}
+	if !s.convertPrices(w, r, productPointers(products), nil) {
 		return
 	}
 
@@ -30,19 +35,29 @@ func (s *Server) handleExportCSV(w http.ResponseWriter, r *http.Request) {
 	defer writer.Flush()
 
 	// Write header row
-	header := []string{"id", "name", "description", "price", "category", "in_stock", "quantity", "created_at", "updated_at"}
+	format := moneyFormatOf(r)
+	priceColumn := "price"
+	if format == moneyMinor {
+		priceColumn = "price_minor"
+	}
+	header := []string{"id", "name", "description", priceColumn, "currency", "category", "in_stock", "quantity", "created_at", "updated_at"}
 	if err := writer.Write(header); err != nil {
 		log.Printf("ERROR: csv header write: %v", err)
 		return
 	}
 
 	for _, p := range products {
-		apiProduct := toAPIProduct(&p)
+		apiProduct := toAPIProduct(&p, format)
+		price := apiProduct.Price.String()
+		if format == moneyMinor {
+			price = strconv.Itoa(apiProduct.Price.Cents)
+		}
 		record := []string{
 			strconv.Itoa(apiProduct.ID),
 			apiProduct.Name,
 			apiProduct.Description,
-			fmt.Sprintf("%.2f", apiProduct.Price),
+			price,
+			apiProduct.Currency,
 			apiProduct.Category,
 			strconv.FormatBool(apiProduct.InStock),
 			strconv.Itoa(apiProduct.Quantity),
@@ -57,10 +72,13 @@ func (s *Server) handleExportCSV(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleImportCSV handles POST /products/import
+//
+// Prices are read from a price column of decimals or a price_minor column of
+// integer cents.
 func (s *Server) handleImportCSV(w http.ResponseWriter, r *http.Request) {
 	contentType := r.Header.Get("Content-Type")
 	if !strings.HasPrefix(contentType, "text/csv") && !strings.HasPrefix(contentType, "multipart/form-data") {
-		http.Error(w, "expected CSV content", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "expected CSV content")
 		return
 	}
 
@@ -69,7 +87,7 @@ func (s *Server) handleImportCSV(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(contentType, "multipart/form-data") {
 		file, _, err := r.FormFile("file")
 		if err != nil {
-			http.Error(w, "failed to read uploaded file", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, codeInvalidBody, "failed to read uploaded file")
 			return
 		}
 		defer file.Close()
@@ -83,19 +101,25 @@ func (s *Server) handleImportCSV(w http.ResponseWriter, r *http.Request) {
 	// Read and validate header
 	header, err := csvReader.Read()
 	if err != nil {
-		http.Error(w, "failed to read CSV header", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "failed to read CSV header")
 		return
 	}
 
-	expectedHeader := []string{"name", "description", "price", "category", "in_stock", "quantity"}
+	expectedHeader := []string{"name", "description", "category", "in_stock", "quantity"}
 	headerMap := make(map[string]int)
 	for i, col := range header {
 		headerMap[strings.ToLower(strings.TrimSpace(col))] = i
 	}
 
+	_, minorPrices := headerMap["price_minor"]
+	if _, ok := headerMap["price"]; !ok && !minorPrices {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "missing required column: price or price_minor")
+		return
+	}
+
 	for _, expected := range expectedHeader {
 		if _, ok := headerMap[expected]; !ok {
-			http.Error(w, fmt.Sprintf("missing required column: %s", expected), http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, codeInvalidBody, fmt.Sprintf("missing required column: %s", expected))
 			return
 		}
 	}
@@ -114,26 +138,15 @@ func (s *Server) handleImportCSV(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		name := strings.TrimSpace(record[headerMap["name"]])
-		description := strings.TrimSpace(record[headerMap["description"]])
-		priceStr := strings.TrimSpace(record[headerMap["price"]])
-		category := strings.TrimSpace(record[headerMap["category"]])
 		inStockStr := strings.TrimSpace(record[headerMap["in_stock"]])
 		quantityStr := strings.TrimSpace(record[headerMap["quantity"]])
 
-		if name == "" {
-			errors = append(errors, fmt.Sprintf("line %d: name is required", lineNum))
-			skipped++
-			continue
-		}
-
-		price, err := strconv.ParseFloat(priceStr, 64)
+		price, priceStr, err := csvPrice(record, headerMap, minorPrices)
 		if err != nil {
 			errors = append(errors, fmt.Sprintf("line %d: invalid price %q", lineNum, priceStr))
 			skipped++
 			continue
 		}
-		priceCents := int(math.Round(price * 100))
 
 		quantity, err := strconv.Atoi(quantityStr)
 		if err != nil {
@@ -142,15 +155,44 @@ func (s *Server) handleImportCSV(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		inStock := strings.EqualFold(inStockStr, "true") || inStockStr == "1"
+		req := CreateProductRequest{
+			Name:        record[headerMap["name"]],
+			Description: strings.TrimSpace(record[headerMap["description"]]),
+			Price:       price,
+			Currency:    optionalColumn(record, headerMap, "currency"),
+			Category:    record[headerMap["category"]],
+			InStock:     strings.EqualFold(inStockStr, "true") || inStockStr == "1",
+			Quantity:    quantity,
+		}
+		if err := req.Validate(); err != nil {
+			errors = append(errors, fmt.Sprintf("line %d: %v", lineNum, err))
+			skipped++
+			continue
+		}
+		categoryID, err := s.lookupCategoryID(req.Category)
+		if err != nil {
+			if err == errNotFound {
+				err = fmt.Errorf("unknown category %q", req.Category)
+			}
+			errors = append(errors, fmt.Sprintf("line %d: %v", lineNum, err))
+			skipped++
+			continue
+		}
+		if req.Currency == "" {
+			req.Currency = BaseCurrency
+		}
 
-		_, err = s.store.CreateProduct(name, description, priceCents, category, inStock, quantity)
+		id, err := s.store.CreateProduct(req.Name, req.Description, req.Price.Cents, req.Currency, categoryID, req.InStock, req.Quantity)
 		if err != nil {
 			errors = append(errors, fmt.Sprintf("line %d: %v", lineNum, err))
 			skipped++
 			continue
 		}
 
+		if created, err := s.store.GetProduct(id); err == nil {
+			s.audit(r, auditEntityProduct, id, id, "create", nil, productAuditFields(created))
+		}
+
 		imported++
 	}
 
@@ -175,13 +217,16 @@ func (s *Server) handleImportCSV(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleExportJSON(w http.ResponseWriter, r *http.Request) {
 	products, err := s.store.ListProducts("")
 	if err != nil {
-		http.Error(w, "failed to list products", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list products")
+		return
+	}
+	if !s.convertPrices(w, r, productPointers(products), nil) {
 		return
 	}
 
 	apiProducts := make([]Product, len(products))
 	for i, p := range products {
-		apiProducts[i] = toAPIProduct(&p)
+		apiProducts[i] = toAPIProduct(&p, moneyFormatOf(r))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -191,3 +236,26 @@ func (s *Server) handleExportJSON(w http.ResponseWriter, r *http.Request) {
 	encoder.SetIndent("", "  ")
 	encoder.Encode(apiProducts)
 }
+
+// optionalColumn returns the trimmed value of a column the CSV may omit, or
+// "" if its header has no such column.
+func optionalColumn(record []string, headerMap map[string]int, name string) string {
+	i, ok := headerMap[name]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+// csvPrice reads a row's price from its price_minor column when minor is set,
+// else from its price column, returning the raw text for error messages.
+func csvPrice(record []string, headerMap map[string]int, minor bool) (Money, string, error) {
+	if !minor {
+		raw := optionalColumn(record, headerMap, "price")
+		price, err := parseMoney(raw)
+		return price, raw, err
+	}
+	raw := optionalColumn(record, headerMap, "price_minor")
+	cents, err := strconv.Atoi(raw)
+	return Money{Cents: cents}, raw, err
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// toAPIImage converts a database image to the API representation.
+func toAPIImage(img *dbImage) Image {
+	return Image{
+		ID:           img.ID,
+		ProductID:    img.ProductID,
+		VariantID:    img.VariantID,
+		URL:          "/media/" + img.Filename,
+		ThumbnailURL: "/media/" + img.Thumbnail,
+		MimeType:     img.MimeType,
+		Width:        img.Width,
+		Height:       img.Height,
+		SizeBytes:    img.SizeBytes,
+		Checksum:     img.Checksum,
+		AltText:      img.AltText,
+		SortOrder:    img.SortOrder,
+		IsPrimary:    img.IsPrimary,
+		CreatedAt:    img.CreatedAt,
+	}
+}
+
+// attachPrimaryImages sets PrimaryImage on each product that has one. A
+// lookup failure is logged and leaves the products without images.
+func (s *Server) attachPrimaryImages(products []Product) {
+	ids := make([]int, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+	images, err := s.store.PrimaryProductImages(ids)
+	if err != nil {
+		log.Printf("ERROR: failed to load primary images: %v", err)
+		return
+	}
+	for i := range products {
+		if img, ok := images[products[i].ID]; ok {
+			apiImage := toAPIImage(&img)
+			products[i].PrimaryImage = &apiImage
+		}
+	}
+}
+
+// attachVariantImages sets PrimaryImage on each variant of a product that has one.
+func (s *Server) attachVariantImages(productID int, variants []Variant) {
+	images, err := s.store.PrimaryVariantImages(productID)
+	if err != nil {
+		log.Printf("ERROR: failed to load variant images: %v", err)
+		return
+	}
+	for i := range variants {
+		if img, ok := images[variants[i].ID]; ok {
+			apiImage := toAPIImage(&img)
+			variants[i].PrimaryImage = &apiImage
+		}
+	}
+}
+
+// imageOwner identifies whose images a request addresses: a product, or one
+// of its variants when VariantID is set.
+type imageOwner struct {
+	ProductID int
+	VariantID *int
+}
+
+// routeImages dispatches image sub-routes. path is like "1/images",
+// "1/images/7", "1/variants/3/images" or "1/variants/3/images/7".
+func (s *Server) routeImages(w http.ResponseWriter, r *http.Request, path string) {
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+
+	productID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
+		return
+	}
+	owner := imageOwner{ProductID: productID}
+	rest := parts[1:]
+
+	if rest[0] == "variants" {
+		if len(rest) < 3 || rest[2] != "images" {
+			notFound(w, r)
+			return
+		}
+		variantID, err := strconv.Atoi(rest[1])
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid variant ID")
+			return
+		}
+		owner.VariantID = &variantID
+		rest = rest[2:]
+	}
+	if rest[0] != "images" || len(rest) > 2 {
+		notFound(w, r)
+		return
+	}
+
+	if len(rest) == 1 {
+		// /products/:id/images or /products/:id/variants/:variantId/images
+		switch r.Method {
+		case http.MethodGet:
+			s.handleListImages(w, r, owner)
+		case http.MethodPost:
+			s.handleUploadImage(w, r, owner)
+		default:
+			methodNotAllowed(w, r)
+		}
+		return
+	}
+
+	imageID, err := strconv.Atoi(rest[1])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid image ID")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.handleGetImage(w, r, owner, imageID)
+	case http.MethodPatch:
+		s.handlePatchImage(w, r, owner, imageID)
+	case http.MethodDelete:
+		s.handleDeleteImage(w, r, owner, imageID)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// checkImageOwner verifies that the product, and the variant if one is
+// addressed, exist and belong together. It writes a 404 and returns false if not.
+func (s *Server) checkImageOwner(w http.ResponseWriter, r *http.Request, owner imageOwner) bool {
+	if _, err := s.store.GetProduct(owner.ProductID); err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return false
+	}
+	if owner.VariantID != nil {
+		v, err := s.store.GetVariant(*owner.VariantID)
+		if err != nil || v.ProductID != owner.ProductID {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "variant not found")
+			return false
+		}
+	}
+	return true
+}
+
+// loadOwnedImage fetches an image and checks it belongs to owner, which
+// must pass checkImageOwner, writing a 404 if it does not. Images of a
+// soft-deleted product are hidden along with it.
+func (s *Server) loadOwnedImage(w http.ResponseWriter, r *http.Request, owner imageOwner, imageID int) (*dbImage, bool) {
+	if !s.checkImageOwner(w, r, owner) {
+		return nil, false
+	}
+	img, err := s.store.GetImage(imageID)
+	if err != nil {
+		if !errors.Is(err, errNotFound) {
+			log.Printf("ERROR: failed to load image: %v", err)
+		}
+		writeError(w, r, http.StatusNotFound, codeNotFound, "image not found")
+		return nil, false
+	}
+	sameVariant := (img.VariantID == nil && owner.VariantID == nil) ||
+		(img.VariantID != nil && owner.VariantID != nil && *img.VariantID == *owner.VariantID)
+	if img.ProductID != owner.ProductID || !sameVariant {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "image not found")
+		return nil, false
+	}
+	return img, true
+}
+
+// handleListImages handles GET /products/:id/images and
+// GET /products/:id/variants/:variantId/images
+func (s *Server) handleListImages(w http.ResponseWriter, r *http.Request, owner imageOwner) {
+	if !s.checkImageOwner(w, r, owner) {
+		return
+	}
+
+	images, err := s.store.ListImages(owner.ProductID, owner.VariantID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list images")
+		return
+	}
+
+	apiImages := make([]Image, len(images))
+	for i, img := range images {
+		apiImages[i] = toAPIImage(&img)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiImages)
+}
+
+// handleUploadImage handles POST /products/:id/images and
+// POST /products/:id/variants/:variantId/images
+//
+// The body is multipart/form-data with the image in "file" and optional
+// "alt_text", "sort_order" and "primary" fields.
+func (s *Server) handleUploadImage(w http.ResponseWriter, r *http.Request, owner imageOwner) {
+	if !s.checkImageOwner(w, r, owner) {
+		return
+	}
+
+	// Leave room for the multipart framing and text fields around the file.
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageUploadBytes+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, codePayloadTooLarge, "image must be at most 10 MB")
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "request must be multipart/form-data")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	req := UpdateImageRequest{AltText: r.FormValue("alt_text")}
+	var errs validationError
+	if v := r.FormValue("sort_order"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs.add("sort_order", "must be an integer")
+		}
+		req.SortOrder = n
+	}
+	if v := r.FormValue("primary"); v != "" {
+		primary, err := strconv.ParseBool(v)
+		if err != nil {
+			errs.add("primary", "must be true or false")
+		}
+		req.IsPrimary = primary
+	}
+	if err := req.Validate(); err != nil {
+		var verr validationError
+		errors.As(err, &verr)
+		errs = append(errs, verr...)
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		errs.add("file", "is required")
+	} else {
+		defer file.Close()
+	}
+	if err := errs.err(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, maxImageUploadBytes+1))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "failed to read image")
+		return
+	}
+	if len(data) > maxImageUploadBytes {
+		writeError(w, r, http.StatusRequestEntityTooLarge, codePayloadTooLarge, "image must be at most 10 MB")
+		return
+	}
+
+	saved, err := saveImage(s.config.ImageDir, data)
+	if errors.Is(err, errUnsupportedImage) {
+		writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMedia, err.Error())
+		return
+	}
+	var verr validationError
+	if errors.As(err, &verr) {
+		writeValidationError(w, r, verr)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to store image: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to store image")
+		return
+	}
+
+	record := dbImage{
+		ProductID: owner.ProductID,
+		VariantID: owner.VariantID,
+		Filename:  saved.Filename,
+		Thumbnail: saved.Thumbnail,
+		MimeType:  saved.MimeType,
+		Width:     saved.Width,
+		Height:    saved.Height,
+		SizeBytes: saved.SizeBytes,
+		Checksum:  saved.Checksum,
+		AltText:   req.AltText,
+		SortOrder: req.SortOrder,
+		IsPrimary: req.IsPrimary,
+	}
+	id, err := s.store.CreateImage(record)
+	if err != nil {
+		log.Printf("ERROR: failed to create image: %v", err)
+		removeImageFiles(s.config.ImageDir, &record)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to create image")
+		return
+	}
+
+	created, err := s.store.GetImage(id)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load image")
+		return
+	}
+	s.audit(r, auditEntityImage, id, owner.ProductID, "create", nil, imageAuditFields(created))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(toAPIImage(created))
+}
+
+// handleGetImage handles GET /products/:id/images/:imageId
+func (s *Server) handleGetImage(w http.ResponseWriter, r *http.Request, owner imageOwner, imageID int) {
+	img, ok := s.loadOwnedImage(w, r, owner, imageID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toAPIImage(img))
+}
+
+// handlePatchImage handles PATCH /products/:id/images/:imageId with a JSON
+// merge patch of alt_text, sort_order and is_primary. Setting is_primary
+// moves the primary flag to this image; it cannot be cleared directly.
+func (s *Server) handlePatchImage(w http.ResponseWriter, r *http.Request, owner imageOwner, imageID int) {
+	if !isMergePatch(r) {
+		writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMedia, "Content-Type must be "+mergePatchContentType)
+		return
+	}
+
+	before, ok := s.loadOwnedImage(w, r, owner, imageID)
+	if !ok {
+		return
+	}
+
+	current := UpdateImageRequest{
+		AltText:   before.AltText,
+		SortOrder: before.SortOrder,
+		IsPrimary: before.IsPrimary,
+	}
+	var req UpdateImageRequest
+	if err := decodeMergePatch(r, current, imagePatchFields, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, err.Error())
+		return
+	}
+	if before.IsPrimary && !req.IsPrimary {
+		writeValidationError(w, r, validationError{{Field: "is_primary", Message: "make another image primary instead"}})
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	if err := s.store.UpdateImage(imageID, req.AltText, req.SortOrder, req.IsPrimary); err != nil {
+		if errors.Is(err, errNotFound) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "image not found")
+			return
+		}
+		log.Printf("ERROR: failed to update image: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to update image")
+		return
+	}
+
+	img, err := s.store.GetImage(imageID)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "image not found")
+		return
+	}
+	s.audit(r, auditEntityImage, imageID, img.ProductID, "update", imageAuditFields(before), imageAuditFields(img))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toAPIImage(img))
+}
+
+// handleDeleteImage handles DELETE /products/:id/images/:imageId
+func (s *Server) handleDeleteImage(w http.ResponseWriter, r *http.Request, owner imageOwner, imageID int) {
+	if _, ok := s.loadOwnedImage(w, r, owner, imageID); !ok {
+		return
+	}
+
+	img, err := s.store.DeleteImage(imageID)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "image not found")
+			return
+		}
+		log.Printf("ERROR: failed to delete image: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to delete image")
+		return
+	}
+	removeImageFiles(s.config.ImageDir, img)
+
+	s.audit(r, auditEntityImage, imageID, img.ProductID, "delete", imageAuditFields(img), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// toAPIOrder converts a database order to the API representation, with
+// amounts written in the given format.
+func toAPIOrder(o *dbOrder, format moneyFormat) Order {
+	var lines []OrderLine
+	for _, l := range o.Lines {
+		lines = append(lines, OrderLine{
+			ID:        l.ID,
+			ProductID: l.ProductID,
+			VariantID: l.VariantID,
+			SKU:       l.SKU,
+			Name:      l.Name,
+			Quantity:  l.Quantity,
+			UnitPrice: newMoney(l.UnitPriceCents, o.Currency, format),
+		})
+	}
+
+	return Order{
+		ID:        o.ID,
+		Status:    o.Status,
+		Customer:  o.Customer,
+		Total:     newMoney(o.TotalCents, o.Currency, format),
+		Currency:  o.Currency,
+		ExpiresAt: o.ExpiresAt,
+		CreatedAt: o.CreatedAt,
+		UpdatedAt: o.UpdatedAt,
+		Lines:     lines,
+		History:   o.History,
+	}
+}
+
+// handleCreateOrder handles POST /orders
+func (s *Server) handleCreateOrder(w http.ResponseWriter, r *http.Request) {
+	var req CreateOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+		return
+	}
+
+	if len(req.Lines) == 0 {
+		writeValidationError(w, r, validationError{{Field: "lines", Message: "must contain at least one line"}})
+		return
+	}
+	var errs validationError
+	for i, l := range req.Lines {
+		if l.Quantity <= 0 {
+			errs.add(fmt.Sprintf("lines[%d].quantity", i), "must be positive")
+		}
+	}
+	if err := errs.err(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	id, err := s.store.CreateOrder(req.Customer, clientIdentity(r), req.Lines, s.config.ReservationTTL)
+	switch {
+	case errors.Is(err, errInsufficientStock):
+		writeError(w, r, http.StatusConflict, codeInsufficientStock, err.Error())
+		return
+	case errors.Is(err, errNotFound), errors.Is(err, errMixedCurrencies):
+		writeError(w, r, http.StatusBadRequest, codeValidationFailed, err.Error())
+		return
+	case err != nil:
+		log.Printf("ERROR: failed to create order: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to create order")
+		return
+	}
+
+	order, err := s.store.GetOrder(id)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load order")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(toAPIOrder(order, moneyFormatOf(r)))
+}
+
+// handleListOrders handles GET /orders
+func (s *Server) handleListOrders(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+		return
+	}
+
+	orders, err := s.store.ListOrders(r.URL.Query().Get("status"), limit)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list orders")
+		return
+	}
+
+	apiOrders := make([]Order, len(orders))
+	for i, o := range orders {
+		apiOrders[i] = toAPIOrder(&o, moneyFormatOf(r))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiOrders)
+}
+
+// handleGetOrder handles GET /orders/:id
+func (s *Server) handleGetOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromPath(r, "/orders/")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid order ID")
+		return
+	}
+
+	order, err := s.store.GetOrder(id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "order not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toAPIOrder(order, moneyFormatOf(r)))
+}
+
+// handleTransitionOrder handles POST /orders/:id/confirm and POST /orders/:id/cancel
+func (s *Server) handleTransitionOrder(w http.ResponseWriter, r *http.Request, to string) {
+	id, err := getIDFromPath(r, "/orders/")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid order ID")
+		return
+	}
+
+	var req OrderTransitionRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+			return
+		}
+	}
+
+	err = s.store.TransitionOrder(id, to, req.Reason, clientIdentity(r))
+	switch {
+	case errors.Is(err, errNotFound):
+		writeError(w, r, http.StatusNotFound, codeNotFound, "order not found")
+		return
+	case errors.Is(err, errInvalidTransition):
+		writeError(w, r, http.StatusConflict, codeInvalidTransition, err.Error())
+		return
+	case err != nil:
+		log.Printf("ERROR: failed to update order %d: %v", id, err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to update order")
+		return
+	}
+
+	order, err := s.store.GetOrder(id)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load order")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toAPIOrder(order, moneyFormatOf(r)))
+}
+
+// routeOrders dispatches /orders/:id sub-routes.
+func (s *Server) routeOrders(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/orders/"), "/")
+	parts := strings.Split(path, "/")
+
+	if len(parts) == 1 {
+		if r.Method == http.MethodGet {
+			s.handleGetOrder(w, r)
+			return
+		}
+		methodNotAllowed(w, r)
+		return
+	}
+
+	if len(parts) == 2 {
+		var to string
+		switch parts[1] {
+		case "confirm":
+			to = OrderConfirmed
+		case "cancel":
+			to = OrderCancelled
+		default:
+			notFound(w, r)
+			return
+		}
+		if r.Method == http.MethodPost {
+			s.handleTransitionOrder(w, r, to)
+			return
+		}
+		methodNotAllowed(w, r)
+		return
+	}
+
+	notFound(w, r)
+}
+
+// expireReservations releases stock held by lapsed reservations.
+func (s *Server) expireReservations() {
+	n, err := s.store.ExpireReservations(time.Now())
+	if err != nil {
+		log.Printf("ERROR: failed to expire reservations: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Expired %d order reservation(s)", n)
+	}
+}
@@ -9,6 +9,7 @@ import (
 )
 
 var funcMap = template.FuncMap{
+	"money": displayMoney,
 	"div": func(a float64, b float64) float64 {
 		if b == 0 {
 			return 0
@@ -28,24 +29,25 @@ func (s *Server) loadTemplate(names ...string) (*template.Template, error) {
 // handlePageProductList renders the product list page at /
 func (s *Server) handlePageProductList(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+		notFound(w, r)
 		return
 	}
 
 	products, err := s.store.ListProducts("")
 	if err != nil {
-		http.Error(w, "failed to load products", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load products")
 		return
 	}
 
 	apiProducts := make([]Product, len(products))
 	for i, p := range products {
-		apiProducts[i] = toAPIProduct(&p)
+		apiProducts[i] = toAPIProduct(&p, moneyNumber)
 	}
+	s.attachPrimaryImages(apiProducts)
 
 	tmpl, err := s.loadTemplate("layout.html", "product_list.html")
 	if err != nil {
-		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "template error: "+err.Error())
 		return
 	}
 
@@ -55,24 +57,36 @@ func (s *Server) handlePageProductList(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "layout", data); err != nil {
-		http.Error(w, "render error: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "render error: "+err.Error())
 	}
 }
 
 // handlePageNewProduct renders the create product form at /new
 func (s *Server) handlePageNewProduct(w http.ResponseWriter, r *http.Request) {
+	categories, err := s.store.ListCategories()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load categories")
+		return
+	}
+	apiCategories := make([]Category, len(categories))
+	for i, c := range categories {
+		apiCategories[i] = toAPICategory(&c)
+	}
+
 	tmpl, err := s.loadTemplate("layout.html", "new_product.html")
 	if err != nil {
-		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "template error: "+err.Error())
 		return
 	}
 
 	data := map[string]interface{}{
-		"Title": "New Product",
+		"Title":      "New Product",
+		"Limits":     formLimits,
+		"Categories": apiCategories,
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "layout", data); err != nil {
-		http.Error(w, "render error: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "render error: "+err.Error())
 	}
 }
 
@@ -87,17 +101,17 @@ func (s *Server) handlePageProductDetail(w http.ResponseWriter, r *http.Request)
 
 	id, err := strconv.Atoi(pathPart)
 	if err != nil {
-		http.NotFound(w, r)
+		notFound(w, r)
 		return
 	}
 
 	product, err := s.store.GetProduct(id)
 	if err != nil {
-		http.Error(w, "product not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
 		return
 	}
 
-	apiProduct := toAPIProduct(product)
+	apiProduct := toAPIProduct(product, moneyNumber)
 
 	variants, err := s.store.ListVariants(id)
 	if err != nil {
@@ -105,22 +119,37 @@ func (s *Server) handlePageProductDetail(w http.ResponseWriter, r *http.Request)
 	}
 	apiVariants := make([]Variant, len(variants))
 	for i, v := range variants {
-		apiVariants[i] = toAPIVariant(&v)
+		apiVariants[i] = toAPIVariant(&v, moneyNumber)
+	}
+	s.attachVariantImages(id, apiVariants)
+
+	images, err := s.store.ListImages(id, nil)
+	if err != nil {
+		images = nil
+	}
+	apiImages := make([]Image, len(images))
+	for i, img := range images {
+		apiImages[i] = toAPIImage(&img)
+	}
+	if len(apiImages) > 0 && apiImages[0].IsPrimary {
+		apiProduct.PrimaryImage = &apiImages[0]
 	}
 
 	tmpl, err := s.loadTemplate("layout.html", "product_detail.html")
 	if err != nil {
-		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "template error: "+err.Error())
 		return
 	}
 
 	data := map[string]interface{}{
 		"Product":  apiProduct,
+		"ETag":     productETag(product),
 		"Variants": apiVariants,
+		"Images":   apiImages,
 		"Title":    apiProduct.Name,
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "layout", data); err != nil {
-		http.Error(w, "render error: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "render error: "+err.Error())
 	}
 }
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// priceSchedulerActor is the audit actor for changes made by the schedule worker.
+const priceSchedulerActor = "system:price-scheduler"
+
+// toAPIPriceSchedule converts a database price schedule to the API
+// representation, with prices in currency written in the given format.
+func toAPIPriceSchedule(ps *dbPriceSchedule, currency string, format moneyFormat) PriceSchedule {
+	return PriceSchedule{
+		ID:            ps.ID,
+		ProductID:     ps.ProductID,
+		VariantID:     ps.VariantID,
+		Price:         newMoney(ps.PriceCents, currency, format),
+		StartsAt:      ps.StartsAt,
+		EndsAt:        ps.EndsAt,
+		Status:        ps.Status,
+		PreviousPrice: moneyPtr(ps.PreviousPriceCents, currency, format),
+		Note:          ps.Note,
+		CreatedBy:     ps.CreatedBy,
+		CreatedAt:     ps.CreatedAt,
+		UpdatedAt:     ps.UpdatedAt,
+	}
+}
+
+// toAPIPriceHistory converts price history, grouped by owner and oldest
+// first as ListPriceHistory returns it, to the API representation. Each
+// price is effective until the next one for the same product or variant.
+func toAPIPriceHistory(changes []dbPriceChange, currency string, format moneyFormat) []PriceChange {
+	history := make([]PriceChange, len(changes))
+	for i, c := range changes {
+		history[i] = PriceChange{
+			ID:            c.ID,
+			VariantID:     c.VariantID,
+			Price:         newMoney(c.PriceCents, currency, format),
+			PreviousPrice: moneyPtr(c.OldPriceCents, currency, format),
+			ScheduleID:    c.ScheduleID,
+			EffectiveFrom: c.ChangedAt,
+		}
+		if i > 0 && sameVariant(changes[i-1].VariantID, c.VariantID) {
+			from := c.ChangedAt
+			history[i-1].EffectiveTo = &from
+		}
+	}
+	return history
+}
+
+func sameVariant(a, b *int) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+// routePrices dispatches price sub-routes. path is like "1/prices",
+// "1/prices/schedules", "1/prices/schedules/4", "1/prices/overrides" or
+// "1/prices/overrides/EUR".
+func (s *Server) routePrices(w http.ResponseWriter, r *http.Request, path string) {
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+
+	productID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
+		return
+	}
+	if parts[1] != "prices" || len(parts) > 4 {
+		notFound(w, r)
+		return
+	}
+	if len(parts) > 2 && parts[2] == "overrides" {
+		s.routePriceOverrides(w, r, productID, parts[3:])
+		return
+	}
+	if len(parts) > 2 && parts[2] != "schedules" {
+		notFound(w, r)
+		return
+	}
+
+	switch len(parts) {
+	case 2:
+		// /products/:id/prices
+		if r.Method == http.MethodGet {
+			s.handleGetPriceHistory(w, r, productID)
+			return
+		}
+		methodNotAllowed(w, r)
+	case 3:
+		// /products/:id/prices/schedules
+		switch r.Method {
+		case http.MethodGet:
+			s.handleListPriceSchedules(w, r, productID)
+		case http.MethodPost:
+			s.handleCreatePriceSchedule(w, r, productID)
+		default:
+			methodNotAllowed(w, r)
+		}
+	case 4:
+		// /products/:id/prices/schedules/:scheduleId
+		scheduleID, err := strconv.Atoi(parts[3])
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid schedule ID")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s.handleGetPriceSchedule(w, r, productID, scheduleID)
+		case http.MethodDelete:
+			s.handleCancelPriceSchedule(w, r, productID, scheduleID)
+		default:
+			methodNotAllowed(w, r)
+		}
+	}
+}
+
+// checkPriceTarget verifies that the product exists and, if variantID is
+// set, that the variant belongs to it, and returns the product. It writes a
+// 404 and returns false if not.
+func (s *Server) checkPriceTarget(w http.ResponseWriter, r *http.Request, productID int, variantID *int) (*dbProduct, bool) {
+	product, err := s.store.GetProduct(productID)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return nil, false
+	}
+	if variantID != nil {
+		v, err := s.store.GetVariant(*variantID)
+		if err != nil || v.ProductID != productID {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "variant not found")
+			return nil, false
+		}
+	}
+	return product, true
+}
+
+// variantIDParam parses the optional variant_id query parameter, writing a
+// 400 and returning false if it is malformed.
+func variantIDParam(w http.ResponseWriter, r *http.Request) (*int, bool) {
+	raw := r.URL.Query().Get("variant_id")
+	if raw == "" {
+		return nil, true
+	}
+	id, err := strconv.Atoi(raw)
+	if err != nil || id <= 0 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "variant_id must be a variant ID")
+		return nil, false
+	}
+	return &id, true
+}
+
+// handleGetPriceHistory handles GET /products/:id/prices
+//
+// Returns every recorded price of the product and its variants, or of one
+// variant with ?variant_id=, together with the schedules not yet finished.
+func (s *Server) handleGetPriceHistory(w http.ResponseWriter, r *http.Request, productID int) {
+	variantID, ok := variantIDParam(w, r)
+	if !ok {
+		return
+	}
+	product, ok := s.checkPriceTarget(w, r, productID, variantID)
+	if !ok {
+		return
+	}
+
+	changes, err := s.store.ListPriceHistory(productID, variantID)
+	if err != nil {
+		log.Printf("ERROR: failed to list price history: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load price history")
+		return
+	}
+	schedules, err := s.store.ListPriceSchedules(productID, variantID, ScheduleScheduled, ScheduleActive)
+	if err != nil {
+		log.Printf("ERROR: failed to list price schedules: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load price schedules")
+		return
+	}
+
+	resp := PriceHistory{
+		ProductID: productID,
+		History:   toAPIPriceHistory(changes, product.Currency, moneyFormatOf(r)),
+		Upcoming:  make([]PriceSchedule, len(schedules)),
+	}
+	for i, ps := range schedules {
+		resp.Upcoming[i] = toAPIPriceSchedule(&ps, product.Currency, moneyFormatOf(r))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleListPriceSchedules handles GET /products/:id/prices/schedules
+//
+// Query parameters:
+//   - variant_id: only schedules for this variant
+//   - status: only schedules with this status
+func (s *Server) handleListPriceSchedules(w http.ResponseWriter, r *http.Request, productID int) {
+	variantID, ok := variantIDParam(w, r)
+	if !ok {
+		return
+	}
+	product, ok := s.checkPriceTarget(w, r, productID, variantID)
+	if !ok {
+		return
+	}
+	var statuses []string
+	if status := r.URL.Query().Get("status"); status != "" {
+		switch status {
+		case ScheduleScheduled, ScheduleActive, ScheduleCompleted, ScheduleCancelled, ScheduleFailed:
+			statuses = []string{status}
+		default:
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "status must be scheduled, active, completed, cancelled or failed")
+			return
+		}
+	}
+
+	schedules, err := s.store.ListPriceSchedules(productID, variantID, statuses...)
+	if err != nil {
+		log.Printf("ERROR: failed to list price schedules: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list price schedules")
+		return
+	}
+
+	apiSchedules := make([]PriceSchedule, len(schedules))
+	for i, ps := range schedules {
+		apiSchedules[i] = toAPIPriceSchedule(&ps, product.Currency, moneyFormatOf(r))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiSchedules)
+}
+
+// handleCreatePriceSchedule handles POST /products/:id/prices/schedules
+func (s *Server) handleCreatePriceSchedule(w http.ResponseWriter, r *http.Request, productID int) {
+	var req CreatePriceScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+	product, ok := s.checkPriceTarget(w, r, productID, req.VariantID)
+	if !ok || !checkPriceCurrency(w, r, "price", req.Price, product.Currency) {
+		return
+	}
+
+	id, err := s.store.CreatePriceSchedule(dbPriceSchedule{
+		ProductID:  productID,
+		VariantID:  req.VariantID,
+		PriceCents: req.Price.Cents,
+		StartsAt:   req.StartsAt,
+		EndsAt:     req.EndsAt,
+		Note:       req.Note,
+		CreatedBy:  clientIdentity(r),
+	})
+	if errors.Is(err, errScheduleOverlap) {
+		writeError(w, r, http.StatusConflict, codeConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to create price schedule: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to create price schedule")
+		return
+	}
+
+	created, err := s.store.GetPriceSchedule(id)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load price schedule")
+		return
+	}
+	s.audit(r, auditEntityPriceSchedule, id, productID, "create", nil, priceScheduleAuditFields(created))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(toAPIPriceSchedule(created, product.Currency, moneyFormatOf(r)))
+}
+
+// loadProductSchedule fetches a schedule and checks it belongs to the
+// product, writing a 404 if it does not.
+func (s *Server) loadProductSchedule(w http.ResponseWriter, r *http.Request, productID, scheduleID int) (*dbPriceSchedule, bool) {
+	ps, err := s.store.GetPriceSchedule(scheduleID)
+	if err != nil || ps.ProductID != productID {
+		if err != nil && !errors.Is(err, errNotFound) {
+			log.Printf("ERROR: failed to load price schedule: %v", err)
+		}
+		writeError(w, r, http.StatusNotFound, codeNotFound, "price schedule not found")
+		return nil, false
+	}
+	return ps, true
+}
+
+// handleGetPriceSchedule handles GET /products/:id/prices/schedules/:scheduleId
+func (s *Server) handleGetPriceSchedule(w http.ResponseWriter, r *http.Request, productID, scheduleID int) {
+	product, ok := s.checkPriceTarget(w, r, productID, nil)
+	if !ok {
+		return
+	}
+	ps, ok := s.loadProductSchedule(w, r, productID, scheduleID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toAPIPriceSchedule(ps, product.Currency, moneyFormatOf(r)))
+}
+
+// handleCancelPriceSchedule handles DELETE /products/:id/prices/schedules/:scheduleId
+//
+// Cancels a schedule that has not started, or ends an active sale early and
+// reverts its price. Finished schedules are kept as history and cannot be
+// cancelled.
+func (s *Server) handleCancelPriceSchedule(w http.ResponseWriter, r *http.Request, productID, scheduleID int) {
+	if _, ok := s.loadProductSchedule(w, r, productID, scheduleID); !ok {
+		return
+	}
+
+	run, err := s.store.CancelPriceSchedule(scheduleID)
+	if errors.Is(err, errNotFound) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "price schedule not found")
+		return
+	}
+	if errors.Is(err, errInvalidTransition) {
+		writeError(w, r, http.StatusConflict, codeInvalidTransition, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to cancel price schedule: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to cancel price schedule")
+		return
+	}
+	s.auditScheduleRun(clientIdentity(r), run)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditScheduleRun records a schedule's status change and any price change
+// it caused.
+func (s *Server) auditScheduleRun(actor string, run *priceScheduleRun) {
+	ps := &run.Schedule
+	before := priceScheduleAuditFields(ps)
+	after := priceScheduleAuditFields(ps)
+	after["status"] = run.Status
+	action := "complete"
+	switch run.Status {
+	case ScheduleActive:
+		action = "start"
+	case ScheduleCancelled:
+		action = "cancel"
+	case ScheduleFailed:
+		action = "fail"
+	}
+	s.auditAs(actor, auditEntityPriceSchedule, ps.ID, ps.ProductID, action, before, after)
+
+	if !run.PriceChanged {
+		return
+	}
+	entityType, entityID := auditEntityProduct, ps.ProductID
+	if ps.VariantID != nil {
+		entityType, entityID = auditEntityVariant, *ps.VariantID
+	}
+	s.auditAs(actor, entityType, entityID, ps.ProductID, "update",
+		map[string]interface{}{"price_cents": run.OldPriceCents},
+		map[string]interface{}{"price_cents": run.NewPriceCents})
+}
+
+// runPriceSchedules starts and ends the scheduled price changes that are due.
+// A schedule that fails is logged and skipped; the rest still run.
+func (s *Server) runPriceSchedules() {
+	runs, err := s.store.RunPriceSchedules(time.Now())
+	if err != nil {
+		log.Printf("ERROR: failed to list due price schedules: %v", err)
+		return
+	}
+
+	ran := 0
+	for i := range runs {
+		run := &runs[i]
+		if run.Err != nil {
+			log.Printf("ERROR: failed to run price schedule %d: %v", run.Schedule.ID, run.Err)
+			if run.Status != ScheduleFailed {
+				continue
+			}
+		} else {
+			ran++
+		}
+		s.auditScheduleRun(priceSchedulerActor, run)
+	}
+	if ran > 0 {
+		log.Printf("Ran %d price schedule(s)", ran)
+	}
+}
+
+// toAPIPriceOverride converts a database price override to the API
+// representation, with its price written in the given format.
+func toAPIPriceOverride(po *dbPriceOverride, format moneyFormat) PriceOverride {
+	return PriceOverride{
+		ID:        po.ID,
+		ProductID: po.ProductID,
+		VariantID: po.VariantID,
+		Currency:  po.Currency,
+		Price:     newMoney(po.PriceCents, po.Currency, format),
+		CreatedAt: po.CreatedAt,
+		UpdatedAt: po.UpdatedAt,
+	}
+}
+
+// routePriceOverrides dispatches /products/:id/prices/overrides and
+// /products/:id/prices/overrides/:currency; rest holds the segments after
+// "overrides".
+func (s *Server) routePriceOverrides(w http.ResponseWriter, r *http.Request, productID int, rest []string) {
+	if len(rest) == 0 {
+		if r.Method == http.MethodGet {
+			s.handleListPriceOverrides(w, r, productID)
+			return
+		}
+		methodNotAllowed(w, r)
+		return
+	}
+
+	currency, ok := normalizeCurrency(rest[0])
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter,
+			"currency must be one of "+strings.Join(supportedCurrencies, ", "))
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		s.handleSetPriceOverride(w, r, productID, currency)
+	case http.MethodDelete:
+		s.handleDeletePriceOverride(w, r, productID, currency)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// handleListPriceOverrides handles GET /products/:id/prices/overrides
+func (s *Server) handleListPriceOverrides(w http.ResponseWriter, r *http.Request, productID int) {
+	if _, ok := s.checkPriceTarget(w, r, productID, nil); !ok {
+		return
+	}
+
+	overrides, err := s.store.ListPriceOverrides(productID)
+	if err != nil {
+		log.Printf("ERROR: failed to list price overrides: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list price overrides")
+		return
+	}
+
+	apiOverrides := make([]PriceOverride, len(overrides))
+	for i, po := range overrides {
+		apiOverrides[i] = toAPIPriceOverride(&po, moneyFormatOf(r))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiOverrides)
+}
+
+// handleSetPriceOverride handles PUT /products/:id/prices/overrides/:currency
+//
+// Fixes the price of the product, or of the variant named by variant_id, in
+// a currency other than its own, so that it is shown instead of a converted one.
+func (s *Server) handleSetPriceOverride(w http.ResponseWriter, r *http.Request, productID int, currency string) {
+	var req SetPriceOverrideRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+	if !checkPriceCurrency(w, r, "price", req.Price, currency) {
+		return
+	}
+	if _, ok := s.checkPriceTarget(w, r, productID, req.VariantID); !ok {
+		return
+	}
+
+	var before *dbPriceOverride
+	if overrides, err := s.store.ListPriceOverrides(productID); err == nil {
+		for i, po := range overrides {
+			if po.Currency == currency && sameVariant(po.VariantID, req.VariantID) {
+				before = &overrides[i]
+			}
+		}
+	}
+
+	po, err := s.store.SetPriceOverride(productID, req.VariantID, currency, req.Price.Cents)
+	if err != nil {
+		log.Printf("ERROR: failed to set price override: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to set price override")
+		return
+	}
+	action := "update"
+	if before == nil {
+		action = "create"
+	}
+	s.audit(r, auditEntityPriceOverride, po.ID, productID, action, priceOverrideAuditFields(before), priceOverrideAuditFields(po))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toAPIPriceOverride(po, moneyFormatOf(r)))
+}
+
+// handleDeletePriceOverride handles DELETE /products/:id/prices/overrides/:currency
+//
+// The override of a variant is addressed with ?variant_id=.
+func (s *Server) handleDeletePriceOverride(w http.ResponseWriter, r *http.Request, productID int, currency string) {
+	variantID, ok := variantIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	po, err := s.store.DeletePriceOverride(productID, variantID, currency)
+	if errors.Is(err, errNotFound) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "price override not found")
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to delete price override: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to delete price override")
+		return
+	}
+	s.audit(r, auditEntityPriceOverride, po.ID, productID, "delete", priceOverrideAuditFields(po), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListExchangeRates handles GET /admin/exchange-rates
+func (s *Server) handleListExchangeRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := s.store.ListExchangeRates()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list exchange rates")
+		return
+	}
+
+	apiRates := make([]ExchangeRate, len(rates))
+	for i, er := range rates {
+		apiRates[i] = ExchangeRate{Currency: er.Currency, Rate: er.Rate, UpdatedAt: er.UpdatedAt}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiRates)
+}
+
+// exchangeRateCurrency parses the currency of an /admin/exchange-rates/:currency
+// path. The base currency has a fixed rate and cannot be addressed.
+func exchangeRateCurrency(w http.ResponseWriter, r *http.Request) (string, bool) {
+	currency, ok := normalizeCurrency(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/exchange-rates/"), "/"))
+	switch {
+	case !ok:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter,
+			"currency must be one of "+strings.Join(supportedCurrencies, ", "))
+		return "", false
+	case currency == BaseCurrency:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, BaseCurrency+" is the base currency; its rate is always 1")
+		return "", false
+	}
+	return currency, true
+}
+
+// handleSetExchangeRate handles PUT /admin/exchange-rates/:currency
+//
+// The rate is the number of units of the currency per unit of the base currency.
+func (s *Server) handleSetExchangeRate(w http.ResponseWriter, r *http.Request) {
+	currency, ok := exchangeRateCurrency(w, r)
+	if !ok {
+		return
+	}
+	var req SetExchangeRateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+		return
+	}
+	rate := strings.TrimSpace(req.Rate.String())
+	if _, ok := parseRate(rate); !ok {
+		writeValidationError(w, r, validationError{{Field: "rate", Message: "must be a positive decimal number"}})
+		return
+	}
+
+	var before map[string]interface{}
+	if old, err := s.store.GetExchangeRate(currency); err == nil {
+		before = map[string]interface{}{"currency": currency, "rate": old.Rate}
+	}
+	if err := s.store.SetExchangeRate(currency, rate); err != nil {
+		log.Printf("ERROR: failed to set exchange rate: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to set exchange rate")
+		return
+	}
+	er, err := s.store.GetExchangeRate(currency)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load exchange rate")
+		return
+	}
+	s.audit(r, auditEntityExchangeRate, 0, 0, "update", before, map[string]interface{}{"currency": currency, "rate": er.Rate})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ExchangeRate{Currency: er.Currency, Rate: er.Rate, UpdatedAt: er.UpdatedAt})
+}
+
+// handleDeleteExchangeRate handles DELETE /admin/exchange-rates/:currency
+func (s *Server) handleDeleteExchangeRate(w http.ResponseWriter, r *http.Request) {
+	currency, ok := exchangeRateCurrency(w, r)
+	if !ok {
+		return
+	}
+
+	old, err := s.store.GetExchangeRate(currency)
+	if err == nil {
+		err = s.store.DeleteExchangeRate(currency)
+	}
+	if errors.Is(err, errNotFound) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "no exchange rate for "+currency)
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to delete exchange rate")
+		return
+	}
+	s.audit(r, auditEntityExchangeRate, 0, 0, "delete", map[string]interface{}{"currency": currency, "rate": old.Rate}, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
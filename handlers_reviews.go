@@ -2,85 +2,318 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // toAPIReview converts a database review to the API representation.
 func toAPIReview(r *dbReview) Review {
-	return Review{
+	review := Review{
 		ID:        r.ID,
 		ProductID: r.ProductID,
 		Author:    r.Author,
 		Rating:    r.Rating,
 		Comment:   r.Comment,
-		Approved:  r.Approved,
+		Approved:  r.Status == ReviewApproved,
+		Status:    r.Status,
 		CreatedAt: r.CreatedAt,
+
+		VerifiedPurchase: r.VerifiedPurchase,
+		HelpfulVotes:     r.HelpfulVotes,
+		UnhelpfulVotes:   r.UnhelpfulVotes,
+	}
+	if r.Reply != "" && r.RepliedAt != nil {
+		review.MerchantReply = &ReviewReply{Body: r.Reply, RepliedAt: *r.RepliedAt}
 	}
+	return review
+}
+
+// toModeratedReview converts a review for moderators, adding who last
+// moderated it and why, and its spam score. Public listings leave those details out.
+func toModeratedReview(r *dbReview) Review {
+	review := toAPIReview(r)
+	review.ModerationReason = r.ModerationReason
+	review.ModeratedBy = r.ModeratedBy
+	review.ModeratedAt = r.ModeratedAt
+	review.SpamScore = &r.SpamScore
+	return review
+}
+
+// reviewModerationActions maps the moderation sub-routes of a review, and the
+// audit actions recorded for them, to the status they move it to.
+var reviewModerationActions = map[string]string{
+	"approve": ReviewApproved,
+	"reject":  ReviewRejected,
+	"flag":    ReviewFlagged,
+}
+
+// handleListReviewQueue handles GET /reviews
+//
+// It lists reviews across all products, newest first. status (default
+// pending) selects the moderation status and limit (default 50, max 200)
+// the number returned.
+func (s *Server) handleListReviewQueue(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = ReviewPending
+	case "all":
+		status = ""
+	case ReviewPending, ReviewApproved, ReviewRejected, ReviewFlagged:
+	default:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "status must be pending, approved, rejected, flagged or all")
+		return
+	}
+
+	limit, err := parseLimit(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+		return
+	}
+
+	reviews, err := s.store.GetRecentReviews(status, limit)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list reviews")
+		return
+	}
+
+	apiReviews := make([]Review, len(reviews))
+	for i, r := range reviews {
+		apiReviews[i] = toModeratedReview(&r)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiReviews)
 }
 
 // handleListReviews handles GET /products/:id/reviews
+//
+// Results are paged: limit (default 50, max 200) and the opaque cursor from the
+// previous response's X-Next-Cursor header select the page. sort orders the
+// reviews: -created_at (newest, the default), -helpful (most helpful),
+// -rating (highest) or rating (lowest). Filters: min_rating, max_rating,
+// since and until (RFC 3339) and has_comment. Only approved reviews are
+// listed unless a moderator asks for another status (or all).
 func (s *Server) handleListReviews(w http.ResponseWriter, r *http.Request) {
 	pathPart := strings.TrimPrefix(r.URL.Path, "/products/")
 	idStr := strings.Split(pathPart, "/")[0]
 	productID, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "invalid product ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
 		return
 	}
 
-	reviews, err := s.store.ListReviews(productID)
+	q, err := parseReviewQuery(r.URL.Query())
 	if err != nil {
-		http.Error(w, "failed to list reviews", http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
 		return
 	}
+	q.ProductID = productID
 
+	reviews, next, total, err := s.store.QueryReviews(q)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list reviews")
+		return
+	}
+
+	convert := toAPIReview
+	if q.Status != ReviewApproved {
+		convert = toModeratedReview
+	}
 	apiReviews := make([]Review, len(reviews))
 	for i, r := range reviews {
-		apiReviews[i] = toAPIReview(&r)
+		apiReviews[i] = convert(&r)
 	}
 
+	nextCursor := ""
+	if next != nil {
+		nextCursor = encodeCursor(*next)
+	}
+	setPageHeaders(w, r, total, nextCursor)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(apiReviews)
 }
 
+// parseReviewQuery builds a ReviewQuery from GET /products/:id/reviews query
+// parameters.
+func parseReviewQuery(values url.Values) (ReviewQuery, error) {
+	q := ReviewQuery{
+		Status: ReviewApproved,
+		Sort:   "created_at",
+		Desc:   true,
+	}
+
+	switch status := values.Get("status"); status {
+	case "":
+	case "all":
+		q.Status = ""
+	case ReviewPending, ReviewApproved, ReviewRejected, ReviewFlagged:
+		q.Status = status
+	default:
+		return q, fmt.Errorf("status must be pending, approved, rejected, flagged or all")
+	}
+
+	limit, err := parseLimit(values)
+	if err != nil {
+		return q, err
+	}
+	q.Limit = limit
+
+	if sort := values.Get("sort"); sort != "" {
+		q.Desc = strings.HasPrefix(sort, "-")
+		q.Sort = strings.TrimPrefix(sort, "-")
+		if _, ok := reviewSortColumns[q.Sort]; !ok {
+			return q, fmt.Errorf("sort must be one of created_at, helpful, rating")
+		}
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		c, err := decodeCursor(cursor)
+		if err != nil {
+			return q, err
+		}
+		q.After = c
+	}
+
+	for _, bound := range []struct {
+		param string
+		dest  **int
+	}{
+		{"min_rating", &q.MinRating},
+		{"max_rating", &q.MaxRating},
+	} {
+		v := values.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		rating, err := strconv.Atoi(v)
+		if err != nil || rating < 1 || rating > 5 {
+			return q, fmt.Errorf("%s must be between 1 and 5", bound.param)
+		}
+		*bound.dest = &rating
+	}
+
+	for _, bound := range []struct {
+		param string
+		dest  **time.Time
+	}{
+		{"since", &q.Since},
+		{"until", &q.Until},
+	} {
+		v := values.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("%s must be an RFC 3339 timestamp", bound.param)
+		}
+		*bound.dest = &t
+	}
+
+	if v := values.Get("has_comment"); v != "" {
+		hasComment, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("has_comment must be true or false")
+		}
+		q.HasComment = &hasComment
+	}
+
+	return q, nil
+}
+
 // handleCreateReview handles POST /products/:id/reviews
+//
+// The review is screened for spam first: clean reviews are published at once,
+// obvious spam is stored as rejected and the rest wait for a moderator.
+// Authors and clients posting too quickly get 429 Too Many Requests.
 func (s *Server) handleCreateReview(w http.ResponseWriter, r *http.Request) {
 	pathPart := strings.TrimPrefix(r.URL.Path, "/products/")
 	idStr := strings.Split(pathPart, "/")[0]
 	productID, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "invalid product ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
 		return
 	}
 
 	var req CreateReviewRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
 		return
 	}
 
-	if req.Author == "" {
-		http.Error(w, `{"error":"author is required"}`, http.StatusBadRequest)
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
 		return
 	}
-	if req.Rating < 1 || req.Rating > 5 {
-		http.Error(w, `{"error":"rating must be between 1 and 5"}`, http.StatusBadRequest)
-		return
+
+	sub := &reviewSubmission{
+		ProductID:   productID,
+		Author:      req.Author,
+		Rating:      req.Rating,
+		Comment:     req.Comment,
+		Client:      clientIP(r),
+		Fingerprint: commentFingerprint(req.Comment),
+	}
+	review := dbReview{
+		ProductID: productID,
+		Author:    req.Author,
+		Rating:    req.Rating,
+		Comment:   req.Comment,
+		Client:    sub.Client,
+	}
+	// Only an API key can vouch for a purchase; X-Client-ID and addresses are
+	// the caller's to choose or share.
+	var buyer string
+	if principal := principalFromContext(r.Context()); principal != nil {
+		buyer = "key:" + strconv.Itoa(principal.ID)
 	}
 
-	id, err := s.store.CreateReview(productID, req.Author, req.Rating, req.Comment)
+	var verdict reviewVerdict
+	id, err := s.store.CreateReview(review, buyer, func(q sqlExecutor, review *dbReview) error {
+		v, err := s.screener.screen(q, sub)
+		if err != nil {
+			return err
+		}
+		verdict = v
+		review.Status = v.Status
+		review.ModerationReason = v.Reason()
+		review.SpamScore = v.Score
+		if v.Status != ReviewPending {
+			now := time.Now().UTC()
+			review.ModeratedBy = reviewScreenerActor
+			review.ModeratedAt = &now
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errNotFound):
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	case errors.Is(err, errTooManyReviews):
+		writeError(w, r, http.StatusTooManyRequests, codeRateLimited, "too many reviews posted recently; try again later")
+		return
+	}
 	if err != nil {
 		log.Printf("ERROR: failed to create review: %v", err)
-		http.Error(w, `{"error":"failed to create review"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to create review")
 		return
 	}
 
+	if created, err := s.store.GetReview(id); err == nil {
+		s.audit(r, auditEntityReview, id, productID, "create", nil, reviewAuditFields(created))
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]int{"id": id})
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "status": verdict.Status})
 }
 
 // handleDeleteReview handles DELETE /products/:id/reviews/:reviewId
@@ -88,75 +321,269 @@ func (s *Server) handleDeleteReview(w http.ResponseWriter, r *http.Request) {
 	pathPart := strings.TrimPrefix(r.URL.Path, "/products/")
 	parts := strings.Split(pathPart, "/")
 	if len(parts) < 3 {
-		http.Error(w, "invalid path", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid path")
 		return
 	}
 
 	reviewID, err := strconv.Atoi(parts[2])
 	if err != nil {
-		http.Error(w, "invalid review ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid review ID")
+		return
+	}
+
+	before, err := s.store.GetReview(reviewID)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "review not found")
 		return
 	}
 
 	err = s.store.DeleteReview(reviewID)
 	if err != nil {
-		http.Error(w, "review not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, codeNotFound, "review not found")
 		return
 	}
 
+	s.audit(r, auditEntityReview, reviewID, before.ProductID, "delete", reviewAuditFields(before), nil)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// handleApproveReview handles POST /products/:id/reviews/:reviewId/approve
-func (s *Server) handleApproveReview(w http.ResponseWriter, r *http.Request) {
+// handleModerateReview handles POST /products/:id/reviews/:reviewId/{approve,reject,flag}
+func (s *Server) handleModerateReview(w http.ResponseWriter, r *http.Request, action string) {
 	pathPart := strings.TrimPrefix(r.URL.Path, "/products/")
 	parts := strings.Split(pathPart, "/")
 	if len(parts) < 3 {
-		http.Error(w, "invalid path", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid path")
 		return
 	}
 
 	reviewID, err := strconv.Atoi(parts[2])
 	if err != nil {
-		http.Error(w, "invalid review ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid review ID")
+		return
+	}
+	to := reviewModerationActions[action]
+
+	var req ModerateReviewRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+			return
+		}
+	}
+	if err := req.Validate(to); err != nil {
+		writeValidationError(w, r, err)
 		return
 	}
 
-	err = s.store.ApproveReview(reviewID)
+	before, err := s.store.GetReview(reviewID)
 	if err != nil {
-		http.Error(w, "review not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, codeNotFound, "review not found")
 		return
 	}
 
+	err = s.store.ModerateReview(reviewID, to, req.Reason, clientIdentity(r))
+	switch {
+	case errors.Is(err, errNotFound):
+		writeError(w, r, http.StatusNotFound, codeNotFound, "review not found")
+		return
+	case errors.Is(err, errInvalidTransition):
+		writeError(w, r, http.StatusConflict, codeInvalidTransition, err.Error())
+		return
+	case err != nil:
+		log.Printf("ERROR: failed to moderate review %d: %v", reviewID, err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to moderate review")
+		return
+	}
+
+	after, err := s.store.GetReview(reviewID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load review")
+		return
+	}
+
+	s.audit(r, auditEntityReview, reviewID, before.ProductID, action, reviewAuditFields(before), reviewAuditFields(after))
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "approved"})
+	json.NewEncoder(w).Encode(toModeratedReview(after))
+}
+
+// reviewIDFromPath returns the review ID of a /products/:id/reviews/:reviewId/...
+// path, writing a 400 response if it is missing or malformed.
+func reviewIDFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/products/"), "/")
+	if len(parts) < 3 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid path")
+		return 0, false
+	}
+	reviewID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid review ID")
+		return 0, false
+	}
+	return reviewID, true
 }
 
+// handleVoteReview handles POST /products/:id/reviews/:reviewId/vote
+//
+// Each API key has one vote per review; voting again replaces it. Only
+// approved reviews can be voted on. Anonymous callers cannot vote: they could
+// only be told apart by X-Client-ID or their address, both of which they can
+// change to vote again. Votes are recorded against the key's ID, as names
+// need not be unique.
+func (s *Server) handleVoteReview(w http.ResponseWriter, r *http.Request) {
+	principal := principalFromContext(r.Context())
+	if principal == nil {
+		unauthorized(w, r, "API key required to vote")
+		return
+	}
+	reviewID, ok := reviewIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req ReviewVoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	helpful, unhelpful, err := s.store.VoteReview(reviewID, "key:"+strconv.Itoa(principal.ID), *req.Helpful)
+	if errors.Is(err, errNotFound) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "review not found")
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to vote on review %d: %v", reviewID, err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to record vote")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"helpful_votes": helpful, "unhelpful_votes": unhelpful})
+}
+
+// handleSetReviewReply handles PUT /products/:id/reviews/:reviewId/reply
+//
+// A review has at most one merchant reply; setting it again replaces it.
+func (s *Server) handleSetReviewReply(w http.ResponseWriter, r *http.Request) {
+	reviewID, ok := reviewIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req ReviewReplyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	after, ok := s.replyToReview(w, r, reviewID, req.Body)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toAPIReview(after))
+}
+
+// handleDeleteReviewReply handles DELETE /products/:id/reviews/:reviewId/reply
+func (s *Server) handleDeleteReviewReply(w http.ResponseWriter, r *http.Request) {
+	reviewID, ok := reviewIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := s.replyToReview(w, r, reviewID, ""); !ok {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// replyToReview sets (or, when reply is empty, removes) the merchant reply to
+// a review and audits the change, returning the updated review. It writes an
+// error response and returns false on failure.
+func (s *Server) replyToReview(w http.ResponseWriter, r *http.Request, reviewID int, reply string) (*dbReview, bool) {
+	before, err := s.store.GetReview(reviewID)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "review not found")
+		return nil, false
+	}
+
+	err = s.store.SetReviewReply(reviewID, reply, clientIdentity(r))
+	if errors.Is(err, errNotFound) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "review not found")
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to reply to review %d: %v", reviewID, err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to save reply")
+		return nil, false
+	}
+
+	after, err := s.store.GetReview(reviewID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load review")
+		return nil, false
+	}
+
+	s.audit(r, auditEntityReview, reviewID, before.ProductID, "reply", reviewAuditFields(before), reviewAuditFields(after))
+	return after, true
+}
+
+// detailsReviewLimit is how many of the newest approved reviews
+// GET /products/:id/details embeds; the rest are paged through
+// GET /products/:id/reviews starting from next_reviews_cursor.
+const detailsReviewLimit = 10
+
 // handleGetProductWithReviews handles GET /products/:id/details
 func (s *Server) handleGetProductWithReviews(w http.ResponseWriter, r *http.Request) {
 	pathPart := strings.TrimPrefix(r.URL.Path, "/products/")
 	idStr := strings.Split(pathPart, "/")[0]
 	productID, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "invalid product ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
 		return
 	}
 
 	product, err := s.store.GetProduct(productID)
 	if err != nil {
-		http.Error(w, "product not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
 		return
 	}
 
-	reviews, err := s.store.ListReviews(productID)
+	reviews, next, _, err := s.store.QueryReviews(ReviewQuery{
+		ProductID: productID,
+		Status:    ReviewApproved,
+		Sort:      "created_at",
+		Desc:      true,
+		Limit:     detailsReviewLimit,
+	})
 	if err != nil {
-		http.Error(w, "failed to load reviews", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to load reviews")
 		return
 	}
 
 	avgRating, reviewCount, err := s.store.GetAverageRating(productID)
 	if err != nil {
-		http.Error(w, "failed to compute rating", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to compute rating")
+		return
+	}
+	weighted, err := s.weightedRating(productID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to compute rating")
+		return
+	}
+	histogram, err := s.store.GetRatingHistogram(productID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to compute rating")
 		return
 	}
 
@@ -165,13 +592,126 @@ func (s *Server) handleGetProductWithReviews(w http.ResponseWriter, r *http.Requ
 		apiReviews[i] = toAPIReview(&r)
 	}
 
+	apiProducts := []Product{toAPIProduct(product, moneyFormatOf(r))}
+	s.attachPrimaryImages(apiProducts)
+
 	result := ProductWithReviews{
-		Product:       toAPIProduct(product),
-		Reviews:       apiReviews,
-		AverageRating: avgRating,
-		ReviewCount:   reviewCount,
+		Product:         apiProducts[0],
+		Reviews:         apiReviews,
+		AverageRating:   avgRating,
+		WeightedRating:  weighted,
+		ReviewCount:     reviewCount,
+		RatingHistogram: histogram,
+	}
+	if next != nil {
+		result.NextReviewsCursor = encodeCursor(*next)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
+
+// weightedRating returns the Bayesian-weighted rating of a product, using the
+// catalog average as the prior.
+func (s *Server) weightedRating(productID int) (float64, error) {
+	prior, _, err := s.store.GetCatalogRating()
+	if err != nil {
+		return 0, err
+	}
+	return s.store.GetWeightedRating(productID, prior, s.config.RatingPriorWeight)
+}
+
+const (
+	defaultTrendMonths = 12
+	maxTrendMonths     = 120
+)
+
+// handleGetReviewSummary handles GET /products/:id/reviews/summary
+//
+// months (default 12, max 120) sets how far back the monthly trend goes,
+// counting the current month.
+func (s *Server) handleGetReviewSummary(w http.ResponseWriter, r *http.Request) {
+	pathPart := strings.TrimPrefix(r.URL.Path, "/products/")
+	idStr := strings.Split(pathPart, "/")[0]
+	productID, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
+		return
+	}
+
+	months := defaultTrendMonths
+	if v := r.URL.Query().Get("months"); v != "" {
+		months, err = strconv.Atoi(v)
+		if err != nil || months <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "months must be a positive integer")
+			return
+		}
+		if months > maxTrendMonths {
+			months = maxTrendMonths
+		}
+	}
+
+	if _, err := s.store.GetProduct(productID); err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+
+	summary := RatingSummary{ProductID: productID}
+	summary.AverageRating, summary.ReviewCount, err = s.store.GetAverageRating(productID)
+	if err == nil {
+		summary.WeightedRating, err = s.weightedRating(productID)
+	}
+	if err == nil {
+		summary.Histogram, err = s.store.GetRatingHistogram(productID)
+	}
+	if err == nil {
+		now := time.Now().UTC()
+		since := time.Date(now.Year(), now.Month()-time.Month(months-1), 1, 0, 0, 0, 0, time.UTC)
+		summary.Trend, err = s.store.GetMonthlyRatings(productID, since)
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to summarize reviews of product %d: %v", productID, err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to summarize reviews")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// handleGetReviewLeaderboard handles GET /reviews/leaderboard
+//
+// top_rated ranks reviewed products by weighted rating, so a single five-star
+// review does not outrank a hundred four-star ones; most_reviewed ranks them
+// by approved review count. limit (default 50, max 200) applies to each list.
+func (s *Server) handleGetReviewLeaderboard(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+		return
+	}
+
+	prior, _, err := s.store.GetCatalogRating()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to compute ratings")
+		return
+	}
+	topRated, err := s.store.RankRatedProducts("top_rated", prior, s.config.RatingPriorWeight, limit)
+	if err != nil {
+		log.Printf("ERROR: failed to rank rated products: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to compute ratings")
+		return
+	}
+	mostReviewed, err := s.store.RankRatedProducts("most_reviewed", prior, s.config.RatingPriorWeight, limit)
+	if err != nil {
+		log.Printf("ERROR: failed to rank rated products: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to compute ratings")
+		return
+	}
+	board := ReviewLeaderboard{TopRated: []RatedProduct{}, MostReviewed: []RatedProduct{}}
+	board.TopRated = append(board.TopRated, topRated...)
+	board.MostReviewed = append(board.MostReviewed, mostReviewed...)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(board)
+}
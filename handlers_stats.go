@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -16,11 +17,20 @@ func (s *Server) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 		dbStatus = "error: " + err.Error()
 	}
 
+	// Audit entries lost since startup leave gaps in the trail an operator
+	// has to fill from the logs, so they mark the service degraded.
+	overall, auditStatus := "ok", "ok"
+	if n, err := s.auditFailures.get(); n > 0 {
+		overall = "degraded"
+		auditStatus = fmt.Sprintf("error: %d entries not recorded, last: %v", n, err)
+	}
+
 	uptime := time.Since(s.startTime).Round(time.Second)
 
 	status := HealthStatus{
-		Status:   "ok",
+		Status:   overall,
 		Database: dbStatus,
+		Audit:    auditStatus,
 		Uptime:   uptime.String(),
 		Version:  appVersion,
 	}
@@ -33,31 +43,31 @@ func (s *Server) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleGetStats(w http.ResponseWriter, r *http.Request) {
 	total, inStock, outOfStock, err := s.store.GetProductCount()
 	if err != nil {
-		http.Error(w, "failed to get product counts", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to get product counts")
 		return
 	}
 
 	avgPrice, err := s.store.GetAverageProductPrice()
 	if err != nil {
-		http.Error(w, "failed to get average price", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to get average price")
 		return
 	}
 
 	totalInventory, err := s.store.GetTotalInventory()
 	if err != nil {
-		http.Error(w, "failed to get inventory", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to get inventory")
 		return
 	}
 
 	totalReviews, err := s.store.GetTotalReviewCount()
 	if err != nil {
-		http.Error(w, "failed to get review count", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to get review count")
 		return
 	}
 
 	categories, err := s.store.GetCategoryStats()
 	if err != nil {
-		http.Error(w, "failed to get category stats", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to get category stats")
 		return
 	}
 
@@ -76,38 +86,68 @@ func (s *Server) handleGetStats(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleSearchProducts handles GET /search?q=...
+//
+// Terms match as prefixes and are ANDed; double-quoted text matches as a phrase.
+// Optional filters: category, in_stock. Results are ranked by relevance.
 func (s *Server) handleSearchProducts(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
+	params := r.URL.Query()
+	query := params.Get("q")
 	if query == "" {
-		http.Error(w, `{"error":"query parameter 'q' is required"}`, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "query parameter 'q' is required")
 		return
 	}
 
-	products, err := s.store.SearchProducts(query)
+	limit, err := parseLimit(params)
 	if err != nil {
-		http.Error(w, "search failed", http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
 		return
 	}
 
-	apiProducts := make([]Product, len(products))
-	for i, p := range products {
-		apiProducts[i] = toAPIProduct(&p)
+	sq := SearchQuery{
+		Text:     query,
+		Category: params.Get("category"),
+		Limit:    limit,
+	}
+	if v := params.Get("in_stock"); v != "" {
+		inStock, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "in_stock must be true or false")
+			return
+		}
+		sq.InStock = &inStock
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(apiProducts)
-}
-
-// handleListCategories handles GET /categories
-func (s *Server) handleListCategories(w http.ResponseWriter, r *http.Request) {
-	categories, err := s.store.ListCategories()
+	hits, err := s.store.SearchProducts(sq)
 	if err != nil {
-		http.Error(w, "failed to list categories", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "search failed")
 		return
 	}
+	found := make([]*dbProduct, len(hits))
+	for i := range hits {
+		found[i] = &hits[i].Product
+	}
+	if !s.convertPrices(w, r, found, nil) {
+		return
+	}
+
+	apiProducts := make([]Product, len(hits))
+	for i, h := range hits {
+		apiProducts[i] = toAPIProduct(&h.Product, moneyFormatOf(r))
+	}
+	s.attachPrimaryImages(apiProducts)
+
+	results := make([]SearchResult, len(hits))
+	for i, h := range hits {
+		results[i] = SearchResult{
+			Product:       apiProducts[i],
+			Score:         h.Score,
+			NameHighlight: h.NameHighlight,
+			Snippet:       h.Snippet,
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(categories)
+	json.NewEncoder(w).Encode(results)
 }
 
 // handleGetAuditLog handles GET /audit
@@ -120,16 +160,18 @@ func (s *Server) handleGetAuditLog(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	entityType := r.URL.Query().Get("entity_type")
+
 	productIDStr := r.URL.Query().Get("product_id")
 	if productIDStr != "" {
 		productID, err := strconv.Atoi(productIDStr)
 		if err != nil {
-			http.Error(w, "invalid product_id", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "invalid product_id")
 			return
 		}
-		entries, err := s.store.GetAuditLog(productID)
+		entries, err := s.store.GetAuditLog(productID, entityType)
 		if err != nil {
-			http.Error(w, "failed to get audit log", http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to get audit log")
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -137,9 +179,9 @@ func (s *Server) handleGetAuditLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	entries, err := s.store.GetRecentAuditLog(limit)
+	entries, err := s.store.GetRecentAuditLog(limit, entityType)
 	if err != nil {
-		http.Error(w, "failed to get audit log", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to get audit log")
 		return
 	}
 
@@ -151,37 +193,37 @@ func (s *Server) handleGetAuditLog(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handlePageStats(w http.ResponseWriter, r *http.Request) {
 	total, inStock, outOfStock, err := s.store.GetProductCount()
 	if err != nil {
-		http.Error(w, "failed to get stats", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to get stats")
 		return
 	}
 
 	avgPrice, err := s.store.GetAverageProductPrice()
 	if err != nil {
-		http.Error(w, "failed to get average price", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to get average price")
 		return
 	}
 
 	totalInventory, err := s.store.GetTotalInventory()
 	if err != nil {
-		http.Error(w, "failed to get inventory", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to get inventory")
 		return
 	}
 
 	totalReviews, err := s.store.GetTotalReviewCount()
 	if err != nil {
-		http.Error(w, "failed to get review count", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to get review count")
 		return
 	}
 
 	categories, err := s.store.GetCategoryStats()
 	if err != nil {
-		http.Error(w, "failed to get categories", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to get categories")
 		return
 	}
 
 	tmpl, err := s.loadTemplate("layout.html", "stats.html")
 	if err != nil {
-		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "template error: "+err.Error())
 		return
 	}
 
@@ -197,6 +239,6 @@ func (s *Server) handlePageStats(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "layout", data); err != nil {
-		http.Error(w, "render error: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "render error: "+err.Error())
 	}
 }
@@ -2,15 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
-	"math"
 	"net/http"
 	"strconv"
 	"strings"
 )
 
-// toAPIVariant converts a database variant to the API representation.
-func toAPIVariant(v *dbVariant) Variant {
+// toAPIVariant converts a database variant to the API representation, with
+// its price written in the given format.
+func toAPIVariant(v *dbVariant, format moneyFormat) Variant {
 	attrs := make(map[string]string)
 	if v.Attributes != "" && v.Attributes != "{}" {
 		json.Unmarshal([]byte(v.Attributes), &attrs)
@@ -21,13 +22,15 @@ func toAPIVariant(v *dbVariant) Variant {
 		ProductID:  v.ProductID,
 		SKU:        v.SKU,
 		Name:       v.Name,
-		Price:      float64(v.PriceCents) / 100,
+		Price:      newMoney(v.PriceCents, v.Currency, format),
+		Currency:   v.Currency,
 		Quantity:   v.Quantity,
 		InStock:    v.InStock,
 		Attributes: attrs,
 		SortOrder:  v.SortOrder,
 		CreatedAt:  v.CreatedAt,
 		UpdatedAt:  v.UpdatedAt,
+		Version:    v.Version,
 	}
 }
 
@@ -37,20 +40,28 @@ func (s *Server) handleListVariants(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.Split(pathPart, "/")[0]
 	productID, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "invalid product ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
 		return
 	}
 
 	variants, err := s.store.ListVariants(productID)
 	if err != nil {
-		http.Error(w, "failed to list variants", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to list variants")
+		return
+	}
+	ptrs := make([]*dbVariant, len(variants))
+	for i := range variants {
+		ptrs[i] = &variants[i]
+	}
+	if !s.convertPrices(w, r, nil, ptrs) {
 		return
 	}
 
 	apiVariants := make([]Variant, len(variants))
 	for i, v := range variants {
-		apiVariants[i] = toAPIVariant(&v)
+		apiVariants[i] = toAPIVariant(&v, moneyFormatOf(r))
 	}
+	s.attachVariantImages(productID, apiVariants)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(apiVariants)
@@ -62,48 +73,56 @@ func (s *Server) handleCreateVariant(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.Split(pathPart, "/")[0]
 	productID, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "invalid product ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
 		return
 	}
 
 	var req CreateVariantRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
 		return
 	}
 
-	if req.SKU == "" {
-		http.Error(w, `{"error":"sku is required"}`, http.StatusBadRequest)
-		return
-	}
-	if req.Name == "" {
-		http.Error(w, `{"error":"name is required"}`, http.StatusBadRequest)
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
 		return
 	}
-	if req.Price < 0 {
-		http.Error(w, `{"error":"price must be non-negative"}`, http.StatusBadRequest)
-		return
+	if req.Price.Currency != "" {
+		product, err := s.store.GetProduct(productID)
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+			return
+		}
+		if !checkPriceCurrency(w, r, "price", req.Price, product.Currency) {
+			return
+		}
 	}
 
-	priceCents := int(math.Round(req.Price * 100))
-
 	attrsJSON := "{}"
 	if req.Attributes != nil {
 		data, err := json.Marshal(req.Attributes)
 		if err != nil {
-			http.Error(w, "invalid attributes", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid attributes")
 			return
 		}
 		attrsJSON = string(data)
 	}
 
-	id, err := s.store.CreateVariant(productID, req.SKU, req.Name, priceCents, req.Quantity, attrsJSON, req.SortOrder)
+	id, err := s.store.CreateVariant(productID, req.SKU, req.Name, req.Price.Cents, req.Quantity, attrsJSON, req.SortOrder)
+	if errors.Is(err, errNotFound) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
 	if err != nil {
 		log.Printf("ERROR: failed to create variant: %v", err)
-		http.Error(w, `{"error":"failed to create variant"}`, http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to create variant")
 		return
 	}
 
+	if created, err := s.store.GetVariant(id); err == nil {
+		s.audit(r, auditEntityVariant, id, productID, "create", nil, variantAuditFields(created))
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]int{"id": id})
@@ -114,24 +133,33 @@ func (s *Server) handleGetVariant(w http.ResponseWriter, r *http.Request) {
 	pathPart := strings.TrimPrefix(r.URL.Path, "/products/")
 	parts := strings.Split(pathPart, "/")
 	if len(parts) < 3 {
-		http.Error(w, "invalid path", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid path")
 		return
 	}
 
 	variantID, err := strconv.Atoi(parts[2])
 	if err != nil {
-		http.Error(w, "invalid variant ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid variant ID")
 		return
 	}
 
 	variant, err := s.store.GetVariant(variantID)
 	if err != nil {
-		http.Error(w, "variant not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, codeNotFound, "variant not found")
+		return
+	}
+
+	if requestedCurrency(r) == "" && writeNotModified(w, r, variantETag(variant)) {
+		return
+	}
+	if !s.convertPrices(w, r, nil, []*dbVariant{variant}) {
 		return
 	}
 
+	apiVariants := []Variant{toAPIVariant(variant, moneyFormatOf(r))}
+	s.attachVariantImages(variant.ProductID, apiVariants)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(toAPIVariant(variant))
+	json.NewEncoder(w).Encode(apiVariants[0])
 }
 
 // handleUpdateVariant handles PUT /products/:id/variants/:variantId
@@ -139,48 +167,160 @@ func (s *Server) handleUpdateVariant(w http.ResponseWriter, r *http.Request) {
 	pathPart := strings.TrimPrefix(r.URL.Path, "/products/")
 	parts := strings.Split(pathPart, "/")
 	if len(parts) < 3 {
-		http.Error(w, "invalid path", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid path")
 		return
 	}
 
 	variantID, err := strconv.Atoi(parts[2])
 	if err != nil {
-		http.Error(w, "invalid variant ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid variant ID")
+		return
+	}
+
+	before, err := s.store.GetVariant(variantID)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "variant not found")
+		return
+	}
+	if !checkIfMatch(w, r, variantETag(before)) {
 		return
 	}
 
 	var req UpdateVariantRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+	if !checkPriceCurrency(w, r, "price", req.Price, before.Currency) {
 		return
 	}
-
-	priceCents := int(math.Round(req.Price * 100))
 
 	attrsJSON := "{}"
 	if req.Attributes != nil {
 		data, err := json.Marshal(req.Attributes)
 		if err != nil {
-			http.Error(w, "invalid attributes", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid attributes")
 			return
 		}
 		attrsJSON = string(data)
 	}
 
-	err = s.store.UpdateVariant(variantID, req.SKU, req.Name, priceCents, req.Quantity, req.InStock, attrsJSON, req.SortOrder)
+	err = s.store.UpdateVariant(variantID, before.Version, req.SKU, req.Name, req.Price.Cents, req.Quantity, req.InStock, attrsJSON, req.SortOrder)
+	switch {
+	case errors.Is(err, errVersionConflict):
+		writeVersionConflict(w, r)
+		return
+	case errors.Is(err, errNotFound):
+		writeError(w, r, http.StatusNotFound, codeNotFound, "variant not found")
+		return
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to update variant")
+		return
+	}
+
+	variant, err := s.store.GetVariant(variantID)
 	if err != nil {
-		http.Error(w, "failed to update variant", http.StatusInternalServerError)
+		writeError(w, r, http.StatusNotFound, codeNotFound, "variant not found")
+		return
+	}
+
+	s.audit(r, auditEntityVariant, variantID, variant.ProductID, "update", variantAuditFields(before), variantAuditFields(variant))
+
+	w.Header().Set("ETag", variantETag(variant))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toAPIVariant(variant, moneyFormatOf(r)))
+}
+
+// handlePatchVariant handles PATCH /products/:id/variants/:variantId with a
+// JSON merge patch.
+func (s *Server) handlePatchVariant(w http.ResponseWriter, r *http.Request) {
+	pathPart := strings.TrimPrefix(r.URL.Path, "/products/")
+	parts := strings.Split(pathPart, "/")
+	if len(parts) < 3 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid path")
+		return
+	}
+
+	variantID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid variant ID")
+		return
+	}
+	if !isMergePatch(r) {
+		writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMedia, "Content-Type must be "+mergePatchContentType)
+		return
+	}
+
+	before, err := s.store.GetVariant(variantID)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "variant not found")
+		return
+	}
+	if !checkIfMatch(w, r, variantETag(before)) {
+		return
+	}
+
+	apiBefore := toAPIVariant(before, moneyNumber)
+	current := UpdateVariantRequest{
+		SKU:        apiBefore.SKU,
+		Name:       apiBefore.Name,
+		Price:      Money{Cents: before.PriceCents},
+		Quantity:   apiBefore.Quantity,
+		InStock:    apiBefore.InStock,
+		Attributes: apiBefore.Attributes,
+		SortOrder:  apiBefore.SortOrder,
+	}
+	var req UpdateVariantRequest
+	if err := decodeMergePatch(r, current, variantPatchFields, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, err.Error())
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+	if !checkPriceCurrency(w, r, "price", req.Price, before.Currency) {
+		return
+	}
+
+	attrsJSON := "{}"
+	if len(req.Attributes) > 0 {
+		data, err := json.Marshal(req.Attributes)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid attributes")
+			return
+		}
+		attrsJSON = string(data)
+	}
+
+	err = s.store.UpdateVariant(variantID, before.Version, req.SKU, req.Name, req.Price.Cents, req.Quantity, req.InStock, attrsJSON, req.SortOrder)
+	switch {
+	case errors.Is(err, errVersionConflict):
+		writeVersionConflict(w, r)
+		return
+	case errors.Is(err, errNotFound):
+		writeError(w, r, http.StatusNotFound, codeNotFound, "variant not found")
+		return
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to update variant")
 		return
 	}
 
 	variant, err := s.store.GetVariant(variantID)
 	if err != nil {
-		http.Error(w, "variant not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, codeNotFound, "variant not found")
 		return
 	}
 
+	s.audit(r, auditEntityVariant, variantID, variant.ProductID, "update", variantAuditFields(before), variantAuditFields(variant))
+
+	w.Header().Set("ETag", variantETag(variant))
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(toAPIVariant(variant))
+	json.NewEncoder(w).Encode(toAPIVariant(variant, moneyFormatOf(r)))
 }
 
 // handleDeleteVariant handles DELETE /products/:id/variants/:variantId
@@ -188,22 +328,41 @@ func (s *Server) handleDeleteVariant(w http.ResponseWriter, r *http.Request) {
 	pathPart := strings.TrimPrefix(r.URL.Path, "/products/")
 	parts := strings.Split(pathPart, "/")
 	if len(parts) < 3 {
-		http.Error(w, "invalid path", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid path")
 		return
 	}
 
 	variantID, err := strconv.Atoi(parts[2])
 	if err != nil {
-		http.Error(w, "invalid variant ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid variant ID")
 		return
 	}
 
-	err = s.store.DeleteVariant(variantID)
+	before, err := s.store.GetVariant(variantID)
 	if err != nil {
-		http.Error(w, "variant not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, codeNotFound, "variant not found")
 		return
 	}
 
+	if !checkIfMatch(w, r, variantETag(before)) {
+		return
+	}
+
+	images, err := s.store.DeleteVariant(variantID, before.Version)
+	switch {
+	case errors.Is(err, errVersionConflict):
+		writeVersionConflict(w, r)
+		return
+	case err != nil:
+		writeError(w, r, http.StatusNotFound, codeNotFound, "variant not found")
+		return
+	}
+	for i := range images {
+		removeImageFiles(s.config.ImageDir, &images[i])
+	}
+
+	s.audit(r, auditEntityVariant, variantID, before.ProductID, "delete", variantAuditFields(before), nil)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -212,35 +371,46 @@ func (s *Server) handlePurchaseVariant(w http.ResponseWriter, r *http.Request) {
 	pathPart := strings.TrimPrefix(r.URL.Path, "/products/")
 	parts := strings.Split(pathPart, "/")
 	if len(parts) < 3 {
-		http.Error(w, "invalid path", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid path")
 		return
 	}
 
-	variantID, err := strconv.Atoi(parts[2])
+	productID, err := strconv.Atoi(parts[0])
 	if err != nil {
-		http.Error(w, "invalid variant ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
 		return
 	}
 
-	variant, err := s.store.GetVariant(variantID)
+	variantID, err := strconv.Atoi(parts[2])
 	if err != nil {
-		http.Error(w, "variant not found", http.StatusNotFound)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid variant ID")
 		return
 	}
 
-	if variant.Quantity <= 0 {
-		http.Error(w, `{"error":"variant out of stock"}`, http.StatusConflict)
+	quantity, err := decodePurchaseQuantity(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, err.Error())
 		return
 	}
 
-	err = s.store.DecrementVariantQuantity(variantID)
-	if err != nil {
-		http.Error(w, "purchase failed", http.StatusInternalServerError)
+	remaining, err := s.store.DecrementVariantQuantity(productID, variantID, quantity)
+	switch {
+	case errors.Is(err, errNotFound):
+		writeError(w, r, http.StatusNotFound, codeNotFound, "variant not found")
+		return
+	case errors.Is(err, errInsufficientStock):
+		writeError(w, r, http.StatusConflict, codeInsufficientStock, "insufficient variant stock")
+		return
+	case err != nil:
+		log.Printf("ERROR: purchase of variant %d failed: %v", variantID, err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "purchase failed")
 		return
 	}
 
+	s.audit(r, auditEntityVariant, variantID, productID, "purchase", stockAuditFields(remaining+quantity), stockAuditFields(remaining))
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "purchased"})
+	json.NewEncoder(w).Encode(PurchaseResult{Status: "purchased", Quantity: quantity, Remaining: remaining})
 }
 
 // handleGetVariantInventory handles GET /products/:id/inventory
@@ -249,13 +419,13 @@ func (s *Server) handleGetVariantInventory(w http.ResponseWriter, r *http.Reques
 	idStr := strings.Split(pathPart, "/")[0]
 	productID, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "invalid product ID", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
 		return
 	}
 
 	inv, err := s.store.GetVariantInventory(productID)
 	if err != nil {
-		http.Error(w, "failed to get inventory", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to get inventory")
 		return
 	}
 
@@ -269,16 +439,123 @@ func (s *Server) handleLookupBySKU(w http.ResponseWriter, r *http.Request) {
 	sku = strings.TrimSuffix(sku, "/")
 
 	if sku == "" {
-		http.Error(w, "sku is required", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "sku is required")
 		return
 	}
 
 	variant, err := s.store.GetVariantBySKU(sku)
 	if err != nil {
-		http.Error(w, "variant not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, codeNotFound, "variant not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toAPIVariant(variant, moneyFormatOf(r)))
+}
+
+// handleRepriceProductVariants handles POST /products/:id/variants/reprice
+func (s *Server) handleRepriceProductVariants(w http.ResponseWriter, r *http.Request) {
+	pathPart := strings.TrimPrefix(r.URL.Path, "/products/")
+	productID, err := strconv.Atoi(strings.Split(pathPart, "/")[0])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidID, "invalid product ID")
+		return
+	}
+
+	var req RepriceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
 		return
 	}
+	if req.Category != "" {
+		writeValidationError(w, r, validationError{{Field: "category", Message: "is only accepted by POST /products/reprice"}})
+		return
+	}
+	if _, err := s.store.GetProduct(productID); err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "product not found")
+		return
+	}
+
+	s.repriceVariants(w, r, repriceScope{ProductID: &productID}, &req)
+}
+
+// handleRepriceCatalog handles POST /products/reprice
+//
+// Reprices the variants of every product, or of the products in the
+// request's category and its subcategories.
+func (s *Server) handleRepriceCatalog(w http.ResponseWriter, r *http.Request) {
+	var req RepriceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBody, "invalid request body")
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+	if _, ok := s.resolveCategory(w, r, req.Category); !ok {
+		return
+	}
+
+	s.repriceVariants(w, r, repriceScope{Category: req.Category}, &req)
+}
+
+// repriceVariants applies a validated reprice to the variants in scope and
+// writes the before/after table. Each changed variant is audited unless the
+// request is a dry run. Amounts that name a currency limit the scope to it;
+// amounts that name none are refused if the scope spans several currencies.
+func (s *Server) repriceVariants(w http.ResponseWriter, r *http.Request, scope repriceScope, req *RepriceRequest) {
+	scope.Currency, _ = req.currency()
+	field := req.absoluteField()
+	scope.OneCurrency = field != "" && scope.Currency == ""
+
+	repriced, err := s.store.RepriceVariants(scope, newRepriceRule(req).apply, req.DryRun)
+	if errors.Is(err, errMixedCurrencies) {
+		writeValidationError(w, r, validationError{{Field: field,
+			Message: "must name a currency, since the variants repriced are priced in more than one"}})
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to reprice variants: %v", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "failed to reprice variants")
+		return
+	}
+
+	format := moneyFormatOf(r)
+	result := RepriceResult{
+		DryRun:   req.DryRun,
+		Matched:  len(repriced),
+		Variants: make([]RepricedVariant, len(repriced)),
+	}
+	for i, rv := range repriced {
+		v := rv.Variant
+		result.Variants[i] = RepricedVariant{
+			VariantID: v.ID,
+			ProductID: v.ProductID,
+			SKU:       v.SKU,
+			Name:      v.Name,
+			OldPrice:  newMoney(v.PriceCents, v.Currency, format),
+			NewPrice:  newMoney(rv.NewPriceCents, v.Currency, format),
+			Limited:   rv.Limited,
+			Skipped:   v.PriceCents == 0,
+		}
+		switch {
+		case v.PriceCents == 0:
+			result.Skipped++
+		case rv.NewPriceCents != v.PriceCents:
+			result.Updated++
+			if !req.DryRun {
+				after := v
+				after.PriceCents = rv.NewPriceCents
+				s.audit(r, auditEntityVariant, v.ID, v.ProductID, "reprice", variantAuditFields(&v), variantAuditFields(&after))
+			}
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(toAPIVariant(variant))
+	json.NewEncoder(w).Encode(result)
 }
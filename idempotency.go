@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// idempotencyMiddleware makes mutating requests that carry an Idempotency-Key
+// header safe to retry. The first request with a given key, route and client
+// runs normally and its response is stored; later requests with the same key
+// and body replay that response without re-running the handler. Reusing a key
+// with a different body, or asking for a different representation of the
+// response, is rejected with 422, and a retry that arrives while the original
+// is still running gets 409.
+func (s *Server) idempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || !isMutatingMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Idempotency-Key is too long")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidBody, "failed to read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := idempotencyScope{
+			Key:    key,
+			Method: r.Method,
+			Path:   r.URL.RequestURI(),
+			Client: clientIdentity(r),
+		}
+		requestHash := idempotencyRequestHash(r, body)
+
+		existing, err := s.store.ClaimIdempotencyKey(scope, requestHash, s.config.IdempotencyRetention)
+		if err != nil {
+			log.Printf("ERROR: idempotency lookup failed: %v", err)
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "internal server error")
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.RequestHash != requestHash:
+				writeError(w, r, http.StatusUnprocessableEntity, codeIdempotencyMismatch, "Idempotency-Key was already used with a different request body or Money-Format/Accept-Currency headers")
+			case !existing.Completed():
+				writeError(w, r, http.StatusConflict, codeIdempotencyInFlight, "a request with this Idempotency-Key is still being processed")
+			default:
+				replayResponse(w, existing)
+			}
+			return
+		}
+
+		rec := &recordingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		completed := false
+		defer func() {
+			// Server errors and panics are not stored, so the client can retry.
+			if !completed {
+				if err := s.store.ReleaseIdempotencyKey(scope); err != nil {
+					log.Printf("ERROR: failed to release idempotency key: %v", err)
+				}
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		if rec.statusCode >= http.StatusInternalServerError {
+			return
+		}
+		if err := s.store.CompleteIdempotencyKey(scope, rec.statusCode, rec.header, rec.body.Bytes()); err != nil {
+			log.Printf("ERROR: failed to store idempotent response: %v", err)
+			return
+		}
+		completed = true
+	})
+}
+
+// idempotencyRequestHash fingerprints what a retry must repeat exactly: the
+// body and the headers that choose how the stored response is represented.
+// The query string is already part of the scope.
+func idempotencyRequestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write(body)
+	fmt.Fprintf(h, "\x00Money-Format:%s\x00Accept-Currency:%s", moneyFormatOf(r), strings.ToUpper(requestedCurrency(r)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// replayResponse writes a stored response, marking it as a replay. The
+// current request keeps its own X-Request-ID.
+func replayResponse(w http.ResponseWriter, rec *idempotencyRecord) {
+	for name, values := range rec.Headers {
+		if name == "X-Request-Id" {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(rec.StatusCode)
+	w.Write(rec.Body)
+}
+
+// recordingResponseWriter passes a response through to the client while
+// keeping a copy of its status, headers and body.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	header      http.Header
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rw *recordingResponseWriter) WriteHeader(code int) {
+	if !rw.wroteHeader {
+		rw.statusCode = code
+		rw.header = rw.ResponseWriter.Header().Clone()
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingResponseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// purgeIdempotencyKeys removes stored responses older than the retention window.
+func (s *Server) purgeIdempotencyKeys() {
+	n, err := s.store.PurgeIdempotencyKeys(time.Now().Add(-s.config.IdempotencyRetention))
+	if err != nil {
+		log.Printf("ERROR: failed to purge idempotency keys: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Purged %d expired idempotency key(s)", n)
+	}
+}
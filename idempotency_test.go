@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	s := &Server{store: newTestStore(t), config: Config{IdempotencyRetention: time.Hour}}
+
+	var calls atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := moneyFormatMiddleware(s.idempotencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch r.URL.Path {
+		case "/slow":
+			close(started)
+			<-release
+		case "/fail":
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "failed")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	})))
+
+	send := func(path, key, body string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Header.Set("Idempotency-Key", key)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	expect := func(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status {
+			t.Fatalf("status = %d, want %d: %s", w.Code, status, w.Body)
+		}
+		if code != "" && !strings.Contains(w.Body.String(), `"code":"`+code+`"`) {
+			t.Errorf("body %s does not carry code %s", w.Body, code)
+		}
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		expect(t, send("/orders", "k1", `{"n":1}`), http.StatusCreated, "")
+		w := send("/orders", "k1", `{"n":1}`)
+		expect(t, w, http.StatusCreated, "")
+		if w.Header().Get("Idempotent-Replayed") != "true" || w.Body.String() != `{"n":1}` {
+			t.Errorf("replay: header %q, body %s", w.Header().Get("Idempotent-Replayed"), w.Body)
+		}
+		if n := calls.Load(); n != 1 {
+			t.Errorf("handler ran %d times, want 1", n)
+		}
+	})
+
+	t.Run("mismatched body", func(t *testing.T) {
+		expect(t, send("/orders", "k1", `{"n":2}`), http.StatusUnprocessableEntity, codeIdempotencyMismatch)
+	})
+
+	t.Run("mismatched representation", func(t *testing.T) {
+		expect(t, send("/orders", "k1", `{"n":1}`, "Money-Format", "decimal"), http.StatusUnprocessableEntity, codeIdempotencyMismatch)
+		expect(t, send("/orders", "k1", `{"n":1}`, "Accept-Currency", "EUR"), http.StatusUnprocessableEntity, codeIdempotencyMismatch)
+	})
+
+	t.Run("other route", func(t *testing.T) {
+		before := calls.Load()
+		expect(t, send("/products", "k1", `{"n":2}`), http.StatusCreated, "")
+		if calls.Load() != before+1 {
+			t.Error("a key used on another route was replayed")
+		}
+	})
+
+	t.Run("in flight", func(t *testing.T) {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- send("/slow", "k2", `{}`) }()
+		<-started
+		expect(t, send("/slow", "k2", `{}`), http.StatusConflict, codeIdempotencyInFlight)
+		close(release)
+		expect(t, <-done, http.StatusCreated, "")
+		expect(t, send("/slow", "k2", `{}`), http.StatusCreated, "")
+	})
+
+	t.Run("server error is not stored", func(t *testing.T) {
+		before := calls.Load()
+		expect(t, send("/fail", "k3", `{}`), http.StatusInternalServerError, "")
+		expect(t, send("/fail", "k3", `{}`), http.StatusInternalServerError, "")
+		if calls.Load() != before+2 {
+			t.Error("a failed request was replayed instead of retried")
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // register the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	maxImageUploadBytes = 10 << 20
+	// maxImagePixels caps width×height. A compressed upload can decode to far
+	// more memory than its size suggests; at this limit the decoded image
+	// takes at most 100 MB (4 bytes per pixel).
+	maxImagePixels = 25_000_000
+	thumbnailSize  = 320
+)
+
+// imageExtensions maps the accepted upload types to the extension stored files get.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+var errUnsupportedImage = errors.New("file must be a JPEG, PNG or GIF image")
+
+// processedImage is an upload that has been checked and written to disk,
+// along with its thumbnail.
+type processedImage struct {
+	Filename  string
+	Thumbnail string
+	MimeType  string
+	Width     int
+	Height    int
+	SizeBytes int
+	Checksum  string
+}
+
+// saveImage validates an uploaded image, writes it and a thumbnail to dir and
+// returns their metadata. Unsupported content yields errUnsupportedImage and
+// an image over maxImagePixels a validationError. The type is sniffed from
+// the content rather than trusted from the client, and the pixel count is
+// read from the header before the full decode, which bounds the memory one
+// upload can take to a single decoded copy of the image.
+func saveImage(dir string, data []byte) (*processedImage, error) {
+	mimeType := http.DetectContentType(data)
+	ext, ok := imageExtensions[mimeType]
+	if !ok {
+		return nil, errUnsupportedImage
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, errUnsupportedImage
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		msg := fmt.Sprintf("must be at most %d megapixels", maxImagePixels/1_000_000)
+		return nil, validationError{{Field: "file", Message: msg}}
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+
+	var thumb bytes.Buffer
+	thumbExt := ".png"
+	if mimeType == "image/jpeg" {
+		thumbExt = ".jpg"
+		err = jpeg.Encode(&thumb, thumbnail(src, thumbnailSize), &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&thumb, thumbnail(src, thumbnailSize))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encode thumbnail: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create image directory: %w", err)
+	}
+	base, err := randomImageName()
+	if err != nil {
+		return nil, err
+	}
+	img := &processedImage{
+		Filename:  base + ext,
+		Thumbnail: base + "_thumb" + thumbExt,
+		MimeType:  mimeType,
+		Width:     cfg.Width,
+		Height:    cfg.Height,
+		SizeBytes: len(data),
+	}
+	sum := sha256.Sum256(data)
+	img.Checksum = hex.EncodeToString(sum[:])
+
+	if err := writeFileAtomic(filepath.Join(dir, img.Filename), data); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, img.Thumbnail), thumb.Bytes()); err != nil {
+		os.Remove(filepath.Join(dir, img.Filename))
+		return nil, err
+	}
+	return img, nil
+}
+
+// removeImageFiles deletes an image's files. Failures are logged rather than
+// returned: the database record is already gone and a stray file is harmless.
+func removeImageFiles(dir string, img *dbImage) {
+	for _, name := range []string{img.Filename, img.Thumbnail} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("ERROR: failed to remove image file %s: %v", name, err)
+		}
+	}
+}
+
+func randomImageName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate image name: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writeFileAtomic writes data to a temporary file beside path and renames it
+// into place, so a partially written file is never served.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("create image file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, bytes.NewReader(data)); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write image file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write image file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// thumbnail scales src down to fit within size×size, preserving its aspect
+// ratio, by averaging each block of source pixels. Images already small
+// enough are returned unscaled. Source rows are converted to RGBA one at a
+// time, so scaling needs memory for one row rather than a full-size copy.
+func thumbnail(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+
+	tw, th := size, size
+	if w > h {
+		th = max(1, h*size/w)
+	} else {
+		tw = max(1, w*size/h)
+	}
+
+	row := image.NewRGBA(image.Rect(0, 0, w, 1))
+	sums := make([]int, tw*4)
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := y*h/th, max((y+1)*h/th, y*h/th+1)
+		clear(sums)
+		for sy := y0; sy < y1; sy++ {
+			draw.Draw(row, row.Bounds(), src, image.Pt(b.Min.X, b.Min.Y+sy), draw.Src)
+			for x := 0; x < tw; x++ {
+				x0, x1 := x*w/tw, max((x+1)*w/tw, x*w/tw+1)
+				s := sums[x*4 : x*4+4]
+				for sx := x0; sx < x1; sx++ {
+					p := row.Pix[sx*4 : sx*4+4]
+					s[0] += int(p[0])
+					s[1] += int(p[1])
+					s[2] += int(p[2])
+					s[3] += int(p[3])
+				}
+			}
+		}
+		for x := 0; x < tw; x++ {
+			x0, x1 := x*w/tw, max((x+1)*w/tw, x*w/tw+1)
+			n := (y1 - y0) * (x1 - x0)
+			s := sums[x*4 : x*4+4]
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(s[0] / n)
+			dst.Pix[i+1] = uint8(s[1] / n)
+			dst.Pix[i+2] = uint8(s[2] / n)
+			dst.Pix[i+3] = uint8(s[3] / n)
+		}
+	}
+	return dst
+}
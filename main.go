@@ -17,13 +17,21 @@ func main() {
 		dbPath = "catalog.db"
 	}
 
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
 	store, err := NewStore(dbPath)
 	if err != nil {
 		log.Fatalf("Failed to initialize store: %v", err)
 	}
 	defer store.Close()
 
-	server := NewServer(store)
+	server := NewServer(store, cfg)
+	if err := server.ensureAdminKey(); err != nil {
+		log.Fatalf("Failed to set up admin API key: %v", err)
+	}
 
 	log.Printf("Starting server on :%s", port)
 	log.Printf("UI: http://localhost:%s/", port)
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -14,7 +19,7 @@ func loggingMiddleware(next http.Handler) http.Handler {
 		lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 		next.ServeHTTP(lrw, r)
 		duration := time.Since(start)
-		log.Printf("%s %s %d %s", r.Method, r.URL.Path, lrw.statusCode, duration.Round(time.Millisecond))
+		log.Printf("%s %s %d %s [%s]", r.Method, r.URL.Path, lrw.statusCode, duration.Round(time.Millisecond), requestIDFromContext(r.Context()))
 	})
 }
 
@@ -36,8 +41,9 @@ func (lrw *loggingResponseWriter) WriteHeader(code int) {
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Client-ID, Idempotency-Key, Accept-Currency, Money-Format")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Request-ID, X-Total-Count, X-Next-Cursor, Link, Idempotent-Replayed, Money-Format")
 		w.Header().Set("Access-Control-Max-Age", "86400")
 
 		if r.Method == http.MethodOptions {
@@ -54,8 +60,8 @@ func recoveryMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				log.Printf("PANIC: %s %s: %v", r.Method, r.URL.Path, err)
-				http.Error(w, "internal server error", http.StatusInternalServerError)
+				log.Printf("PANIC: %s %s [%s]: %v", r.Method, r.URL.Path, requestIDFromContext(r.Context()), err)
+				writeError(w, r, http.StatusInternalServerError, codeInternal, "internal server error")
 			}
 		}()
 		next.ServeHTTP(w, r)
@@ -127,13 +133,8 @@ func (rl *rateLimiter) allow(ip string) bool {
 
 func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := r.RemoteAddr
-		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-			ip = forwarded
-		}
-
-		if !rl.allow(ip) {
-			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		if !rl.allow(clientIP(r)) {
+			writeError(w, r, http.StatusTooManyRequests, codeRateLimited, "rate limit exceeded")
 			return
 		}
 
@@ -141,6 +142,83 @@ func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
 	})
 }
 
+type clientIPKey struct{}
+
+// clientIPMiddleware works out the address each request originated from and
+// stores it for clientIP. X-Forwarded-For is only believed when the
+// connection comes from one of trusted; its entries are then read from the
+// right, skipping further trusted proxies, so a client cannot choose its own
+// address by sending the header itself.
+func clientIPMiddleware(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	isTrusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		for _, network := range trusted {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := r.RemoteAddr
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				ip = host
+			}
+			if isTrusted(ip) {
+				hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+				for i := len(hops) - 1; i >= 0; i-- {
+					hop := strings.TrimSpace(hops[i])
+					if hop == "" {
+						continue
+					}
+					ip = hop
+					if !isTrusted(hop) {
+						break
+					}
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+		})
+	}
+}
+
+// clientIP returns the address the request originated from, as worked out by
+// clientIPMiddleware. The port is dropped so every connection from one host
+// maps to the same client.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// clientIdentity identifies the caller for audit, idempotency and voting
+// purposes. An authenticated API key is identified by its ID, since names
+// need not be unique; otherwise clients may name themselves with X-Client-ID,
+// falling back to the originating address.
+func clientIdentity(r *http.Request) string {
+	if k := principalFromContext(r.Context()); k != nil {
+		return "key:" + strconv.Itoa(k.ID)
+	}
+	if id := strings.TrimSpace(r.Header.Get("X-Client-ID")); id != "" {
+		return id
+	}
+	return clientIP(r)
+}
+
+// clientDisplayName is clientIdentity with the API key's name added, for log
+// messages read by people.
+func clientDisplayName(r *http.Request) string {
+	if k := principalFromContext(r.Context()); k != nil {
+		return fmt.Sprintf("key:%d (%s)", k.ID, k.Name)
+	}
+	return clientIdentity(r)
+}
+
 // chain applies a sequence of middleware to a handler.
 func chain(h http.Handler, middlewares ...func(http.Handler) http.Handler) http.Handler {
 	for i := len(middlewares) - 1; i >= 0; i-- {
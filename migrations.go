@@ -0,0 +1,789 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// sqlExecutor is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// migration is a single, numbered schema change. Migrations run in version
+// order, each inside its own transaction, and are recorded in schema_migrations
+// so they are applied exactly once per database.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations is the ordered list of schema changes. Append new migrations to
+// the end with the next version number; never edit or reorder applied ones.
+//
+// Versions 1-4 use CREATE TABLE IF NOT EXISTS so that databases created before
+// migrations existed adopt the tracking table without error.
+var migrations = []migration{
+	{1, "create products", execStatements(`
+		CREATE TABLE IF NOT EXISTS products (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			description TEXT DEFAULT '',
+			price_cents INTEGER NOT NULL,
+			category TEXT DEFAULT '',
+			in_stock BOOLEAN DEFAULT 1,
+			quantity INTEGER DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			deleted_at DATETIME DEFAULT NULL,
+			UNIQUE(name)
+		)
+	`)},
+	{2, "create reviews", execStatements(`
+		CREATE TABLE IF NOT EXISTS reviews (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER NOT NULL,
+			author TEXT NOT NULL,
+			rating INTEGER NOT NULL CHECK(rating >= 1 AND rating <= 5),
+			comment TEXT DEFAULT '',
+			approved BOOLEAN DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (product_id) REFERENCES products(id)
+		)
+	`)},
+	{3, "create audit log", execStatements(`
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			detail TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (product_id) REFERENCES products(id)
+		)
+	`)},
+	{4, "create variants", execStatements(`
+		CREATE TABLE IF NOT EXISTS variants (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER NOT NULL,
+			sku TEXT NOT NULL,
+			name TEXT NOT NULL,
+			price_cents INTEGER DEFAULT 0,
+			quantity INTEGER DEFAULT 0,
+			in_stock BOOLEAN DEFAULT 1,
+			attributes TEXT DEFAULT '{}',
+			sort_order INTEGER DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(sku),
+			FOREIGN KEY (product_id) REFERENCES products(id)
+		)
+	`)},
+	// Some databases already gained these columns before migrations existed,
+	// so they are added only when missing.
+	{5, "add audit entity columns", func(tx *sql.Tx) error {
+		columns := []struct{ name, def string }{
+			{"entity_type", "TEXT NOT NULL DEFAULT 'product'"},
+			{"entity_id", "INTEGER NOT NULL DEFAULT 0"},
+			{"actor", "TEXT NOT NULL DEFAULT ''"},
+			{"changes", "TEXT NOT NULL DEFAULT '[]'"},
+		}
+		for _, c := range columns {
+			if err := addColumnIfMissing(tx, "audit_log", c.name, c.def); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`UPDATE audit_log SET entity_id = product_id WHERE entity_id = 0 AND entity_type = 'product'`)
+		return err
+	}},
+	// products_fts indexes each product under its own rowid. The variants column
+	// holds the names and SKUs of the product's variants so they match too.
+	{6, "create product search index", execStatements(`
+		CREATE VIRTUAL TABLE products_fts USING fts5(
+			name, description, variants,
+			tokenize = 'unicode61 remove_diacritics 2'
+		)
+	`, `
+		INSERT INTO products_fts (rowid, name, description, variants)
+		SELECT p.id, p.name, COALESCE(p.description, ''),
+		       (SELECT COALESCE(group_concat(v.name || ' ' || v.sku, ' '), '') FROM variants v WHERE v.product_id = p.id)
+		FROM products p
+	`, `
+		CREATE TRIGGER products_fts_insert AFTER INSERT ON products BEGIN
+			INSERT INTO products_fts (rowid, name, description, variants)
+			VALUES (new.id, new.name, COALESCE(new.description, ''), '');
+		END
+	`, `
+		CREATE TRIGGER products_fts_update AFTER UPDATE OF name, description ON products BEGIN
+			UPDATE products_fts SET name = new.name, description = COALESCE(new.description, '')
+			WHERE rowid = new.id;
+		END
+	`, `
+		CREATE TRIGGER products_fts_delete AFTER DELETE ON products BEGIN
+			DELETE FROM products_fts WHERE rowid = old.id;
+		END
+	`, `
+		CREATE TRIGGER variants_fts_insert AFTER INSERT ON variants BEGIN
+			UPDATE products_fts
+			SET variants = (SELECT COALESCE(group_concat(name || ' ' || sku, ' '), '') FROM variants WHERE product_id = new.product_id)
+			WHERE rowid = new.product_id;
+		END
+	`, `
+		CREATE TRIGGER variants_fts_update AFTER UPDATE OF name, sku, product_id ON variants BEGIN
+			UPDATE products_fts
+			SET variants = (SELECT COALESCE(group_concat(name || ' ' || sku, ' '), '') FROM variants WHERE product_id = old.product_id)
+			WHERE rowid = old.product_id;
+			UPDATE products_fts
+			SET variants = (SELECT COALESCE(group_concat(name || ' ' || sku, ' '), '') FROM variants WHERE product_id = new.product_id)
+			WHERE rowid = new.product_id;
+		END
+	`, `
+		CREATE TRIGGER variants_fts_delete AFTER DELETE ON variants BEGIN
+			UPDATE products_fts
+			SET variants = (SELECT COALESCE(group_concat(name || ' ' || sku, ' '), '') FROM variants WHERE product_id = old.product_id)
+			WHERE rowid = old.product_id;
+		END
+	`)},
+	// Order lines snapshot the name, SKU and unit price at reservation time so
+	// orders stay readable after the catalog changes.
+	{7, "create orders", execStatements(`
+		CREATE TABLE orders (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			status TEXT NOT NULL,
+			customer TEXT NOT NULL DEFAULT '',
+			client TEXT NOT NULL DEFAULT '',
+			total_cents INTEGER NOT NULL DEFAULT 0,
+			expires_at DATETIME,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL
+		)
+	`, `
+		CREATE INDEX idx_orders_status_expires ON orders (status, expires_at)
+	`, `
+		CREATE TABLE order_lines (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+			product_id INTEGER REFERENCES products(id) ON DELETE SET NULL,
+			variant_id INTEGER REFERENCES variants(id) ON DELETE SET NULL,
+			sku TEXT NOT NULL DEFAULT '',
+			name TEXT NOT NULL,
+			quantity INTEGER NOT NULL CHECK(quantity > 0),
+			unit_price_cents INTEGER NOT NULL
+		)
+	`, `
+		CREATE INDEX idx_order_lines_order ON order_lines (order_id)
+	`, `
+		CREATE TABLE order_status_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+			from_status TEXT NOT NULL DEFAULT '',
+			to_status TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			actor TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL
+		)
+	`, `
+		CREATE INDEX idx_order_status_history_order ON order_status_history (order_id)
+	`)},
+	// A status_code of 0 marks a request that is still being processed.
+	{8, "create idempotency keys", execStatements(`
+		CREATE TABLE idempotency_keys (
+			idempotency_key TEXT NOT NULL,
+			method TEXT NOT NULL,
+			path TEXT NOT NULL,
+			client TEXT NOT NULL,
+			request_hash TEXT NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			headers TEXT NOT NULL DEFAULT '{}',
+			body BLOB,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (idempotency_key, method, path, client)
+		)
+	`, `
+		CREATE INDEX idx_idempotency_keys_created ON idempotency_keys (created_at)
+	`)},
+	// Only a SHA-256 hash of each key is stored; key_prefix is kept so
+	// administrators can tell keys apart without seeing them.
+	{9, "create api keys", execStatements(`
+		CREATE TABLE api_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			key_prefix TEXT NOT NULL,
+			key_hash TEXT NOT NULL UNIQUE,
+			role TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_used_at DATETIME,
+			revoked_at DATETIME
+		)
+	`)},
+	// version backs ETags and If-Match. The triggers bump it on every update
+	// that does not set it explicitly, so stock changes and bulk edits made
+	// anywhere in the store invalidate outstanding ETags too.
+	{10, "add row versions", execStatements(`
+		ALTER TABLE products ADD COLUMN version INTEGER NOT NULL DEFAULT 1
+	`, `
+		ALTER TABLE variants ADD COLUMN version INTEGER NOT NULL DEFAULT 1
+	`, `
+		CREATE TRIGGER products_version AFTER UPDATE ON products
+		WHEN new.version = old.version BEGIN
+			UPDATE products SET version = old.version + 1 WHERE id = new.id;
+		END
+	`, `
+		CREATE TRIGGER variants_version AFTER UPDATE ON variants
+		WHEN new.version = old.version BEGIN
+			UPDATE variants SET version = old.version + 1 WHERE id = new.id;
+		END
+	`)},
+	// Images belong to a product and optionally to one of its variants. The
+	// partial unique index allows at most one primary image per product and
+	// per variant.
+	{11, "create product images", execStatements(`
+		CREATE TABLE product_images (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+			variant_id INTEGER REFERENCES variants(id) ON DELETE CASCADE,
+			filename TEXT NOT NULL,
+			thumbnail TEXT NOT NULL,
+			mime_type TEXT NOT NULL,
+			width INTEGER NOT NULL,
+			height INTEGER NOT NULL,
+			size_bytes INTEGER NOT NULL,
+			checksum TEXT NOT NULL,
+			alt_text TEXT NOT NULL DEFAULT '',
+			sort_order INTEGER NOT NULL DEFAULT 0,
+			is_primary INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL
+		)
+	`, `
+		CREATE INDEX idx_product_images_owner ON product_images (product_id, variant_id, sort_order)
+	`, `
+		CREATE UNIQUE INDEX idx_product_images_primary
+		ON product_images (product_id, IFNULL(variant_id, 0)) WHERE is_primary = 1
+	`)},
+	// Categories replace the free-text products.category column. Existing
+	// strings become categories keyed by the slug slugify derives, so names
+	// differing only in case, spacing or punctuation merge. The text
+	// column stays as a denormalized copy of the slug for filtering and export;
+	// the store writes it alongside category_id and the trigger follows renames.
+	{12, "create categories", func(tx *sql.Tx) error {
+		err := execStatements(`
+			CREATE TABLE categories (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				slug TEXT NOT NULL UNIQUE,
+				name TEXT NOT NULL,
+				description TEXT NOT NULL DEFAULT '',
+				parent_id INTEGER REFERENCES categories(id),
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL
+			)
+		`, `
+			CREATE INDEX idx_categories_parent ON categories (parent_id)
+		`, `
+			ALTER TABLE products ADD COLUMN category_id INTEGER REFERENCES categories(id)
+		`, `
+			CREATE INDEX idx_products_category_id ON products (category_id)
+		`)(tx)
+		if err != nil {
+			return err
+		}
+		if err := backfillCategories(tx); err != nil {
+			return err
+		}
+		return execStatements(`
+			UPDATE products SET category = '' WHERE category_id IS NULL AND category IS NOT NULL AND category != ''
+		`, `
+			CREATE TRIGGER categories_slug_update AFTER UPDATE OF slug ON categories BEGIN
+				UPDATE products SET category = new.slug WHERE category_id = new.id;
+			END
+		`)(tx)
+	}},
+	// Each price_history row is a price that took effect at changed_at and
+	// lasted until the next row for the same product or variant. Triggers
+	// record every change whichever code path makes it; the schedule worker
+	// tags the rows it causes with schedule_id. Existing prices are backfilled
+	// as effective from creation.
+	{13, "create price history and schedules", execStatements(`
+		CREATE TABLE price_schedules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+			variant_id INTEGER REFERENCES variants(id) ON DELETE CASCADE,
+			price_cents INTEGER NOT NULL,
+			starts_at DATETIME NOT NULL,
+			ends_at DATETIME,
+			status TEXT NOT NULL,
+			previous_price_cents INTEGER,
+			note TEXT NOT NULL DEFAULT '',
+			created_by TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL
+		)
+	`, `
+		CREATE INDEX idx_price_schedules_owner ON price_schedules (product_id, variant_id)
+	`, `
+		CREATE INDEX idx_price_schedules_due ON price_schedules (status, starts_at)
+	`, `
+		CREATE TABLE price_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+			variant_id INTEGER REFERENCES variants(id) ON DELETE CASCADE,
+			old_price_cents INTEGER,
+			price_cents INTEGER NOT NULL,
+			schedule_id INTEGER REFERENCES price_schedules(id),
+			changed_at DATETIME NOT NULL
+		)
+	`, `
+		CREATE INDEX idx_price_history_owner ON price_history (product_id, variant_id, id)
+	`, `
+		INSERT INTO price_history (product_id, variant_id, price_cents, changed_at)
+		SELECT id, NULL, price_cents, created_at FROM products
+	`, `
+		INSERT INTO price_history (product_id, variant_id, price_cents, changed_at)
+		SELECT product_id, id, price_cents, created_at FROM variants
+	`, `
+		CREATE TRIGGER products_price_insert AFTER INSERT ON products BEGIN
+			INSERT INTO price_history (product_id, variant_id, price_cents, changed_at)
+			VALUES (new.id, NULL, new.price_cents, strftime('%Y-%m-%d %H:%M:%f', 'now'));
+		END
+	`, `
+		CREATE TRIGGER products_price_update AFTER UPDATE OF price_cents ON products
+		WHEN new.price_cents IS NOT old.price_cents BEGIN
+			INSERT INTO price_history (product_id, variant_id, old_price_cents, price_cents, changed_at)
+			VALUES (new.id, NULL, old.price_cents, new.price_cents, strftime('%Y-%m-%d %H:%M:%f', 'now'));
+		END
+	`, `
+		CREATE TRIGGER variants_price_insert AFTER INSERT ON variants BEGIN
+			INSERT INTO price_history (product_id, variant_id, price_cents, changed_at)
+			VALUES (new.product_id, new.id, new.price_cents, strftime('%Y-%m-%d %H:%M:%f', 'now'));
+		END
+	`, `
+		CREATE TRIGGER variants_price_update AFTER UPDATE OF price_cents ON variants
+		WHEN new.price_cents IS NOT old.price_cents BEGIN
+			INSERT INTO price_history (product_id, variant_id, old_price_cents, price_cents, changed_at)
+			VALUES (new.product_id, new.id, old.price_cents, new.price_cents, strftime('%Y-%m-%d %H:%M:%f', 'now'));
+		END
+	`)},
+	// Stored prices are in their product's currency; variants carry a copy of
+	// it, kept in step by a trigger. Exchange rates are units of a currency
+	// per US dollar, kept as decimal text so conversions can be exact.
+	{14, "add currencies", execStatements(`
+		ALTER TABLE products ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD'
+	`, `
+		ALTER TABLE variants ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD'
+	`, `
+		CREATE TRIGGER products_currency_update AFTER UPDATE OF currency ON products
+		WHEN new.currency IS NOT old.currency BEGIN
+			UPDATE variants SET currency = new.currency WHERE product_id = new.id;
+		END
+	`, `
+		CREATE TABLE exchange_rates (
+			currency TEXT PRIMARY KEY,
+			rate TEXT NOT NULL,
+			updated_at DATETIME NOT NULL
+		)
+	`, `
+		CREATE TABLE price_overrides (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+			variant_id INTEGER REFERENCES variants(id) ON DELETE CASCADE,
+			currency TEXT NOT NULL,
+			price_cents INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL
+		)
+	`, `
+		CREATE UNIQUE INDEX idx_price_overrides_owner ON price_overrides (product_id, COALESCE(variant_id, 0), currency)
+	`)},
+	// Connections now run with foreign keys enforced. The audit log outlives
+	// the rows it describes and records category and exchange-rate changes
+	// under product 0, so it is rebuilt without its foreign key. Rows that
+	// were orphaned while the keys went unchecked are removed, or unlinked
+	// where the schema says ON DELETE SET NULL.
+	{15, "enforce foreign keys", func(tx *sql.Tx) error {
+		err := execStatements(`
+			CREATE TABLE audit_log_new (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				product_id INTEGER NOT NULL,
+				action TEXT NOT NULL,
+				detail TEXT DEFAULT '',
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				entity_type TEXT NOT NULL DEFAULT 'product',
+				entity_id INTEGER NOT NULL DEFAULT 0,
+				actor TEXT NOT NULL DEFAULT '',
+				changes TEXT NOT NULL DEFAULT '[]'
+			)
+		`, `
+			INSERT INTO audit_log_new (id, product_id, action, detail, created_at, entity_type, entity_id, actor, changes)
+			SELECT id, product_id, action, detail, created_at, entity_type, entity_id, actor, changes FROM audit_log
+		`, `
+			DROP TABLE audit_log
+		`, `
+			ALTER TABLE audit_log_new RENAME TO audit_log
+		`, `
+			DELETE FROM reviews WHERE product_id NOT IN (SELECT id FROM products)
+		`, `
+			DELETE FROM variants WHERE product_id NOT IN (SELECT id FROM products)
+		`, `
+			DELETE FROM product_images WHERE product_id NOT IN (SELECT id FROM products)
+			   OR variant_id NOT IN (SELECT id FROM variants)
+		`, `
+			DELETE FROM price_schedules WHERE product_id NOT IN (SELECT id FROM products)
+			   OR variant_id NOT IN (SELECT id FROM variants)
+		`, `
+			DELETE FROM price_history WHERE product_id NOT IN (SELECT id FROM products)
+			   OR variant_id NOT IN (SELECT id FROM variants)
+			   OR schedule_id NOT IN (SELECT id FROM price_schedules)
+		`, `
+			DELETE FROM price_overrides WHERE product_id NOT IN (SELECT id FROM products)
+			   OR variant_id NOT IN (SELECT id FROM variants)
+		`, `
+			DELETE FROM order_lines WHERE order_id NOT IN (SELECT id FROM orders)
+		`, `
+			DELETE FROM order_status_history WHERE order_id NOT IN (SELECT id FROM orders)
+		`, `
+			UPDATE order_lines SET product_id = NULL WHERE product_id NOT IN (SELECT id FROM products)
+		`, `
+			UPDATE order_lines SET variant_id = NULL WHERE variant_id NOT IN (SELECT id FROM variants)
+		`, `
+			UPDATE products SET category_id = NULL, category = '' WHERE category_id NOT IN (SELECT id FROM categories)
+		`, `
+			UPDATE categories SET parent_id = NULL WHERE parent_id NOT IN (SELECT id FROM categories)
+		`)(tx)
+		if err != nil {
+			return err
+		}
+		return checkForeignKeys(tx)
+	}},
+	// Reviews move through moderation statuses instead of a bare approved
+	// flag, which is kept in step for older readers.
+	{16, "add review moderation", execStatements(`
+		ALTER TABLE reviews ADD COLUMN status TEXT NOT NULL DEFAULT 'pending'
+	`, `
+		ALTER TABLE reviews ADD COLUMN moderation_reason TEXT NOT NULL DEFAULT ''
+	`, `
+		ALTER TABLE reviews ADD COLUMN moderated_by TEXT NOT NULL DEFAULT ''
+	`, `
+		ALTER TABLE reviews ADD COLUMN moderated_at DATETIME
+	`, `
+		UPDATE reviews SET status = 'approved' WHERE approved = 1
+	`, `
+		CREATE INDEX idx_reviews_status ON reviews (status, created_at)
+	`, `
+		CREATE INDEX idx_reviews_product ON reviews (product_id, status, created_at)
+	`)},
+	// Review screening records who posted each review and how suspicious it
+	// looked. Comments are fingerprinted so duplicates can be found across
+	// products; existing comments are fingerprinted here.
+	{17, "add review screening", func(tx *sql.Tx) error {
+		err := execStatements(`
+			ALTER TABLE reviews ADD COLUMN client TEXT NOT NULL DEFAULT ''
+		`, `
+			ALTER TABLE reviews ADD COLUMN spam_score INTEGER NOT NULL DEFAULT 0
+		`, `
+			ALTER TABLE reviews ADD COLUMN comment_fingerprint TEXT NOT NULL DEFAULT ''
+		`, `
+			CREATE INDEX idx_reviews_fingerprint ON reviews (comment_fingerprint)
+		`, `
+			CREATE INDEX idx_reviews_author ON reviews (lower(author), created_at)
+		`, `
+			CREATE INDEX idx_reviews_client ON reviews (client, created_at)
+		`)(tx)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(`SELECT id, comment FROM reviews`)
+		if err != nil {
+			return err
+		}
+		fingerprints := make(map[int]string)
+		for rows.Next() {
+			var id int
+			var comment sql.NullString
+			if err := rows.Scan(&id, &comment); err != nil {
+				rows.Close()
+				return err
+			}
+			fingerprints[id] = commentFingerprint(comment.String)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for id, fp := range fingerprints {
+			if _, err := tx.Exec(`UPDATE reviews SET comment_fingerprint = ? WHERE id = ?`, fp, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	// Shoppers vote on how helpful reviews are, one vote per API key (voter
+	// is "key:" and the key's ID); the counts are kept on the review for
+	// sorting. A merchant may post one public reply per review. Existing
+	// reviews carry no key to tie them to an order, so none starts out as a
+	// verified purchase.
+	{18, "add review votes and replies", execStatements(`
+		CREATE TABLE review_votes (
+			review_id INTEGER NOT NULL REFERENCES reviews(id) ON DELETE CASCADE,
+			voter TEXT NOT NULL,
+			helpful INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (review_id, voter)
+		)
+	`, `
+		ALTER TABLE reviews ADD COLUMN helpful_votes INTEGER NOT NULL DEFAULT 0
+	`, `
+		ALTER TABLE reviews ADD COLUMN unhelpful_votes INTEGER NOT NULL DEFAULT 0
+	`, `
+		ALTER TABLE reviews ADD COLUMN verified_purchase INTEGER NOT NULL DEFAULT 0
+	`, `
+		ALTER TABLE reviews ADD COLUMN reply TEXT NOT NULL DEFAULT ''
+	`, `
+		ALTER TABLE reviews ADD COLUMN reply_by TEXT NOT NULL DEFAULT ''
+	`, `
+		ALTER TABLE reviews ADD COLUMN replied_at DATETIME
+	`)},
+	// An order is charged in one currency, that of its products. Earlier
+	// orders take the current currency of their first product still in the
+	// catalog, or the base currency.
+	{19, "add order currency", execStatements(`
+		ALTER TABLE orders ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD'
+	`, `
+		UPDATE orders SET currency = COALESCE((
+			SELECT p.currency FROM order_lines l JOIN products p ON p.id = l.product_id
+			WHERE l.order_id = orders.id ORDER BY l.id LIMIT 1), 'USD')
+	`)},
+}
+
+// backfillCategories creates a category for each distinct free-text category
+// of the existing products, with its slug derived by slugify, and links the
+// products to it. Names that differ only in case, spacing or punctuation share
+// a category, named after the first of them.
+func backfillCategories(tx *sql.Tx) error {
+	rows, err := tx.Query(`
+		SELECT DISTINCT trim(category) FROM products
+		WHERE trim(COALESCE(category, '')) != ''
+		ORDER BY 1`)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	taken := make(map[string]bool)
+	ids := make(map[string]int64) // by slugify(name)
+	for _, name := range names {
+		key := slugify(name)
+		id, ok := ids[key]
+		if !ok {
+			result, err := tx.Exec(
+				`INSERT INTO categories (slug, name, created_at, updated_at) VALUES (?, ?, ?, ?)`,
+				uniqueSlug(key, taken), name, now, now,
+			)
+			if err != nil {
+				return fmt.Errorf("create category %q: %w", name, err)
+			}
+			if id, err = result.LastInsertId(); err != nil {
+				return err
+			}
+			ids[key] = id
+		}
+		_, err := tx.Exec(
+			`UPDATE products SET category_id = ?, category = (SELECT slug FROM categories WHERE id = ?)
+			 WHERE trim(category) = ?`,
+			id, id, name,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uniqueSlug returns slug, or slug with the lowest numeric suffix not yet in
+// taken, and marks the result taken. An empty slug becomes "category".
+func uniqueSlug(slug string, taken map[string]bool) string {
+	if slug == "" {
+		slug = "category"
+	}
+	candidate := slug
+	for n := 2; taken[candidate]; n++ {
+		candidate = fmt.Sprintf("%s-%d", slug, n)
+	}
+	taken[candidate] = true
+	return candidate
+}
+
+// execStatements returns a migration step that runs each statement in order.
+func execStatements(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// latestSchemaVersion returns the schema version this binary migrates to.
+func latestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// migrate brings the database schema up to date. It refuses to run against a
+// database whose schema is newer than this binary understands, since an older
+// binary writing to a newer schema can silently corrupt data.
+func migrate(db *sql.DB) error {
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version <= migrations[i-1].version {
+			return fmt.Errorf("migration %d (%s) is out of order", migrations[i].version, migrations[i].name)
+		}
+	}
+
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	latest := latestSchemaVersion()
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d); upgrade the binary", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		log.Printf("Applied migration %d: %s", m.version, m.name)
+	}
+
+	return nil
+}
+
+// currentSchemaVersion returns the highest applied migration version.
+func currentSchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	return version, nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.version, m.name, time.Now().UTC(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// checkForeignKeys fails if any row references a parent that does not exist.
+func checkForeignKeys(tx *sql.Tx) error {
+	rows, err := tx.Query(`PRAGMA foreign_key_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var violations []string
+	for rows.Next() {
+		var (
+			table, parent string
+			rowid         sql.NullInt64
+			fkid          int
+		)
+		if err := rows.Scan(&table, &rowid, &parent, &fkid); err != nil {
+			return err
+		}
+		violations = append(violations, fmt.Sprintf("%s row %d references a missing %s", table, rowid.Int64, parent))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("foreign key violations: %s", strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is already present.
+func addColumnIfMissing(db sqlExecutor, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   bool
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
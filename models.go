@@ -1,6 +1,9 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // dbProduct is the internal representation matching the SQLite schema.
 // Prices are stored as integer cents.
@@ -9,59 +12,138 @@ type dbProduct struct {
 	Name        string
 	Description string
 	PriceCents  int
+	Currency    string
 	Category    string
+	CategoryID  *int
 	InStock     bool
 	Quantity    int
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
 	DeletedAt   *time.Time
+	Version     int
 }
 
 // Product is the API-facing representation.
-// Prices are represented as dollar floats (e.g., 29.99).
+// Price is in Currency, written in the format the request negotiated.
 type Product struct {
 	ID          int        `json:"id"`
 	Name        string     `json:"name"`
 	Description string     `json:"description"`
-	Price       float64    `json:"price"`
+	Price       Money      `json:"price"`
+	Currency    string     `json:"currency"`
 	Category    string     `json:"category"`
+	CategoryID  *int       `json:"category_id"`
 	InStock     bool       `json:"in_stock"`
 	Quantity    int        `json:"quantity"`
 	CreatedAt   time.Time  `json:"created_at"`
 	UpdatedAt   time.Time  `json:"updated_at"`
 	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	Version     int        `json:"version"`
+
+	// PrimaryImage is set by handlers that load images; it is nil when the
+	// product has none.
+	PrimaryImage *Image `json:"primary_image,omitempty"`
 }
 
-// CreateProductRequest is the expected body for POST /products.
+// CreateProductRequest is the expected body for POST /products. Category is
+// the slug of an existing category, or empty for none. Currency is that of
+// Price; it defaults to the base currency for new products and to the current
+// one for updates, or to the currency Price names.
 type CreateProductRequest struct {
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Category    string  `json:"category"`
-	InStock     bool    `json:"in_stock"`
-	Quantity    int     `json:"quantity"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Price       Money  `json:"price"`
+	Currency    string `json:"currency"`
+	Category    string `json:"category"`
+	InStock     bool   `json:"in_stock"`
+	Quantity    int    `json:"quantity"`
+}
+
+// PurchaseRequest is the optional body for the purchase endpoints.
+// Quantity defaults to 1 when omitted.
+type PurchaseRequest struct {
+	Quantity int `json:"quantity"`
 }
 
+// PurchaseResult is returned by the purchase endpoints.
+type PurchaseResult struct {
+	Status    string `json:"status"`
+	Quantity  int    `json:"quantity"`
+	Remaining int    `json:"remaining"`
+}
+
+// Review moderation statuses. New reviews are pending; only approved ones
+// are shown publicly and count towards ratings.
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+	ReviewFlagged  = "flagged"
+)
+
 // dbReview is the internal representation for product reviews.
 type dbReview struct {
-	ID        int
-	ProductID int
-	Author    string
-	Rating    int
-	Comment   string
-	Approved  bool
-	CreatedAt time.Time
+	ID               int
+	ProductID        int
+	Author           string
+	Rating           int
+	Comment          string
+	Status           string
+	ModerationReason string
+	ModeratedBy      string
+	ModeratedAt      *time.Time
+	Client           string
+	SpamScore        int
+	HelpfulVotes     int
+	UnhelpfulVotes   int
+	VerifiedPurchase bool
+	Reply            string
+	ReplyBy          string
+	RepliedAt        *time.Time
+	CreatedAt        time.Time
 }
 
-// Review is the API-facing representation of a product review.
+// Review is the API-facing representation of a product review. Approved
+// mirrors Status for clients written before moderation statuses existed.
 type Review struct {
-	ID        int       `json:"id"`
-	ProductID int       `json:"product_id"`
-	Author    string    `json:"author"`
-	Rating    int       `json:"rating"`
-	Comment   string    `json:"comment"`
-	Approved  bool      `json:"approved"`
-	CreatedAt time.Time `json:"created_at"`
+	ID               int          `json:"id"`
+	ProductID        int          `json:"product_id"`
+	Author           string       `json:"author"`
+	Rating           int          `json:"rating"`
+	Comment          string       `json:"comment"`
+	Approved         bool         `json:"approved"`
+	Status           string       `json:"status"`
+	VerifiedPurchase bool         `json:"verified_purchase"`
+	HelpfulVotes     int          `json:"helpful_votes"`
+	UnhelpfulVotes   int          `json:"unhelpful_votes"`
+	MerchantReply    *ReviewReply `json:"merchant_reply,omitempty"`
+	ModerationReason string       `json:"moderation_reason,omitempty"`
+	ModeratedBy      string       `json:"moderated_by,omitempty"`
+	ModeratedAt      *time.Time   `json:"moderated_at,omitempty"`
+	SpamScore        *int         `json:"spam_score,omitempty"`
+	CreatedAt        time.Time    `json:"created_at"`
+}
+
+// ReviewReply is the merchant's public reply to a review.
+type ReviewReply struct {
+	Body      string    `json:"body"`
+	RepliedAt time.Time `json:"replied_at"`
+}
+
+// ReviewVoteRequest is the body for voting on a review's helpfulness.
+type ReviewVoteRequest struct {
+	Helpful *bool `json:"helpful"`
+}
+
+// ReviewReplyRequest is the body for setting the merchant reply to a review.
+type ReviewReplyRequest struct {
+	Body string `json:"body"`
+}
+
+// ModerateReviewRequest is the optional body for approving, rejecting or
+// flagging a review. Rejecting and flagging require a reason.
+type ModerateReviewRequest struct {
+	Reason string `json:"reason"`
 }
 
 // CreateReviewRequest is the expected body for POST /products/:id/reviews.
@@ -71,24 +153,84 @@ type CreateReviewRequest struct {
 	Comment string `json:"comment"`
 }
 
-// ProductWithReviews combines a product with its reviews for detail views.
+// ProductWithReviews combines a product with the first page of its reviews
+// for detail views. ReviewCount and RatingHistogram cover every approved
+// review; NextReviewsCursor continues the listing at GET /products/:id/reviews.
 type ProductWithReviews struct {
-	Product       Product  `json:"product"`
-	Reviews       []Review `json:"reviews"`
-	AverageRating float64  `json:"average_rating"`
-	ReviewCount   int      `json:"review_count"`
+	Product           Product     `json:"product"`
+	Reviews           []Review    `json:"reviews"`
+	NextReviewsCursor string      `json:"next_reviews_cursor,omitempty"`
+	AverageRating     float64     `json:"average_rating"`
+	WeightedRating    float64     `json:"weighted_rating"`
+	ReviewCount       int         `json:"review_count"`
+	RatingHistogram   map[int]int `json:"rating_histogram"`
+}
+
+// RatingSummary describes a product's approved reviews: the plain and
+// Bayesian-weighted average, the number of reviews per star and the monthly
+// trend, oldest month first.
+type RatingSummary struct {
+	ProductID      int             `json:"product_id"`
+	AverageRating  float64         `json:"average_rating"`
+	WeightedRating float64         `json:"weighted_rating"`
+	ReviewCount    int             `json:"review_count"`
+	Histogram      map[int]int     `json:"histogram"`
+	Trend          []MonthlyRating `json:"trend"`
+}
+
+// MonthlyRating is the average of the approved reviews posted in one month
+// (formatted YYYY-MM).
+type MonthlyRating struct {
+	Month         string  `json:"month"`
+	AverageRating float64 `json:"average_rating"`
+	ReviewCount   int     `json:"review_count"`
 }
 
-// CategoryStat holds aggregate statistics for a product category.
+// RatedProduct is a product's entry in the review leaderboard.
+type RatedProduct struct {
+	ProductID      int     `json:"product_id"`
+	Name           string  `json:"name"`
+	AverageRating  float64 `json:"average_rating"`
+	WeightedRating float64 `json:"weighted_rating"`
+	ReviewCount    int     `json:"review_count"`
+}
+
+// ReviewLeaderboard lists the catalog's best-rated and most-reviewed products.
+type ReviewLeaderboard struct {
+	TopRated     []RatedProduct `json:"top_rated"`
+	MostReviewed []RatedProduct `json:"most_reviewed"`
+}
+
+// SearchResult is a product returned by GET /search. Score is the BM25
+// relevance (higher is better). NameHighlight and Snippet are HTML-escaped with
+// matched terms wrapped in <mark> tags.
+type SearchResult struct {
+	Product
+	Score         float64 `json:"score"`
+	NameHighlight string  `json:"name_highlight"`
+	Snippet       string  `json:"snippet"`
+}
+
+// CategoryStat holds aggregate statistics for a product category. Counts and
+// totals include the products of all its subcategories; DirectProductCount
+// covers only products assigned to the category itself. Products without a
+// category are reported under an empty Category with no CategoryID.
+// AveragePrice is in the base currency.
 type CategoryStat struct {
-	Category       string  `json:"category"`
-	ProductCount   int     `json:"product_count"`
-	AveragePrice   float64 `json:"average_price"`
-	TotalInventory int     `json:"total_inventory"`
-	InStockCount   int     `json:"in_stock_count"`
+	Category           string  `json:"category"`
+	CategoryID         *int    `json:"category_id"`
+	Name               string  `json:"name"`
+	ParentID           *int    `json:"parent_id"`
+	Depth              int     `json:"depth"`
+	DirectProductCount int     `json:"direct_product_count"`
+	ProductCount       int     `json:"product_count"`
+	AveragePrice       float64 `json:"average_price"`
+	TotalInventory     int     `json:"total_inventory"`
+	InStockCount       int     `json:"in_stock_count"`
 }
 
-// DashboardStats holds overall catalog statistics.
+// DashboardStats holds overall catalog statistics. AveragePrice is in the
+// base currency.
 type DashboardStats struct {
 	TotalProducts   int            `json:"total_products"`
 	TotalInStock    int            `json:"total_in_stock"`
@@ -99,21 +241,36 @@ type DashboardStats struct {
 	Categories      []CategoryStat `json:"categories"`
 }
 
-// AuditEntry represents a logged change to a product.
+// AuditEntry represents a logged change to a product, variant or review.
+// ProductID is always the owning product so a product's full history can be
+// queried in one place; EntityType and EntityID identify what was changed.
 type AuditEntry struct {
-	ID        int       `json:"id"`
-	ProductID int       `json:"product_id"`
-	Action    string    `json:"action"`
-	Detail    string    `json:"detail"`
-	CreatedAt time.Time `json:"created_at"`
+	ID         int           `json:"id"`
+	ProductID  int           `json:"product_id"`
+	EntityType string        `json:"entity_type"`
+	EntityID   int           `json:"entity_id"`
+	Action     string        `json:"action"`
+	Actor      string        `json:"actor"`
+	Changes    []FieldChange `json:"changes"`
+	Detail     string        `json:"detail"`
+	CreatedAt  time.Time     `json:"created_at"`
+}
+
+// FieldChange records the before and after value of a single field.
+// Old is nil for creations and New is nil for deletions.
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
 }
 
 // HealthStatus is returned by the health check endpoint.
 type HealthStatus struct {
-	Status    string `json:"status"`
-	Database  string `json:"database"`
-	Uptime    string `json:"uptime"`
-	Version   string `json:"version"`
+	Status   string `json:"status"`
+	Database string `json:"database"`
+	Audit    string `json:"audit"`
+	Uptime   string `json:"uptime"`
+	Version  string `json:"version"`
 }
 
 // dbVariant is the internal representation for product variants.
@@ -125,34 +282,41 @@ type dbVariant struct {
 	SKU        string
 	Name       string
 	PriceCents int
+	Currency   string // the product's currency
 	Quantity   int
 	InStock    bool
 	Attributes string // JSON-encoded key-value pairs, e.g., {"size":"L","color":"blue"}
 	SortOrder  int
 	CreatedAt  time.Time
 	UpdatedAt  time.Time
+	Version    int
 }
 
 // Variant is the API-facing representation of a product variant.
 type Variant struct {
-	ID         int                    `json:"id"`
-	ProductID  int                    `json:"product_id"`
-	SKU        string                 `json:"sku"`
-	Name       string                 `json:"name"`
-	Price      float64                `json:"price"`
-	Quantity   int                    `json:"quantity"`
-	InStock    bool                   `json:"in_stock"`
-	Attributes map[string]string      `json:"attributes"`
-	SortOrder  int                    `json:"sort_order"`
-	CreatedAt  time.Time              `json:"created_at"`
-	UpdatedAt  time.Time              `json:"updated_at"`
+	ID         int               `json:"id"`
+	ProductID  int               `json:"product_id"`
+	SKU        string            `json:"sku"`
+	Name       string            `json:"name"`
+	Price      Money             `json:"price"`
+	Currency   string            `json:"currency"`
+	Quantity   int               `json:"quantity"`
+	InStock    bool              `json:"in_stock"`
+	Attributes map[string]string `json:"attributes"`
+	SortOrder  int               `json:"sort_order"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	Version    int               `json:"version"`
+
+	// PrimaryImage is the variant's own primary image, if it has one.
+	PrimaryImage *Image `json:"primary_image,omitempty"`
 }
 
 // CreateVariantRequest is the expected body for POST /products/:id/variants.
 type CreateVariantRequest struct {
 	SKU        string            `json:"sku"`
 	Name       string            `json:"name"`
-	Price      float64           `json:"price"`
+	Price      Money             `json:"price"`
 	Quantity   int               `json:"quantity"`
 	Attributes map[string]string `json:"attributes"`
 	SortOrder  int               `json:"sort_order"`
@@ -162,7 +326,7 @@ type CreateVariantRequest struct {
 type UpdateVariantRequest struct {
 	SKU        string            `json:"sku"`
 	Name       string            `json:"name"`
-	Price      float64           `json:"price"`
+	Price      Money             `json:"price"`
 	Quantity   int               `json:"quantity"`
 	InStock    bool              `json:"in_stock"`
 	Attributes map[string]string `json:"attributes"`
@@ -186,3 +350,389 @@ type VariantInventory struct {
 	TotalStock   int `json:"total_stock"`
 	InStockCount int `json:"in_stock_count"`
 }
+
+// Order statuses. A reserved order holds stock until it is confirmed,
+// cancelled, or its reservation expires.
+const (
+	OrderReserved  = "reserved"
+	OrderConfirmed = "confirmed"
+	OrderCancelled = "cancelled"
+	OrderExpired   = "expired"
+)
+
+// dbOrder is the internal representation of an order.
+type dbOrder struct {
+	ID         int
+	Status     string
+	Customer   string
+	Client     string
+	TotalCents int
+	Currency   string
+	ExpiresAt  *time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	Lines      []dbOrderLine
+	History    []OrderStatusChange
+}
+
+// dbOrderLine is one product or variant line of an order. ProductID and
+// VariantID are nil once the referenced catalog entry has been removed.
+type dbOrderLine struct {
+	ID             int
+	OrderID        int
+	ProductID      *int
+	VariantID      *int
+	SKU            string
+	Name           string
+	Quantity       int
+	UnitPriceCents int
+}
+
+// Order is the API-facing representation of an order. Lines and History are
+// omitted from order listings. Amounts are in the order's currency.
+type Order struct {
+	ID        int                 `json:"id"`
+	Status    string              `json:"status"`
+	Customer  string              `json:"customer"`
+	Total     Money               `json:"total"`
+	Currency  string              `json:"currency"`
+	ExpiresAt *time.Time          `json:"expires_at,omitempty"`
+	CreatedAt time.Time           `json:"created_at"`
+	UpdatedAt time.Time           `json:"updated_at"`
+	Lines     []OrderLine         `json:"lines,omitempty"`
+	History   []OrderStatusChange `json:"history,omitempty"`
+}
+
+// OrderLine is the API-facing representation of an order line.
+type OrderLine struct {
+	ID        int    `json:"id"`
+	ProductID *int   `json:"product_id"`
+	VariantID *int   `json:"variant_id,omitempty"`
+	SKU       string `json:"sku,omitempty"`
+	Name      string `json:"name"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice Money  `json:"unit_price"`
+}
+
+// OrderStatusChange records one transition in an order's lifecycle.
+type OrderStatusChange struct {
+	FromStatus string    `json:"from_status,omitempty"`
+	ToStatus   string    `json:"to_status"`
+	Reason     string    `json:"reason,omitempty"`
+	Actor      string    `json:"actor,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CreateOrderRequest is the expected body for POST /orders.
+type CreateOrderRequest struct {
+	Customer string             `json:"customer"`
+	Lines    []OrderLineRequest `json:"lines"`
+}
+
+// OrderLineRequest requests a quantity of a product, or of one of its variants
+// when VariantID is set.
+type OrderLineRequest struct {
+	ProductID int  `json:"product_id"`
+	VariantID *int `json:"variant_id,omitempty"`
+	Quantity  int  `json:"quantity"`
+}
+
+// OrderTransitionRequest is the optional body for confirming or cancelling an order.
+type OrderTransitionRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Roles that can be assigned to API keys.
+const (
+	RoleViewer    = "viewer"
+	RoleEditor    = "editor"
+	RoleInventory = "inventory"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// APIKey describes an issued API key. The key itself is never stored.
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Role       string     `json:"role"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// CreateAPIKeyRequest is the expected body for POST /admin/keys.
+type CreateAPIKeyRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// CreatedAPIKey is returned once, when a key is issued; Key is the only copy
+// of the secret.
+type CreatedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// dbImage is the internal representation of an uploaded product or variant
+// image. Filename and Thumbnail are relative to the configured image directory.
+type dbImage struct {
+	ID        int
+	ProductID int
+	VariantID *int
+	Filename  string
+	Thumbnail string
+	MimeType  string
+	Width     int
+	Height    int
+	SizeBytes int
+	Checksum  string
+	AltText   string
+	SortOrder int
+	IsPrimary bool
+	CreatedAt time.Time
+}
+
+// Image is the API-facing representation of a product or variant image.
+type Image struct {
+	ID           int       `json:"id"`
+	ProductID    int       `json:"product_id"`
+	VariantID    *int      `json:"variant_id,omitempty"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+	MimeType     string    `json:"mime_type"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	SizeBytes    int       `json:"size_bytes"`
+	Checksum     string    `json:"checksum"`
+	AltText      string    `json:"alt_text"`
+	SortOrder    int       `json:"sort_order"`
+	IsPrimary    bool      `json:"is_primary"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// UpdateImageRequest holds the image metadata PATCH may change.
+type UpdateImageRequest struct {
+	AltText   string `json:"alt_text"`
+	SortOrder int    `json:"sort_order"`
+	IsPrimary bool   `json:"is_primary"`
+}
+
+// dbCategory is the internal representation of a category.
+type dbCategory struct {
+	ID          int
+	Slug        string
+	Name        string
+	Description string
+	ParentID    *int
+	Path        []string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Category is the API-facing representation of a category. Path lists the
+// slugs from the root category down to this one.
+type Category struct {
+	ID          int       `json:"id"`
+	Slug        string    `json:"slug"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	ParentID    *int      `json:"parent_id"`
+	Path        []string  `json:"path"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// CreateCategoryRequest is the expected body for POST and PUT /categories.
+// Slug defaults to one derived from Name when omitted.
+type CreateCategoryRequest struct {
+	Slug        string `json:"slug"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	ParentID    *int   `json:"parent_id"`
+}
+
+// Price schedule statuses. A scheduled change becomes active when it starts
+// and completed when it ends; one without an end completes as soon as it is
+// applied. A schedule the worker could not start or end is failed.
+const (
+	ScheduleScheduled = "scheduled"
+	ScheduleActive    = "active"
+	ScheduleCompleted = "completed"
+	ScheduleCancelled = "cancelled"
+	ScheduleFailed    = "failed"
+)
+
+// dbPriceChange is one row of price history: a price that took effect at
+// ChangedAt. OldPriceCents is nil for the first price recorded.
+type dbPriceChange struct {
+	ID            int
+	ProductID     int
+	VariantID     *int
+	OldPriceCents *int
+	PriceCents    int
+	ScheduleID    *int
+	ChangedAt     time.Time
+}
+
+// PriceChange is the API-facing representation of a price history entry.
+// EffectiveTo is nil for the current price.
+type PriceChange struct {
+	ID            int        `json:"id"`
+	VariantID     *int       `json:"variant_id,omitempty"`
+	Price         Money      `json:"price"`
+	PreviousPrice *Money     `json:"previous_price,omitempty"`
+	ScheduleID    *int       `json:"schedule_id,omitempty"`
+	EffectiveFrom time.Time  `json:"effective_from"`
+	EffectiveTo   *time.Time `json:"effective_to"`
+}
+
+// dbPriceSchedule is the internal representation of a scheduled price change.
+// PreviousPriceCents is the price replaced when the schedule was applied.
+type dbPriceSchedule struct {
+	ID                 int
+	ProductID          int
+	VariantID          *int
+	PriceCents         int
+	StartsAt           time.Time
+	EndsAt             *time.Time
+	Status             string
+	PreviousPriceCents *int
+	Note               string
+	CreatedBy          string
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+}
+
+// PriceSchedule is the API-facing representation of a scheduled price
+// change. A schedule with an end is a sale: the price reverts when it ends.
+type PriceSchedule struct {
+	ID            int        `json:"id"`
+	ProductID     int        `json:"product_id"`
+	VariantID     *int       `json:"variant_id,omitempty"`
+	Price         Money      `json:"price"`
+	StartsAt      time.Time  `json:"starts_at"`
+	EndsAt        *time.Time `json:"ends_at,omitempty"`
+	Status        string     `json:"status"`
+	PreviousPrice *Money     `json:"previous_price,omitempty"`
+	Note          string     `json:"note"`
+	CreatedBy     string     `json:"created_by"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// PriceHistory is the response for GET /products/:id/prices: every recorded
+// price, oldest first, and the schedules still to start or end.
+type PriceHistory struct {
+	ProductID int             `json:"product_id"`
+	History   []PriceChange   `json:"history"`
+	Upcoming  []PriceSchedule `json:"upcoming"`
+}
+
+// CreatePriceScheduleRequest is the expected body for POST
+// /products/:id/prices/schedules. VariantID targets one variant instead of
+// the product; EndsAt makes the change a sale that reverts when it ends.
+type CreatePriceScheduleRequest struct {
+	VariantID *int       `json:"variant_id"`
+	Price     Money      `json:"price"`
+	StartsAt  time.Time  `json:"starts_at"`
+	EndsAt    *time.Time `json:"ends_at"`
+	Note      string     `json:"note"`
+}
+
+// Rounding strategies for repricing.
+const (
+	RoundNearestCent = "nearest_cent"
+	RoundEnds99      = "ends_99"
+)
+
+// RepriceRequest is the expected body for POST /products/:id/variants/reprice
+// and POST /products/reprice. Exactly one of Percent and Delta is required.
+// Category limits a catalog-wide reprice to a category and its subcategories;
+// amounts that name a currency limit it to products priced in that currency.
+type RepriceRequest struct {
+	Percent  *float64 `json:"percent"`
+	Delta    *Money   `json:"delta"`
+	Rounding string   `json:"rounding"`
+	MinPrice *Money   `json:"min_price"`
+	MaxPrice *Money   `json:"max_price"`
+	Category string   `json:"category"`
+	DryRun   bool     `json:"dry_run"`
+}
+
+// RepricedVariant is one row of a reprice's before/after table. Limited
+// reports that min_price or max_price applied; Skipped marks a variant left
+// alone because it has no price.
+type RepricedVariant struct {
+	VariantID int    `json:"variant_id"`
+	ProductID int    `json:"product_id"`
+	SKU       string `json:"sku"`
+	Name      string `json:"name"`
+	OldPrice  Money  `json:"old_price"`
+	NewPrice  Money  `json:"new_price"`
+	Limited   bool   `json:"limited,omitempty"`
+	Skipped   bool   `json:"skipped,omitempty"`
+}
+
+// RepriceResult is the response for a reprice. Updated counts the variants
+// whose price changed, or would change for a dry run.
+type RepriceResult struct {
+	DryRun   bool              `json:"dry_run"`
+	Matched  int               `json:"matched"`
+	Updated  int               `json:"updated"`
+	Skipped  int               `json:"skipped"`
+	Variants []RepricedVariant `json:"variants"`
+}
+
+// dbExchangeRate is a stored exchange rate: Rate units of Currency per unit of
+// the base currency, as a decimal string.
+type dbExchangeRate struct {
+	Currency  string
+	Rate      string
+	UpdatedAt time.Time
+}
+
+// ExchangeRate is the API-facing representation of an exchange rate. Rate is
+// a decimal string so that it round-trips exactly.
+type ExchangeRate struct {
+	Currency  string    `json:"currency"`
+	Rate      string    `json:"rate"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SetExchangeRateRequest is the expected body for PUT
+// /admin/exchange-rates/:currency. Rate may be a JSON number or string.
+type SetExchangeRateRequest struct {
+	Rate json.Number `json:"rate"`
+}
+
+// dbPriceOverride is a fixed price for a product or variant in a currency
+// other than its own, used instead of converting.
+type dbPriceOverride struct {
+	ID         int
+	ProductID  int
+	VariantID  *int
+	Currency   string
+	PriceCents int
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// PriceOverride is the API-facing representation of a price override.
+type PriceOverride struct {
+	ID        int       `json:"id"`
+	ProductID int       `json:"product_id"`
+	VariantID *int      `json:"variant_id,omitempty"`
+	Currency  string    `json:"currency"`
+	Price     Money     `json:"price"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SetPriceOverrideRequest is the expected body for PUT
+// /products/:id/prices/overrides/:currency. VariantID targets a variant.
+type SetPriceOverrideRequest struct {
+	VariantID *int  `json:"variant_id"`
+	Price     Money `json:"price"`
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// moneyFormat is how responses write money amounts. Clients choose one with
+// the Money-Format request header; without it amounts are JSON numbers, as
+// they always have been.
+type moneyFormat string
+
+const (
+	moneyNumber  moneyFormat = "number"  // 24.99
+	moneyDecimal moneyFormat = "decimal" // "24.99"
+	moneyMinor   moneyFormat = "minor"   // {"amount_minor": 2499, "currency": "USD"}
+)
+
+// maxMinorUnits bounds parsed amounts so that any amount fits in an int; it
+// is far beyond any price validation accepts.
+const maxMinorUnits = 1 << 53
+
+// decimalPattern matches the amounts accepted as numbers or strings: plain
+// decimals, with an exponent as JSON numbers may have.
+var decimalPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?([eE][+-]?[0-9]{1,3})?$`)
+
+// Money is an amount in minor units (cents) of Currency. Input may give it as
+// a JSON number or decimal string of major units, or as an object with
+// amount_minor and currency; either way it is parsed exactly, never through
+// a float. Currency is empty when the input did not name one.
+type Money struct {
+	Cents    int
+	Currency string
+
+	format moneyFormat
+	// inexact is set when the input had more than two decimal places and
+	// Cents was rounded; validation rejects such amounts.
+	inexact bool
+}
+
+// newMoney returns an amount to be written in the given format.
+func newMoney(cents int, currency string, format moneyFormat) Money {
+	return Money{Cents: cents, Currency: currency, format: format}
+}
+
+// moneyPtr is newMoney for nullable amounts.
+func moneyPtr(cents *int, currency string, format moneyFormat) *Money {
+	if cents == nil {
+		return nil
+	}
+	m := newMoney(*cents, currency, format)
+	return &m
+}
+
+// String returns the amount as a decimal of major units, e.g. "24.99".
+func (m Money) String() string {
+	return formatCents(m.Cents)
+}
+
+// in reports whether m is in currency or names no currency.
+func (m Money) in(currency string) bool {
+	return m.Currency == "" || m.Currency == currency
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	switch m.format {
+	case moneyDecimal:
+		return json.Marshal(formatCents(m.Cents))
+	case moneyMinor:
+		return json.Marshal(struct {
+			AmountMinor int    `json:"amount_minor"`
+			Currency    string `json:"currency,omitempty"`
+		}{m.Cents, m.Currency})
+	default:
+		return []byte(formatCents(m.Cents)), nil
+	}
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		return nil
+	case len(data) > 0 && data[0] == '{':
+		var obj struct {
+			AmountMinor *json.Number `json:"amount_minor"`
+			Currency    string       `json:"currency"`
+		}
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+		if obj.AmountMinor == nil {
+			return fmt.Errorf("money object needs amount_minor")
+		}
+		cents, err := strconv.ParseInt(obj.AmountMinor.String(), 10, 64)
+		if err != nil || cents > maxMinorUnits || cents < -maxMinorUnits {
+			return fmt.Errorf("amount_minor must be an integer")
+		}
+		*m = Money{Cents: int(cents), Currency: obj.Currency}
+		return nil
+	case len(data) > 0 && data[0] == '"':
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		parsed, err := parseMoney(s)
+		if err != nil {
+			return err
+		}
+		*m = parsed
+		return nil
+	default:
+		parsed, err := parseMoney(string(data))
+		if err != nil {
+			return err
+		}
+		*m = parsed
+		return nil
+	}
+}
+
+// parseMoney parses a decimal amount of major units exactly. Amounts with
+// more than two decimal places are rounded and marked inexact.
+func parseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if !decimalPattern.MatchString(s) {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	amount, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	amount.Mul(amount, big.NewRat(100, 1))
+
+	limit := big.NewRat(maxMinorUnits, 1)
+	switch {
+	case amount.Cmp(limit) > 0:
+		return Money{Cents: maxMinorUnits}, nil
+	case amount.Cmp(new(big.Rat).Neg(limit)) < 0:
+		return Money{Cents: -maxMinorUnits}, nil
+	}
+	return Money{Cents: int(roundHalfEven(amount)), inexact: !amount.IsInt()}, nil
+}
+
+// formatCents writes cents as a decimal of major units, e.g. -1050 as "-10.50".
+func formatCents(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// currencySymbols are used when pages show prices.
+var currencySymbols = map[string]string{"USD": "$", "EUR": "€", "GBP": "£"}
+
+// displayMoney formats an amount for pages, e.g. "$24.99".
+func displayMoney(m Money) string {
+	if symbol, ok := currencySymbols[m.Currency]; ok {
+		return symbol + m.String()
+	}
+	return strings.TrimSpace(m.String() + " " + m.Currency)
+}
+
+type moneyFormatKey struct{}
+
+// moneyFormatOf returns the money format negotiated by moneyFormatMiddleware.
+func moneyFormatOf(r *http.Request) moneyFormat {
+	if f, ok := r.Context().Value(moneyFormatKey{}).(moneyFormat); ok {
+		return f
+	}
+	return moneyNumber
+}
+
+// moneyFormatMiddleware reads the Money-Format request header, rejecting
+// unknown formats, and echoes the format used in the response.
+func moneyFormatMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Money-Format")
+		format := moneyFormat(strings.ToLower(strings.TrimSpace(r.Header.Get("Money-Format"))))
+		switch format {
+		case "":
+			format = moneyNumber
+		case moneyNumber, moneyDecimal, moneyMinor:
+		default:
+			writeError(w, r, http.StatusBadRequest, codeInvalidParameter, "Money-Format must be number, decimal or minor")
+			return
+		}
+		w.Header().Set("Money-Format", string(format))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), moneyFormatKey{}, format)))
+	})
+}
+
+// checkPriceCurrency rejects a price that names a currency other than the
+// one it is stored in, writing a validation error and returning false.
+func checkPriceCurrency(w http.ResponseWriter, r *http.Request, field string, price Money, currency string) bool {
+	if price.in(currency) {
+		return true
+	}
+	writeValidationError(w, r, validationError{{Field: field, Message: "must be in " + currency}})
+	return false
+}
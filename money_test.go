@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		input   string
+		cents   int
+		inexact bool
+		err     bool
+	}{
+		{input: "0", cents: 0},
+		{input: "19.99", cents: 1999},
+		{input: " 19.9 ", cents: 1990},
+		{input: "-10.5", cents: -1050},
+		{input: "0.1", cents: 10},
+		{input: "1e2", cents: 10000},
+		{input: "1.5E+1", cents: 1500},
+		{input: "1999e-2", cents: 1999},
+		{input: "2E-3", cents: 0, inexact: true},
+		{input: "19.995", cents: 2000, inexact: true}, // tie, to even
+		{input: "19.985", cents: 1998, inexact: true}, // tie, to even
+		{input: "19.9951", cents: 2000, inexact: true},
+		{input: "0.001", cents: 0, inexact: true},
+		{input: "90071992547409.91", cents: maxMinorUnits - 1},
+		{input: "90071992547409.93", cents: maxMinorUnits},
+		{input: "1e300", cents: maxMinorUnits},
+		{input: "-1e300", cents: -maxMinorUnits},
+		{input: "", err: true},
+		{input: "abc", err: true},
+		{input: "1,99", err: true},
+		{input: "$5", err: true},
+		{input: ".5", err: true},
+		{input: "5.", err: true},
+		{input: "+5", err: true},
+		{input: "1e1000", err: true},
+		{input: "0x10", err: true},
+		{input: "NaN", err: true},
+		{input: "Infinity", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			m, err := parseMoney(tt.input)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parseMoney(%q) = %d, want an error", tt.input, m.Cents)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMoney(%q): %v", tt.input, err)
+			}
+			if m.Cents != tt.cents || m.inexact != tt.inexact {
+				t.Errorf("parseMoney(%q) = %d (inexact %v), want %d (inexact %v)", tt.input, m.Cents, m.inexact, tt.cents, tt.inexact)
+			}
+		})
+	}
+}
+
+func TestCheckPriceLimits(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{`"1000000.00"`, ""},
+		{`{"amount_minor": 100000000}`, ""},
+		{`"1000000.01"`, "must be at most"},
+		{`1e300`, "must be at most"},
+		{`"-0.01"`, "must be non-negative"},
+		{`"9.999"`, "at most two decimal places"},
+		{`{"amount_minor": 1, "currency": "JPY"}`, "currency must be one of"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var m Money
+			if err := json.Unmarshal([]byte(tt.input), &m); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			var errs validationError
+			checkPrice(&errs, "price", &m)
+			got := ""
+			if len(errs) > 0 {
+				got = errs[0].Message
+			}
+			if (tt.err == "") != (got == "") || !strings.Contains(got, tt.err) {
+				t.Errorf("validation error %q, want %q", got, tt.err)
+			}
+		})
+	}
+}
+
+func TestMoneyJSONRoundTrip(t *testing.T) {
+	formats := []struct {
+		format moneyFormat
+		want   string // JSON for 1999 EUR
+	}{
+		{moneyNumber, `19.99`},
+		{moneyDecimal, `"19.99"`},
+		{moneyMinor, `{"amount_minor":1999,"currency":"EUR"}`},
+	}
+	amounts := []int{0, 5, 1999, -1050, 100, maxMinorUnits}
+	for _, f := range formats {
+		t.Run(string(f.format), func(t *testing.T) {
+			if got, _ := json.Marshal(newMoney(1999, "EUR", f.format)); string(got) != f.want {
+				t.Errorf("marshal = %s, want %s", got, f.want)
+			}
+			for _, cents := range amounts {
+				data, err := json.Marshal(newMoney(cents, "EUR", f.format))
+				if err != nil {
+					t.Fatalf("marshal %d: %v", cents, err)
+				}
+				var back Money
+				if err := json.Unmarshal(data, &back); err != nil {
+					t.Fatalf("unmarshal %s: %v", data, err)
+				}
+				if back.Cents != cents || back.inexact {
+					t.Errorf("%d round-tripped through %s as %d (inexact %v)", cents, data, back.Cents, back.inexact)
+				}
+				if f.format == moneyMinor && back.Currency != "EUR" {
+					t.Errorf("%s lost its currency: %q", data, back.Currency)
+				}
+			}
+		})
+	}
+
+	// Inside a struct, as in request bodies.
+	var req struct {
+		Price *Money `json:"price"`
+	}
+	if err := json.Unmarshal([]byte(`{"price": null}`), &req); err != nil || req.Price != nil {
+		t.Errorf("null price: %v, %+v", err, req.Price)
+	}
+	for _, bad := range []string{`{"price": {"currency": "USD"}}`, `{"price": {"amount_minor": 1.5}}`, `{"price": true}`} {
+		if err := json.Unmarshal([]byte(bad), &req); err == nil {
+			t.Errorf("%s was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+// pageCursor is the decoded form of an opaque pagination cursor. It holds the
+// sort key and value of the last row returned plus its ID as a tiebreaker, so
+// the next page can resume with a keyset comparison instead of an OFFSET.
+type pageCursor struct {
+	Sort  string          `json:"s"`
+	Desc  bool            `json:"d,omitempty"`
+	Value json.RawMessage `json:"v"`
+	ID    int             `json:"id"`
+}
+
+// encodeCursor serializes a cursor into an opaque URL-safe token.
+func encodeCursor(c pageCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a token produced by encodeCursor.
+func decodeCursor(token string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &c, nil
+}
+
+// parseLimit reads the limit query parameter, applying the default and cap.
+func parseLimit(q url.Values) (int, error) {
+	limitStr := q.Get("limit")
+	if limitStr == "" {
+		return defaultPageLimit, nil
+	}
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("limit must be a positive integer")
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return limit, nil
+}
+
+// setPageHeaders advertises the total count and, when more rows remain, the
+// cursor and URL for the next page.
+func setPageHeaders(w http.ResponseWriter, r *http.Request, total int, nextCursor string) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if nextCursor == "" {
+		return
+	}
+	w.Header().Set("X-Next-Cursor", nextCursor)
+
+	next := *r.URL
+	q := next.Query()
+	q.Set("cursor", nextCursor)
+	next.RawQuery = q.Encode()
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+)
+
+const mergePatchContentType = "application/merge-patch+json"
+
+// mergePatch applies an RFC 7396 merge patch to doc in place: null members are
+// removed, objects are merged recursively and any other value replaces the
+// existing one.
+func mergePatch(doc, patch map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	for name, value := range patch {
+		switch v := value.(type) {
+		case nil:
+			delete(doc, name)
+		case map[string]interface{}:
+			existing, _ := doc[name].(map[string]interface{})
+			doc[name] = mergePatch(existing, v)
+		default:
+			doc[name] = v
+		}
+	}
+	return doc
+}
+
+// patchField describes a member a merge patch may change.
+type patchField struct {
+	// Removable fields may be set to null, resetting them to their zero value.
+	Removable bool
+}
+
+// decodeMergePatch reads a merge-patch document from the request, applies it
+// to current (the resource's writable fields as a request struct) and decodes
+// the result into dst. Only the members listed in fields may appear in the
+// patch. The returned error is suitable for a 400 response.
+func decodeMergePatch(r *http.Request, current interface{}, fields map[string]patchField, dst interface{}) error {
+	var patch map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch == nil {
+		return fmt.Errorf("patch must be a JSON object")
+	}
+
+	var unknown []string
+	for name, value := range patch {
+		field, ok := fields[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		if value == nil && !field.Removable {
+			return fmt.Errorf("%s cannot be null", name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("fields cannot be patched: %v", unknown)
+	}
+
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	merged, err := json.Marshal(mergePatch(doc, patch))
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(merged))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return fmt.Errorf("invalid patch: %v", err)
+	}
+	return nil
+}
+
+// isMergePatch reports whether the request body is declared as a merge patch.
+// Plain application/json is accepted too, since a merge patch is valid JSON.
+func isMergePatch(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == mergePatchContentType || mediaType == "application/json"
+}
+
+// productPatchFields lists the product members PATCH may change.
+var productPatchFields = map[string]patchField{
+	"name":        {},
+	"description": {Removable: true},
+	"price":       {},
+	"currency":    {},
+	"category":    {Removable: true},
+	"in_stock":    {},
+	"quantity":    {},
+}
+
+// variantPatchFields lists the variant members PATCH may change.
+var variantPatchFields = map[string]patchField{
+	"sku":        {},
+	"name":       {},
+	"price":      {},
+	"quantity":   {},
+	"in_stock":   {},
+	"attributes": {Removable: true},
+	"sort_order": {Removable: true},
+}
+
+// imagePatchFields lists the image members PATCH may change.
+var imagePatchFields = map[string]patchField{
+	"alt_text":   {Removable: true},
+	"sort_order": {Removable: true},
+	"is_primary": {},
+}
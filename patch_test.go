@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestMergePatch runs the object examples of RFC 7396, Appendix A.
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		doc, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`null`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{`{"a":"scalar"}`, `{"a":{"b":1}}`, `{"a":{"b":1}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.doc+" + "+tt.patch, func(t *testing.T) {
+			var doc, patch map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.doc), &doc); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.patch), &patch); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := json.Marshal(mergePatch(doc, patch))
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMergePatch(t *testing.T) {
+	type target struct {
+		Name string            `json:"name"`
+		Note *string           `json:"note"`
+		Tags map[string]string `json:"tags"`
+	}
+	fields := map[string]patchField{
+		"name": {},
+		"note": {Removable: true},
+		"tags": {Removable: true},
+	}
+	note := "fragile"
+	current := target{Name: "lamp", Note: &note, Tags: map[string]string{"color": "red", "size": "l"}}
+
+	tests := []struct {
+		name  string
+		patch string
+		want  target
+		err   string
+	}{
+		{"replace", `{"name":"desk lamp"}`, target{Name: "desk lamp", Note: &note, Tags: current.Tags}, ""},
+		{"null removes", `{"note":null}`, target{Name: "lamp", Tags: current.Tags}, ""},
+		{"nested merge", `{"tags":{"size":null,"shade":"linen"}}`,
+			target{Name: "lamp", Note: &note, Tags: map[string]string{"color": "red", "shade": "linen"}}, ""},
+		{"nested null removes all", `{"tags":null}`, target{Name: "lamp", Note: &note}, ""},
+		{"empty patch", `{}`, current, ""},
+		{"field not patchable", `{"id":7,"version":2,"name":"x"}`, target{}, "fields cannot be patched: [id version]"},
+		{"required field nulled", `{"name":null}`, target{}, "name cannot be null"},
+		{"wrong type", `{"name":5}`, target{}, "invalid patch"},
+		{"not an object", `["name"]`, target{}, "patch must be a JSON object"},
+		{"null document", `null`, target{}, "patch must be a JSON object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPatch, "/products/1", strings.NewReader(tt.patch))
+			var got target
+			err := decodeMergePatch(r, current, fields, &got)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if current.Tags["size"] != "l" {
+		t.Error("patching modified the current resource")
+	}
+}
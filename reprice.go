@@ -0,0 +1,64 @@
+package main
+
+import "math"
+
+// repriceRule computes new prices for a reprice request. Prices are in cents.
+type repriceRule struct {
+	percent  *float64
+	delta    int
+	rounding string
+	floor    *int
+	ceiling  *int
+}
+
+// newRepriceRule builds the rule for a validated request.
+func newRepriceRule(req *RepriceRequest) repriceRule {
+	rule := repriceRule{percent: req.Percent, rounding: req.Rounding}
+	if req.Delta != nil {
+		rule.delta = req.Delta.Cents
+	}
+	if req.MinPrice != nil {
+		rule.floor = &req.MinPrice.Cents
+	}
+	if req.MaxPrice != nil {
+		rule.ceiling = &req.MaxPrice.Cents
+	}
+	return rule
+}
+
+// apply returns the new price for cents and whether the floor or ceiling
+// limited it. The change is applied and rounded first and the limits last,
+// so a limit may leave a price without a .99 ending. Prices of zero are left
+// alone, and no price is taken below zero.
+func (rule repriceRule) apply(cents int) (int, bool) {
+	if cents == 0 {
+		return 0, false
+	}
+
+	var price int
+	if rule.percent != nil {
+		price = int(math.Round(float64(cents) * (100 + *rule.percent) / 100))
+	} else {
+		price = cents + rule.delta
+	}
+	if rule.rounding == RoundEnds99 && price > 0 {
+		// The nearest price ending in .99, and never less than 0.99.
+		dollars := (price + 1 + 50) / 100
+		if dollars < 1 {
+			dollars = 1
+		}
+		price = dollars*100 - 1
+	}
+	if price < 0 {
+		price = 0
+	}
+
+	limited := false
+	if rule.floor != nil && price < *rule.floor {
+		price, limited = *rule.floor, true
+	}
+	if rule.ceiling != nil && price > *rule.ceiling {
+		price, limited = *rule.ceiling, true
+	}
+	return price, limited
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// reviewScreenerActor is the audit and moderation actor for decisions made
+// by the review screening pipeline.
+const reviewScreenerActor = "system:review-screening"
+
+// errTooManyReviews is returned when an author or client posts reviews faster
+// than the configured velocity limits allow.
+var errTooManyReviews = errors.New("too many reviews")
+
+// reviewSubmission is a validated review about to be stored, along with the
+// client that sent it.
+type reviewSubmission struct {
+	ProductID int
+	Author    string
+	Rating    int
+	Comment   string
+	Client    string
+	// Fingerprint identifies the comment regardless of case and spacing.
+	Fingerprint string
+}
+
+// reviewFinding is one reason a review looks like spam and the score it adds.
+type reviewFinding struct {
+	Score  int
+	Reason string
+}
+
+// reviewCheck inspects a submission, reading existing reviews through q. It
+// returns what it found suspicious, if anything; an error stops screening and
+// rejects the request outright.
+type reviewCheck func(q sqlExecutor, sub *reviewSubmission) ([]reviewFinding, error)
+
+// reviewVerdict is the outcome of screening a review: the moderation status
+// it starts in, its total score and the reasons behind it.
+type reviewVerdict struct {
+	Status  string
+	Score   int
+	Reasons []string
+}
+
+// Reason joins the verdict's reasons for storing as a moderation reason.
+func (v reviewVerdict) Reason() string {
+	return strings.Join(v.Reasons, "; ")
+}
+
+// reviewScreener runs each check on a submission and turns the summed score
+// into a moderation status: clean reviews are approved, obvious spam is
+// rejected and anything in between waits for a moderator.
+type reviewScreener struct {
+	checks       []reviewCheck
+	approveScore int
+	rejectScore  int
+}
+
+// newReviewScreener builds the default screening pipeline from cfg.
+func newReviewScreener(cfg Config) *reviewScreener {
+	return &reviewScreener{
+		checks: []reviewCheck{
+			velocityCheck(cfg.ReviewAuthorLimit, cfg.ReviewClientLimit, cfg.ReviewVelocityWindow),
+			bannedWordsCheck(cfg.ReviewBannedWords),
+			linkCheck(),
+			duplicateCommentCheck(),
+		},
+		approveScore: cfg.ReviewApproveScore,
+		rejectScore:  cfg.ReviewRejectScore,
+	}
+}
+
+// screen runs every check in order and returns the verdict. The checks read
+// through q, which should be the transaction the review is then inserted in,
+// so that no other review can slip in between a count and the insert.
+func (rs *reviewScreener) screen(q sqlExecutor, sub *reviewSubmission) (reviewVerdict, error) {
+	var v reviewVerdict
+	for _, check := range rs.checks {
+		findings, err := check(q, sub)
+		if err != nil {
+			return v, err
+		}
+		for _, f := range findings {
+			v.Score += f.Score
+			v.Reasons = append(v.Reasons, f.Reason)
+		}
+	}
+
+	switch {
+	case v.Score >= rs.rejectScore:
+		v.Status = ReviewRejected
+	case v.Score <= rs.approveScore:
+		v.Status = ReviewApproved
+	default:
+		v.Status = ReviewPending
+	}
+	return v, nil
+}
+
+// commentFingerprint hashes a comment after folding case and collapsing
+// whitespace, so trivially altered copies still match. Empty comments have
+// no fingerprint.
+func commentFingerprint(comment string) string {
+	normalized := strings.Join(strings.Fields(strings.ToLower(comment)), " ")
+	if normalized == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// velocityCheck limits how many reviews one author name or one client address
+// may post within window. A limit of zero disables that side.
+func velocityCheck(authorLimit, clientLimit int, window time.Duration) reviewCheck {
+	return func(q sqlExecutor, sub *reviewSubmission) ([]reviewFinding, error) {
+		byAuthor, byClient, err := countRecentReviews(q, sub.Author, sub.Client, time.Now().Add(-window))
+		if err != nil {
+			return nil, err
+		}
+		if authorLimit > 0 && byAuthor >= authorLimit {
+			return nil, fmt.Errorf("author has posted %d reviews in the last %s: %w", byAuthor, window, errTooManyReviews)
+		}
+		if clientLimit > 0 && byClient >= clientLimit {
+			return nil, fmt.Errorf("client has posted %d reviews in the last %s: %w", byClient, window, errTooManyReviews)
+		}
+		return nil, nil
+	}
+}
+
+// bannedWordScore is enough on its own to reject a review.
+const bannedWordScore = 100
+
+// bannedWordsCheck looks for whole-word, case-insensitive matches of any of
+// words in the author and comment.
+func bannedWordsCheck(words []string) reviewCheck {
+	var quoted []string
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+	if len(quoted) == 0 {
+		return func(sqlExecutor, *reviewSubmission) ([]reviewFinding, error) { return nil, nil }
+	}
+	pattern := regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+
+	return func(_ sqlExecutor, sub *reviewSubmission) ([]reviewFinding, error) {
+		seen := make(map[string]bool)
+		var findings []reviewFinding
+		for _, match := range pattern.FindAllString(sub.Author+"\n"+sub.Comment, -1) {
+			word := strings.ToLower(match)
+			if seen[word] {
+				continue
+			}
+			seen[word] = true
+			findings = append(findings, reviewFinding{bannedWordScore, fmt.Sprintf("contains banned word %q", word)})
+		}
+		return findings, nil
+	}
+}
+
+// linkPattern matches URLs and bare domains such as "example.com/offer".
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+|\b[a-z0-9-]+\.(?:com|net|org|info|biz|ru|cn|io|xyz|top)\b\S*`)
+
+const (
+	// linkScore is added for each link in a review.
+	linkScore = 25
+	// linkDensityScore is added when links make up a large share of the text.
+	linkDensityScore = 50
+	// maxLinkDensity is the share of words that may be links before the
+	// review counts as link spam.
+	maxLinkDensity = 0.1
+)
+
+// linkCheck scores links in the comment, and more heavily when they make up
+// a large share of it.
+func linkCheck() reviewCheck {
+	return func(_ sqlExecutor, sub *reviewSubmission) ([]reviewFinding, error) {
+		links := len(linkPattern.FindAllString(sub.Comment, -1))
+		if links == 0 {
+			return nil, nil
+		}
+		findings := []reviewFinding{{links * linkScore, fmt.Sprintf("contains %d link(s)", links)}}
+		words := len(strings.Fields(sub.Comment))
+		if float64(links)/float64(words) > maxLinkDensity {
+			findings = append(findings, reviewFinding{linkDensityScore, fmt.Sprintf("%d of %d words are links", links, words)})
+		}
+		return findings, nil
+	}
+}
+
+const (
+	// duplicateScore is added when the same comment was already posted.
+	duplicateScore = 50
+	// minDuplicateLength is the shortest comment checked for duplicates, so
+	// that short remarks like "Works great" are not penalized.
+	minDuplicateLength = 20
+)
+
+// duplicateCommentCheck scores comments that already appear on another
+// review, on any product.
+func duplicateCommentCheck() reviewCheck {
+	return func(q sqlExecutor, sub *reviewSubmission) ([]reviewFinding, error) {
+		if sub.Fingerprint == "" || len(strings.TrimSpace(sub.Comment)) < minDuplicateLength {
+			return nil, nil
+		}
+		n, err := countReviewsWithFingerprint(q, sub.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		return []reviewFinding{{duplicateScore, fmt.Sprintf("comment duplicates %d existing review(s)", n)}}, nil
+	}
+}
@@ -7,33 +7,60 @@ import (
 )
 
 type Server struct {
-	store     *Store
-	router    http.Handler
-	startTime time.Time
+	store    *Store
+	config   Config
+	screener *reviewScreener
+	router   http.Handler
+	// auditFailures tracks audit entries that could not be recorded.
+	auditFailures auditFailures
+	startTime     time.Time
 }
 
-func NewServer(store *Store) *Server {
+func NewServer(store *Store, config Config) *Server {
 	s := &Server{
 		store:     store,
+		config:    config,
+		screener:  newReviewScreener(config),
 		startTime: time.Now(),
 	}
 	s.routes()
+	s.startWorkers()
 	return s
 }
 
+// startWorkers launches the server's periodic background jobs.
+func (s *Server) startWorkers() {
+	go runEvery(s.config.ReservationSweepInterval, s.expireReservations)
+	go runEvery(time.Hour, s.purgeIdempotencyKeys)
+	go runEvery(s.config.PriceScheduleInterval, s.runPriceSchedules)
+	go runEvery(time.Hour, s.purgeDeletedProducts)
+}
+
+// runEvery calls fn once per interval for the lifetime of the process.
+func runEvery(interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		fn()
+	}
+}
+
 func (s *Server) routes() {
 	mux := http.NewServeMux()
 
 	// Static files
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
+	// Uploaded images and thumbnails
+	mux.Handle("/media/", http.StripPrefix("/media/", mediaHandler(s.config.ImageDir)))
+
 	// Page routes (HTML)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
 			s.handlePageProductList(w, r)
 			return
 		}
-		http.NotFound(w, r)
+		notFound(w, r)
 	})
 	mux.HandleFunc("/new", s.handlePageNewProduct)
 	mux.HandleFunc("/stats", s.handlePageStats)
@@ -45,11 +72,100 @@ func (s *Server) routes() {
 	mux.HandleFunc("/search", s.handleSearchProducts)
 
 	// Categories
-	mux.HandleFunc("/categories", s.handleListCategories)
+	mux.HandleFunc("/categories", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			s.handleListCategories(w, r)
+		case http.MethodPost:
+			s.handleCreateCategory(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+	})
+	mux.HandleFunc("/categories/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			s.handleGetCategory(w, r)
+		case http.MethodPut:
+			s.handleUpdateCategory(w, r)
+		case http.MethodDelete:
+			s.handleDeleteCategory(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+	})
+
+	// Review moderation queue
+	mux.HandleFunc("/reviews", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			s.handleListReviewQueue(w, r)
+			return
+		}
+		methodNotAllowed(w, r)
+	})
+
+	mux.HandleFunc("/reviews/leaderboard", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			s.handleGetReviewLeaderboard(w, r)
+			return
+		}
+		methodNotAllowed(w, r)
+	})
 
 	// Audit log
 	mux.HandleFunc("/audit", s.handleGetAuditLog)
 
+	// API key administration
+	mux.HandleFunc("/admin/keys", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			s.handleListAPIKeys(w, r)
+		case http.MethodPost:
+			s.handleCreateAPIKey(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+	})
+	mux.HandleFunc("/admin/keys/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			s.handleRevokeAPIKey(w, r)
+			return
+		}
+		methodNotAllowed(w, r)
+	})
+
+	// Exchange rate administration
+	mux.HandleFunc("/admin/exchange-rates", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			s.handleListExchangeRates(w, r)
+			return
+		}
+		methodNotAllowed(w, r)
+	})
+	mux.HandleFunc("/admin/exchange-rates/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			s.handleSetExchangeRate(w, r)
+		case http.MethodDelete:
+			s.handleDeleteExchangeRate(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+	})
+
+	// Orders
+	mux.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			s.handleListOrders(w, r)
+		case http.MethodPost:
+			s.handleCreateOrder(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+	})
+	mux.HandleFunc("/orders/", s.routeOrders)
+
 	// SKU lookup
 	mux.HandleFunc("/sku/", s.handleLookupBySKU)
 
@@ -61,7 +177,7 @@ func (s *Server) routes() {
 		case http.MethodPost:
 			s.handleCreateProduct(w, r)
 		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			methodNotAllowed(w, r)
 		}
 	})
 
@@ -71,21 +187,30 @@ func (s *Server) routes() {
 			s.handleExportCSV(w, r)
 			return
 		}
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
 	})
 	mux.HandleFunc("/products/export/json", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
 			s.handleExportJSON(w, r)
 			return
 		}
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
 	})
 	mux.HandleFunc("/products/import", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			s.handleImportCSV(w, r)
 			return
 		}
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
+	})
+
+	// Catalog-wide variant repricing
+	mux.HandleFunc("/products/reprice", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			s.handleRepriceCatalog(w, r)
+			return
+		}
+		methodNotAllowed(w, r)
 	})
 
 	// Stats API
@@ -94,31 +219,55 @@ func (s *Server) routes() {
 			s.handleGetStats(w, r)
 			return
 		}
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
 	})
 
 	mux.HandleFunc("/products/", func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimPrefix(r.URL.Path, "/products/")
 
+		// Handle /products/:id/reviews and /products/:id/reviews/:reviewId
+		if strings.Contains(path, "/reviews") {
+			s.routeReviews(w, r, path)
+			return
+		}
+
+		// Handle /products/:id/prices and /products/:id/prices/schedules[/:scheduleId]
+		if strings.Contains(path, "/prices") {
+			s.routePrices(w, r, path)
+			return
+		}
+
+		// Handle /products/:id/images and /products/:id/variants/:variantId/images.
+		// Checked before /variants so variant images reach routeImages.
+		if strings.Contains(path, "/images") {
+			s.routeImages(w, r, path)
+			return
+		}
+
+		// Handle /products/:id/variants and /products/:id/variants/:variantId.
+		// Checked before /purchase so variant purchases reach routeVariants.
+		if strings.Contains(path, "/variants") {
+			s.routeVariants(w, r, path)
+			return
+		}
+
 		// Handle /products/:id/purchase
 		if strings.HasSuffix(path, "/purchase") {
 			if r.Method == http.MethodPost {
 				s.handlePurchaseProduct(w, r)
 				return
 			}
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		// Handle /products/:id/reviews and /products/:id/reviews/:reviewId
-		if strings.Contains(path, "/reviews") {
-			s.routeReviews(w, r, path)
+			methodNotAllowed(w, r)
 			return
 		}
 
-		// Handle /products/:id/variants and /products/:id/variants/:variantId
-		if strings.Contains(path, "/variants") {
-			s.routeVariants(w, r, path)
+		// Handle /products/:id/restore
+		if strings.HasSuffix(path, "/restore") {
+			if r.Method == http.MethodPost {
+				s.handleRestoreProduct(w, r)
+				return
+			}
+			methodNotAllowed(w, r)
 			return
 		}
 
@@ -128,7 +277,7 @@ func (s *Server) routes() {
 				s.handleGetVariantInventory(w, r)
 				return
 			}
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			methodNotAllowed(w, r)
 			return
 		}
 
@@ -138,7 +287,7 @@ func (s *Server) routes() {
 				s.handleGetProductWithReviews(w, r)
 				return
 			}
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			methodNotAllowed(w, r)
 			return
 		}
 
@@ -155,32 +304,67 @@ func (s *Server) routes() {
 			}
 		case http.MethodPut:
 			s.handleUpdateProduct(w, r)
+		case http.MethodPatch:
+			s.handlePatchProduct(w, r)
 		case http.MethodDelete:
 			s.handleDeleteProduct(w, r)
 		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			methodNotAllowed(w, r)
 		}
 	})
 
 	// Apply middleware
 	rl := newRateLimiter(100, time.Minute)
-	s.router = chain(mux, recoveryMiddleware, loggingMiddleware, corsMiddleware, rl.middleware)
+	s.router = chain(mux, requestIDMiddleware, recoveryMiddleware, loggingMiddleware, corsMiddleware, clientIPMiddleware(s.config.TrustedProxies), rl.middleware, s.authMiddleware, moneyFormatMiddleware, s.idempotencyMiddleware)
 }
 
 // routeReviews dispatches review sub-routes.
 func (s *Server) routeReviews(w http.ResponseWriter, r *http.Request, path string) {
-	// path is like "1/reviews" or "1/reviews/5" or "1/reviews/5/approve"
-	if strings.HasSuffix(path, "/approve") {
+	// path is like "1/reviews", "1/reviews/5", "1/reviews/summary",
+	// "1/reviews/5/approve", "1/reviews/5/vote" or "1/reviews/5/reply"
+	parts := strings.Split(path, "/")
+	// parts[0] = id, parts[1] = "reviews", parts[2] = reviewId (optional),
+	// parts[3] = moderation action, vote or reply (optional)
+
+	if len(parts) == 4 && parts[3] == "vote" {
 		if r.Method == http.MethodPost {
-			s.handleApproveReview(w, r)
+			s.handleVoteReview(w, r)
 			return
 		}
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
+		return
+	}
+	if len(parts) == 4 && parts[3] == "reply" {
+		switch r.Method {
+		case http.MethodPut:
+			s.handleSetReviewReply(w, r)
+		case http.MethodDelete:
+			s.handleDeleteReviewReply(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+		return
+	}
+	if len(parts) == 3 && parts[2] == "summary" {
+		if r.Method == http.MethodGet {
+			s.handleGetReviewSummary(w, r)
+			return
+		}
+		methodNotAllowed(w, r)
+		return
+	}
+	if len(parts) == 4 {
+		if _, ok := reviewModerationActions[parts[3]]; !ok {
+			notFound(w, r)
+			return
+		}
+		if r.Method == http.MethodPost {
+			s.handleModerateReview(w, r, parts[3])
+			return
+		}
+		methodNotAllowed(w, r)
 		return
 	}
-
-	parts := strings.Split(path, "/")
-	// parts[0] = id, parts[1] = "reviews", parts[2] = reviewId (optional)
 
 	if len(parts) == 2 {
 		// /products/:id/reviews
@@ -190,7 +374,7 @@ func (s *Server) routeReviews(w http.ResponseWriter, r *http.Request, path strin
 		case http.MethodPost:
 			s.handleCreateReview(w, r)
 		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			methodNotAllowed(w, r)
 		}
 		return
 	}
@@ -201,23 +385,31 @@ func (s *Server) routeReviews(w http.ResponseWriter, r *http.Request, path strin
 		case http.MethodDelete:
 			s.handleDeleteReview(w, r)
 		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			methodNotAllowed(w, r)
 		}
 		return
 	}
 
-	http.NotFound(w, r)
+	notFound(w, r)
 }
 
 // routeVariants dispatches variant sub-routes.
 func (s *Server) routeVariants(w http.ResponseWriter, r *http.Request, path string) {
-	// path is like "1/variants" or "1/variants/5" or "1/variants/5/purchase"
+	// path is like "1/variants", "1/variants/5", "1/variants/5/purchase" or "1/variants/reprice"
+	if strings.HasSuffix(path, "/variants/reprice") {
+		if r.Method == http.MethodPost {
+			s.handleRepriceProductVariants(w, r)
+			return
+		}
+		methodNotAllowed(w, r)
+		return
+	}
 	if strings.HasSuffix(path, "/purchase") {
 		if r.Method == http.MethodPost {
 			s.handlePurchaseVariant(w, r)
 			return
 		}
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
 		return
 	}
 
@@ -232,7 +424,7 @@ func (s *Server) routeVariants(w http.ResponseWriter, r *http.Request, path stri
 		case http.MethodPost:
 			s.handleCreateVariant(w, r)
 		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			methodNotAllowed(w, r)
 		}
 		return
 	}
@@ -244,15 +436,32 @@ func (s *Server) routeVariants(w http.ResponseWriter, r *http.Request, path stri
 			s.handleGetVariant(w, r)
 		case http.MethodPut:
 			s.handleUpdateVariant(w, r)
+		case http.MethodPatch:
+			s.handlePatchVariant(w, r)
 		case http.MethodDelete:
 			s.handleDeleteVariant(w, r)
 		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			methodNotAllowed(w, r)
 		}
 		return
 	}
 
-	http.NotFound(w, r)
+	notFound(w, r)
+}
+
+// mediaHandler serves uploaded images from dir. Directory listings are
+// refused so stored files can only be fetched by name.
+func mediaHandler(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "" || strings.HasSuffix(r.URL.Path, "/") {
+			notFound(w, r)
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		files.ServeHTTP(w, r)
+	})
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
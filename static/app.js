@@ -15,20 +15,67 @@ function showToast(message, type) {
     }, 3000);
 }
 
-async function deleteProduct(id) {
+// problemMessage returns a readable message from an API error body
+// (application/problem+json), preferring the first field error.
+function problemMessage(problem, fallback) {
+    if (!problem) {
+        return fallback;
+    }
+    if (problem.errors && problem.errors.length > 0) {
+        return problem.errors[0].field + ' ' + problem.errors[0].message;
+    }
+    return problem.detail || problem.title || fallback;
+}
+
+// apiFetch wraps fetch, sending the API key saved in localStorage. When the
+// server asks for credentials, the user is prompted once and the request retried.
+async function apiFetch(url, options) {
+    options = options || {};
+    var key = localStorage.getItem('apiKey');
+    var response = await fetch(url, withApiKey(options, key));
+    if (response.status !== 401) {
+        return response;
+    }
+
+    key = prompt('This action requires an API key:');
+    if (!key) {
+        return response;
+    }
+    localStorage.setItem('apiKey', key);
+    return fetch(url, withApiKey(options, key));
+}
+
+function withApiKey(options, key) {
+    var headers = Object.assign({}, options.headers);
+    if (key) {
+        headers['Authorization'] = 'Bearer ' + key;
+    }
+    return Object.assign({}, options, { headers: headers });
+}
+
+// deleteProduct deletes the product shown on the page. etag is the version
+// the page was rendered from, so a product changed since then is not deleted.
+async function deleteProduct(id, etag) {
     if (!confirm('Are you sure you want to delete this product?')) {
         return;
     }
 
     try {
-        var response = await fetch('/products/' + id, {
-            method: 'GET',
+        var headers = {};
+        if (etag) {
+            headers['If-Match'] = etag;
+        }
+        var response = await apiFetch('/products/' + id, {
+            method: 'DELETE',
+            headers: headers,
         });
         if (response.ok) {
             showToast('Deleted!', 'success');
             setTimeout(function() {
                 window.location.href = '/';
             }, 1000);
+        } else if (response.status === 412) {
+            showToast('This product was changed by someone else. Reload and try again.', 'error');
         } else {
             showToast('Failed to delete product', 'error');
         }
@@ -39,19 +86,19 @@ async function deleteProduct(id) {
 
 async function purchaseProduct(id) {
     try {
-        var response = await fetch('/products/' + id + '/purchase', {
+        var response = await apiFetch('/products/' + id + '/purchase', {
             method: 'POST',
         });
         if (response.ok) {
+            var result = await response.json();
             showToast('Purchased!', 'success');
             var qtyEl = document.getElementById('product-quantity');
             if (qtyEl) {
-                var current = parseInt(qtyEl.textContent);
-                qtyEl.textContent = Math.max(0, current - 1);
+                qtyEl.textContent = result.remaining;
             }
         } else {
             var data = await response.json();
-            showToast(data.error || 'Purchase failed', 'error');
+            showToast(problemMessage(data, 'Purchase failed'), 'error');
         }
     } catch (err) {
         showToast('Network error', 'error');
@@ -66,14 +113,14 @@ async function createProduct(event) {
     var data = {
         name: formData.get('name') || '',
         description: formData.get('description') || '',
-        price: parseFloat(formData.get('price')) || 0,
+        price: formData.get('price') || '0',
         category: formData.get('category') || '',
         quantity: parseInt(formData.get('quantity')) || 0,
         in_stock: (parseInt(formData.get('quantity')) || 0) > 0
     };
 
     try {
-        var response = await fetch('/products', {
+        var response = await apiFetch('/products', {
             method: 'POST',
             headers: { 'Content-Type': 'application/json' },
             body: JSON.stringify(data),
@@ -83,9 +130,12 @@ async function createProduct(event) {
             setTimeout(function() {
                 window.location.href = '/';
             }, 1000);
+        } else {
+            var problem = await response.json();
+            showToast(problemMessage(problem, 'Failed to create product'), 'error');
         }
     } catch (err) {
-        document.getElementById('error-msg').style.display = 'block';
+        showToast('Network error', 'error');
     }
 }
 
@@ -110,19 +160,19 @@ async function submitReview(event, productId) {
     }
 
     try {
-        var response = await fetch('/products/' + productId + '/reviews', {
+        var response = await apiFetch('/products/' + productId + '/reviews', {
             method: 'POST',
             headers: { 'Content-Type': 'application/json' },
             body: JSON.stringify(data),
         });
+        var result = await response.json();
         if (response.ok) {
-            showToast('Review submitted!', 'success');
+            showToast(result.status === 'approved' ? 'Review published!' : 'Review submitted for moderation', 'success');
             setTimeout(function() {
                 window.location.reload();
             }, 1000);
         } else {
-            var result = await response.json();
-            showToast(result.error || 'Failed to submit review', 'error');
+            showToast(problemMessage(result, 'Failed to submit review'), 'error');
         }
     } catch (err) {
         showToast('Network error', 'error');
@@ -135,7 +185,7 @@ async function deleteReview(productId, reviewId) {
     }
 
     try {
-        var response = await fetch('/products/' + productId + '/reviews/' + reviewId, {
+        var response = await apiFetch('/products/' + productId + '/reviews/' + reviewId, {
             method: 'DELETE',
         });
         if (response.ok) {
@@ -167,7 +217,7 @@ async function searchProducts(event) {
     }
 
     try {
-        var response = await fetch('/search?q=' + encodeURIComponent(query));
+        var response = await apiFetch('/search?q=' + encodeURIComponent(query));
         if (response.ok) {
             var products = await response.json();
             displaySearchResults(products);
@@ -194,7 +244,12 @@ function displaySearchResults(products) {
 
     products.forEach(function(p) {
         html += '<tr>';
-        html += '<td><a href="/products/' + p.id + '">' + escapeHtml(p.name) + '</a></td>';
+        // name_highlight and snippet are escaped server-side; only <mark> tags are added.
+        html += '<td><a href="/products/' + p.id + '">' + (p.name_highlight || escapeHtml(p.name)) + '</a>';
+        if (p.snippet) {
+            html += '<div class="search-snippet">' + p.snippet + '</div>';
+        }
+        html += '</td>';
         html += '<td class="price">$' + p.price.toFixed(2) + '</td>';
         html += '<td>' + escapeHtml(p.category) + '</td>';
         html += '<td>' + (p.in_stock ? '<span class="badge badge-success">In Stock</span>' : '<span class="badge badge-danger">Out of Stock</span>') + '</td>';
@@ -227,19 +282,19 @@ function formatCurrency(amount) {
 
 async function purchaseVariant(productId, variantId) {
     try {
-        var response = await fetch('/products/' + productId + '/variants/' + variantId + '/purchase', {
+        var response = await apiFetch('/products/' + productId + '/variants/' + variantId + '/purchase', {
             method: 'POST',
         });
         if (response.ok) {
+            var result = await response.json();
             showToast('Variant purchased!', 'success');
             var qtyEl = document.getElementById('variant-qty-' + variantId);
             if (qtyEl) {
-                var current = parseInt(qtyEl.textContent);
-                qtyEl.textContent = Math.max(0, current - 1);
+                qtyEl.textContent = result.remaining;
             }
         } else {
             var data = await response.json();
-            showToast(data.error || 'Purchase failed', 'error');
+            showToast(problemMessage(data, 'Purchase failed'), 'error');
         }
     } catch (err) {
         showToast('Network error', 'error');
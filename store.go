@@ -2,8 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,8 +23,13 @@ type cachedProduct struct {
 	expiresAt time.Time
 }
 
+// NewStore opens the database at dbPath, migrates it and seeds an empty
+// catalog. Transactions begin IMMEDIATE: every transaction the store opens
+// writes, most of them after reading what they check, and taking the write
+// lock up front means a concurrent writer waits under busy_timeout instead of
+// invalidating those reads and failing with SQLITE_BUSY.
 func NewStore(dbPath string) (*Store, error) {
-	db, err := sql.Open("sqlite", dbPath+"?_journal_mode=WAL&_busy_timeout=5000")
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
@@ -31,8 +38,8 @@ func NewStore(dbPath string) (*Store, error) {
 		return nil, fmt.Errorf("ping database: %w", err)
 	}
 
-	if err := createTables(db); err != nil {
-		return nil, fmt.Errorf("create tables: %w", err)
+	if err := migrate(db); err != nil {
+		return nil, fmt.Errorf("migrate database: %w", err)
 	}
 
 	store := &Store{
@@ -40,18 +47,6 @@ func NewStore(dbPath string) (*Store, error) {
 		productCache: make(map[int]cachedProduct),
 	}
 
-	if err := createReviewTable(store); err != nil {
-		return nil, fmt.Errorf("create review table: %w", err)
-	}
-
-	if err := createAuditTable(store); err != nil {
-		return nil, fmt.Errorf("create audit table: %w", err)
-	}
-
-	if err := createVariantTable(store); err != nil {
-		return nil, fmt.Errorf("create variant table: %w", err)
-	}
-
 	if err := seedData(db); err != nil {
 		return nil, fmt.Errorf("seed data: %w", err)
 	}
@@ -59,25 +54,6 @@ func NewStore(dbPath string) (*Store, error) {
 	return store, nil
 }
 
-func createTables(db *sql.DB) error {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS products (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT NOT NULL,
-			description TEXT DEFAULT '',
-			price_cents INTEGER NOT NULL,
-			category TEXT DEFAULT '',
-			in_stock BOOLEAN DEFAULT 1,
-			quantity INTEGER DEFAULT 0,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			deleted_at DATETIME DEFAULT NULL,
-			UNIQUE(name)
-		)
-	`)
-	return err
-}
-
 func seedData(db *sql.DB) error {
 	var count int
 	err := db.QueryRow(`SELECT COUNT(*) FROM products`).Scan(&count)
@@ -92,11 +68,11 @@ func seedData(db *sql.DB) error {
 
 	now := time.Now().UTC()
 	seeds := []struct {
-		name, desc    string
-		priceCents    int
-		category      string
-		inStock       bool
-		quantity      int
+		name, desc string
+		priceCents int
+		category   string
+		inStock    bool
+		quantity   int
 	}{
 		{"Wireless Mouse", "Ergonomic wireless mouse with USB receiver", 2499, "electronics", true, 25},
 		{"Mechanical Keyboard", "Cherry MX Blue switches, full-size layout", 8999, "electronics", true, 12},
@@ -108,10 +84,25 @@ func seedData(db *sql.DB) error {
 		{"Webcam HD", "1080p webcam with built-in microphone", 5999, "electronics", true, 3},
 	}
 
+	for _, c := range []struct{ slug, name string }{
+		{"electronics", "Electronics"},
+		{"furniture", "Furniture"},
+		{"office", "Office"},
+	} {
+		_, err := db.Exec(
+			`INSERT OR IGNORE INTO categories (slug, name, created_at, updated_at) VALUES (?, ?, ?, ?)`,
+			c.slug, c.name, now, now,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
 	for _, s := range seeds {
 		_, err := db.Exec(
-			`INSERT OR IGNORE INTO products (name, description, price_cents, category, in_stock, quantity, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-			s.name, s.desc, s.priceCents, s.category, s.inStock, s.quantity, now, now,
+			`INSERT OR IGNORE INTO products (name, description, price_cents, category, category_id, in_stock, quantity, created_at, updated_at)
+			 VALUES (?, ?, ?, ?, (SELECT id FROM categories WHERE slug = ?), ?, ?, ?, ?)`,
+			s.name, s.desc, s.priceCents, s.category, s.category, s.inStock, s.quantity, now, now,
 		)
 		if err != nil {
 			return err
@@ -161,15 +152,15 @@ func (s *Store) Close() error {
 	return s.db.Close()
 }
 
-// ListProducts returns all products, optionally filtered by category.
+// ListProducts returns all products that are not deleted, optionally filtered by a category slug
+// (including its subcategories).
 func (s *Store) ListProducts(category string) ([]dbProduct, error) {
-	var query string
+	query := `SELECT ` + productColumns + ` FROM products WHERE deleted_at IS NULL`
 	var args []interface{}
 
 	if category != "" {
-		query = fmt.Sprintf(`SELECT id, name, description, price_cents, category, in_stock, quantity, created_at, updated_at, deleted_at FROM products WHERE category = '%s'`, category)
-	} else {
-		query = `SELECT id, name, description, price_cents, category, in_stock, quantity, created_at, updated_at, deleted_at FROM products`
+		query += ` AND ` + categorySubtreeFilter("category_id")
+		args = append(args, slugify(category))
 	}
 
 	rows, err := s.db.Query(query, args...)
@@ -178,20 +169,234 @@ func (s *Store) ListProducts(category string) ([]dbProduct, error) {
 	}
 	defer rows.Close()
 
+	return scanProducts(rows)
+}
+
+// liveProductFilter matches rows of a table with a product_id column whose
+// product has not been soft-deleted.
+const liveProductFilter = `product_id IN (SELECT id FROM products WHERE deleted_at IS NULL)`
+
+const productColumns = `id, name, description, price_cents, currency, category, category_id, in_stock, quantity, created_at, updated_at, deleted_at, version`
+
+func scanProducts(rows *sql.Rows) ([]dbProduct, error) {
 	var products []dbProduct
 	for rows.Next() {
 		var p dbProduct
-		err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.PriceCents, &p.Category,
-			&p.InStock, &p.Quantity, &p.CreatedAt, &p.UpdatedAt, &p.DeletedAt)
+		err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.PriceCents, &p.Currency, &p.Category, &p.CategoryID,
+			&p.InStock, &p.Quantity, &p.CreatedAt, &p.UpdatedAt, &p.DeletedAt, &p.Version)
 		if err != nil {
 			return nil, fmt.Errorf("scan product: %w", err)
 		}
 		products = append(products, p)
 	}
-
 	return products, rows.Err()
 }
 
+// productSortColumns maps the public sort keys accepted by QueryProducts to columns.
+var productSortColumns = map[string]string{
+	"name":       "name",
+	"price":      "price_cents",
+	"created_at": "created_at",
+	"quantity":   "quantity",
+}
+
+// Values of ProductQuery.Deleted. The zero value leaves deleted products out.
+const (
+	DeletedOnly    = "only"
+	DeletedInclude = "include"
+)
+
+// ProductQuery describes a filtered, sorted page of products.
+// Nil filter fields are not applied. Category is a slug and also matches
+// products in its subcategories. Price bounds and the price sort are in
+// PriceCurrency, the base currency if empty, and compare each product's price
+// as shown in it (see priceInSQL).
+type ProductQuery struct {
+	Deleted       string
+	Category      string
+	MinPriceCents *int
+	MaxPriceCents *int
+	PriceCurrency string
+	InStock       *bool
+	UpdatedSince  *time.Time
+	Sort          string
+	Desc          bool
+	Limit         int
+	After         *pageCursor
+}
+
+// QueryProducts returns one page of products matching q, the cursor for the
+// following page (nil on the last page) and the total number of matches. A
+// query on price returns errNoExchangeRate if some product's price cannot be
+// shown in q.PriceCurrency.
+func (s *Store) QueryProducts(q ProductQuery) ([]dbProduct, *pageCursor, int, error) {
+	sortCol, ok := productSortColumns[q.Sort]
+	if !ok {
+		return nil, nil, 0, fmt.Errorf("unsupported sort field %q", q.Sort)
+	}
+
+	var price string
+	var priceArgs, sortArgs []interface{}
+	if q.MinPriceCents != nil || q.MaxPriceCents != nil || q.Sort == "price" {
+		currency := q.PriceCurrency
+		if currency == "" {
+			currency = BaseCurrency
+		}
+		var err error
+		if price, priceArgs, err = s.priceIn(currency); err != nil {
+			return nil, nil, 0, err
+		}
+		if q.Sort == "price" {
+			sortCol, sortArgs = price, priceArgs
+		}
+	}
+
+	var where []string
+	var args []interface{}
+	switch q.Deleted {
+	case DeletedOnly:
+		where = append(where, "deleted_at IS NOT NULL")
+	case DeletedInclude:
+	default:
+		where = append(where, "deleted_at IS NULL")
+	}
+	if q.Category != "" {
+		where = append(where, categorySubtreeFilter("category_id"))
+		args = append(args, slugify(q.Category))
+	}
+	if q.MinPriceCents != nil {
+		where = append(where, price+" >= ?")
+		args = append(append(args, priceArgs...), *q.MinPriceCents)
+	}
+	if q.MaxPriceCents != nil {
+		where = append(where, price+" <= ?")
+		args = append(append(args, priceArgs...), *q.MaxPriceCents)
+	}
+	if q.InStock != nil {
+		where = append(where, "in_stock = ?")
+		args = append(args, *q.InStock)
+	}
+	if q.UpdatedSince != nil {
+		where = append(where, "updated_at >= ?")
+		args = append(args, q.UpdatedSince.UTC())
+	}
+
+	filter := ""
+	if len(where) > 0 {
+		filter = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM products`+filter, args...).Scan(&total); err != nil {
+		return nil, nil, 0, fmt.Errorf("count products: %w", err)
+	}
+
+	cmp, dir := ">", "ASC"
+	if q.Desc {
+		cmp, dir = "<", "DESC"
+	}
+
+	pageWhere := where
+	pageArgs := append([]interface{}{}, args...)
+	if q.After != nil {
+		if q.After.Sort != q.Sort || q.After.Desc != q.Desc {
+			return nil, nil, 0, fmt.Errorf("cursor does not match the requested sort")
+		}
+		value, err := productCursorValue(q.Sort, q.After.Value)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		pageWhere = append(pageWhere, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", sortCol, cmp))
+		pageArgs = append(append(pageArgs, sortArgs...), value)
+		pageArgs = append(append(pageArgs, sortArgs...), value, q.After.ID)
+	}
+
+	query := `SELECT ` + productColumns + ` FROM products`
+	if len(pageWhere) > 0 {
+		query += " WHERE " + strings.Join(pageWhere, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT ?", sortCol, dir, dir)
+	pageArgs = append(append(pageArgs, sortArgs...), q.Limit+1)
+
+	rows, err := s.db.Query(query, pageArgs...)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("query products: %w", err)
+	}
+	defer rows.Close()
+
+	products, err := scanProducts(rows)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var next *pageCursor
+	if len(products) > q.Limit {
+		products = products[:q.Limit]
+		last := products[len(products)-1]
+		var sortValue interface{}
+		if q.Sort == "price" {
+			var shown float64
+			args := append(append([]interface{}{}, sortArgs...), last.ID)
+			if err := s.db.QueryRow(`SELECT `+price+` FROM products WHERE id = ?`, args...).Scan(&shown); err != nil {
+				return nil, nil, 0, fmt.Errorf("price of last product: %w", err)
+			}
+			sortValue = shown
+		} else {
+			sortValue = productSortValue(&last, q.Sort)
+		}
+		value, _ := json.Marshal(sortValue)
+		next = &pageCursor{Sort: q.Sort, Desc: q.Desc, Value: value, ID: last.ID}
+	}
+
+	return products, next, total, nil
+}
+
+// productSortValue returns the value of p's sort key as stored in a cursor.
+// Prices are not covered: the price sort depends on exchange rates and
+// overrides, so QueryProducts reads its key back from the database.
+func productSortValue(p *dbProduct, sort string) interface{} {
+	switch sort {
+	case "name":
+		return p.Name
+	case "quantity":
+		return p.Quantity
+	default:
+		return p.CreatedAt.UTC()
+	}
+}
+
+// productCursorValue decodes a cursor value into the type its sort column holds.
+func productCursorValue(sort string, raw json.RawMessage) (interface{}, error) {
+	var err error
+	switch sort {
+	case "name":
+		var v string
+		err = json.Unmarshal(raw, &v)
+		if err == nil {
+			return v, nil
+		}
+	case "price":
+		var v float64
+		err = json.Unmarshal(raw, &v)
+		if err == nil {
+			return v, nil
+		}
+	case "quantity":
+		var v int
+		err = json.Unmarshal(raw, &v)
+		if err == nil {
+			return v, nil
+		}
+	default:
+		var v time.Time
+		err = json.Unmarshal(raw, &v)
+		if err == nil {
+			return v.UTC(), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid cursor")
+}
+
 func (s *Store) GetProduct(id int) (*dbProduct, error) {
 	now := time.Now().UTC()
 	s.cacheMu.RLock()
@@ -204,10 +409,9 @@ func (s *Store) GetProduct(id int) (*dbProduct, error) {
 
 	var p dbProduct
 	err := s.db.QueryRow(
-		`SELECT id, name, description, price_cents, category, in_stock, quantity, created_at, updated_at, deleted_at
-		 FROM products WHERE id = ? AND deleted_at IS NULL`, id,
-	).Scan(&p.ID, &p.Name, &p.Description, &p.PriceCents, &p.Category,
-		&p.InStock, &p.Quantity, &p.CreatedAt, &p.UpdatedAt, &p.DeletedAt)
+		`SELECT `+productColumns+` FROM products WHERE id = ? AND deleted_at IS NULL`, id,
+	).Scan(&p.ID, &p.Name, &p.Description, &p.PriceCents, &p.Currency, &p.Category, &p.CategoryID,
+		&p.InStock, &p.Quantity, &p.CreatedAt, &p.UpdatedAt, &p.DeletedAt, &p.Version)
 	if err != nil {
 		return nil, err
 	}
@@ -221,7 +425,16 @@ func (s *Store) GetProduct(id int) (*dbProduct, error) {
 	return &p, nil
 }
 
-func (s *Store) CreateProduct(name, description string, priceCents int, category string, inStock bool, quantity int) (int, error) {
+// invalidateProduct drops a product from the read cache after it changes.
+func (s *Store) invalidateProduct(id int) {
+	s.cacheMu.Lock()
+	delete(s.productCache, id)
+	s.cacheMu.Unlock()
+}
+
+// CreateProduct inserts a product priced in currency. categoryID may be nil;
+// the category slug column is filled in from it.
+func (s *Store) CreateProduct(name, description string, priceCents int, currency string, categoryID *int, inStock bool, quantity int) (int, error) {
 	if name == "" {
 		return 0, fmt.Errorf("name is required")
 	}
@@ -229,16 +442,11 @@ func (s *Store) CreateProduct(name, description string, priceCents int, category
 		return 0, fmt.Errorf("price must be non-negative")
 	}
 
-	if len(description) > 128 {
-		log.Printf("WARN: description for %q truncated from %d to 128 characters", name, len(description))
-		description = description[:128]
-	}
-
 	now := time.Now().UTC()
 	result, err := s.db.Exec(
-		`INSERT INTO products (name, description, price_cents, category, in_stock, quantity, created_at, updated_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		name, description, priceCents, category, inStock, quantity, now, now,
+		`INSERT INTO products (name, description, price_cents, currency, category, category_id, in_stock, quantity, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, COALESCE((SELECT slug FROM categories WHERE id = ?), ''), ?, ?, ?, ?, ?)`,
+		name, description, priceCents, currency, categoryID, categoryID, inStock, quantity, now, now,
 	)
 	if err != nil {
 		return 0, err
@@ -252,65 +460,181 @@ func (s *Store) CreateProduct(name, description string, priceCents int, category
 	return int(id), nil
 }
 
-// UpdateProduct updates fields for a product.
-func (s *Store) UpdateProduct(id int, name, description string, priceCents int, category string, inStock bool, quantity int) error {
+// UpdateProduct overwrites a product's fields, provided it is still at the
+// given version. It returns errVersionConflict if the product has changed
+// since that version was read and errNotFound if it no longer exists.
+func (s *Store) UpdateProduct(id, version int, name, description string, priceCents int, currency string, categoryID *int, inStock bool, quantity int) error {
 	now := time.Now().UTC()
 	result, err := s.db.Exec(
-		`UPDATE products SET name = ?, description = ?, price_cents = ?, category = ?, in_stock = ?, quantity = ?, updated_at = ?
-		 WHERE id = ? AND deleted_at IS NULL`,
-		name, description, priceCents, category, inStock, quantity, now, id,
+		`UPDATE products SET name = ?, description = ?, price_cents = ?, currency = ?,
+		        category = COALESCE((SELECT slug FROM categories WHERE id = ?), ''), category_id = ?,
+		        in_stock = ?, quantity = ?, updated_at = ?
+		 WHERE id = ? AND version = ? AND deleted_at IS NULL`,
+		name, description, priceCents, currency, categoryID, categoryID, inStock, quantity, now, id, version,
 	)
 	if err != nil {
 		return err
 	}
 
-	rows, err := result.RowsAffected()
+	s.invalidateProduct(id)
+	return s.checkVersionedWrite(result, `SELECT 1 FROM products WHERE id = ? AND deleted_at IS NULL`, id)
+}
+
+// DeleteProduct soft-deletes a product that is still at the given version.
+// Errors are as for UpdateProduct.
+func (s *Store) DeleteProduct(id, version int) error {
+	now := time.Now().UTC()
+	result, err := s.db.Exec(
+		`UPDATE products SET deleted_at = ?, updated_at = ? WHERE id = ? AND version = ? AND deleted_at IS NULL`,
+		now, now, id, version,
+	)
 	if err != nil {
 		return err
 	}
-	if rows == 0 {
-		return fmt.Errorf("product not found")
-	}
 
-	return nil
+	s.invalidateProduct(id)
+	return s.checkVersionedWrite(result, `SELECT 1 FROM products WHERE id = ? AND deleted_at IS NULL`, id)
 }
 
-func (s *Store) DeleteProduct(id int) error {
+// GetDeletedProduct returns a soft-deleted product. It is never cached, and
+// returns errNotFound if the product does not exist or is not deleted.
+func (s *Store) GetDeletedProduct(id int) (*dbProduct, error) {
+	var p dbProduct
+	err := s.db.QueryRow(
+		`SELECT `+productColumns+` FROM products WHERE id = ? AND deleted_at IS NOT NULL`, id,
+	).Scan(&p.ID, &p.Name, &p.Description, &p.PriceCents, &p.Currency, &p.Category, &p.CategoryID,
+		&p.InStock, &p.Quantity, &p.CreatedAt, &p.UpdatedAt, &p.DeletedAt, &p.Version)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// RestoreProduct undoes the soft deletion of a product at the given version.
+// It returns errVersionConflict if the product has changed since that version
+// was read and errNotFound if it does not exist or is not deleted.
+func (s *Store) RestoreProduct(id, version int) error {
 	now := time.Now().UTC()
 	result, err := s.db.Exec(
-		`UPDATE products SET deleted_at = ?, updated_at = ? WHERE id = ? AND deleted_at IS NULL`,
-		now, now, id,
+		`UPDATE products SET deleted_at = NULL, updated_at = ? WHERE id = ? AND version = ? AND deleted_at IS NOT NULL`,
+		now, id, version,
 	)
 	if err != nil {
 		return err
 	}
 
-	rows, err := result.RowsAffected()
+	s.invalidateProduct(id)
+	return s.checkVersionedWrite(result, `SELECT 1 FROM products WHERE id = ? AND deleted_at IS NOT NULL`, id)
+}
+
+// PurgeProduct permanently removes a product, deleted or not, together with
+// its variants, reviews, images and prices. Order lines keep their copied SKU,
+// name and price but lose the link to the product (the foreign keys cascade
+// to prices and order lines). The removed images are returned so the caller
+// can remove their files.
+func (s *Store) PurgeProduct(id int) ([]dbImage, error) {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if rows == 0 {
-		return fmt.Errorf("product not found")
+	defer tx.Rollback()
+
+	images, err := purgeProductRows(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
 
-	return nil
+	s.invalidateProduct(id)
+	return images, nil
 }
 
-// DecrementQuantity decreases quantity by 1 and updates in_stock.
-func (s *Store) DecrementQuantity(id int) error {
-	var currentQty int
-	err := s.db.QueryRow(`SELECT quantity FROM products WHERE id = ?`, id).Scan(&currentQty)
+// purgeProductRows deletes a product and every row that belongs to it.
+func purgeProductRows(tx *sql.Tx, id int) ([]dbImage, error) {
+	rows, err := tx.Query(`DELETE FROM product_images WHERE product_id = ? RETURNING `+imageColumns, id)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("delete product images: %w", err)
+	}
+	images, err := scanImages(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
 	}
 
-	newQty := currentQty - 1
-	inStock := newQty > 0
-	now := time.Now().UTC()
+	for _, stmt := range []string{
+		`DELETE FROM reviews WHERE product_id = ?`,
+		`DELETE FROM variants WHERE product_id = ?`,
+	} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return nil, fmt.Errorf("purge product %d: %w", id, err)
+		}
+	}
+
+	result, err := tx.Exec(`DELETE FROM products WHERE id = ?`, id)
+	if err != nil {
+		return nil, fmt.Errorf("purge product %d: %w", id, err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, errNotFound
+	}
+	return images, nil
+}
 
-	_, err = s.db.Exec(
-		`UPDATE products SET quantity = ?, in_stock = ?, updated_at = ? WHERE id = ?`,
-		newQty, inStock, now, id,
+// ExpiredDeletedProducts returns the products soft-deleted before cutoff,
+// oldest deletion first.
+func (s *Store) ExpiredDeletedProducts(cutoff time.Time) ([]dbProduct, error) {
+	rows, err := s.db.Query(
+		`SELECT `+productColumns+` FROM products WHERE deleted_at IS NOT NULL AND deleted_at < ? ORDER BY deleted_at, id`,
+		cutoff.UTC(),
 	)
-	return err
+	if err != nil {
+		return nil, fmt.Errorf("list expired deleted products: %w", err)
+	}
+	defer rows.Close()
+	return scanProducts(rows)
+}
+
+// checkVersionedWrite interprets the result of a write guarded by
+// "version = ?". When no row matched, existsQuery tells a stale version
+// (errVersionConflict) apart from a missing row (errNotFound).
+func (s *Store) checkVersionedWrite(result sql.Result, existsQuery string, id int) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		return nil
+	}
+
+	var one int
+	err = s.db.QueryRow(existsQuery, id).Scan(&one)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return errVersionConflict
+}
+
+// DecrementQuantity atomically removes quantity units from a product's stock
+// and returns the quantity remaining. The check and the decrement happen in a
+// single conditional UPDATE, so concurrent purchases can never oversell: when
+// fewer than quantity units remain it fails with errInsufficientStock and the
+// stock is left untouched.
+func (s *Store) DecrementQuantity(id, quantity int) (int, error) {
+	line, err := reserveProductStock(s.db, id, quantity, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	s.invalidateProduct(id)
+	return line.remaining, nil
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const apiKeyPrefix = "pck_"
+
+// hashAPIKey returns the stored form of an API key. Keys are long random
+// strings, so a plain SHA-256 is sufficient; no salt or stretching is needed.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey returns a new random API key.
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(buf), nil
+}
+
+// displayPrefix returns the part of a key shown to administrators. Short,
+// operator-chosen keys reveal at most a third of their length.
+func displayPrefix(key string) string {
+	n := len(apiKeyPrefix) + 6
+	if len(key) < 3*n {
+		n = len(key) / 3
+	}
+	return key[:n]
+}
+
+const apiKeyColumns = `id, name, key_prefix, role, created_at, last_used_at, revoked_at`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var k APIKey
+	err := row.Scan(&k.ID, &k.Name, &k.Prefix, &k.Role, &k.CreatedAt, &k.LastUsedAt, &k.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// CreateAPIKey issues a new key with the given role. The plaintext key is
+// returned only here.
+func (s *Store) CreateAPIKey(name, role string) (string, *APIKey, error) {
+	key, err := generateAPIKey()
+	if err != nil {
+		return "", nil, fmt.Errorf("generate api key: %w", err)
+	}
+	k, err := s.insertAPIKey(name, key, role)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, k, nil
+}
+
+// EnsureAPIKey registers a caller-supplied key unless it already exists.
+func (s *Store) EnsureAPIKey(name, key, role string) error {
+	var id int
+	err := s.db.QueryRow(`SELECT id FROM api_keys WHERE key_hash = ?`, hashAPIKey(key)).Scan(&id)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	_, err = s.insertAPIKey(name, key, role)
+	return err
+}
+
+func (s *Store) insertAPIKey(name, key, role string) (*APIKey, error) {
+	now := time.Now().UTC()
+	result, err := s.db.Exec(
+		`INSERT INTO api_keys (name, key_prefix, key_hash, role, created_at) VALUES (?, ?, ?, ?, ?)`,
+		name, displayPrefix(key), hashAPIKey(key), role, now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("insert api key: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &APIKey{ID: int(id), Name: name, Prefix: displayPrefix(key), Role: role, CreatedAt: now}, nil
+}
+
+// apiKeyUsageResolution is how stale a key's last_used_at may get.
+const apiKeyUsageResolution = time.Minute
+
+// AuthenticateAPIKey returns the active key matching the plaintext key, or
+// errNotFound if it is unknown or revoked.
+func (s *Store) AuthenticateAPIKey(key string) (*APIKey, error) {
+	k, err := scanAPIKey(s.db.QueryRow(
+		`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL`,
+		hashAPIKey(key),
+	))
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Recording every use would make each read take the database's write
+	// lock, so last_used_at is only refreshed once it is a minute old.
+	now := time.Now().UTC()
+	if k.LastUsedAt != nil && now.Sub(*k.LastUsedAt) < apiKeyUsageResolution {
+		return k, nil
+	}
+	_, err = s.db.Exec(
+		`UPDATE api_keys SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)`,
+		now, k.ID, now.Add(-apiKeyUsageResolution),
+	)
+	if err != nil {
+		return nil, err
+	}
+	k.LastUsedAt = &now
+	return k, nil
+}
+
+// ListAPIKeys returns every issued key, including revoked ones.
+func (s *Store) ListAPIKeys() ([]APIKey, error) {
+	rows, err := s.db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("list api keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan api key: %w", err)
+		}
+		keys = append(keys, *k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey disables a key. Revoked keys are kept for the record.
+func (s *Store) RevokeAPIKey(id int) error {
+	result, err := s.db.Exec(
+		`UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`,
+		time.Now().UTC(), id,
+	)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// CountActiveAdminKeys returns the number of unrevoked admin keys.
+func (s *Store) CountActiveAdminKeys() (int, error) {
+	var n int
+	err := s.db.QueryRow(
+		`SELECT COUNT(*) FROM api_keys WHERE role = ? AND revoked_at IS NULL`, RoleAdmin,
+	).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	errSlugTaken           = errors.New("slug already in use")
+	errCategoryCycle       = errors.New("category cannot be its own ancestor")
+	errCategoryHasChildren = errors.New("category has subcategories")
+	errCategoryHasProducts = errors.New("category has products")
+	errParentNotFound      = errors.New("parent category not found")
+)
+
+// categoryTreeCTE walks the category tree from the roots, giving each
+// category its depth and its path of slugs joined by char(1), which sorts
+// parents directly before their children.
+const categoryTreeCTE = `WITH RECURSIVE tree(id, path, depth) AS (
+	SELECT id, slug, 0 FROM categories WHERE parent_id IS NULL
+	UNION ALL
+	SELECT c.id, t.path || char(1) || c.slug, t.depth + 1
+	FROM categories c JOIN tree t ON c.parent_id = t.id
+)`
+
+// categorySubtreeFilter returns a condition matching rows whose column holds
+// the category with the slug bound to its placeholder or any of its
+// descendants. Callers bind slugify of the reference, so "Home Office" finds
+// "home-office".
+func categorySubtreeFilter(column string) string {
+	return column + ` IN (WITH RECURSIVE subtree(id) AS (
+		SELECT id FROM categories WHERE slug = ?
+		UNION
+		SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+	) SELECT id FROM subtree)`
+}
+
+const categorySelect = categoryTreeCTE + `
+	SELECT c.id, c.slug, c.name, c.description, c.parent_id, t.path, c.created_at, c.updated_at
+	FROM categories c JOIN tree t ON t.id = c.id`
+
+func scanCategory(row interface{ Scan(...interface{}) error }) (*dbCategory, error) {
+	var c dbCategory
+	var path string
+	err := row.Scan(&c.ID, &c.Slug, &c.Name, &c.Description, &c.ParentID, &path, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	c.Path = strings.Split(path, "\x01")
+	return &c, nil
+}
+
+// ListCategories returns every category in tree order: each parent is
+// followed by its descendants, siblings sorted by slug.
+func (s *Store) ListCategories() ([]dbCategory, error) {
+	rows, err := s.db.Query(categorySelect + ` ORDER BY t.path`)
+	if err != nil {
+		return nil, fmt.Errorf("list categories: %w", err)
+	}
+	defer rows.Close()
+
+	var categories []dbCategory
+	for rows.Next() {
+		c, err := scanCategory(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan category: %w", err)
+		}
+		categories = append(categories, *c)
+	}
+	return categories, rows.Err()
+}
+
+// GetCategory returns a category by ID, or errNotFound.
+func (s *Store) GetCategory(id int) (*dbCategory, error) {
+	c, err := scanCategory(s.db.QueryRow(categorySelect+` WHERE c.id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	return c, err
+}
+
+// GetCategoryBySlug returns the category a product's category field refers
+// to, normalizing the reference with slugify, or errNotFound.
+func (s *Store) GetCategoryBySlug(ref string) (*dbCategory, error) {
+	c, err := scanCategory(s.db.QueryRow(categorySelect+` WHERE c.slug = ?`, slugify(ref)))
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	return c, err
+}
+
+// CreateCategory adds a category. It returns errSlugTaken if the slug is in
+// use and errParentNotFound if the parent does not exist.
+func (s *Store) CreateCategory(slug, name, description string, parentID *int) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := checkCategoryWrite(tx, 0, slug, parentID); err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	result, err := tx.Exec(
+		`INSERT INTO categories (slug, name, description, parent_id, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		slug, name, description, parentID, now, now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("insert category: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+// UpdateCategory overwrites a category. Besides the errors of CreateCategory
+// it returns errCategoryCycle if the new parent is the category itself or one
+// of its descendants, and errNotFound if the category does not exist. Renaming the slug updates the products' copy of it.
+func (s *Store) UpdateCategory(id int, slug, name, description string, parentID *int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkCategoryWrite(tx, id, slug, parentID); err != nil {
+		return err
+	}
+	if parentID != nil {
+		var inSubtree int
+		err := tx.QueryRow(
+			`WITH RECURSIVE subtree(id) AS (
+				SELECT ?
+				UNION
+				SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+			) SELECT COUNT(*) FROM subtree WHERE id = ?`,
+			id, *parentID,
+		).Scan(&inSubtree)
+		if err != nil {
+			return err
+		}
+		if inSubtree > 0 {
+			return errCategoryCycle
+		}
+	}
+
+	result, err := tx.Exec(
+		`UPDATE categories SET slug = ?, name = ?, description = ?, parent_id = ?, updated_at = ? WHERE id = ?`,
+		slug, name, description, parentID, time.Now().UTC(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("update category: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.invalidateAllProducts()
+	return nil
+}
+
+// checkCategoryWrite verifies that slug is free (ignoring category id) and
+// that the parent, if any, exists.
+func checkCategoryWrite(tx *sql.Tx, id int, slug string, parentID *int) error {
+	var taken int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM categories WHERE slug = ? AND id != ?`, slug, id).Scan(&taken); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return errSlugTaken
+	}
+	if parentID != nil {
+		var exists int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM categories WHERE id = ?`, *parentID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return errParentNotFound
+		}
+	}
+	return nil
+}
+
+// DeleteCategory removes a category that has no subcategories and no active
+// products. Soft-deleted products still pointing at it lose their category.
+func (s *Store) DeleteCategory(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var children, products int
+	err = tx.QueryRow(
+		`SELECT (SELECT COUNT(*) FROM categories WHERE parent_id = ?),
+		        (SELECT COUNT(*) FROM products WHERE category_id = ? AND deleted_at IS NULL)`,
+		id, id,
+	).Scan(&children, &products)
+	if err != nil {
+		return err
+	}
+	if children > 0 {
+		return errCategoryHasChildren
+	}
+	if products > 0 {
+		return errCategoryHasProducts
+	}
+
+	if _, err := tx.Exec(`UPDATE products SET category_id = NULL, category = '' WHERE category_id = ?`, id); err != nil {
+		return err
+	}
+	result, err := tx.Exec(`DELETE FROM categories WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete category: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return tx.Commit()
+}
+
+// invalidateAllProducts empties the product read cache, for changes such as a
+// category rename that touch many products at once.
+func (s *Store) invalidateAllProducts() {
+	s.cacheMu.Lock()
+	s.productCache = make(map[int]cachedProduct)
+	s.cacheMu.Unlock()
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ListExchangeRates returns the stored exchange rates ordered by currency.
+// The base currency is not stored; its rate is always 1.
+func (s *Store) ListExchangeRates() ([]dbExchangeRate, error) {
+	rows, err := s.db.Query(`SELECT currency, rate, updated_at FROM exchange_rates ORDER BY currency`)
+	if err != nil {
+		return nil, fmt.Errorf("list exchange rates: %w", err)
+	}
+	defer rows.Close()
+
+	var rates []dbExchangeRate
+	for rows.Next() {
+		var er dbExchangeRate
+		if err := rows.Scan(&er.Currency, &er.Rate, &er.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("scan exchange rate: %w", err)
+		}
+		rates = append(rates, er)
+	}
+	return rates, rows.Err()
+}
+
+// ExchangeRates returns every usable rate keyed by currency, including the
+// base currency at 1.
+func (s *Store) ExchangeRates() (map[string]*big.Rat, error) {
+	stored, err := s.ListExchangeRates()
+	if err != nil {
+		return nil, err
+	}
+	rates := map[string]*big.Rat{BaseCurrency: big.NewRat(1, 1)}
+	for _, er := range stored {
+		if rate, ok := parseRate(er.Rate); ok {
+			rates[er.Currency] = rate
+		}
+	}
+	return rates, nil
+}
+
+// GetExchangeRate returns the stored rate for a currency, or errNotFound.
+func (s *Store) GetExchangeRate(currency string) (*dbExchangeRate, error) {
+	var er dbExchangeRate
+	err := s.db.QueryRow(`SELECT currency, rate, updated_at FROM exchange_rates WHERE currency = ?`, currency).
+		Scan(&er.Currency, &er.Rate, &er.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &er, nil
+}
+
+// SetExchangeRate stores the rate for a currency, replacing any previous one.
+func (s *Store) SetExchangeRate(currency, rate string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO exchange_rates (currency, rate, updated_at) VALUES (?, ?, ?)
+		 ON CONFLICT (currency) DO UPDATE SET rate = excluded.rate, updated_at = excluded.updated_at`,
+		currency, rate, time.Now().UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("set exchange rate: %w", err)
+	}
+	return nil
+}
+
+// DeleteExchangeRate removes the rate for a currency, or returns errNotFound.
+func (s *Store) DeleteExchangeRate(currency string) error {
+	result, err := s.db.Exec(`DELETE FROM exchange_rates WHERE currency = ?`, currency)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// priceInSQL returns an SQL expression, and its arguments, for the price in
+// cents of each row of the products table named table when shown in currency:
+// its override in that currency if it has one, otherwise its stored price
+// converted at rates and rounded. It is NULL for products priced in a
+// currency rates lack. rates must include currency.
+func priceInSQL(table, currency string, rates map[string]*big.Rat) (string, []interface{}) {
+	expr := `COALESCE((SELECT o.price_cents FROM price_overrides o
+	                   WHERE o.product_id = ` + table + `.id AND o.variant_id IS NULL AND o.currency = ?),
+	                  CASE ` + table + `.currency`
+	args := []interface{}{currency}
+	from := make([]string, 0, len(rates))
+	for c := range rates {
+		from = append(from, c)
+	}
+	sort.Strings(from)
+	for _, c := range from {
+		if c == currency {
+			expr += ` WHEN ? THEN ` + table + `.price_cents`
+			args = append(args, c)
+			continue
+		}
+		factor, _ := new(big.Rat).Quo(rates[currency], rates[c]).Float64()
+		expr += ` WHEN ? THEN ROUND(` + table + `.price_cents * ?)`
+		args = append(args, c, factor)
+	}
+	return expr + ` END)`, args
+}
+
+// priceIn returns priceInSQL for the products table in currency at the
+// current exchange rates. It returns errNoExchangeRate if currency, or that of
+// any product, has no rate, so that every product has a price to compare.
+func (s *Store) priceIn(currency string) (string, []interface{}, error) {
+	rates, err := s.ExchangeRates()
+	if err != nil {
+		return "", nil, err
+	}
+	if _, ok := rates[currency]; !ok {
+		return "", nil, fmt.Errorf("%w for %s", errNoExchangeRate, currency)
+	}
+	rows, err := s.db.Query(`SELECT DISTINCT currency FROM products`)
+	if err != nil {
+		return "", nil, fmt.Errorf("list product currencies: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return "", nil, err
+		}
+		if _, ok := rates[c]; !ok {
+			return "", nil, fmt.Errorf("cannot convert %s to %s: %w for %s", c, currency, errNoExchangeRate, c)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", nil, err
+	}
+	expr, args := priceInSQL("products", currency, rates)
+	return expr, args, nil
+}
+
+const priceOverrideColumns = `id, product_id, variant_id, currency, price_cents, created_at, updated_at`
+
+func scanPriceOverride(row interface{ Scan(...interface{}) error }) (*dbPriceOverride, error) {
+	var po dbPriceOverride
+	err := row.Scan(&po.ID, &po.ProductID, &po.VariantID, &po.Currency, &po.PriceCents, &po.CreatedAt, &po.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &po, nil
+}
+
+// ListPriceOverrides returns the overrides of a product and its variants,
+// the product's own first.
+func (s *Store) ListPriceOverrides(productID int) ([]dbPriceOverride, error) {
+	rows, err := s.db.Query(
+		`SELECT `+priceOverrideColumns+` FROM price_overrides WHERE product_id = ?
+		 ORDER BY variant_id IS NOT NULL, variant_id, currency`,
+		productID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list price overrides: %w", err)
+	}
+	defer rows.Close()
+
+	var overrides []dbPriceOverride
+	for rows.Next() {
+		po, err := scanPriceOverride(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan price override: %w", err)
+		}
+		overrides = append(overrides, *po)
+	}
+	return overrides, rows.Err()
+}
+
+// PriceOverridesIn returns the overrides in currency for the given products
+// and their variants.
+func (s *Store) PriceOverridesIn(currency string, productIDs []int) (map[priceOwner]int, error) {
+	overrides := make(map[priceOwner]int)
+	if len(productIDs) == 0 {
+		return overrides, nil
+	}
+	args := []interface{}{currency}
+	for _, id := range productIDs {
+		args = append(args, id)
+	}
+	rows, err := s.db.Query(
+		`SELECT product_id, COALESCE(variant_id, 0), price_cents FROM price_overrides
+		 WHERE currency = ? AND product_id IN (?`+strings.Repeat(`, ?`, len(productIDs)-1)+`)`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("load price overrides: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var owner priceOwner
+		var cents int
+		if err := rows.Scan(&owner.ProductID, &owner.VariantID, &cents); err != nil {
+			return nil, fmt.Errorf("scan price override: %w", err)
+		}
+		overrides[owner] = cents
+	}
+	return overrides, rows.Err()
+}
+
+// SetPriceOverride sets the price of a product (variantID nil) or variant in
+// currency, replacing any previous override, and returns the override.
+func (s *Store) SetPriceOverride(productID int, variantID *int, currency string, priceCents int) (*dbPriceOverride, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	result, err := tx.Exec(
+		`UPDATE price_overrides SET price_cents = ?, updated_at = ?
+		 WHERE product_id = ? AND COALESCE(variant_id, 0) = ? AND currency = ?`,
+		priceCents, now, productID, ownerOf(productID, variantID).VariantID, currency,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("update price override: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		_, err := tx.Exec(
+			`INSERT INTO price_overrides (product_id, variant_id, currency, price_cents, created_at, updated_at)
+			 VALUES (?, ?, ?, ?, ?, ?)`,
+			productID, variantID, currency, priceCents, now, now,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("insert price override: %w", err)
+		}
+	}
+
+	po, err := scanPriceOverride(tx.QueryRow(
+		`SELECT `+priceOverrideColumns+` FROM price_overrides
+		 WHERE product_id = ? AND COALESCE(variant_id, 0) = ? AND currency = ?`,
+		productID, ownerOf(productID, variantID).VariantID, currency,
+	))
+	if err != nil {
+		return nil, err
+	}
+	return po, tx.Commit()
+}
+
+// DeletePriceOverride removes an override and returns it, or errNotFound.
+func (s *Store) DeletePriceOverride(productID int, variantID *int, currency string) (*dbPriceOverride, error) {
+	po, err := scanPriceOverride(s.db.QueryRow(
+		`DELETE FROM price_overrides
+		 WHERE product_id = ? AND COALESCE(variant_id, 0) = ? AND currency = ?
+		 RETURNING `+priceOverrideColumns,
+		productID, ownerOf(productID, variantID).VariantID, currency,
+	))
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	return po, err
+}
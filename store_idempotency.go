@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// idempotencyScope identifies a stored request: the same key may be reused
+// safely on a different route or by a different client.
+type idempotencyScope struct {
+	Key    string
+	Method string
+	Path   string
+	Client string
+}
+
+// idempotencyRecord is a stored request and, once it has completed, its response.
+type idempotencyRecord struct {
+	RequestHash string
+	StatusCode  int
+	Headers     http.Header
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// Completed reports whether the original request has finished and its
+// response can be replayed.
+func (r *idempotencyRecord) Completed() bool {
+	return r.StatusCode != 0
+}
+
+// ClaimIdempotencyKey reserves scope for a new request with the given body
+// hash. If the scope is already claimed, the existing record is returned and
+// nothing is written. Records older than retention are discarded first so
+// expired keys can be reused.
+func (s *Store) ClaimIdempotencyKey(scope idempotencyScope, requestHash string, retention time.Duration) (*idempotencyRecord, error) {
+	now := time.Now().UTC()
+
+	_, err := s.db.Exec(
+		`DELETE FROM idempotency_keys
+		 WHERE idempotency_key = ? AND method = ? AND path = ? AND client = ? AND created_at < ?`,
+		scope.Key, scope.Method, scope.Path, scope.Client, now.Add(-retention),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("expire idempotency key: %w", err)
+	}
+
+	result, err := s.db.Exec(
+		`INSERT INTO idempotency_keys (idempotency_key, method, path, client, request_hash, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?)
+		 ON CONFLICT DO NOTHING`,
+		scope.Key, scope.Method, scope.Path, scope.Client, requestHash, now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("claim idempotency key: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 1 {
+		return nil, nil
+	}
+
+	var rec idempotencyRecord
+	var headersJSON string
+	var body []byte
+	err = s.db.QueryRow(
+		`SELECT request_hash, status_code, headers, COALESCE(body, x''), created_at FROM idempotency_keys
+		 WHERE idempotency_key = ? AND method = ? AND path = ? AND client = ?`,
+		scope.Key, scope.Method, scope.Path, scope.Client,
+	).Scan(&rec.RequestHash, &rec.StatusCode, &headersJSON, &body, &rec.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("load idempotency key: %w", err)
+	}
+	rec.Body = body
+	if err := json.Unmarshal([]byte(headersJSON), &rec.Headers); err != nil {
+		return nil, fmt.Errorf("decode idempotency headers: %w", err)
+	}
+	return &rec, nil
+}
+
+// CompleteIdempotencyKey stores the response for a claimed scope so retries replay it.
+func (s *Store) CompleteIdempotencyKey(scope idempotencyScope, statusCode int, headers http.Header, body []byte) error {
+	headersJSON, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`UPDATE idempotency_keys SET status_code = ?, headers = ?, body = ?
+		 WHERE idempotency_key = ? AND method = ? AND path = ? AND client = ?`,
+		statusCode, string(headersJSON), body, scope.Key, scope.Method, scope.Path, scope.Client,
+	)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets a claimed scope so the request can be retried.
+func (s *Store) ReleaseIdempotencyKey(scope idempotencyScope) error {
+	_, err := s.db.Exec(
+		`DELETE FROM idempotency_keys WHERE idempotency_key = ? AND method = ? AND path = ? AND client = ?`,
+		scope.Key, scope.Method, scope.Path, scope.Client,
+	)
+	return err
+}
+
+// PurgeIdempotencyKeys deletes stored requests created before cutoff and
+// returns how many were removed.
+func (s *Store) PurgeIdempotencyKeys(cutoff time.Time) (int, error) {
+	result, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?`, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const imageColumns = `id, product_id, variant_id, filename, thumbnail, mime_type, width, height, size_bytes, checksum, alt_text, sort_order, is_primary, created_at`
+
+func scanImage(row interface{ Scan(...interface{}) error }) (*dbImage, error) {
+	var img dbImage
+	err := row.Scan(&img.ID, &img.ProductID, &img.VariantID, &img.Filename, &img.Thumbnail,
+		&img.MimeType, &img.Width, &img.Height, &img.SizeBytes, &img.Checksum,
+		&img.AltText, &img.SortOrder, &img.IsPrimary, &img.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+func scanImages(rows *sql.Rows) ([]dbImage, error) {
+	var images []dbImage
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan image: %w", err)
+		}
+		images = append(images, *img)
+	}
+	return images, rows.Err()
+}
+
+// imageScope returns the WHERE clause selecting the images that share an
+// owner with img: the product itself, or one of its variants.
+func imageScope(productID int, variantID *int) (string, []interface{}) {
+	if variantID == nil {
+		return `product_id = ? AND variant_id IS NULL`, []interface{}{productID}
+	}
+	return `product_id = ? AND variant_id = ?`, []interface{}{productID, *variantID}
+}
+
+// touchImageOwner bumps the version of the product or variant an image
+// belongs to. Product and variant JSON embed the primary image, so any image
+// change must change their ETag too.
+func touchImageOwner(tx sqlExecutor, productID int, variantID *int) error {
+	now := time.Now().UTC()
+	var err error
+	if variantID == nil {
+		_, err = tx.Exec(`UPDATE products SET version = version + 1, updated_at = ? WHERE id = ?`, now, productID)
+	} else {
+		_, err = tx.Exec(`UPDATE variants SET version = version + 1, updated_at = ? WHERE id = ?`, now, *variantID)
+	}
+	if err != nil {
+		return fmt.Errorf("touch image owner: %w", err)
+	}
+	return nil
+}
+
+// CreateImage records an uploaded image. The first image of a product or
+// variant becomes its primary image, as does any image created with IsPrimary.
+// Every image change bumps its owner's version.
+func (s *Store) CreateImage(img dbImage) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	scope, args := imageScope(img.ProductID, img.VariantID)
+	var existing int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM product_images WHERE `+scope, args...).Scan(&existing); err != nil {
+		return 0, err
+	}
+	if existing == 0 {
+		img.IsPrimary = true
+	}
+	if img.IsPrimary {
+		if _, err := tx.Exec(`UPDATE product_images SET is_primary = 0 WHERE `+scope, args...); err != nil {
+			return 0, err
+		}
+	}
+
+	result, err := tx.Exec(
+		`INSERT INTO product_images (product_id, variant_id, filename, thumbnail, mime_type, width, height,
+		                             size_bytes, checksum, alt_text, sort_order, is_primary, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		img.ProductID, img.VariantID, img.Filename, img.Thumbnail, img.MimeType, img.Width, img.Height,
+		img.SizeBytes, img.Checksum, img.AltText, img.SortOrder, img.IsPrimary, time.Now().UTC(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("insert image: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := touchImageOwner(tx, img.ProductID, img.VariantID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.invalidateProduct(img.ProductID)
+	return int(id), nil
+}
+
+// GetImage returns a single image by ID, or errNotFound.
+func (s *Store) GetImage(id int) (*dbImage, error) {
+	img, err := scanImage(s.db.QueryRow(`SELECT `+imageColumns+` FROM product_images WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	return img, err
+}
+
+// ListImages returns the images of a product (variantID nil) or of one of its
+// variants, primary first and then by sort order.
+func (s *Store) ListImages(productID int, variantID *int) ([]dbImage, error) {
+	scope, args := imageScope(productID, variantID)
+	rows, err := s.db.Query(
+		`SELECT `+imageColumns+` FROM product_images WHERE `+scope+`
+		 ORDER BY is_primary DESC, sort_order, id`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list images: %w", err)
+	}
+	defer rows.Close()
+	return scanImages(rows)
+}
+
+// UpdateImage changes an image's alt text and sort order. Making an image
+// primary demotes the previous primary image of the same product or variant;
+// the primary flag cannot be cleared directly, only moved.
+func (s *Store) UpdateImage(id int, altText string, sortOrder int, primary bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	img, err := scanImage(tx.QueryRow(`SELECT `+imageColumns+` FROM product_images WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if primary && !img.IsPrimary {
+		scope, args := imageScope(img.ProductID, img.VariantID)
+		if _, err := tx.Exec(`UPDATE product_images SET is_primary = 0 WHERE `+scope, args...); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(
+		`UPDATE product_images SET alt_text = ?, sort_order = ?, is_primary = ? WHERE id = ?`,
+		altText, sortOrder, primary || img.IsPrimary, id,
+	)
+	if err != nil {
+		return fmt.Errorf("update image: %w", err)
+	}
+	if err := touchImageOwner(tx, img.ProductID, img.VariantID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.invalidateProduct(img.ProductID)
+	return nil
+}
+
+// DeleteImage removes an image record and returns it so the caller can remove
+// its files. If it was the primary image, the next image by sort order is
+// promoted.
+func (s *Store) DeleteImage(id int) (*dbImage, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	img, err := scanImage(tx.QueryRow(`SELECT `+imageColumns+` FROM product_images WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM product_images WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	if img.IsPrimary {
+		scope, args := imageScope(img.ProductID, img.VariantID)
+		_, err := tx.Exec(
+			`UPDATE product_images SET is_primary = 1
+			 WHERE id = (SELECT id FROM product_images WHERE `+scope+` ORDER BY sort_order, id LIMIT 1)`,
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := touchImageOwner(tx, img.ProductID, img.VariantID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.invalidateProduct(img.ProductID)
+	return img, nil
+}
+
+// PrimaryProductImages returns the primary product-level image of each of the
+// given products that has one, keyed by product ID.
+func (s *Store) PrimaryProductImages(productIDs []int) (map[int]dbImage, error) {
+	images := make(map[int]dbImage)
+	if len(productIDs) == 0 {
+		return images, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(productIDs)), ", ")
+	args := make([]interface{}, len(productIDs))
+	for i, id := range productIDs {
+		args[i] = id
+	}
+	rows, err := s.db.Query(
+		`SELECT `+imageColumns+` FROM product_images
+		 WHERE is_primary = 1 AND variant_id IS NULL AND product_id IN (`+placeholders+`)`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("primary images: %w", err)
+	}
+	defer rows.Close()
+
+	list, err := scanImages(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range list {
+		images[img.ProductID] = img
+	}
+	return images, nil
+}
+
+// PrimaryVariantImages returns the primary image of each variant of a product
+// that has one, keyed by variant ID.
+func (s *Store) PrimaryVariantImages(productID int) (map[int]dbImage, error) {
+	rows, err := s.db.Query(
+		`SELECT `+imageColumns+` FROM product_images
+		 WHERE is_primary = 1 AND product_id = ? AND variant_id IS NOT NULL`,
+		productID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("primary variant images: %w", err)
+	}
+	defer rows.Close()
+
+	list, err := scanImages(rows)
+	if err != nil {
+		return nil, err
+	}
+	images := make(map[int]dbImage, len(list))
+	for _, img := range list {
+		images[*img.VariantID] = img
+	}
+	return images, nil
+}
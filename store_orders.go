@@ -0,0 +1,405 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	errNotFound          = errors.New("not found")
+	errInsufficientStock = errors.New("insufficient stock")
+	errInvalidTransition = errors.New("invalid status transition")
+	errVersionConflict   = errors.New("modified by another request")
+	errMixedCurrencies   = errors.New("mixed currencies")
+)
+
+// orderTransitions lists the statuses each order status may move to.
+var orderTransitions = map[string][]string{
+	OrderReserved:  {OrderConfirmed, OrderCancelled, OrderExpired},
+	OrderConfirmed: {OrderCancelled},
+}
+
+// reservedLine is the catalog snapshot taken when a line's stock is reserved.
+type reservedLine struct {
+	name           string
+	sku            string
+	unitPriceCents int
+	currency       string
+	remaining      int
+}
+
+// reserveProductStock atomically takes quantity units of a product's stock.
+// It returns errInsufficientStock when fewer units are available, leaving the
+// stock untouched.
+func reserveProductStock(tx sqlExecutor, productID, quantity int, now time.Time) (reservedLine, error) {
+	var line reservedLine
+	err := tx.QueryRow(
+		`UPDATE products
+		 SET quantity = quantity - ?, in_stock = (quantity - ?) > 0, updated_at = ?
+		 WHERE id = ? AND deleted_at IS NULL AND quantity >= ?
+		 RETURNING name, price_cents, currency, quantity`,
+		quantity, quantity, now, productID, quantity,
+	).Scan(&line.name, &line.unitPriceCents, &line.currency, &line.remaining)
+	if err == sql.ErrNoRows {
+		var exists bool
+		if err := tx.QueryRow(`SELECT 1 FROM products WHERE id = ? AND deleted_at IS NULL`, productID).Scan(&exists); err == sql.ErrNoRows {
+			return line, fmt.Errorf("product %d: %w", productID, errNotFound)
+		}
+		return line, fmt.Errorf("product %d: %w", productID, errInsufficientStock)
+	}
+	return line, err
+}
+
+// reserveVariantStock atomically takes quantity units of a variant's stock.
+// A variant without its own price is charged at its product's price.
+func reserveVariantStock(tx sqlExecutor, productID, variantID, quantity int, now time.Time) (reservedLine, error) {
+	var line reservedLine
+	err := tx.QueryRow(
+		`UPDATE variants
+		 SET quantity = quantity - ?, in_stock = (quantity - ?) > 0, updated_at = ?
+		 WHERE id = ? AND product_id = ? AND quantity >= ? AND `+liveProductFilter+`
+		 RETURNING name, sku, price_cents, currency, quantity`,
+		quantity, quantity, now, variantID, productID, quantity,
+	).Scan(&line.name, &line.sku, &line.unitPriceCents, &line.currency, &line.remaining)
+	if err == sql.ErrNoRows {
+		var exists bool
+		if err := tx.QueryRow(`SELECT 1 FROM variants WHERE id = ? AND product_id = ? AND `+liveProductFilter, variantID, productID).Scan(&exists); err == sql.ErrNoRows {
+			return line, fmt.Errorf("variant %d: %w", variantID, errNotFound)
+		}
+		return line, fmt.Errorf("variant %d: %w", variantID, errInsufficientStock)
+	}
+	if err != nil {
+		return line, err
+	}
+
+	if line.unitPriceCents == 0 {
+		err = tx.QueryRow(`SELECT price_cents FROM products WHERE id = ?`, productID).Scan(&line.unitPriceCents)
+	}
+	return line, err
+}
+
+// releaseStock returns an order line's units to the product or variant it came from.
+func releaseStock(tx sqlExecutor, line dbOrderLine, now time.Time) error {
+	var err error
+	switch {
+	case line.VariantID != nil:
+		_, err = tx.Exec(
+			`UPDATE variants SET quantity = quantity + ?, in_stock = (quantity + ?) > 0, updated_at = ? WHERE id = ?`,
+			line.Quantity, line.Quantity, now, *line.VariantID,
+		)
+	case line.ProductID != nil:
+		_, err = tx.Exec(
+			`UPDATE products SET quantity = quantity + ?, in_stock = (quantity + ?) > 0, updated_at = ? WHERE id = ?`,
+			line.Quantity, line.Quantity, now, *line.ProductID,
+		)
+	}
+	return err
+}
+
+// CreateOrder reserves stock for every line in a single transaction. If any
+// line cannot be reserved, nothing is reserved and the error is returned. The
+// order is charged in the currency its lines are priced in; lines priced in
+// different currencies are rejected with errMixedCurrencies.
+func (s *Store) CreateOrder(customer, client string, lines []OrderLineRequest, ttl time.Duration) (int, error) {
+	if len(lines) == 0 {
+		return 0, fmt.Errorf("order must have at least one line")
+	}
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(ttl)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`INSERT INTO orders (status, customer, client, expires_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		OrderReserved, customer, client, expiresAt, now, now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("insert order: %w", err)
+	}
+	orderID64, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	orderID := int(orderID64)
+
+	total, currency := 0, ""
+	touched := make(map[int]bool)
+	for i, l := range lines {
+		if l.Quantity <= 0 {
+			return 0, fmt.Errorf("line quantity must be positive")
+		}
+
+		var reserved reservedLine
+		if l.VariantID != nil {
+			reserved, err = reserveVariantStock(tx, l.ProductID, *l.VariantID, l.Quantity, now)
+		} else {
+			reserved, err = reserveProductStock(tx, l.ProductID, l.Quantity, now)
+			touched[l.ProductID] = true
+		}
+		if err != nil {
+			return 0, err
+		}
+		if currency == "" {
+			currency = reserved.currency
+		} else if reserved.currency != currency {
+			return 0, fmt.Errorf("line %d is priced in %s, not %s: %w", i, reserved.currency, currency, errMixedCurrencies)
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO order_lines (order_id, product_id, variant_id, sku, name, quantity, unit_price_cents)
+			 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			orderID, l.ProductID, l.VariantID, reserved.sku, reserved.name, l.Quantity, reserved.unitPriceCents,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("insert order line: %w", err)
+		}
+		total += reserved.unitPriceCents * l.Quantity
+	}
+
+	if _, err := tx.Exec(`UPDATE orders SET total_cents = ?, currency = ? WHERE id = ?`, total, currency, orderID); err != nil {
+		return 0, err
+	}
+	if err := insertOrderHistory(tx, orderID, "", OrderReserved, "", client, now); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for id := range touched {
+		s.invalidateProduct(id)
+	}
+	return orderID, nil
+}
+
+func insertOrderHistory(tx sqlExecutor, orderID int, from, to, reason, actor string, now time.Time) error {
+	_, err := tx.Exec(
+		`INSERT INTO order_status_history (order_id, from_status, to_status, reason, actor, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		orderID, from, to, reason, actor, now,
+	)
+	return err
+}
+
+// GetOrder returns an order with its lines and status history.
+func (s *Store) GetOrder(id int) (*dbOrder, error) {
+	o, err := getOrder(s.db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(
+		`SELECT from_status, to_status, reason, actor, created_at
+		 FROM order_status_history WHERE order_id = ? ORDER BY id`,
+		id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("order history: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h OrderStatusChange
+		if err := rows.Scan(&h.FromStatus, &h.ToStatus, &h.Reason, &h.Actor, &h.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan order history: %w", err)
+		}
+		o.History = append(o.History, h)
+	}
+	return o, rows.Err()
+}
+
+// getOrder loads an order and its lines.
+func getOrder(q sqlExecutor, id int) (*dbOrder, error) {
+	var o dbOrder
+	err := q.QueryRow(
+		`SELECT id, status, customer, client, total_cents, currency, expires_at, created_at, updated_at
+		 FROM orders WHERE id = ?`,
+		id,
+	).Scan(&o.ID, &o.Status, &o.Customer, &o.Client, &o.TotalCents, &o.Currency, &o.ExpiresAt, &o.CreatedAt, &o.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("order %d: %w", id, errNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(
+		`SELECT id, order_id, product_id, variant_id, sku, name, quantity, unit_price_cents
+		 FROM order_lines WHERE order_id = ? ORDER BY id`,
+		id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("order lines: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l dbOrderLine
+		err := rows.Scan(&l.ID, &l.OrderID, &l.ProductID, &l.VariantID, &l.SKU, &l.Name, &l.Quantity, &l.UnitPriceCents)
+		if err != nil {
+			return nil, fmt.Errorf("scan order line: %w", err)
+		}
+		o.Lines = append(o.Lines, l)
+	}
+	return &o, rows.Err()
+}
+
+// ListOrders returns the most recent orders, optionally filtered by status.
+// Lines and history are not loaded.
+func (s *Store) ListOrders(status string, limit int) ([]dbOrder, error) {
+	rows, err := s.db.Query(
+		`SELECT id, status, customer, client, total_cents, currency, expires_at, created_at, updated_at
+		 FROM orders WHERE (? = '' OR status = ?)
+		 ORDER BY created_at DESC, id DESC LIMIT ?`,
+		status, status, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list orders: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []dbOrder
+	for rows.Next() {
+		var o dbOrder
+		err := rows.Scan(&o.ID, &o.Status, &o.Customer, &o.Client, &o.TotalCents, &o.Currency, &o.ExpiresAt, &o.CreatedAt, &o.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("scan order: %w", err)
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+// TransitionOrder moves an order to a new status, recording the change in its
+// history. Cancelling or expiring an order returns its reserved stock. A
+// reservation that has already lapsed cannot be confirmed; it is expired
+// instead and errInvalidTransition is returned. Of concurrent transitions
+// from the same status only the first applies; the rest also get
+// errInvalidTransition.
+func (s *Store) TransitionOrder(id int, to, reason, actor string) error {
+	now := time.Now().UTC()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	o, err := getOrder(tx, id)
+	if err != nil {
+		return err
+	}
+
+	lapsed := o.Status == OrderReserved && o.ExpiresAt != nil && !now.Before(*o.ExpiresAt)
+	if lapsed && to == OrderConfirmed {
+		if err := s.applyTransition(tx, o, OrderExpired, "reservation expired", "system", now); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		s.invalidateOrderProducts(o)
+		return fmt.Errorf("order %d reservation has expired: %w", id, errInvalidTransition)
+	}
+
+	if err := s.applyTransition(tx, o, to, reason, actor, now); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.invalidateOrderProducts(o)
+	return nil
+}
+
+func (s *Store) applyTransition(tx *sql.Tx, o *dbOrder, to, reason, actor string, now time.Time) error {
+	allowed := false
+	for _, next := range orderTransitions[o.Status] {
+		if next == to {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("order %d is %s and cannot become %s: %w", o.ID, o.Status, to, errInvalidTransition)
+	}
+
+	// The status guard keeps a transition from applying twice should another
+	// one have committed since o was read.
+	result, err := tx.Exec(
+		`UPDATE orders SET status = ?, expires_at = NULL, updated_at = ? WHERE id = ? AND status = ?`,
+		to, now, o.ID, o.Status,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("order %d is no longer %s: %w", o.ID, o.Status, errInvalidTransition)
+	}
+
+	if to == OrderCancelled || to == OrderExpired {
+		for _, line := range o.Lines {
+			if err := releaseStock(tx, line, now); err != nil {
+				return fmt.Errorf("release stock: %w", err)
+			}
+		}
+	}
+	return insertOrderHistory(tx, o.ID, o.Status, to, reason, actor, now)
+}
+
+func (s *Store) invalidateOrderProducts(o *dbOrder) {
+	for _, line := range o.Lines {
+		if line.ProductID != nil && line.VariantID == nil {
+			s.invalidateProduct(*line.ProductID)
+		}
+	}
+}
+
+// ExpireReservations expires every reserved order whose reservation has
+// lapsed, releasing its stock. It returns the number of orders expired.
+func (s *Store) ExpireReservations(now time.Time) (int, error) {
+	rows, err := s.db.Query(
+		`SELECT id FROM orders WHERE status = ? AND expires_at <= ?`,
+		OrderReserved, now.UTC(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("find expired reservations: %w", err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, id := range ids {
+		err := s.TransitionOrder(id, OrderExpired, "reservation expired", "system")
+		if errors.Is(err, errInvalidTransition) {
+			// Confirmed or cancelled since the query ran.
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var errScheduleOverlap = errors.New("overlaps another price schedule")
+
+const priceScheduleColumns = `id, product_id, variant_id, price_cents, starts_at, ends_at, status, previous_price_cents, note, created_by, created_at, updated_at`
+
+func scanPriceSchedule(row interface{ Scan(...interface{}) error }) (*dbPriceSchedule, error) {
+	var ps dbPriceSchedule
+	err := row.Scan(&ps.ID, &ps.ProductID, &ps.VariantID, &ps.PriceCents, &ps.StartsAt, &ps.EndsAt,
+		&ps.Status, &ps.PreviousPriceCents, &ps.Note, &ps.CreatedBy, &ps.CreatedAt, &ps.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &ps, nil
+}
+
+func queryPriceSchedules(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, where string, args ...interface{}) ([]dbPriceSchedule, error) {
+	rows, err := q.Query(`SELECT `+priceScheduleColumns+` FROM price_schedules WHERE `+where+` ORDER BY starts_at, id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list price schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []dbPriceSchedule
+	for rows.Next() {
+		ps, err := scanPriceSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan price schedule: %w", err)
+		}
+		schedules = append(schedules, *ps)
+	}
+	return schedules, rows.Err()
+}
+
+// until returns the end of the period a schedule holds its price for the
+// purpose of overlap checks. A permanent change occupies only its start.
+func (ps *dbPriceSchedule) until() time.Time {
+	if ps.EndsAt == nil {
+		return ps.StartsAt
+	}
+	return *ps.EndsAt
+}
+
+// overlaps reports whether two schedules would hold their prices at the same
+// time. A sale may start exactly when another ends.
+func (ps *dbPriceSchedule) overlaps(other *dbPriceSchedule) bool {
+	if ps.StartsAt.Equal(other.StartsAt) {
+		return true
+	}
+	return ps.StartsAt.Before(other.until()) && other.StartsAt.Before(ps.until())
+}
+
+// ListPriceHistory returns the recorded prices of a product and its variants,
+// or of one variant when variantID is set, grouped by owner and oldest first.
+func (s *Store) ListPriceHistory(productID int, variantID *int) ([]dbPriceChange, error) {
+	where, args := `product_id = ?`, []interface{}{productID}
+	if variantID != nil {
+		where, args = `product_id = ? AND variant_id = ?`, []interface{}{productID, *variantID}
+	}
+	rows, err := s.db.Query(
+		`SELECT id, product_id, variant_id, old_price_cents, price_cents, schedule_id, changed_at
+		 FROM price_history WHERE `+where+`
+		 ORDER BY variant_id IS NOT NULL, variant_id, id`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list price history: %w", err)
+	}
+	defer rows.Close()
+
+	var changes []dbPriceChange
+	for rows.Next() {
+		var c dbPriceChange
+		if err := rows.Scan(&c.ID, &c.ProductID, &c.VariantID, &c.OldPriceCents, &c.PriceCents, &c.ScheduleID, &c.ChangedAt); err != nil {
+			return nil, fmt.Errorf("scan price change: %w", err)
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// ListPriceSchedules returns the schedules of a product, optionally limited
+// to one variant and to the given statuses, in start order.
+func (s *Store) ListPriceSchedules(productID int, variantID *int, statuses ...string) ([]dbPriceSchedule, error) {
+	where, args := `product_id = ?`, []interface{}{productID}
+	if variantID != nil {
+		where += ` AND variant_id = ?`
+		args = append(args, *variantID)
+	}
+	if len(statuses) > 0 {
+		where += ` AND status IN (?` + strings.Repeat(`, ?`, len(statuses)-1) + `)`
+		for _, st := range statuses {
+			args = append(args, st)
+		}
+	}
+	return queryPriceSchedules(s.db, where, args...)
+}
+
+// GetPriceSchedule returns a schedule by ID, or errNotFound.
+func (s *Store) GetPriceSchedule(id int) (*dbPriceSchedule, error) {
+	ps, err := scanPriceSchedule(s.db.QueryRow(`SELECT `+priceScheduleColumns+` FROM price_schedules WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	return ps, err
+}
+
+// CreatePriceSchedule records a future price change. It returns
+// errScheduleOverlap if the change would overlap a pending or active schedule
+// for the same product or variant. The check and the insert share one
+// IMMEDIATE transaction, so concurrent requests cannot both pass it.
+func (s *Store) CreatePriceSchedule(ps dbPriceSchedule) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	scope, args := `product_id = ? AND variant_id IS NULL`, []interface{}{ps.ProductID}
+	if ps.VariantID != nil {
+		scope, args = `product_id = ? AND variant_id = ?`, []interface{}{ps.ProductID, *ps.VariantID}
+	}
+	existing, err := queryPriceSchedules(tx, scope+` AND status IN (?, ?)`, append(args, ScheduleScheduled, ScheduleActive)...)
+	if err != nil {
+		return 0, err
+	}
+	for i := range existing {
+		if ps.overlaps(&existing[i]) {
+			return 0, fmt.Errorf("schedule %d: %w", existing[i].ID, errScheduleOverlap)
+		}
+	}
+
+	now := time.Now().UTC()
+	var endsAt *time.Time
+	if ps.EndsAt != nil {
+		t := ps.EndsAt.UTC()
+		endsAt = &t
+	}
+	result, err := tx.Exec(
+		`INSERT INTO price_schedules (product_id, variant_id, price_cents, starts_at, ends_at, status, note, created_by, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ps.ProductID, ps.VariantID, ps.PriceCents, ps.StartsAt.UTC(), endsAt, ScheduleScheduled,
+		ps.Note, ps.CreatedBy, now, now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("insert price schedule: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+// priceScheduleRun describes what happened to one schedule when it was run
+// or cancelled: the schedule, its new status, and the price change made, if
+// any. Err is set when running the schedule failed.
+type priceScheduleRun struct {
+	Schedule      dbPriceSchedule
+	Status        string
+	PriceChanged  bool
+	OldPriceCents int
+	NewPriceCents int
+	Err           error
+}
+
+// CancelPriceSchedule cancels a schedule that has not finished. Cancelling an
+// active sale reverts the price at once, unless it has been changed since the
+// sale started. It returns errInvalidTransition for finished schedules.
+func (s *Store) CancelPriceSchedule(id int) (*priceScheduleRun, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ps, err := scanPriceSchedule(tx.QueryRow(`SELECT `+priceScheduleColumns+` FROM price_schedules WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	run := &priceScheduleRun{Schedule: *ps, Status: ScheduleCancelled}
+	switch ps.Status {
+	case ScheduleScheduled:
+	case ScheduleActive:
+		if err := revertSale(tx, run, time.Now().UTC()); err != nil && err != errNotFound {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("schedule %d is %s and cannot be cancelled: %w", ps.ID, ps.Status, errInvalidTransition)
+	}
+
+	if err := setScheduleStatus(tx, run, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.invalidateProduct(ps.ProductID)
+	return run, nil
+}
+
+// RunPriceSchedules ends the sales whose end has passed and then applies the
+// schedules whose start has passed, in that order so that a sale may follow
+// another back to back. Each schedule is handled in its own transaction, and
+// one that fails is marked failed and reported in its run's Err without
+// holding up the rest. The error is only for failing to list due schedules.
+func (s *Store) RunPriceSchedules(now time.Time) ([]priceScheduleRun, error) {
+	now = now.UTC()
+	ending, err := queryPriceSchedules(s.db, `status = ? AND ends_at <= ?`, ScheduleActive, now)
+	if err != nil {
+		return nil, err
+	}
+	starting, err := queryPriceSchedules(s.db, `status = ? AND starts_at <= ?`, ScheduleScheduled, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []priceScheduleRun
+	for _, ps := range ending {
+		runs = append(runs, s.runDuePriceSchedule(ps, now, endSale))
+	}
+	for _, ps := range starting {
+		runs = append(runs, s.runDuePriceSchedule(ps, now, startSchedule))
+	}
+	return runs, nil
+}
+
+// runDuePriceSchedule runs one due schedule. If that fails, the schedule is
+// marked failed so that later runs do not retry it forever; if even that
+// fails, the run keeps the schedule's status and is retried next time.
+func (s *Store) runDuePriceSchedule(ps dbPriceSchedule, now time.Time, step func(*sql.Tx, *priceScheduleRun, time.Time) error) priceScheduleRun {
+	run, err := s.runPriceSchedule(ps, now, step)
+	if err == nil {
+		return *run
+	}
+	failed := priceScheduleRun{Schedule: ps, Status: ScheduleFailed, Err: err}
+	_, markErr := s.db.Exec(
+		`UPDATE price_schedules SET status = ?, updated_at = ? WHERE id = ? AND status = ?`,
+		ScheduleFailed, now, ps.ID, ps.Status,
+	)
+	if markErr != nil {
+		failed.Status = ps.Status
+		failed.Err = fmt.Errorf("%w; marking it failed: %v", err, markErr)
+	}
+	return failed
+}
+
+// runPriceSchedule applies step to one schedule in a transaction, checking
+// first that no one else has moved it on since it was listed.
+func (s *Store) runPriceSchedule(ps dbPriceSchedule, now time.Time, step func(*sql.Tx, *priceScheduleRun, time.Time) error) (*priceScheduleRun, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := scanPriceSchedule(tx.QueryRow(`SELECT `+priceScheduleColumns+` FROM price_schedules WHERE id = ?`, ps.ID))
+	if err != nil {
+		return nil, err
+	}
+	run := &priceScheduleRun{Schedule: *current, Status: current.Status}
+	if current.Status != ps.Status {
+		return run, nil
+	}
+	if err := step(tx, run, now); err != nil {
+		return nil, err
+	}
+	if err := setScheduleStatus(tx, run, now); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.invalidateProduct(ps.ProductID)
+	return run, nil
+}
+
+// startSchedule applies a due schedule. A sale whose whole window has already
+// passed, for instance while the server was down, is completed without
+// touching the price; a schedule whose product or variant is gone is cancelled.
+func startSchedule(tx *sql.Tx, run *priceScheduleRun, now time.Time) error {
+	ps := &run.Schedule
+	if ps.EndsAt != nil && !ps.EndsAt.After(now) {
+		run.Status = ScheduleCompleted
+		return nil
+	}
+
+	old, err := currentPrice(tx, ps.ProductID, ps.VariantID)
+	if err == errNotFound {
+		run.Status = ScheduleCancelled
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := setScheduledPrice(tx, ps, ps.PriceCents, now); err != nil {
+		return err
+	}
+	ps.PreviousPriceCents = &old
+	run.PriceChanged, run.OldPriceCents, run.NewPriceCents = old != ps.PriceCents, old, ps.PriceCents
+	run.Status = ScheduleCompleted
+	if ps.EndsAt != nil {
+		run.Status = ScheduleActive
+	}
+	return nil
+}
+
+// endSale completes an active sale, reverting its price.
+func endSale(tx *sql.Tx, run *priceScheduleRun, now time.Time) error {
+	run.Status = ScheduleCompleted
+	if err := revertSale(tx, run, now); err != nil && err != errNotFound {
+		return err
+	}
+	return nil
+}
+
+// revertSale restores the price an active sale replaced. If the price has
+// been changed by hand since the sale started, that change is kept.
+func revertSale(tx *sql.Tx, run *priceScheduleRun, now time.Time) error {
+	ps := &run.Schedule
+	if ps.PreviousPriceCents == nil {
+		return nil
+	}
+	price, err := currentPrice(tx, ps.ProductID, ps.VariantID)
+	if err != nil {
+		return err
+	}
+	if price != ps.PriceCents {
+		return nil
+	}
+	if err := setScheduledPrice(tx, ps, *ps.PreviousPriceCents, now); err != nil {
+		return err
+	}
+	run.PriceChanged, run.OldPriceCents, run.NewPriceCents = price != *ps.PreviousPriceCents, price, *ps.PreviousPriceCents
+	return nil
+}
+
+// currentPrice returns the price of a live product or of one of its
+// variants, or errNotFound.
+func currentPrice(tx *sql.Tx, productID int, variantID *int) (int, error) {
+	var price int
+	var err error
+	if variantID == nil {
+		err = tx.QueryRow(`SELECT price_cents FROM products WHERE id = ? AND deleted_at IS NULL`, productID).Scan(&price)
+	} else {
+		err = tx.QueryRow(
+			`SELECT v.price_cents FROM variants v JOIN products p ON p.id = v.product_id
+			 WHERE v.id = ? AND v.product_id = ? AND p.deleted_at IS NULL`,
+			*variantID, productID,
+		).Scan(&price)
+	}
+	if err == sql.ErrNoRows {
+		return 0, errNotFound
+	}
+	return price, err
+}
+
+// setScheduledPrice changes the price a schedule targets and tags the price
+// history rows the change records with the schedule's ID.
+func setScheduledPrice(tx *sql.Tx, ps *dbPriceSchedule, priceCents int, now time.Time) error {
+	var lastID int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM price_history`).Scan(&lastID); err != nil {
+		return err
+	}
+
+	var err error
+	if ps.VariantID == nil {
+		_, err = tx.Exec(`UPDATE products SET price_cents = ?, updated_at = ? WHERE id = ?`, priceCents, now, ps.ProductID)
+	} else {
+		_, err = tx.Exec(`UPDATE variants SET price_cents = ?, updated_at = ? WHERE id = ?`, priceCents, now, *ps.VariantID)
+	}
+	if err != nil {
+		return fmt.Errorf("set price: %w", err)
+	}
+	_, err = tx.Exec(`UPDATE price_history SET schedule_id = ? WHERE id > ?`, ps.ID, lastID)
+	return err
+}
+
+func setScheduleStatus(tx *sql.Tx, run *priceScheduleRun, now time.Time) error {
+	_, err := tx.Exec(
+		`UPDATE price_schedules SET status = ?, previous_price_cents = ?, updated_at = ? WHERE id = ?`,
+		run.Status, run.Schedule.PreviousPriceCents, now, run.Schedule.ID,
+	)
+	return err
+}
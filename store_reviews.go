@@ -1,47 +1,98 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 )
 
-// CreateReviewTable creates the reviews table if it doesn't exist.
-func createReviewTable(s *Store) error {
-	_, err := s.db.Exec(`
-		CREATE TABLE IF NOT EXISTS reviews (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			product_id INTEGER NOT NULL,
-			author TEXT NOT NULL,
-			rating INTEGER NOT NULL CHECK(rating >= 1 AND rating <= 5),
-			comment TEXT DEFAULT '',
-			approved BOOLEAN DEFAULT 0,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (product_id) REFERENCES products(id)
-		)
-	`)
-	return err
-}
-
-// CreateReview inserts a new review for a product.
-func (s *Store) CreateReview(productID int, author string, rating int, comment string) (int, error) {
-	if author == "" {
+// reviewTransitions lists the moderation statuses each review status may
+// move to. Rejected reviews can be reconsidered and approved.
+var reviewTransitions = map[string][]string{
+	ReviewPending:  {ReviewApproved, ReviewRejected, ReviewFlagged},
+	ReviewApproved: {ReviewRejected, ReviewFlagged},
+	ReviewFlagged:  {ReviewApproved, ReviewRejected},
+	ReviewRejected: {ReviewApproved},
+}
+
+const reviewColumns = `id, product_id, author, rating, comment, status, moderation_reason, moderated_by, moderated_at, client, spam_score,
+	helpful_votes, unhelpful_votes, verified_purchase, reply, reply_by, replied_at, created_at`
+
+func scanReview(row interface{ Scan(...interface{}) error }) (*dbReview, error) {
+	var r dbReview
+	err := row.Scan(&r.ID, &r.ProductID, &r.Author, &r.Rating, &r.Comment,
+		&r.Status, &r.ModerationReason, &r.ModeratedBy, &r.ModeratedAt, &r.Client, &r.SpamScore,
+		&r.HelpfulVotes, &r.UnhelpfulVotes, &r.VerifiedPurchase, &r.Reply, &r.ReplyBy, &r.RepliedAt, &r.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func scanReviews(rows *sql.Rows) ([]dbReview, error) {
+	var reviews []dbReview
+	for rows.Next() {
+		r, err := scanReview(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan review: %w", err)
+		}
+		reviews = append(reviews, *r)
+	}
+	return reviews, rows.Err()
+}
+
+// CreateReview inserts a new review for a product in the moderation status
+// screening gave it (pending if unset). It is marked as a verified purchase
+// when buyer, the client identity of the authenticated API key posting it (""
+// for anonymous callers), placed a confirmed order that included the product.
+// It returns errNotFound if the product does not exist or is deleted.
+//
+// screen, if not nil, runs just before the insert in the same transaction,
+// which holds the write lock from its start, and may set the review's
+// moderation fields; an error from it is returned and nothing is inserted. Screening
+// there means concurrent submissions cannot all pass a limit that only one
+// of them should.
+func (s *Store) CreateReview(r dbReview, buyer string, screen func(q sqlExecutor, r *dbReview) error) (int, error) {
+	if r.Author == "" {
 		return 0, fmt.Errorf("author is required")
 	}
-	if rating < 1 || rating > 5 {
+	if r.Rating < 1 || r.Rating > 5 {
 		return 0, fmt.Errorf("rating must be between 1 and 5")
 	}
 
 	// Verify product exists and is not deleted.
-	_, err := s.GetProduct(productID)
+	_, err := s.GetProduct(r.ProductID)
 	if err != nil {
-		return 0, fmt.Errorf("product not found")
+		return 0, errNotFound
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if screen != nil {
+		if err := screen(tx, &r); err != nil {
+			return 0, err
+		}
+	}
+	if r.Status == "" {
+		r.Status = ReviewPending
 	}
 
 	now := time.Now().UTC()
-	result, err := s.db.Exec(
-		`INSERT INTO reviews (product_id, author, rating, comment, approved, created_at)
-		 VALUES (?, ?, ?, ?, ?, ?)`,
-		productID, author, rating, comment, false, now,
+	result, err := tx.Exec(
+		`INSERT INTO reviews (product_id, author, rating, comment, approved, status, moderation_reason, moderated_by, moderated_at,
+		                      client, spam_score, comment_fingerprint, verified_purchase, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+		         ? <> '' AND EXISTS (SELECT 1 FROM orders o JOIN order_lines l ON l.order_id = o.id
+		                             WHERE o.status = ? AND l.product_id = ? AND o.client = ?),
+		         ?)`,
+		r.ProductID, r.Author, r.Rating, r.Comment, r.Status == ReviewApproved, r.Status, r.ModerationReason, r.ModeratedBy, r.ModeratedAt,
+		r.Client, r.SpamScore, commentFingerprint(r.Comment), buyer, OrderConfirmed, r.ProductID, buyer, now,
 	)
 	if err != nil {
 		return 0, fmt.Errorf("insert review: %w", err)
@@ -51,50 +102,169 @@ func (s *Store) CreateReview(productID int, author string, rating int, comment s
 	if err != nil {
 		return 0, err
 	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
 	return int(id), nil
 }
 
-// ListReviews returns all reviews for a product.
-func (s *Store) ListReviews(productID int) ([]dbReview, error) {
-	rows, err := s.db.Query(
-		`SELECT id, product_id, author, rating, comment, approved, created_at
-		 FROM reviews WHERE product_id = ? ORDER BY created_at DESC`,
-		productID,
-	)
+// reviewSortColumns maps the public sort keys accepted by QueryReviews to columns.
+var reviewSortColumns = map[string]string{
+	"created_at": "created_at",
+	"helpful":    "helpful_votes",
+	"rating":     "rating",
+}
+
+// ReviewQuery selects a page of a product's reviews. An empty Status matches
+// every moderation status.
+type ReviewQuery struct {
+	ProductID  int
+	Status     string
+	MinRating  *int
+	MaxRating  *int
+	Since      *time.Time
+	Until      *time.Time
+	HasComment *bool
+	Sort       string
+	Desc       bool
+	Limit      int
+	After      *pageCursor
+}
+
+// QueryReviews returns one page of a product's reviews matching q, the cursor
+// for the following page (nil on the last page) and the total number of
+// matches. Reviews are ordered by q.Sort, a key of reviewSortColumns, with
+// ties going to the newest review. Reviews of a soft-deleted product are
+// hidden until the product is restored.
+func (s *Store) QueryReviews(q ReviewQuery) ([]dbReview, *pageCursor, int, error) {
+	sortCol, ok := reviewSortColumns[q.Sort]
+	if !ok {
+		return nil, nil, 0, fmt.Errorf("unsupported sort field %q", q.Sort)
+	}
+
+	where := []string{"product_id = ?", liveProductFilter}
+	args := []interface{}{q.ProductID}
+	if q.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, q.Status)
+	}
+	if q.MinRating != nil {
+		where = append(where, "rating >= ?")
+		args = append(args, *q.MinRating)
+	}
+	if q.MaxRating != nil {
+		where = append(where, "rating <= ?")
+		args = append(args, *q.MaxRating)
+	}
+	if q.Since != nil {
+		where = append(where, "created_at >= ?")
+		args = append(args, q.Since.UTC())
+	}
+	if q.Until != nil {
+		where = append(where, "created_at < ?")
+		args = append(args, q.Until.UTC())
+	}
+	if q.HasComment != nil {
+		if *q.HasComment {
+			where = append(where, "trim(comment) != ''")
+		} else {
+			where = append(where, "trim(comment) = ''")
+		}
+	}
+
+	var total int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM reviews WHERE `+strings.Join(where, " AND "), args...).Scan(&total)
 	if err != nil {
-		return nil, fmt.Errorf("list reviews: %w", err)
+		return nil, nil, 0, fmt.Errorf("count reviews: %w", err)
 	}
-	defer rows.Close()
 
-	var reviews []dbReview
-	for rows.Next() {
-		var r dbReview
-		err := rows.Scan(&r.ID, &r.ProductID, &r.Author, &r.Rating, &r.Comment, &r.Approved, &r.CreatedAt)
+	cmp, dir := ">", "ASC"
+	if q.Desc {
+		cmp, dir = "<", "DESC"
+	}
+
+	pageWhere := where
+	pageArgs := append([]interface{}{}, args...)
+	if q.After != nil {
+		if q.After.Sort != q.Sort || q.After.Desc != q.Desc {
+			return nil, nil, 0, fmt.Errorf("cursor does not match the requested sort")
+		}
+		value, err := reviewCursorValue(q.Sort, q.After.Value)
 		if err != nil {
-			return nil, fmt.Errorf("scan review: %w", err)
+			return nil, nil, 0, err
 		}
-		reviews = append(reviews, r)
+		pageWhere = append(pageWhere, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id < ?))", sortCol, cmp))
+		pageArgs = append(pageArgs, value, value, q.After.ID)
 	}
-	return reviews, rows.Err()
+
+	query := `SELECT ` + reviewColumns + ` FROM reviews WHERE ` + strings.Join(pageWhere, " AND ") +
+		fmt.Sprintf(" ORDER BY %s %s, id DESC LIMIT ?", sortCol, dir)
+	pageArgs = append(pageArgs, q.Limit+1)
+
+	rows, err := s.db.Query(query, pageArgs...)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("query reviews: %w", err)
+	}
+	defer rows.Close()
+
+	reviews, err := scanReviews(rows)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var next *pageCursor
+	if len(reviews) > q.Limit {
+		reviews = reviews[:q.Limit]
+		last := reviews[len(reviews)-1]
+		value, _ := json.Marshal(reviewSortValue(&last, q.Sort))
+		next = &pageCursor{Sort: q.Sort, Desc: q.Desc, Value: value, ID: last.ID}
+	}
+
+	return reviews, next, total, nil
+}
+
+// reviewSortValue returns the value of r's sort key as stored in a cursor.
+func reviewSortValue(r *dbReview, sort string) interface{} {
+	switch sort {
+	case "helpful":
+		return r.HelpfulVotes
+	case "rating":
+		return r.Rating
+	default:
+		return r.CreatedAt.UTC()
+	}
+}
+
+// reviewCursorValue decodes a cursor value into the type its sort column holds.
+func reviewCursorValue(sort string, raw json.RawMessage) (interface{}, error) {
+	switch sort {
+	case "helpful", "rating":
+		var v int
+		if err := json.Unmarshal(raw, &v); err == nil {
+			return v, nil
+		}
+	default:
+		var v time.Time
+		if err := json.Unmarshal(raw, &v); err == nil {
+			return v.UTC(), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid cursor")
 }
 
-// GetReview returns a single review by ID.
+// GetReview returns a single review by ID, whatever its moderation status, or
+// sql.ErrNoRows if it does not exist or its product is soft-deleted.
 func (s *Store) GetReview(reviewID int) (*dbReview, error) {
-	var r dbReview
-	err := s.db.QueryRow(
-		`SELECT id, product_id, author, rating, comment, approved, created_at
-		 FROM reviews WHERE id = ?`,
+	return scanReview(s.db.QueryRow(
+		`SELECT `+reviewColumns+`
+		 FROM reviews WHERE id = ? AND `+liveProductFilter,
 		reviewID,
-	).Scan(&r.ID, &r.ProductID, &r.Author, &r.Rating, &r.Comment, &r.Approved, &r.CreatedAt)
-	if err != nil {
-		return nil, err
-	}
-	return &r, nil
+	))
 }
 
 // DeleteReview removes a review by ID.
 func (s *Store) DeleteReview(reviewID int) error {
-	result, err := s.db.Exec(`DELETE FROM reviews WHERE id = ?`, reviewID)
+	result, err := s.db.Exec(`DELETE FROM reviews WHERE id = ? AND `+liveProductFilter, reviewID)
 	if err != nil {
 		return err
 	}
@@ -108,29 +278,56 @@ func (s *Store) DeleteReview(reviewID int) error {
 	return nil
 }
 
-// ApproveReview marks a review as approved.
-func (s *Store) ApproveReview(reviewID int) error {
-	result, err := s.db.Exec(`UPDATE reviews SET approved = 1 WHERE id = ?`, reviewID)
+// ModerateReview moves a review to a new moderation status, recording the
+// reason and the moderator. It returns errNotFound if the review does not
+// exist or belongs to a soft-deleted product, and errInvalidTransition if its
+// current status does not allow the change.
+func (s *Store) ModerateReview(reviewID int, to, reason, moderator string) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
-	rows, err := result.RowsAffected()
+	defer tx.Rollback()
+
+	var from string
+	err = tx.QueryRow(`SELECT status FROM reviews WHERE id = ? AND `+liveProductFilter, reviewID).Scan(&from)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
 	if err != nil {
 		return err
 	}
-	if rows == 0 {
-		return fmt.Errorf("review not found")
+
+	allowed := false
+	for _, next := range reviewTransitions[from] {
+		if next == to {
+			allowed = true
+			break
+		}
 	}
-	return nil
+	if !allowed {
+		return fmt.Errorf("review %d is %s and cannot become %s: %w", reviewID, from, to, errInvalidTransition)
+	}
+
+	_, err = tx.Exec(
+		`UPDATE reviews SET status = ?, approved = ?, moderation_reason = ?, moderated_by = ?, moderated_at = ?
+		 WHERE id = ?`,
+		to, to == ReviewApproved, reason, moderator, time.Now().UTC(), reviewID,
+	)
+	if err != nil {
+		return fmt.Errorf("moderate review: %w", err)
+	}
+	return tx.Commit()
 }
 
-// GetAverageRating returns the average rating for a product.
+// GetAverageRating returns the average rating and number of approved reviews
+// for a product.
 func (s *Store) GetAverageRating(productID int) (float64, int, error) {
 	var avg float64
 	var count int
 	err := s.db.QueryRow(
-		`SELECT COALESCE(AVG(rating), 0), COUNT(*) FROM reviews WHERE product_id = ?`,
-		productID,
+		`SELECT COALESCE(AVG(rating), 0), COUNT(*) FROM reviews WHERE product_id = ? AND status = ? AND `+liveProductFilter,
+		productID, ReviewApproved,
 	).Scan(&avg, &count)
 	if err != nil {
 		return 0, 0, err
@@ -138,50 +335,239 @@ func (s *Store) GetAverageRating(productID int) (float64, int, error) {
 	return avg, count, nil
 }
 
-// GetRecentReviews returns the most recent reviews across all products.
-func (s *Store) GetRecentReviews(limit int) ([]dbReview, error) {
+// weightedRatingSQL is the Bayesian-weighted rating of the approved reviews
+// aggregated in a query, aliased r: their ratings blended with weight reviews
+// at the catalog average prior, rounded to two decimals, or the prior when
+// there are neither. Its arguments are weightedRatingArgs(prior, weight).
+const weightedRatingSQL = `COALESCE(ROUND((TOTAL(r.rating) + ? * ?) / (COUNT(*) + ?), 2), ROUND(?, 2))`
+
+func weightedRatingArgs(prior float64, weight int) []interface{} {
+	return []interface{}{prior, weight, weight, prior}
+}
+
+// GetWeightedRating returns a product's weighted rating (see
+// weightedRatingSQL).
+func (s *Store) GetWeightedRating(productID int, prior float64, weight int) (float64, error) {
+	var rating float64
+	args := append(weightedRatingArgs(prior, weight), productID, ReviewApproved)
+	err := s.db.QueryRow(
+		`SELECT `+weightedRatingSQL+` FROM reviews r WHERE r.product_id = ? AND r.status = ? AND `+liveProductFilter,
+		args...,
+	).Scan(&rating)
+	return rating, err
+}
+
+// GetRecentReviews returns the most recent reviews across all products,
+// optionally only those with the given moderation status.
+func (s *Store) GetRecentReviews(status string, limit int) ([]dbReview, error) {
 	if limit <= 0 {
 		limit = 10
 	}
+	query := `SELECT ` + reviewColumns + ` FROM reviews WHERE ` + liveProductFilter
+	var args []interface{}
+	if status != "" {
+		query += ` AND status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY created_at DESC, id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("recent reviews: %w", err)
+	}
+	defer rows.Close()
+	return scanReviews(rows)
+}
+
+// countRecentReviews returns how many reviews, in any status, were posted
+// since the given time by author (ignoring case) and by client.
+func countRecentReviews(q sqlExecutor, author, client string, since time.Time) (int, int, error) {
+	var byAuthor, byClient int
+	err := q.QueryRow(
+		`SELECT (SELECT COUNT(*) FROM reviews WHERE lower(author) = lower(?) AND created_at >= ?),
+		        (SELECT COUNT(*) FROM reviews WHERE client = ? AND created_at >= ?)`,
+		author, since.UTC(), client, since.UTC(),
+	).Scan(&byAuthor, &byClient)
+	return byAuthor, byClient, err
+}
+
+// countReviewsWithFingerprint returns how many reviews, on any product and in
+// any status, have a comment with the given fingerprint.
+func countReviewsWithFingerprint(q sqlExecutor, fingerprint string) (int, error) {
+	var n int
+	err := q.QueryRow(`SELECT COUNT(*) FROM reviews WHERE comment_fingerprint = ?`, fingerprint).Scan(&n)
+	return n, err
+}
+
+// VoteReview records voter's helpful or unhelpful vote on an approved review,
+// replacing any earlier vote by the same voter, and returns the review's new
+// vote counts. It returns errNotFound if no approved review has that ID.
+func (s *Store) VoteReview(reviewID int, voter string, helpful bool) (int, int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var one int
+	err = tx.QueryRow(`SELECT 1 FROM reviews WHERE id = ? AND status = ? AND `+liveProductFilter, reviewID, ReviewApproved).Scan(&one)
+	if err == sql.ErrNoRows {
+		return 0, 0, errNotFound
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO review_votes (review_id, voter, helpful, created_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT (review_id, voter) DO UPDATE SET helpful = excluded.helpful, created_at = excluded.created_at`,
+		reviewID, voter, helpful, time.Now().UTC(),
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("record vote: %w", err)
+	}
+
+	var up, down int
+	err = tx.QueryRow(
+		`UPDATE reviews
+		 SET helpful_votes = (SELECT COUNT(*) FROM review_votes WHERE review_id = ? AND helpful = 1),
+		     unhelpful_votes = (SELECT COUNT(*) FROM review_votes WHERE review_id = ? AND helpful = 0)
+		 WHERE id = ?
+		 RETURNING helpful_votes, unhelpful_votes`,
+		reviewID, reviewID, reviewID,
+	).Scan(&up, &down)
+	if err != nil {
+		return 0, 0, fmt.Errorf("count votes: %w", err)
+	}
+	return up, down, tx.Commit()
+}
+
+// SetReviewReply sets the merchant's reply to a review, replacing any earlier
+// one; an empty reply removes it. It returns errNotFound if the review does
+// not exist.
+func (s *Store) SetReviewReply(reviewID int, reply, repliedBy string) error {
+	var repliedAt *time.Time
+	if reply != "" {
+		now := time.Now().UTC()
+		repliedAt = &now
+	} else {
+		repliedBy = ""
+	}
+
+	result, err := s.db.Exec(
+		`UPDATE reviews SET reply = ?, reply_by = ?, replied_at = ? WHERE id = ? AND `+liveProductFilter,
+		reply, repliedBy, repliedAt, reviewID,
+	)
+	if err != nil {
+		return fmt.Errorf("set review reply: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// GetCatalogRating returns the average rating and number of approved reviews
+// across all products.
+func (s *Store) GetCatalogRating() (float64, int, error) {
+	var avg float64
+	var count int
+	err := s.db.QueryRow(
+		`SELECT COALESCE(AVG(rating), 0), COUNT(*) FROM reviews WHERE status = ? AND `+liveProductFilter,
+		ReviewApproved,
+	).Scan(&avg, &count)
+	return avg, count, err
+}
+
+// GetRatingHistogram returns the number of approved reviews of a product for
+// each star rating from 1 to 5, including ratings nobody gave.
+func (s *Store) GetRatingHistogram(productID int) (map[int]int, error) {
 	rows, err := s.db.Query(
-		`SELECT id, product_id, author, rating, comment, approved, created_at
-		 FROM reviews ORDER BY created_at DESC LIMIT ?`,
-		limit,
+		`SELECT rating, COUNT(*) FROM reviews WHERE product_id = ? AND status = ? AND `+liveProductFilter+` GROUP BY rating`,
+		productID, ReviewApproved,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("recent reviews: %w", err)
+		return nil, fmt.Errorf("rating histogram: %w", err)
 	}
 	defer rows.Close()
 
-	var reviews []dbReview
+	histogram := map[int]int{1: 0, 2: 0, 3: 0, 4: 0, 5: 0}
 	for rows.Next() {
-		var r dbReview
-		err := rows.Scan(&r.ID, &r.ProductID, &r.Author, &r.Rating, &r.Comment, &r.Approved, &r.CreatedAt)
-		if err != nil {
-			return nil, fmt.Errorf("scan review: %w", err)
+		var rating, count int
+		if err := rows.Scan(&rating, &count); err != nil {
+			return nil, err
 		}
-		reviews = append(reviews, r)
+		histogram[rating] = count
 	}
-	return reviews, rows.Err()
+	return histogram, rows.Err()
 }
 
-// CountReviewsByProduct returns review counts grouped by product.
-func (s *Store) CountReviewsByProduct() (map[int]int, error) {
+// GetMonthlyRatings returns the average rating and count of a product's
+// approved reviews for each month since the given time, oldest first. Months
+// without reviews are left out.
+func (s *Store) GetMonthlyRatings(productID int, since time.Time) ([]MonthlyRating, error) {
 	rows, err := s.db.Query(
-		`SELECT product_id, COUNT(*) FROM reviews GROUP BY product_id`,
+		`SELECT substr(created_at, 1, 7) AS month, AVG(rating), COUNT(*)
+		 FROM reviews WHERE product_id = ? AND status = ? AND created_at >= ? AND `+liveProductFilter+`
+		 GROUP BY month ORDER BY month`,
+		productID, ReviewApproved, since.UTC(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("monthly ratings: %w", err)
+	}
+	defer rows.Close()
+
+	trend := []MonthlyRating{}
+	for rows.Next() {
+		var m MonthlyRating
+		if err := rows.Scan(&m.Month, &m.AverageRating, &m.ReviewCount); err != nil {
+			return nil, err
+		}
+		trend = append(trend, m)
+	}
+	return trend, rows.Err()
+}
+
+// ratedProductOrders maps the review leaderboard's rankings to ORDER BY
+// clauses for RankRatedProducts.
+var ratedProductOrders = map[string]string{
+	"top_rated":     `weighted_rating DESC, review_count DESC, r.product_id`,
+	"most_reviewed": `review_count DESC, weighted_rating DESC, r.product_id`,
+}
+
+// RankRatedProducts returns up to limit live products with approved reviews,
+// with their names, ranked by order (a key of ratedProductOrders). Weighted
+// ratings blend in weight reviews at prior (see weightedRatingSQL).
+func (s *Store) RankRatedProducts(order string, prior float64, weight, limit int) ([]RatedProduct, error) {
+	orderBy, ok := ratedProductOrders[order]
+	if !ok {
+		return nil, fmt.Errorf("unknown rating order %q", order)
+	}
+	rows, err := s.db.Query(`
+		SELECT r.product_id, p.name, AVG(r.rating), COUNT(*) AS review_count,
+		       `+weightedRatingSQL+` AS weighted_rating
+		FROM reviews r JOIN products p ON p.id = r.product_id AND p.deleted_at IS NULL
+		WHERE r.status = ?
+		GROUP BY r.product_id
+		ORDER BY `+orderBy+`
+		LIMIT ?`,
+		append(weightedRatingArgs(prior, weight), ReviewApproved, limit)...,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	counts := make(map[int]int)
+	var rated []RatedProduct
 	for rows.Next() {
-		var productID, count int
-		if err := rows.Scan(&productID, &count); err != nil {
+		var p RatedProduct
+		if err := rows.Scan(&p.ProductID, &p.Name, &p.AverageRating, &p.ReviewCount, &p.WeightedRating); err != nil {
 			return nil, err
 		}
-		counts[productID] = count
+		rated = append(rated, p)
 	}
-	return counts, rows.Err()
+	return rated, rows.Err()
 }
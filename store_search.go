@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+)
+
+// Markers wrapped around matched terms by FTS5. Control characters cannot
+// appear in the indexed text, so they survive HTML escaping unambiguously and
+// are swapped for <mark> tags afterwards.
+const (
+	highlightOpen  = "\x02"
+	highlightClose = "\x03"
+)
+
+// SearchQuery describes a full-text product search.
+type SearchQuery struct {
+	Text     string
+	Category string
+	InStock  *bool
+	Limit    int
+}
+
+// searchHit is a product matched by SearchProducts along with its ranking.
+type searchHit struct {
+	Product       dbProduct
+	Score         float64
+	NameHighlight string
+	Snippet       string
+}
+
+// buildMatchExpression converts user input into an FTS5 MATCH expression.
+// Double-quoted text becomes a phrase query; every other term is quoted and
+// matched as a prefix. Terms are implicitly ANDed. User input never reaches
+// FTS5 unquoted, so operators and column filters cannot be injected.
+func buildMatchExpression(input string) string {
+	var terms []string
+	quote := func(s string) string {
+		return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+	}
+
+	rest := input
+	for {
+		start := strings.Index(rest, `"`)
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start+1:], `"`)
+		if end < 0 {
+			break
+		}
+		for _, word := range strings.FieldsFunc(rest[:start], unicode.IsSpace) {
+			terms = append(terms, quote(word)+"*")
+		}
+		if phrase := strings.TrimSpace(rest[start+1 : start+1+end]); phrase != "" {
+			terms = append(terms, quote(phrase))
+		}
+		rest = rest[start+1+end+1:]
+	}
+	for _, word := range strings.FieldsFunc(strings.ReplaceAll(rest, `"`, " "), unicode.IsSpace) {
+		terms = append(terms, quote(word)+"*")
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// renderHighlight HTML-escapes FTS5 output and turns match markers into <mark> tags.
+func renderHighlight(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, highlightOpen, "<mark>")
+	return strings.ReplaceAll(s, highlightClose, "</mark>")
+}
+
+// SearchProducts runs a ranked full-text search over product names,
+// descriptions and variant names/SKUs. Results are ordered by BM25 relevance,
+// weighting name matches above variant and description matches.
+func (s *Store) SearchProducts(q SearchQuery) ([]searchHit, error) {
+	match := buildMatchExpression(q.Text)
+	if match == "" {
+		return nil, nil
+	}
+
+	where := []string{"products_fts MATCH ?", "p.deleted_at IS NULL"}
+	args := []interface{}{highlightOpen, highlightClose, highlightOpen, highlightClose, match}
+	if q.Category != "" {
+		where = append(where, categorySubtreeFilter("p.category_id"))
+		args = append(args, slugify(q.Category))
+	}
+	if q.InStock != nil {
+		where = append(where, "p.in_stock = ?")
+		args = append(args, *q.InStock)
+	}
+	args = append(args, q.Limit)
+
+	rows, err := s.db.Query(
+		`SELECT p.id, p.name, p.description, p.price_cents, p.currency, p.category, p.category_id, p.in_stock, p.quantity,
+		        p.created_at, p.updated_at, p.deleted_at, p.version,
+		        -bm25(products_fts, 10.0, 2.0, 5.0),
+		        highlight(products_fts, 0, ?, ?),
+		        snippet(products_fts, 1, ?, ?, '…', 16)
+		 FROM products_fts
+		 JOIN products p ON p.id = products_fts.rowid
+		 WHERE `+strings.Join(where, " AND ")+`
+		 ORDER BY bm25(products_fts, 10.0, 2.0, 5.0), p.id
+		 LIMIT ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("search products: %w", err)
+	}
+	defer rows.Close()
+
+	var hits []searchHit
+	for rows.Next() {
+		var h searchHit
+		p := &h.Product
+		err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.PriceCents, &p.Currency, &p.Category, &p.CategoryID,
+			&p.InStock, &p.Quantity, &p.CreatedAt, &p.UpdatedAt, &p.DeletedAt, &p.Version,
+			&h.Score, &h.NameHighlight, &h.Snippet)
+		if err != nil {
+			return nil, fmt.Errorf("scan search result: %w", err)
+		}
+		h.NameHighlight = renderHighlight(h.NameHighlight)
+		h.Snippet = renderHighlight(h.Snippet)
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestBuildMatchExpression(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"empty", "", ""},
+		{"blank", "  \t ", ""},
+		{"single term", "mouse", `"mouse"*`},
+		{"terms", "wireless  mouse", `"wireless"* "mouse"*`},
+		{"phrase", `"usb receiver"`, `"usb receiver"`},
+		{"phrase between terms", `desk "sit-stand" lamp`, `"desk"* "sit-stand" "lamp"*`},
+		{"two phrases", `"a b" "c d"`, `"a b" "c d"`},
+		{"empty phrase", `"" mouse`, `"mouse"*`},
+		{"unterminated phrase", `desk "sit stand`, `"desk"* "sit"* "stand"*`},
+		{"stray quote inside a term", `a"b`, `"a"* "b"*`},
+		{"boolean operators", "mouse OR NOT desk AND lamp", `"mouse"* "OR"* "NOT"* "desk"* "AND"* "lamp"*`},
+		{"column filter", "name:mouse", `"name:mouse"*`},
+		{"column set", "{name description}:mouse", `"{name"* "description}:mouse"*`},
+		{"near group", "NEAR(mouse desk, 2)", `"NEAR(mouse"* "desk,"* "2)"*`},
+		{"prefix and initial tokens", "* ^mouse", `"*"* "^mouse"*`},
+		{"parentheses", "(mouse)", `"(mouse)"*`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildMatchExpression(tt.input); got != tt.want {
+				t.Errorf("buildMatchExpression(%q) = %s, want %s", tt.input, got, tt.want)
+			}
+		})
+	}
+
+	// Whatever the input, FTS5 must accept the expression.
+	s := newTestStore(t)
+	for _, tt := range tests {
+		if _, err := s.SearchProducts(SearchQuery{Text: tt.input, Limit: 10}); err != nil {
+			t.Errorf("search %q: %v", tt.input, err)
+		}
+	}
+}
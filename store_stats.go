@@ -1,98 +1,116 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"time"
 )
 
-// createAuditTable creates the audit_log table if it doesn't exist.
-func createAuditTable(s *Store) error {
-	_, err := s.db.Exec(`
-		CREATE TABLE IF NOT EXISTS audit_log (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			product_id INTEGER NOT NULL,
-			action TEXT NOT NULL,
-			detail TEXT DEFAULT '',
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (product_id) REFERENCES products(id)
-		)
-	`)
-	return err
-}
+const auditColumns = `id, product_id, entity_type, entity_id, action, actor, changes, detail, created_at`
+
+// LogAudit records a change to a product or one of its variants or reviews.
+func (s *Store) LogAudit(e AuditEntry) error {
+	changes := e.Changes
+	if changes == nil {
+		changes = []FieldChange{}
+	}
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("encode audit changes: %w", err)
+	}
 
-// LogAudit records an action taken on a product.
-func (s *Store) LogAudit(productID int, action, detail string) error {
 	now := time.Now().UTC()
-	_, err := s.db.Exec(
-		`INSERT INTO audit_log (product_id, action, detail, created_at) VALUES (?, ?, ?, ?)`,
-		productID, action, detail, now,
+	_, err = s.db.Exec(
+		`INSERT INTO audit_log (product_id, entity_type, entity_id, action, actor, changes, detail, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.ProductID, e.EntityType, e.EntityID, e.Action, e.Actor, string(changesJSON), e.Detail, now,
 	)
 	return err
 }
 
-// GetAuditLog returns the audit trail for a specific product.
-func (s *Store) GetAuditLog(productID int) ([]AuditEntry, error) {
+// GetAuditLog returns the audit trail for a specific product, including its
+// variants and reviews. An empty entityType matches every entity type.
+func (s *Store) GetAuditLog(productID int, entityType string) ([]AuditEntry, error) {
 	rows, err := s.db.Query(
-		`SELECT id, product_id, action, detail, created_at
-		 FROM audit_log WHERE product_id = ? ORDER BY created_at DESC`,
-		productID,
+		`SELECT `+auditColumns+`
+		 FROM audit_log WHERE product_id = ? AND (? = '' OR entity_type = ?)
+		 ORDER BY created_at DESC, id DESC`,
+		productID, entityType, entityType,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("get audit log: %w", err)
 	}
 	defer rows.Close()
-
-	var entries []AuditEntry
-	for rows.Next() {
-		var e AuditEntry
-		err := rows.Scan(&e.ID, &e.ProductID, &e.Action, &e.Detail, &e.CreatedAt)
-		if err != nil {
-			return nil, fmt.Errorf("scan audit entry: %w", err)
-		}
-		entries = append(entries, e)
-	}
-	return entries, rows.Err()
+	return scanAuditEntries(rows)
 }
 
 // GetRecentAuditLog returns the most recent audit entries across all products.
-func (s *Store) GetRecentAuditLog(limit int) ([]AuditEntry, error) {
+// An empty entityType matches every entity type.
+func (s *Store) GetRecentAuditLog(limit int, entityType string) ([]AuditEntry, error) {
 	if limit <= 0 {
 		limit = 50
 	}
 	rows, err := s.db.Query(
-		`SELECT id, product_id, action, detail, created_at
-		 FROM audit_log ORDER BY created_at DESC LIMIT ?`,
-		limit,
+		`SELECT `+auditColumns+`
+		 FROM audit_log WHERE (? = '' OR entity_type = ?)
+		 ORDER BY created_at DESC, id DESC LIMIT ?`,
+		entityType, entityType, limit,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("recent audit log: %w", err)
 	}
 	defer rows.Close()
+	return scanAuditEntries(rows)
+}
 
+func scanAuditEntries(rows *sql.Rows) ([]AuditEntry, error) {
 	var entries []AuditEntry
 	for rows.Next() {
 		var e AuditEntry
-		err := rows.Scan(&e.ID, &e.ProductID, &e.Action, &e.Detail, &e.CreatedAt)
+		var changesJSON string
+		err := rows.Scan(&e.ID, &e.ProductID, &e.EntityType, &e.EntityID, &e.Action, &e.Actor, &changesJSON, &e.Detail, &e.CreatedAt)
 		if err != nil {
 			return nil, fmt.Errorf("scan audit entry: %w", err)
 		}
+		if err := json.Unmarshal([]byte(changesJSON), &e.Changes); err != nil {
+			return nil, fmt.Errorf("decode audit changes: %w", err)
+		}
 		entries = append(entries, e)
 	}
 	return entries, rows.Err()
 }
 
-// GetCategoryStats returns aggregate statistics grouped by category.
+// GetCategoryStats returns aggregate statistics for every category in tree
+// order. Each category's figures roll up the products of all its descendants;
+// products without a category are summarized in a final row. Average prices
+// are in cents of the base currency (see priceInSQL) and leave out products
+// priced in a currency without an exchange rate.
 func (s *Store) GetCategoryStats() ([]CategoryStat, error) {
-	rows, err := s.db.Query(`
-		SELECT category, COUNT(*) as product_count,
-		       COALESCE(AVG(price_cents), 0) as avg_price,
-		       COALESCE(SUM(quantity), 0) as total_inventory,
-		       SUM(CASE WHEN in_stock = 1 THEN 1 ELSE 0 END) as in_stock_count
-		FROM products
-		WHERE deleted_at IS NULL
-		GROUP BY category
-		ORDER BY product_count DESC
-	`)
+	rates, err := s.ExchangeRates()
+	if err != nil {
+		return nil, err
+	}
+	price, priceArgs := priceInSQL("p", BaseCurrency, rates)
+	rows, err := s.db.Query(categoryTreeCTE+`,
+		closure(ancestor, id) AS (
+			SELECT id, id FROM categories
+			UNION
+			SELECT cl.ancestor, c.id FROM categories c JOIN closure cl ON c.parent_id = cl.id
+		)
+		SELECT c.slug, c.id, c.name, c.parent_id, t.depth,
+		       COUNT(CASE WHEN p.category_id = c.id THEN 1 END) as direct_count,
+		       COUNT(p.id) as product_count,
+		       COALESCE(AVG(`+price+`), 0) as avg_price,
+		       COALESCE(SUM(p.quantity), 0) as total_inventory,
+		       COALESCE(SUM(CASE WHEN p.in_stock = 1 THEN 1 ELSE 0 END), 0) as in_stock_count
+		FROM categories c
+		JOIN tree t ON t.id = c.id
+		JOIN closure cl ON cl.ancestor = c.id
+		LEFT JOIN products p ON p.category_id = cl.id AND p.deleted_at IS NULL
+		GROUP BY c.id
+		ORDER BY t.path
+	`, priceArgs...)
 	if err != nil {
 		return nil, fmt.Errorf("category stats: %w", err)
 	}
@@ -101,13 +119,36 @@ func (s *Store) GetCategoryStats() ([]CategoryStat, error) {
 	var stats []CategoryStat
 	for rows.Next() {
 		var s CategoryStat
-		err := rows.Scan(&s.Category, &s.ProductCount, &s.AveragePrice, &s.TotalInventory, &s.InStockCount)
+		var id int
+		err := rows.Scan(&s.Category, &id, &s.Name, &s.ParentID, &s.Depth, &s.DirectProductCount,
+			&s.ProductCount, &s.AveragePrice, &s.TotalInventory, &s.InStockCount)
 		if err != nil {
 			return nil, fmt.Errorf("scan category stat: %w", err)
 		}
+		s.CategoryID = &id
 		stats = append(stats, s)
 	}
-	return stats, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var none CategoryStat
+	price, priceArgs = priceInSQL("products", BaseCurrency, rates)
+	err = s.db.QueryRow(`
+		SELECT COUNT(*), COALESCE(AVG(`+price+`), 0), COALESCE(SUM(quantity), 0),
+		       COALESCE(SUM(CASE WHEN in_stock = 1 THEN 1 ELSE 0 END), 0)
+		FROM products
+		WHERE deleted_at IS NULL AND category_id IS NULL
+	`, priceArgs...).Scan(&none.ProductCount, &none.AveragePrice, &none.TotalInventory, &none.InStockCount)
+	if err != nil {
+		return nil, fmt.Errorf("uncategorized stats: %w", err)
+	}
+	if none.ProductCount > 0 {
+		none.Name = "Uncategorized"
+		none.DirectProductCount = none.ProductCount
+		stats = append(stats, none)
+	}
+	return stats, nil
 }
 
 // GetProductCount returns counts of total, in-stock, and out-of-stock products.
@@ -121,11 +162,18 @@ func (s *Store) GetProductCount() (total, inStock, outOfStock int, err error) {
 	return
 }
 
-// GetAverageProductPrice returns the average price in cents across all active products.
+// GetAverageProductPrice returns the average price across all active products
+// in cents of the base currency, leaving out products priced in a currency
+// without an exchange rate.
 func (s *Store) GetAverageProductPrice() (float64, error) {
+	rates, err := s.ExchangeRates()
+	if err != nil {
+		return 0, err
+	}
+	price, args := priceInSQL("products", BaseCurrency, rates)
 	var avg float64
-	err := s.db.QueryRow(
-		`SELECT COALESCE(AVG(price_cents), 0) FROM products WHERE deleted_at IS NULL`,
+	err = s.db.QueryRow(
+		`SELECT COALESCE(AVG(`+price+`), 0) FROM products WHERE deleted_at IS NULL`, args...,
 	).Scan(&avg)
 	return avg, err
 }
@@ -142,55 +190,6 @@ func (s *Store) GetTotalInventory() (int, error) {
 // GetTotalReviewCount returns the total number of reviews in the system.
 func (s *Store) GetTotalReviewCount() (int, error) {
 	var count int
-	err := s.db.QueryRow(`SELECT COUNT(*) FROM reviews`).Scan(&count)
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM reviews WHERE ` + liveProductFilter).Scan(&count)
 	return count, err
 }
-
-// SearchProducts performs a basic text search across product name and description.
-func (s *Store) SearchProducts(query string) ([]dbProduct, error) {
-	pattern := "%" + query + "%"
-	rows, err := s.db.Query(
-		`SELECT id, name, description, price_cents, category, in_stock, quantity, created_at, updated_at, deleted_at
-		 FROM products
-		 WHERE deleted_at IS NULL AND (name LIKE ? OR description LIKE ?)
-		 ORDER BY name`,
-		pattern, pattern,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("search products: %w", err)
-	}
-	defer rows.Close()
-
-	var products []dbProduct
-	for rows.Next() {
-		var p dbProduct
-		err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.PriceCents, &p.Category,
-			&p.InStock, &p.Quantity, &p.CreatedAt, &p.UpdatedAt, &p.DeletedAt)
-		if err != nil {
-			return nil, fmt.Errorf("scan product: %w", err)
-		}
-		products = append(products, p)
-	}
-	return products, rows.Err()
-}
-
-// ListCategories returns distinct category names.
-func (s *Store) ListCategories() ([]string, error) {
-	rows, err := s.db.Query(
-		`SELECT DISTINCT category FROM products WHERE deleted_at IS NULL AND category != '' ORDER BY category`,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("list categories: %w", err)
-	}
-	defer rows.Close()
-
-	var categories []string
-	for rows.Next() {
-		var c string
-		if err := rows.Scan(&c); err != nil {
-			return nil, err
-		}
-		categories = append(categories, c)
-	}
-	return categories, rows.Err()
-}
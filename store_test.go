@@ -0,0 +1,1040 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestStore opens a migrated, seeded store in a temporary directory.
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := NewStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// openAtVersion opens a database in a temporary directory with only the
+// migrations up to and including version applied, so a test can arrange data
+// the way an older release left it before running the rest with migrate.
+func openAtVersion(t *testing.T, version int) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db")+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	all := migrations
+	migrations = nil
+	for _, m := range all {
+		if m.version <= version {
+			migrations = append(migrations, m)
+		}
+	}
+	err = migrate(db)
+	migrations = all
+	if err != nil {
+		t.Fatalf("migrate to %d: %v", version, err)
+	}
+	return db
+}
+
+// hammer runs try from n goroutines at once and returns how many succeeded.
+// Every failure must be refused.
+func hammer(t *testing.T, n int, refused error, try func() error) int {
+	t.Helper()
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded int
+		start     = make(chan struct{})
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			err := try()
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				succeeded++
+			case !errors.Is(err, refused):
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return succeeded
+}
+
+func TestDecrementQuantityConcurrent(t *testing.T) {
+	s := newTestStore(t)
+	const stock, buyers = 7, 50
+
+	id, err := s.CreateProduct("Contended", "", 1000, BaseCurrency, nil, true, stock)
+	if err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+
+	succeeded := hammer(t, buyers, errInsufficientStock, func() error {
+		_, err := s.DecrementQuantity(id, 1)
+		return err
+	})
+	if succeeded != stock {
+		t.Errorf("%d purchases succeeded, want %d", succeeded, stock)
+	}
+
+	var quantity int
+	var inStock bool
+	if err := s.db.QueryRow(`SELECT quantity, in_stock FROM products WHERE id = ?`, id).Scan(&quantity, &inStock); err != nil {
+		t.Fatalf("read product: %v", err)
+	}
+	if quantity != 0 || inStock {
+		t.Errorf("quantity = %d, in_stock = %v; want 0, false", quantity, inStock)
+	}
+}
+
+func TestReserveVariantStockConcurrent(t *testing.T) {
+	s := newTestStore(t)
+	const stock, buyers = 5, 40
+
+	productID, err := s.CreateProduct("Contended", "", 1000, BaseCurrency, nil, true, 0)
+	if err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	variantID, err := s.CreateVariant(productID, "HOT-SKU", "Hot", 0, stock, "{}", 0)
+	if err != nil {
+		t.Fatalf("create variant: %v", err)
+	}
+
+	succeeded := hammer(t, buyers, errInsufficientStock, func() error {
+		_, err := reserveVariantStock(s.db, productID, variantID, 1, time.Now().UTC())
+		return err
+	})
+	if succeeded != stock {
+		t.Errorf("%d purchases succeeded, want %d", succeeded, stock)
+	}
+
+	var quantity int
+	var inStock bool
+	if err := s.db.QueryRow(`SELECT quantity, in_stock FROM variants WHERE id = ?`, variantID).Scan(&quantity, &inStock); err != nil {
+		t.Fatalf("read variant: %v", err)
+	}
+	if quantity != 0 || inStock {
+		t.Errorf("quantity = %d, in_stock = %v; want 0, false", quantity, inStock)
+	}
+}
+
+func TestMigrationBackfillsCategorySlugs(t *testing.T) {
+	db := openAtVersion(t, 11)
+	for i, category := range []string{"Home Office", " home_office ", "Home & Garden", "Toys", "!!!", ""} {
+		_, err := db.Exec(`INSERT INTO products (name, price_cents, category) VALUES (?, 100, ?)`, fmt.Sprint("Product ", i), category)
+		if err != nil {
+			t.Fatalf("insert product: %v", err)
+		}
+	}
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	got := make(map[string]string)
+	rows, err := db.Query(`SELECT slug, name FROM categories`)
+	if err != nil {
+		t.Fatalf("list categories: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var slug, name string
+		if err := rows.Scan(&slug, &name); err != nil {
+			t.Fatalf("scan category: %v", err)
+		}
+		if !slugPattern.MatchString(slug) {
+			t.Errorf("slug %q for %q is not valid", slug, name)
+		}
+		got[name] = slug
+	}
+	want := map[string]string{
+		"!!!":           "category",
+		"Home & Garden": "home-garden",
+		"Home Office":   "home-office",
+		"Toys":          "toys",
+	}
+	if len(got) != len(want) {
+		t.Errorf("categories = %v, want %v", got, want)
+	}
+	for name, slug := range want {
+		if got[name] != slug {
+			t.Errorf("category %q has slug %q, want %q", name, got[name], slug)
+		}
+	}
+
+	var unlinked int
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM products p LEFT JOIN categories c ON c.id = p.category_id
+		WHERE p.category != COALESCE(c.slug, '')`).Scan(&unlinked)
+	if err != nil {
+		t.Fatalf("check products: %v", err)
+	}
+	if unlinked != 0 {
+		t.Errorf("%d products do not carry their category's slug", unlinked)
+	}
+}
+
+func TestRunPriceSchedulesContinuesPastFailure(t *testing.T) {
+	s := newTestStore(t)
+	var ids [2]int
+	for i := range ids {
+		productID, err := s.CreateProduct(fmt.Sprint("Scheduled ", i), "", 1000, BaseCurrency, nil, true, 1)
+		if err != nil {
+			t.Fatalf("create product: %v", err)
+		}
+		ids[i], err = s.CreatePriceSchedule(dbPriceSchedule{
+			ProductID:  productID,
+			PriceCents: 500,
+			StartsAt:   time.Now().Add(-time.Minute),
+		})
+		if err != nil {
+			t.Fatalf("create schedule: %v", err)
+		}
+		if i == 0 {
+			_, err = s.db.Exec(`CREATE TRIGGER fail_price BEFORE UPDATE OF price_cents ON products
+				WHEN new.id = ` + fmt.Sprint(productID) + ` BEGIN SELECT RAISE(ABORT, 'price locked'); END`)
+			if err != nil {
+				t.Fatalf("create trigger: %v", err)
+			}
+		}
+	}
+
+	runs, err := s.RunPriceSchedules(time.Now())
+	if err != nil {
+		t.Fatalf("run schedules: %v", err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("got %d runs, want 2", len(runs))
+	}
+	for i, want := range []string{ScheduleFailed, ScheduleCompleted} {
+		var status string
+		if err := s.db.QueryRow(`SELECT status FROM price_schedules WHERE id = ?`, ids[i]).Scan(&status); err != nil {
+			t.Fatalf("read schedule: %v", err)
+		}
+		if status != want {
+			t.Errorf("schedule %d is %s, want %s", ids[i], status, want)
+		}
+	}
+	if runs[0].Err == nil || runs[1].Err != nil {
+		t.Errorf("run errors = %v, %v; want only the first to fail", runs[0].Err, runs[1].Err)
+	}
+}
+
+func TestForeignKeysRejectOrphans(t *testing.T) {
+	s := newTestStore(t)
+	const missing = 999999
+	now := time.Now().UTC()
+	for table, insert := range map[string]string{
+		"variants":        `INSERT INTO variants (product_id, sku, name) VALUES (?1, 'ORPHAN', 'Orphan')`,
+		"reviews":         `INSERT INTO reviews (product_id, author, rating) VALUES (?1, 'someone', 5)`,
+		"product_images":  `INSERT INTO product_images (product_id, filename, thumbnail, mime_type, width, height, size_bytes, checksum, created_at) VALUES (?1, 'a.png', 'a_thumb.png', 'image/png', 1, 1, 1, '', ?2)`,
+		"price_overrides": `INSERT INTO price_overrides (product_id, currency, price_cents, created_at, updated_at) VALUES (?1, 'EUR', 100, ?2, ?2)`,
+		"price_schedules": `INSERT INTO price_schedules (product_id, price_cents, starts_at, status, created_at, updated_at) VALUES (?1, 100, ?2, 'scheduled', ?2, ?2)`,
+		"price_history":   `INSERT INTO price_history (product_id, price_cents, changed_at) VALUES (?1, 100, ?2)`,
+	} {
+		if _, err := s.db.Exec(insert, missing, now); err == nil {
+			t.Errorf("%s row for a missing product was inserted", table)
+		}
+	}
+}
+
+func TestPurgeProductRemovesDependentRows(t *testing.T) {
+	s := newTestStore(t)
+	productID, err := s.CreateProduct("Doomed", "", 1000, BaseCurrency, nil, true, 10)
+	if err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	variantID, err := s.CreateVariant(productID, "DOOMED-1", "Doomed", 1200, 10, "{}", 0)
+	if err != nil {
+		t.Fatalf("create variant: %v", err)
+	}
+	if _, err := s.SetPriceOverride(productID, nil, "EUR", 900); err != nil {
+		t.Fatalf("set override: %v", err)
+	}
+	if _, err := s.SetPriceOverride(productID, &variantID, "EUR", 1100); err != nil {
+		t.Fatalf("set variant override: %v", err)
+	}
+	if _, err := s.CreatePriceSchedule(dbPriceSchedule{
+		ProductID:  productID,
+		PriceCents: 800,
+		StartsAt:   time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatalf("create schedule: %v", err)
+	}
+	orderID, err := s.CreateOrder("customer", "test", []OrderLineRequest{
+		{ProductID: productID, Quantity: 1},
+		{ProductID: productID, VariantID: &variantID, Quantity: 1},
+	}, time.Hour)
+	if err != nil {
+		t.Fatalf("create order: %v", err)
+	}
+
+	if _, err := s.PurgeProduct(productID); err != nil {
+		t.Fatalf("purge product: %v", err)
+	}
+
+	for _, table := range []string{"variants", "price_overrides", "price_schedules", "price_history"} {
+		var n int
+		if err := s.db.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE product_id = ?`, productID).Scan(&n); err != nil {
+			t.Fatalf("count %s: %v", table, err)
+		}
+		if n != 0 {
+			t.Errorf("%d %s rows outlived their product", n, table)
+		}
+	}
+
+	var lines, linked int
+	err = s.db.QueryRow(`
+		SELECT COUNT(*), COUNT(product_id) + COUNT(variant_id) FROM order_lines WHERE order_id = ?`,
+		orderID).Scan(&lines, &linked)
+	if err != nil {
+		t.Fatalf("count order lines: %v", err)
+	}
+	if lines != 2 || linked != 0 {
+		t.Errorf("order has %d lines with %d links; want 2 lines, unlinked", lines, linked)
+	}
+}
+
+func TestMigrationRemovesOrphans(t *testing.T) {
+	db := openAtVersion(t, 14)
+	db.SetMaxOpenConns(1)
+	now := time.Now().UTC()
+	stmts := []string{
+		`PRAGMA foreign_keys = OFF`,
+		`INSERT INTO products (id, name, price_cents, category_id) VALUES (1, 'Kept', 100, 77)`,
+		`INSERT INTO categories (id, slug, name, parent_id, created_at, updated_at) VALUES (1, 'kept', 'Kept', 77, ?1, ?1)`,
+		`INSERT INTO orders (id, status, created_at, updated_at) VALUES (1, 'pending', ?1, ?1)`,
+		`INSERT INTO variants (product_id, sku, name) VALUES (2, 'ORPHAN', 'Orphan')`,
+		`INSERT INTO reviews (product_id, author, rating) VALUES (2, 'someone', 5)`,
+		`INSERT INTO product_images (product_id, variant_id, filename, thumbnail, mime_type, width, height, size_bytes, checksum, created_at)
+		 VALUES (1, 77, 'a.png', 'a_thumb.png', 'image/png', 1, 1, 1, '', ?1)`,
+		`INSERT INTO price_schedules (product_id, price_cents, starts_at, status, created_at, updated_at) VALUES (2, 100, ?1, 'scheduled', ?1, ?1)`,
+		`INSERT INTO price_history (product_id, price_cents, schedule_id, changed_at) VALUES (1, 100, 77, ?1)`,
+		`INSERT INTO price_overrides (product_id, currency, price_cents, created_at, updated_at) VALUES (2, 'EUR', 100, ?1, ?1)`,
+		`INSERT INTO order_lines (order_id, product_id, name, quantity, unit_price_cents) VALUES (77, 1, 'Lost', 1, 100)`,
+		`INSERT INTO order_lines (order_id, product_id, variant_id, name, quantity, unit_price_cents) VALUES (1, 2, 77, 'Gone', 1, 100)`,
+		`PRAGMA foreign_keys = ON`,
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt, now); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	defer tx.Rollback()
+	if err := checkForeignKeys(tx); err != nil {
+		t.Errorf("after migration: %v", err)
+	}
+
+	var lines int
+	var productID, variantID sql.NullInt64
+	err = tx.QueryRow(`SELECT COUNT(*), MAX(product_id), MAX(variant_id) FROM order_lines`).Scan(&lines, &productID, &variantID)
+	if err != nil {
+		t.Fatalf("read order lines: %v", err)
+	}
+	if lines != 1 || productID.Valid || variantID.Valid {
+		t.Errorf("order lines = %d, product %v, variant %v; want 1 unlinked line", lines, productID, variantID)
+	}
+	var categoryID sql.NullInt64
+	if err := tx.QueryRow(`SELECT category_id FROM products WHERE id = 1`).Scan(&categoryID); err != nil {
+		t.Fatalf("read product: %v", err)
+	}
+	if categoryID.Valid {
+		t.Errorf("product still points at missing category %d", categoryID.Int64)
+	}
+}
+
+func TestQueryReviewsPaging(t *testing.T) {
+	s := newTestStore(t)
+	productID, err := s.CreateProduct("Reviewed", "", 1000, BaseCurrency, nil, true, 1)
+	if err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	// Repeated ratings and vote counts make pages break inside ties.
+	for i, r := range []struct {
+		rating  int
+		comment string
+		votes   int
+		status  string
+	}{
+		{4, "good", 2, ReviewApproved},
+		{5, "", 0, ReviewApproved},
+		{4, "fine", 0, ReviewPending},
+		{2, "poor", 2, ReviewApproved},
+		{4, " ", 0, ReviewApproved},
+		{5, "great", 3, ReviewRejected},
+		{1, "awful", 2, ReviewApproved},
+	} {
+		// Votes are only taken on approved reviews, so the rejected review is
+		// voted on before it is rejected.
+		screen := func(q sqlExecutor, review *dbReview) error {
+			review.Status = ReviewPending
+			if r.status != ReviewPending {
+				review.Status = ReviewApproved
+			}
+			return nil
+		}
+		id, err := s.CreateReview(dbReview{ProductID: productID, Author: fmt.Sprint("author ", i), Rating: r.rating, Comment: r.comment}, "", screen)
+		if err != nil {
+			t.Fatalf("create review: %v", err)
+		}
+		for v := 0; v < r.votes; v++ {
+			if _, _, err := s.VoteReview(id, fmt.Sprint("key:", v), true); err != nil {
+				t.Fatalf("vote: %v", err)
+			}
+		}
+		if r.status == ReviewRejected {
+			if err := s.ModerateReview(id, r.status, "setup", "mod"); err != nil {
+				t.Fatalf("moderate review: %v", err)
+			}
+		}
+	}
+
+	all, _, _, err := s.QueryReviews(ReviewQuery{ProductID: productID, Sort: "created_at", Limit: 100})
+	if err != nil {
+		t.Fatalf("query reviews: %v", err)
+	}
+	key := map[string]func(r dbReview) string{
+		"rating":     func(r dbReview) string { return fmt.Sprint(r.Rating) },
+		"helpful":    func(r dbReview) string { return fmt.Sprintf("%09d", r.HelpfulVotes) },
+		"created_at": func(r dbReview) string { return r.CreatedAt.Format(time.RFC3339Nano) },
+	}
+	// want returns the IDs of the reviews passing keep, ordered by sort with
+	// ties going to the newest review.
+	want := func(sortKey string, desc bool, keep func(r dbReview) bool) []int {
+		var rs []dbReview
+		for _, r := range all {
+			if keep(r) {
+				rs = append(rs, r)
+			}
+		}
+		sort.SliceStable(rs, func(i, j int) bool {
+			ki, kj := key[sortKey](rs[i]), key[sortKey](rs[j])
+			if ki == kj {
+				return rs[i].ID > rs[j].ID
+			}
+			return (ki < kj) != desc
+		})
+		ids := make([]int, len(rs))
+		for i, r := range rs {
+			ids[i] = r.ID
+		}
+		return ids
+	}
+
+	intPtr := func(n int) *int { return &n }
+	boolPtr := func(b bool) *bool { return &b }
+	everything := func(dbReview) bool { return true }
+	approved := func(r dbReview) bool { return r.Status == ReviewApproved }
+	tests := []struct {
+		name string
+		q    ReviewQuery
+		keep func(r dbReview) bool
+	}{
+		{"created_at", ReviewQuery{Sort: "created_at"}, everything},
+		{"-created_at", ReviewQuery{Sort: "created_at", Desc: true}, everything},
+		{"rating", ReviewQuery{Sort: "rating"}, everything},
+		{"-rating", ReviewQuery{Sort: "rating", Desc: true}, everything},
+		{"-helpful", ReviewQuery{Sort: "helpful", Desc: true}, everything},
+		{"approved", ReviewQuery{Sort: "rating", Desc: true, Status: ReviewApproved}, approved},
+		{"rating range", ReviewQuery{Sort: "helpful", Desc: true, MinRating: intPtr(2), MaxRating: intPtr(4)},
+			func(r dbReview) bool { return r.Rating >= 2 && r.Rating <= 4 }},
+		{"with comment", ReviewQuery{Sort: "created_at", Desc: true, HasComment: boolPtr(true)},
+			func(r dbReview) bool { return strings.TrimSpace(r.Comment) != "" }},
+		{"without comment", ReviewQuery{Sort: "created_at", Desc: true, HasComment: boolPtr(false)},
+			func(r dbReview) bool { return strings.TrimSpace(r.Comment) == "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.q
+			q.ProductID, q.Limit = productID, 2
+			var got []int
+			for {
+				reviews, next, total, err := s.QueryReviews(q)
+				if err != nil {
+					t.Fatalf("query reviews: %v", err)
+				}
+				if w := len(want(tt.q.Sort, tt.q.Desc, tt.keep)); total != w {
+					t.Fatalf("total = %d, want %d", total, w)
+				}
+				for _, r := range reviews {
+					got = append(got, r.ID)
+				}
+				if next == nil {
+					break
+				}
+				if q.After, err = decodeCursor(encodeCursor(*next)); err != nil {
+					t.Fatalf("decode cursor: %v", err)
+				}
+			}
+			if w := want(tt.q.Sort, tt.q.Desc, tt.keep); fmt.Sprint(got) != fmt.Sprint(w) {
+				t.Errorf("got %v, want %v", got, w)
+			}
+		})
+	}
+
+	_, next, _, err := s.QueryReviews(ReviewQuery{ProductID: productID, Sort: "rating", Limit: 2})
+	if err != nil || next == nil {
+		t.Fatalf("first page: cursor %v, err %v", next, err)
+	}
+	if _, _, _, err := s.QueryReviews(ReviewQuery{ProductID: productID, Sort: "rating", Desc: true, Limit: 2, After: next}); err == nil {
+		t.Error("an ascending cursor was accepted for a descending sort")
+	}
+}
+
+func TestModerateReviewTransitions(t *testing.T) {
+	s := newTestStore(t)
+	productID, err := s.CreateProduct("Moderated", "", 1000, BaseCurrency, nil, true, 1)
+	if err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	statuses := []string{ReviewPending, ReviewApproved, ReviewFlagged, ReviewRejected}
+	allowed := map[string]string{
+		ReviewPending:  "approved rejected flagged",
+		ReviewApproved: "rejected flagged",
+		ReviewFlagged:  "approved rejected",
+		ReviewRejected: "approved",
+	}
+
+	for _, from := range statuses {
+		for _, to := range statuses {
+			t.Run(from+" to "+to, func(t *testing.T) {
+				id, err := s.CreateReview(dbReview{ProductID: productID, Author: "author", Rating: 3}, "", nil)
+				if err != nil {
+					t.Fatalf("create review: %v", err)
+				}
+				if from != ReviewPending {
+					if err := s.ModerateReview(id, from, "setup", "mod"); err != nil {
+						t.Fatalf("move review to %s: %v", from, err)
+					}
+				}
+
+				err = s.ModerateReview(id, to, "because", "mod")
+				want := strings.Contains(" "+allowed[from]+" ", " "+to+" ")
+				if want != (err == nil) {
+					t.Fatalf("moderate: got %v, want allowed %v", err, want)
+				}
+				if err != nil && !errors.Is(err, errInvalidTransition) {
+					t.Fatalf("moderate: got %v, want errInvalidTransition", err)
+				}
+
+				r, err := s.GetReview(id)
+				if err != nil {
+					t.Fatalf("get review: %v", err)
+				}
+				wantStatus, wantReason := from, "setup"
+				switch {
+				case want:
+					wantStatus, wantReason = to, "because"
+				case from == ReviewPending:
+					wantReason = ""
+				}
+				if r.Status != wantStatus || r.ModerationReason != wantReason {
+					t.Errorf("review is %s (%q), want %s (%q)", r.Status, r.ModerationReason, wantStatus, wantReason)
+				}
+			})
+		}
+	}
+
+	if err := s.ModerateReview(1<<30, ReviewApproved, "", "mod"); !errors.Is(err, errNotFound) {
+		t.Errorf("moderate missing review: got %v, want errNotFound", err)
+	}
+	id, err := s.CreateReview(dbReview{ProductID: productID, Author: "author", Rating: 3}, "", nil)
+	if err != nil {
+		t.Fatalf("create review: %v", err)
+	}
+	if err := s.DeleteProduct(productID, 1); err != nil {
+		t.Fatalf("delete product: %v", err)
+	}
+	if err := s.ModerateReview(id, ReviewApproved, "", "mod"); !errors.Is(err, errNotFound) {
+		t.Errorf("moderate review of a deleted product: got %v, want errNotFound", err)
+	}
+}
+
+func TestRankRatedProducts(t *testing.T) {
+	s := newTestStore(t)
+	approve := func(q sqlExecutor, r *dbReview) error {
+		r.Status = ReviewApproved
+		return nil
+	}
+	ids := make(map[string]int)
+	for _, p := range []struct {
+		name    string
+		ratings []int
+		pending bool
+	}{
+		{name: "one five", ratings: []int{5}},
+		{name: "ten fours", ratings: []int{4, 4, 4, 4, 4, 4, 4, 4, 4, 4}},
+		{name: "three threes", ratings: []int{3, 3, 3}},
+		{name: "pending fives", ratings: []int{5, 5}, pending: true},
+		{name: "unreviewed"},
+		{name: "deleted", ratings: []int{5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5}},
+	} {
+		id, err := s.CreateProduct(p.name, "", 1000, BaseCurrency, nil, true, 1)
+		if err != nil {
+			t.Fatalf("create product: %v", err)
+		}
+		ids[p.name] = id
+		screen := approve
+		if p.pending {
+			screen = nil
+		}
+		for _, rating := range p.ratings {
+			if _, err := s.CreateReview(dbReview{ProductID: id, Author: "author", Rating: rating}, "", screen); err != nil {
+				t.Fatalf("create review: %v", err)
+			}
+		}
+	}
+	if err := s.DeleteProduct(ids["deleted"], 1); err != nil {
+		t.Fatalf("delete product: %v", err)
+	}
+
+	// With five reviews of 3.0 blended in: one five is (5+15)/6 = 3.33, ten
+	// fours (40+15)/15 = 3.67 and three threes (9+15)/8 = 3.
+	const prior, weight = 3.0, 5
+	ranked := func(order string) string {
+		t.Helper()
+		rated, err := s.RankRatedProducts(order, prior, weight, 10)
+		if err != nil {
+			t.Fatalf("rank %s: %v", order, err)
+		}
+		var got []string
+		for _, p := range rated {
+			got = append(got, fmt.Sprintf("%s %.2f/%d", p.Name, p.WeightedRating, p.ReviewCount))
+		}
+		return strings.Join(got, ", ")
+	}
+	if got, want := ranked("top_rated"), "ten fours 3.67/10, one five 3.33/1, three threes 3.00/3"; got != want {
+		t.Errorf("top_rated: got %s, want %s", got, want)
+	}
+	if got, want := ranked("most_reviewed"), "ten fours 3.67/10, three threes 3.00/3, one five 3.33/1"; got != want {
+		t.Errorf("most_reviewed: got %s, want %s", got, want)
+	}
+	if rated, err := s.RankRatedProducts("top_rated", prior, weight, 1); err != nil || len(rated) != 1 {
+		t.Errorf("limit 1: got %d products, err %v", len(rated), err)
+	}
+	if _, err := s.RankRatedProducts("newest", prior, weight, 10); err == nil {
+		t.Error("an unknown order was accepted")
+	}
+
+	tests := []struct {
+		product string
+		prior   float64
+		weight  int
+		want    float64
+	}{
+		{"one five", prior, weight, 3.33},
+		{"one five", prior, 0, 5},
+		{"ten fours", 4.5, 10, 4.25},
+		{"pending fives", prior, weight, 3},
+		{"unreviewed", 3.456, weight, 3.46},
+		{"unreviewed", 3.456, 0, 3.46},
+	}
+	for _, tt := range tests {
+		got, err := s.GetWeightedRating(ids[tt.product], tt.prior, tt.weight)
+		if err != nil {
+			t.Fatalf("weighted rating of %s: %v", tt.product, err)
+		}
+		if got != tt.want {
+			t.Errorf("weighted rating of %s (prior %v, weight %d) = %v, want %v", tt.product, tt.prior, tt.weight, got, tt.want)
+		}
+	}
+}
+
+func TestCreateReviewVelocityLimitConcurrent(t *testing.T) {
+	s := newTestStore(t)
+	const limit, posters = 3, 30
+	screener := newReviewScreener(Config{ReviewClientLimit: limit, ReviewVelocityWindow: time.Hour, ReviewRejectScore: 100})
+
+	productID, err := s.CreateProduct("Reviewed", "", 1000, BaseCurrency, nil, true, 1)
+	if err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+
+	var mu sync.Mutex
+	next := 0
+	succeeded := hammer(t, posters, errTooManyReviews, func() error {
+		mu.Lock()
+		next++
+		author := fmt.Sprint("author ", next)
+		mu.Unlock()
+		sub := &reviewSubmission{ProductID: productID, Author: author, Rating: 5, Client: "203.0.113.9"}
+		review := dbReview{ProductID: productID, Author: author, Rating: 5, Client: sub.Client}
+		_, err := s.CreateReview(review, "", func(q sqlExecutor, r *dbReview) error {
+			v, err := screener.screen(q, sub)
+			r.Status = v.Status
+			return err
+		})
+		return err
+	})
+	if succeeded != limit {
+		t.Errorf("%d reviews accepted, want %d", succeeded, limit)
+	}
+}
+
+func TestCreateReviewVerifiedPurchase(t *testing.T) {
+	s := newTestStore(t)
+	productID, err := s.CreateProduct("Bought", "", 1000, BaseCurrency, nil, true, 5)
+	if err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	orderID, err := s.CreateOrder("Alice", "key:7", []OrderLineRequest{{ProductID: productID, Quantity: 1}}, time.Hour)
+	if err != nil {
+		t.Fatalf("create order: %v", err)
+	}
+	if err := s.TransitionOrder(orderID, OrderConfirmed, "", "test"); err != nil {
+		t.Fatalf("confirm order: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		author string
+		buyer  string
+		want   bool
+	}{
+		{"key that ordered", "anyone", "key:7", true},
+		{"other key", "Alice", "key:8", false},
+		{"anonymous with the customer's name", "Alice", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := s.CreateReview(dbReview{ProductID: productID, Author: tt.author, Rating: 4}, tt.buyer, nil)
+			if err != nil {
+				t.Fatalf("create review: %v", err)
+			}
+			r, err := s.GetReview(id)
+			if err != nil {
+				t.Fatalf("get review: %v", err)
+			}
+			if r.VerifiedPurchase != tt.want {
+				t.Errorf("verified_purchase = %v, want %v", r.VerifiedPurchase, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryProductsPaging(t *testing.T) {
+	s := newTestStore(t)
+	categoryID, err := s.CreateCategory("paging", "Paging", "", nil)
+	if err != nil {
+		t.Fatalf("create category: %v", err)
+	}
+	// Repeated prices and quantities make pages break inside ties.
+	for _, p := range []struct {
+		name     string
+		cents    int
+		quantity int
+	}{
+		{"b", 300, 2}, {"a", 100, 5}, {"e", 200, 2}, {"c", 300, 0}, {"g", 300, 2}, {"d", 100, 0}, {"f", 200, 5},
+	} {
+		if _, err := s.CreateProduct(p.name, "", p.cents, BaseCurrency, &categoryID, p.quantity > 0, p.quantity); err != nil {
+			t.Fatalf("create product: %v", err)
+		}
+	}
+
+	all, _, _, err := s.QueryProducts(ProductQuery{Category: "paging", Sort: "created_at", Limit: 100})
+	if err != nil {
+		t.Fatalf("query products: %v", err)
+	}
+	key := map[string]func(p dbProduct) string{
+		"name":       func(p dbProduct) string { return p.Name },
+		"price":      func(p dbProduct) string { return fmt.Sprintf("%09d", p.PriceCents) },
+		"quantity":   func(p dbProduct) string { return fmt.Sprintf("%09d", p.Quantity) },
+		"created_at": func(p dbProduct) string { return p.CreatedAt.Format(time.RFC3339Nano) },
+	}
+	// want returns the IDs of the products passing keep, ordered by sort with
+	// ties broken by ID in the same direction.
+	want := func(sortKey string, desc bool, keep func(p dbProduct) bool) []int {
+		var ps []dbProduct
+		for _, p := range all {
+			if keep(p) {
+				ps = append(ps, p)
+			}
+		}
+		sort.SliceStable(ps, func(i, j int) bool {
+			ki, kj := key[sortKey](ps[i]), key[sortKey](ps[j])
+			if ki == kj {
+				return (ps[i].ID < ps[j].ID) != desc
+			}
+			return (ki < kj) != desc
+		})
+		ids := make([]int, len(ps))
+		for i, p := range ps {
+			ids[i] = p.ID
+		}
+		return ids
+	}
+	// page walks every page of q, passing each cursor through its token.
+	page := func(t *testing.T, q ProductQuery) ([]int, int) {
+		var ids []int
+		total := -1
+		for {
+			products, next, n, err := s.QueryProducts(q)
+			if err != nil {
+				t.Fatalf("query products: %v", err)
+			}
+			if total >= 0 && n != total {
+				t.Fatalf("total changed from %d to %d between pages", total, n)
+			}
+			total = n
+			for _, p := range products {
+				ids = append(ids, p.ID)
+			}
+			if next == nil {
+				return ids, total
+			}
+			if q.After, err = decodeCursor(encodeCursor(*next)); err != nil {
+				t.Fatalf("decode cursor: %v", err)
+			}
+		}
+	}
+
+	intPtr := func(n int) *int { return &n }
+	boolPtr := func(b bool) *bool { return &b }
+	everything := func(dbProduct) bool { return true }
+	tests := []struct {
+		name string
+		q    ProductQuery
+		keep func(p dbProduct) bool
+	}{
+		{"name", ProductQuery{Sort: "name"}, everything},
+		{"-name", ProductQuery{Sort: "name", Desc: true}, everything},
+		{"price", ProductQuery{Sort: "price"}, everything},
+		{"-price", ProductQuery{Sort: "price", Desc: true}, everything},
+		{"quantity", ProductQuery{Sort: "quantity"}, everything},
+		{"-quantity", ProductQuery{Sort: "quantity", Desc: true}, everything},
+		{"created_at", ProductQuery{Sort: "created_at"}, everything},
+		{"-created_at", ProductQuery{Sort: "created_at", Desc: true}, everything},
+		{"in stock", ProductQuery{Sort: "name", InStock: boolPtr(true)}, func(p dbProduct) bool { return p.InStock }},
+		{"price range", ProductQuery{Sort: "quantity", MinPriceCents: intPtr(200), MaxPriceCents: intPtr(250)},
+			func(p dbProduct) bool { return p.PriceCents >= 200 && p.PriceCents <= 250 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.q.Category, tt.q.Limit = "paging", 2
+			got, total := page(t, tt.q)
+			w := want(tt.q.Sort, tt.q.Desc, tt.keep)
+			if fmt.Sprint(got) != fmt.Sprint(w) {
+				t.Errorf("got %v, want %v", got, w)
+			}
+			if total != len(w) {
+				t.Errorf("total = %d, want %d", total, len(w))
+			}
+		})
+	}
+
+	_, next, _, err := s.QueryProducts(ProductQuery{Category: "paging", Sort: "name", Limit: 2})
+	if err != nil || next == nil {
+		t.Fatalf("first page: cursor %v, err %v", next, err)
+	}
+	if _, _, _, err := s.QueryProducts(ProductQuery{Category: "paging", Sort: "quantity", Limit: 2, After: next}); err == nil {
+		t.Error("a name cursor was accepted for a quantity sort")
+	}
+}
+
+func TestQueryProductsPriceAcrossCurrencies(t *testing.T) {
+	s := newTestStore(t)
+	categoryID, err := s.CreateCategory("fx", "FX", "", nil)
+	if err != nil {
+		t.Fatalf("create category: %v", err)
+	}
+	for currency, rate := range map[string]string{"EUR": "0.5", "GBP": "1"} {
+		if err := s.SetExchangeRate(currency, rate); err != nil {
+			t.Fatalf("set rate: %v", err)
+		}
+	}
+	ids := make(map[string]int)
+	for _, p := range []struct {
+		name     string
+		cents    int
+		currency string
+	}{
+		{"dollars", 1000, "USD"}, // $10
+		{"euros", 1500, "EUR"},   // $30
+		{"pounds", 1200, "GBP"},  // $12, overridden to $5
+	} {
+		id, err := s.CreateProduct(p.name, "", p.cents, p.currency, &categoryID, true, 1)
+		if err != nil {
+			t.Fatalf("create product: %v", err)
+		}
+		ids[p.name] = id
+	}
+	if _, err := s.SetPriceOverride(ids["pounds"], nil, "USD", 500); err != nil {
+		t.Fatalf("set override: %v", err)
+	}
+
+	names := func(q ProductQuery) []string {
+		t.Helper()
+		var got []string
+		for {
+			page, next, _, err := s.QueryProducts(q)
+			if err != nil {
+				t.Fatalf("query products: %v", err)
+			}
+			for _, p := range page {
+				got = append(got, p.Name)
+			}
+			if next == nil {
+				return got
+			}
+			q.After = next
+		}
+	}
+	intPtr := func(n int) *int { return &n }
+
+	tests := []struct {
+		name string
+		q    ProductQuery
+		want []string
+	}{
+		{"sort by dollar price", ProductQuery{Sort: "price"}, []string{"pounds", "dollars", "euros"}},
+		{"descending", ProductQuery{Sort: "price", Desc: true}, []string{"euros", "dollars", "pounds"}},
+		{"dollar minimum", ProductQuery{Sort: "price", MinPriceCents: intPtr(2000)}, []string{"euros"}},
+		{"euro maximum", ProductQuery{Sort: "price", PriceCurrency: "EUR", MaxPriceCents: intPtr(600)}, []string{"dollars", "pounds"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.q.Category, tt.q.Limit = "fx", 1
+			if got := names(tt.q); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if err := s.DeleteExchangeRate("GBP"); err != nil {
+		t.Fatalf("delete rate: %v", err)
+	}
+	if _, _, _, err := s.QueryProducts(ProductQuery{Category: "fx", Sort: "price", Limit: 10}); !errors.Is(err, errNoExchangeRate) {
+		t.Errorf("sort without a GBP rate: got %v, want errNoExchangeRate", err)
+	}
+}
+
+func TestCreateOrderCurrency(t *testing.T) {
+	s := newTestStore(t)
+	dollars, err := s.CreateProduct("Dollars", "", 1000, "USD", nil, true, 5)
+	if err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	euros, err := s.CreateProduct("Euros", "", 900, "EUR", nil, true, 5)
+	if err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+
+	_, err = s.CreateOrder("customer", "test", []OrderLineRequest{
+		{ProductID: dollars, Quantity: 1},
+		{ProductID: euros, Quantity: 1},
+	}, time.Hour)
+	if !errors.Is(err, errMixedCurrencies) {
+		t.Fatalf("mixed order: got %v, want errMixedCurrencies", err)
+	}
+	if p, _ := s.GetProduct(dollars); p.Quantity != 5 {
+		t.Errorf("quantity after rejected order = %d, want 5", p.Quantity)
+	}
+
+	orderID, err := s.CreateOrder("customer", "test", []OrderLineRequest{{ProductID: euros, Quantity: 2}}, time.Hour)
+	if err != nil {
+		t.Fatalf("create order: %v", err)
+	}
+	o, err := s.GetOrder(orderID)
+	if err != nil {
+		t.Fatalf("get order: %v", err)
+	}
+	if o.Currency != "EUR" || o.TotalCents != 1800 {
+		t.Errorf("order total = %d %s, want 1800 EUR", o.TotalCents, o.Currency)
+	}
+}
+
+func TestTransitionOrderConcurrent(t *testing.T) {
+	s := newTestStore(t)
+	const stock = 10
+	productID, err := s.CreateProduct("Ordered", "", 1000, BaseCurrency, nil, true, stock)
+	if err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	orderID, err := s.CreateOrder("customer", "test", []OrderLineRequest{{ProductID: productID, Quantity: 3}}, time.Hour)
+	if err != nil {
+		t.Fatalf("create order: %v", err)
+	}
+
+	succeeded := hammer(t, 20, errInvalidTransition, func() error {
+		return s.TransitionOrder(orderID, OrderCancelled, "", "test")
+	})
+	if succeeded != 1 {
+		t.Errorf("%d cancellations succeeded, want 1", succeeded)
+	}
+
+	var quantity int
+	if err := s.db.QueryRow(`SELECT quantity FROM products WHERE id = ?`, productID).Scan(&quantity); err != nil {
+		t.Fatalf("read product: %v", err)
+	}
+	if quantity != stock {
+		t.Errorf("quantity = %d after cancelling, want %d", quantity, stock)
+	}
+}
+
+func TestCreatePriceScheduleOverlapConcurrent(t *testing.T) {
+	s := newTestStore(t)
+	productID, err := s.CreateProduct("Scheduled", "", 1000, BaseCurrency, nil, true, 1)
+	if err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	start := time.Now().Add(time.Hour)
+	end := start.Add(time.Hour)
+
+	succeeded := hammer(t, 20, errScheduleOverlap, func() error {
+		_, err := s.CreatePriceSchedule(dbPriceSchedule{
+			ProductID:  productID,
+			PriceCents: 500,
+			StartsAt:   start,
+			EndsAt:     &end,
+		})
+		return err
+	})
+	if succeeded != 1 {
+		t.Errorf("%d overlapping schedules created, want 1", succeeded)
+	}
+}
+
+func TestUpdateCategoryErrors(t *testing.T) {
+	s := newTestStore(t)
+	id, err := s.CreateCategory("garden", "Garden", "", nil)
+	if err != nil {
+		t.Fatalf("create category: %v", err)
+	}
+	missing := 999999
+	if _, err := s.CreateCategory("tools", "Tools", "", &missing); !errors.Is(err, errParentNotFound) {
+		t.Errorf("create under missing parent: got %v, want errParentNotFound", err)
+	}
+	if err := s.UpdateCategory(id, "garden", "Garden", "", &missing); !errors.Is(err, errParentNotFound) {
+		t.Errorf("update to missing parent: got %v, want errParentNotFound", err)
+	}
+	if err := s.UpdateCategory(missing, "gone", "Gone", "", nil); !errors.Is(err, errNotFound) {
+		t.Errorf("update missing category: got %v, want errNotFound", err)
+	}
+}
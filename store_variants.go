@@ -2,32 +2,15 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"time"
 )
 
-// createVariantTable creates the variants table if it doesn't exist.
-func createVariantTable(s *Store) error {
-	_, err := s.db.Exec(`
-		CREATE TABLE IF NOT EXISTS variants (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			product_id INTEGER NOT NULL,
-			sku TEXT NOT NULL,
-			name TEXT NOT NULL,
-			price_cents INTEGER DEFAULT 0,
-			quantity INTEGER DEFAULT 0,
-			in_stock BOOLEAN DEFAULT 1,
-			attributes TEXT DEFAULT '{}',
-			sort_order INTEGER DEFAULT 0,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE(sku),
-			FOREIGN KEY (product_id) REFERENCES products(id)
-		)
-	`)
-	return err
-}
+const variantColumns = `id, product_id, sku, name, price_cents, currency, quantity, in_stock, attributes, sort_order, created_at, updated_at, version`
 
-// CreateVariant inserts a new variant for a product.
+// CreateVariant inserts a new variant for a product, priced in the
+// product's currency. It returns errNotFound if the product does not exist or
+// is deleted.
 func (s *Store) CreateVariant(productID int, sku, name string, priceCents, quantity int, attributes string, sortOrder int) (int, error) {
 	if sku == "" {
 		return 0, fmt.Errorf("sku is required")
@@ -36,19 +19,19 @@ func (s *Store) CreateVariant(productID int, sku, name string, priceCents, quant
 		return 0, fmt.Errorf("name is required")
 	}
 
-	// Verify product exists.
+	// Verify product exists and is not deleted.
 	_, err := s.GetProduct(productID)
 	if err != nil {
-		return 0, fmt.Errorf("product not found")
+		return 0, errNotFound
 	}
 
 	inStock := quantity > 0
 	now := time.Now().UTC()
 
 	result, err := s.db.Exec(
-		`INSERT INTO variants (product_id, sku, name, price_cents, quantity, in_stock, attributes, sort_order, created_at, updated_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		productID, sku, name, priceCents, quantity, inStock, attributes, sortOrder, now, now,
+		`INSERT INTO variants (product_id, sku, name, price_cents, currency, quantity, in_stock, attributes, sort_order, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, (SELECT currency FROM products WHERE id = ?), ?, ?, ?, ?, ?, ?)`,
+		productID, sku, name, priceCents, productID, quantity, inStock, attributes, sortOrder, now, now,
 	)
 	if err != nil {
 		return 0, fmt.Errorf("insert variant: %w", err)
@@ -62,11 +45,14 @@ func (s *Store) CreateVariant(productID int, sku, name string, priceCents, quant
 	return int(id), nil
 }
 
+// Variants belong to their product's lifecycle: while it is soft-deleted they
+// cannot be read, changed or bought, and restoring it brings them back.
+
 // ListVariants returns all variants for a product, ordered by sort_order.
 func (s *Store) ListVariants(productID int) ([]dbVariant, error) {
 	rows, err := s.db.Query(
-		`SELECT id, product_id, sku, name, price_cents, quantity, in_stock, attributes, sort_order, created_at, updated_at
-		 FROM variants WHERE product_id = ? ORDER BY sort_order ASC, id ASC`,
+		`SELECT `+variantColumns+`
+		 FROM variants WHERE product_id = ? AND `+liveProductFilter+` ORDER BY sort_order ASC, id ASC`,
 		productID,
 	)
 	if err != nil {
@@ -77,8 +63,8 @@ func (s *Store) ListVariants(productID int) ([]dbVariant, error) {
 	var variants []dbVariant
 	for rows.Next() {
 		var v dbVariant
-		err := rows.Scan(&v.ID, &v.ProductID, &v.SKU, &v.Name, &v.PriceCents,
-			&v.Quantity, &v.InStock, &v.Attributes, &v.SortOrder, &v.CreatedAt, &v.UpdatedAt)
+		err := rows.Scan(&v.ID, &v.ProductID, &v.SKU, &v.Name, &v.PriceCents, &v.Currency,
+			&v.Quantity, &v.InStock, &v.Attributes, &v.SortOrder, &v.CreatedAt, &v.UpdatedAt, &v.Version)
 		if err != nil {
 			return nil, fmt.Errorf("scan variant: %w", err)
 		}
@@ -91,11 +77,11 @@ func (s *Store) ListVariants(productID int) ([]dbVariant, error) {
 func (s *Store) GetVariant(variantID int) (*dbVariant, error) {
 	var v dbVariant
 	err := s.db.QueryRow(
-		`SELECT id, product_id, sku, name, price_cents, quantity, in_stock, attributes, sort_order, created_at, updated_at
-		 FROM variants WHERE id = ?`,
+		`SELECT `+variantColumns+`
+		 FROM variants WHERE id = ? AND `+liveProductFilter,
 		variantID,
-	).Scan(&v.ID, &v.ProductID, &v.SKU, &v.Name, &v.PriceCents,
-		&v.Quantity, &v.InStock, &v.Attributes, &v.SortOrder, &v.CreatedAt, &v.UpdatedAt)
+	).Scan(&v.ID, &v.ProductID, &v.SKU, &v.Name, &v.PriceCents, &v.Currency,
+		&v.Quantity, &v.InStock, &v.Attributes, &v.SortOrder, &v.CreatedAt, &v.UpdatedAt, &v.Version)
 	if err != nil {
 		return nil, err
 	}
@@ -106,78 +92,71 @@ func (s *Store) GetVariant(variantID int) (*dbVariant, error) {
 func (s *Store) GetVariantBySKU(sku string) (*dbVariant, error) {
 	var v dbVariant
 	err := s.db.QueryRow(
-		`SELECT id, product_id, sku, name, price_cents, quantity, in_stock, attributes, sort_order, created_at, updated_at
-		 FROM variants WHERE sku = ?`,
+		`SELECT `+variantColumns+`
+		 FROM variants WHERE sku = ? AND `+liveProductFilter,
 		sku,
-	).Scan(&v.ID, &v.ProductID, &v.SKU, &v.Name, &v.PriceCents,
-		&v.Quantity, &v.InStock, &v.Attributes, &v.SortOrder, &v.CreatedAt, &v.UpdatedAt)
+	).Scan(&v.ID, &v.ProductID, &v.SKU, &v.Name, &v.PriceCents, &v.Currency,
+		&v.Quantity, &v.InStock, &v.Attributes, &v.SortOrder, &v.CreatedAt, &v.UpdatedAt, &v.Version)
 	if err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
-// UpdateVariant updates fields for a variant.
-func (s *Store) UpdateVariant(variantID int, sku, name string, priceCents, quantity int, inStock bool, attributes string, sortOrder int) error {
+// UpdateVariant updates fields for a variant that is still at the given
+// version. Errors are as for UpdateProduct.
+func (s *Store) UpdateVariant(variantID, version int, sku, name string, priceCents, quantity int, inStock bool, attributes string, sortOrder int) error {
 	now := time.Now().UTC()
 	result, err := s.db.Exec(
 		`UPDATE variants SET sku = ?, name = ?, price_cents = ?, quantity = ?, in_stock = ?, attributes = ?, sort_order = ?, updated_at = ?
-		 WHERE id = ?`,
-		sku, name, priceCents, quantity, inStock, attributes, sortOrder, now, variantID,
+		 WHERE id = ? AND version = ? AND `+liveProductFilter,
+		sku, name, priceCents, quantity, inStock, attributes, sortOrder, now, variantID, version,
 	)
 	if err != nil {
 		return fmt.Errorf("update variant: %w", err)
 	}
+	return s.checkVersionedWrite(result, `SELECT 1 FROM variants WHERE id = ? AND `+liveProductFilter, variantID)
+}
 
-	rows, err := result.RowsAffected()
+// DeleteVariant removes a variant that is still at the given version, along
+// with its images and prices. The removed images are returned so the caller
+// can remove their files.
+func (s *Store) DeleteVariant(variantID, version int) ([]dbImage, error) {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return err
-	}
-	if rows == 0 {
-		return fmt.Errorf("variant not found")
+		return nil, err
 	}
-	return nil
-}
+	defer tx.Rollback()
 
-// DeleteVariant removes a variant by ID.
-func (s *Store) DeleteVariant(variantID int) error {
-	result, err := s.db.Exec(`DELETE FROM variants WHERE id = ?`, variantID)
+	rows, err := tx.Query(`DELETE FROM product_images WHERE variant_id = ? RETURNING `+imageColumns, variantID)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("delete variant images: %w", err)
 	}
-	rows, err := result.RowsAffected()
+	images, err := scanImages(rows)
+	rows.Close()
 	if err != nil {
-		return err
-	}
-	if rows == 0 {
-		return fmt.Errorf("variant not found")
+		return nil, err
 	}
-	return nil
-}
 
-// DeleteVariantsByProduct removes all variants for a product.
-func (s *Store) DeleteVariantsByProduct(productID int) error {
-	_, err := s.db.Exec(`DELETE FROM variants WHERE product_id = ?`, productID)
-	return err
+	result, err := tx.Exec(`DELETE FROM variants WHERE id = ? AND version = ? AND `+liveProductFilter, variantID, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkVersionedWrite(result, `SELECT 1 FROM variants WHERE id = ? AND `+liveProductFilter, variantID); err != nil {
+		return nil, err
+	}
+	return images, tx.Commit()
 }
 
-// DecrementVariantQuantity decreases a variant's quantity by 1.
-func (s *Store) DecrementVariantQuantity(variantID int) error {
-	var currentQty int
-	err := s.db.QueryRow(`SELECT quantity FROM variants WHERE id = ?`, variantID).Scan(&currentQty)
+// DecrementVariantQuantity atomically removes quantity units from a variant's
+// stock and returns the quantity remaining. Like DecrementQuantity it fails
+// with errInsufficientStock rather than letting stock go negative.
+func (s *Store) DecrementVariantQuantity(productID, variantID, quantity int) (int, error) {
+	line, err := reserveVariantStock(s.db, productID, variantID, quantity, time.Now().UTC())
 	if err != nil {
-		return err
+		return 0, err
 	}
-
-	newQty := currentQty - 1
-	inStock := newQty > 0
-	now := time.Now().UTC()
-
-	_, err = s.db.Exec(
-		`UPDATE variants SET quantity = ?, in_stock = ?, updated_at = ? WHERE id = ?`,
-		newQty, inStock, now, variantID,
-	)
-	return err
+	return line.remaining, nil
 }
 
 // GetVariantInventory returns an inventory summary for a product's variants.
@@ -187,7 +166,7 @@ func (s *Store) GetVariantInventory(productID int) (*VariantInventory, error) {
 
 	err := s.db.QueryRow(
 		`SELECT COUNT(*), COALESCE(SUM(quantity), 0), SUM(CASE WHEN in_stock = 1 THEN 1 ELSE 0 END)
-		 FROM variants WHERE product_id = ?`,
+		 FROM variants WHERE product_id = ? AND `+liveProductFilter,
 		productID,
 	).Scan(&inv.VariantCount, &inv.TotalStock, &inv.InStockCount)
 	if err != nil {
@@ -196,20 +175,102 @@ func (s *Store) GetVariantInventory(productID int) (*VariantInventory, error) {
 	return &inv, nil
 }
 
-// BulkUpdateVariantPrices updates price for all variants of a product by a percentage.
-func (s *Store) BulkUpdateVariantPrices(productID int, multiplier float64) (int, error) {
-	now := time.Now().UTC()
-	result, err := s.db.Exec(
-		`UPDATE variants SET price_cents = CAST(price_cents * ? AS INTEGER), updated_at = ?
-		 WHERE product_id = ?`,
-		multiplier, now, productID,
-	)
+// repriceScope selects the variants a reprice applies to: those of one
+// product, of the products in a category and its subcategories, or, with
+// neither set, of the whole catalog. Currency, if set, further limits it to
+// products priced in that currency. Variants of deleted products are never
+// included. OneCurrency refuses a reprice whose priced variants are in more
+// than one currency, for rules with amounts that only make sense in one.
+type repriceScope struct {
+	ProductID   *int
+	Category    string
+	Currency    string
+	OneCurrency bool
+}
+
+// repricedVariant is a variant matched by a reprice together with the price
+// the rule gave it. Limited reports that a floor or ceiling applied.
+type repricedVariant struct {
+	Variant       dbVariant
+	NewPriceCents int
+	Limited       bool
+}
+
+// RepriceVariants sets the price of every variant in scope to the one newPrice
+// computes from its current price, in a single transaction. With dryRun the
+// transaction is rolled back, so the result shows what would change without
+// writing anything. Variants are returned in product and sort order. If
+// scope.OneCurrency is set and the variants to reprice are in different
+// currencies, nothing is written and errMixedCurrencies is returned.
+func (s *Store) RepriceVariants(scope repriceScope, newPrice func(cents int) (int, bool), dryRun bool) ([]repricedVariant, error) {
+	where, args := []string{`p.deleted_at IS NULL`}, []interface{}{}
+	if scope.ProductID != nil {
+		where = append(where, `v.product_id = ?`)
+		args = append(args, *scope.ProductID)
+	}
+	if scope.Category != "" {
+		where = append(where, categorySubtreeFilter(`p.category_id`))
+		args = append(args, slugify(scope.Category))
+	}
+	if scope.Currency != "" {
+		where = append(where, `p.currency = ?`)
+		args = append(args, scope.Currency)
+	}
+
+	tx, err := s.db.Begin()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	rows, err := result.RowsAffected()
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`SELECT v.id, v.product_id, v.sku, v.name, v.price_cents, v.currency, v.quantity, v.in_stock, v.attributes,
+		        v.sort_order, v.created_at, v.updated_at, v.version
+		 FROM variants v JOIN products p ON p.id = v.product_id
+		 WHERE `+strings.Join(where, ` AND `)+`
+		 ORDER BY v.product_id, v.sort_order, v.id`,
+		args...,
+	)
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("list variants to reprice: %w", err)
+	}
+	var repriced []repricedVariant
+	currency := ""
+	for rows.Next() {
+		var v dbVariant
+		err := rows.Scan(&v.ID, &v.ProductID, &v.SKU, &v.Name, &v.PriceCents, &v.Currency,
+			&v.Quantity, &v.InStock, &v.Attributes, &v.SortOrder, &v.CreatedAt, &v.UpdatedAt, &v.Version)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan variant: %w", err)
+		}
+		if scope.OneCurrency && v.PriceCents != 0 {
+			if currency == "" {
+				currency = v.Currency
+			} else if v.Currency != currency {
+				rows.Close()
+				return nil, fmt.Errorf("variants priced in %s and %s: %w", currency, v.Currency, errMixedCurrencies)
+			}
+		}
+		cents, limited := newPrice(v.PriceCents)
+		repriced = append(repriced, repricedVariant{Variant: v, NewPriceCents: cents, Limited: limited})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return repriced, nil
+	}
+
+	now := time.Now().UTC()
+	for _, rv := range repriced {
+		if rv.NewPriceCents == rv.Variant.PriceCents {
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE variants SET price_cents = ?, updated_at = ? WHERE id = ?`, rv.NewPriceCents, now, rv.Variant.ID); err != nil {
+			return nil, fmt.Errorf("reprice variant %d: %w", rv.Variant.ID, err)
+		}
 	}
-	return int(rows), nil
+	return repriced, tx.Commit()
 }
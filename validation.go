@@ -0,0 +1,408 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on request fields. Lengths are in characters (runes), not bytes, so
+// non-ASCII text is never cut mid-character; over-long values are rejected
+// rather than truncated. The HTML forms use the same limits.
+const (
+	maxNameLength           = 200
+	maxDescriptionLength    = 2000
+	maxCategoryLength       = 64
+	maxCategoryNameLength   = 100
+	maxSKULength            = 64
+	maxAttributes           = 20
+	maxAttributeKeyLength   = 32
+	maxAttributeValueLength = 100
+	maxAuthorLength         = 100
+	maxCommentLength        = 2000
+	maxAltTextLength        = 250
+	maxNoteLength           = 500
+	maxReasonLength         = 500
+	maxPrice                = 1000000
+	maxQuantity             = 1000000
+)
+
+// formLimits exposes the limits to templates.
+var formLimits = map[string]int{
+	"Name":        maxNameLength,
+	"Description": maxDescriptionLength,
+	"Price":       maxPrice,
+	"Quantity":    maxQuantity,
+}
+
+var (
+	skuPattern          = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	slugPattern         = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	attributeKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+)
+
+// Validate normalizes the request (trimming surrounding whitespace) and
+// checks it, returning every field error found.
+func (req *CreateProductRequest) Validate() error {
+	var errs validationError
+	req.Name = strings.TrimSpace(req.Name)
+	req.Category = strings.TrimSpace(req.Category)
+
+	checkText(&errs, "name", req.Name, true, maxNameLength, false)
+	checkText(&errs, "description", req.Description, false, maxDescriptionLength, true)
+	if checkText(&errs, "category", req.Category, false, maxCategoryLength, false) {
+		for _, c := range req.Category {
+			if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != ' ' && c != '-' && c != '_' {
+				errs.add("category", "may contain only letters, digits, spaces, hyphens and underscores")
+				break
+			}
+		}
+	}
+	checkPrice(&errs, "price", &req.Price)
+	if req.Currency != "" {
+		checkCurrency(&errs, "currency", &req.Currency)
+	}
+	switch {
+	case req.Currency == "":
+		req.Currency = req.Price.Currency
+	case !req.Price.in(req.Currency):
+		errs.add("price", "must be in "+req.Currency)
+	}
+	checkQuantity(&errs, "quantity", req.Quantity)
+	return errs.err()
+}
+
+// Validate normalizes and checks a new variant.
+func (req *CreateVariantRequest) Validate() error {
+	var errs validationError
+	req.SKU = strings.TrimSpace(req.SKU)
+	req.Name = strings.TrimSpace(req.Name)
+	checkVariant(&errs, req.SKU, req.Name, &req.Price, req.Quantity, req.Attributes, req.SortOrder)
+	return errs.err()
+}
+
+// Validate normalizes and checks a variant update.
+func (req *UpdateVariantRequest) Validate() error {
+	var errs validationError
+	req.SKU = strings.TrimSpace(req.SKU)
+	req.Name = strings.TrimSpace(req.Name)
+	checkVariant(&errs, req.SKU, req.Name, &req.Price, req.Quantity, req.Attributes, req.SortOrder)
+	return errs.err()
+}
+
+// Validate normalizes and checks a new review.
+func (req *CreateReviewRequest) Validate() error {
+	var errs validationError
+	req.Author = strings.TrimSpace(req.Author)
+
+	checkText(&errs, "author", req.Author, true, maxAuthorLength, false)
+	if req.Rating < 1 || req.Rating > 5 {
+		errs.add("rating", "must be between 1 and 5")
+	}
+	checkText(&errs, "comment", req.Comment, false, maxCommentLength, true)
+	return errs.err()
+}
+
+// Validate normalizes and checks a moderation decision moving a review to
+// status to.
+func (req *ModerateReviewRequest) Validate(to string) error {
+	var errs validationError
+	req.Reason = strings.TrimSpace(req.Reason)
+
+	checkText(&errs, "reason", req.Reason, to != ReviewApproved, maxReasonLength, true)
+	return errs.err()
+}
+
+// Validate checks a helpfulness vote.
+func (req *ReviewVoteRequest) Validate() error {
+	var errs validationError
+	if req.Helpful == nil {
+		errs.add("helpful", "is required")
+	}
+	return errs.err()
+}
+
+// Validate normalizes and checks a merchant reply.
+func (req *ReviewReplyRequest) Validate() error {
+	var errs validationError
+	req.Body = strings.TrimSpace(req.Body)
+
+	checkText(&errs, "body", req.Body, true, maxCommentLength, true)
+	return errs.err()
+}
+
+// Validate normalizes and checks image metadata.
+func (req *UpdateImageRequest) Validate() error {
+	var errs validationError
+	req.AltText = strings.TrimSpace(req.AltText)
+
+	checkText(&errs, "alt_text", req.AltText, false, maxAltTextLength, false)
+	if req.SortOrder < 0 {
+		errs.add("sort_order", "must be non-negative")
+	}
+	return errs.err()
+}
+
+// Validate normalizes and checks a category, deriving the slug from the
+// name when none is given.
+func (req *CreateCategoryRequest) Validate() error {
+	var errs validationError
+	req.Name = strings.TrimSpace(req.Name)
+	req.Slug = strings.TrimSpace(req.Slug)
+	if req.Slug == "" {
+		req.Slug = slugify(req.Name)
+	}
+
+	checkText(&errs, "name", req.Name, true, maxCategoryNameLength, false)
+	if checkText(&errs, "slug", req.Slug, true, maxCategoryLength, false) && !slugPattern.MatchString(req.Slug) {
+		errs.add("slug", "may contain only lowercase letters and digits separated by single hyphens")
+	}
+	checkText(&errs, "description", req.Description, false, maxDescriptionLength, true)
+	if req.ParentID != nil && *req.ParentID <= 0 {
+		errs.add("parent_id", "must be a category ID")
+	}
+	return errs.err()
+}
+
+// Validate normalizes and checks a price schedule. Changes must be
+// scheduled for the future; to change a price now, update the product or
+// variant directly.
+func (req *CreatePriceScheduleRequest) Validate() error {
+	var errs validationError
+	req.Note = strings.TrimSpace(req.Note)
+
+	checkPrice(&errs, "price", &req.Price)
+	switch {
+	case req.StartsAt.IsZero():
+		errs.add("starts_at", "is required")
+	case !req.StartsAt.After(time.Now()):
+		errs.add("starts_at", "must be in the future")
+	}
+	if req.EndsAt != nil && !req.EndsAt.After(req.StartsAt) {
+		errs.add("ends_at", "must be after starts_at")
+	}
+	if req.VariantID != nil && *req.VariantID <= 0 {
+		errs.add("variant_id", "must be a variant ID")
+	}
+	checkText(&errs, "note", req.Note, false, maxNoteLength, false)
+	return errs.err()
+}
+
+// Validate normalizes and checks a reprice, defaulting to rounding to the
+// nearest cent.
+func (req *RepriceRequest) Validate() error {
+	var errs validationError
+	req.Rounding = strings.TrimSpace(req.Rounding)
+	req.Category = strings.TrimSpace(req.Category)
+	if req.Rounding == "" {
+		req.Rounding = RoundNearestCent
+	}
+
+	switch {
+	case req.Percent == nil && req.Delta == nil:
+		errs.add("percent", "either percent or delta is required")
+	case req.Percent != nil && req.Delta != nil:
+		errs.add("delta", "cannot be combined with percent")
+	case req.Percent != nil:
+		if math.IsNaN(*req.Percent) || *req.Percent <= -100 || *req.Percent > 1000 {
+			errs.add("percent", "must be greater than -100 and at most 1000")
+		}
+	case req.Delta != nil:
+		if checkMoneyCurrency(&errs, "delta", req.Delta) {
+			switch {
+			case req.Delta.Cents < -maxPrice*100 || req.Delta.Cents > maxPrice*100:
+				errs.add("delta", fmt.Sprintf("must be between -%d and %d", maxPrice, maxPrice))
+			case req.Delta.inexact:
+				errs.add("delta", "must have at most two decimal places")
+			}
+		}
+	}
+	if req.Rounding != RoundNearestCent && req.Rounding != RoundEnds99 {
+		errs.add("rounding", "must be nearest_cent or ends_99")
+	}
+	if req.MinPrice != nil {
+		checkPrice(&errs, "min_price", req.MinPrice)
+	}
+	if req.MaxPrice != nil {
+		checkPrice(&errs, "max_price", req.MaxPrice)
+	}
+	if req.MinPrice != nil && req.MaxPrice != nil && req.MinPrice.Cents > req.MaxPrice.Cents {
+		errs.add("max_price", "must not be less than min_price")
+	}
+	if _, ok := req.currency(); !ok {
+		errs.add("delta", "amounts must all be in the same currency")
+	}
+	checkText(&errs, "category", req.Category, false, maxCategoryLength, false)
+	return errs.err()
+}
+
+// currency returns the currency the reprice's amounts name, or "" if they
+// name none. It reports false if they name different currencies.
+func (req *RepriceRequest) currency() (string, bool) {
+	currency := ""
+	for _, m := range []*Money{req.Delta, req.MinPrice, req.MaxPrice} {
+		switch {
+		case m == nil || m.Currency == "":
+		case currency == "":
+			currency = m.Currency
+		case m.Currency != currency:
+			return "", false
+		}
+	}
+	return currency, true
+}
+
+// absoluteField returns the field of the first amount the reprice gives in
+// money rather than as a percentage, or "" if it gives none.
+func (req *RepriceRequest) absoluteField() string {
+	switch {
+	case req.Delta != nil:
+		return "delta"
+	case req.MinPrice != nil:
+		return "min_price"
+	case req.MaxPrice != nil:
+		return "max_price"
+	}
+	return ""
+}
+
+// Validate checks a price override.
+func (req *SetPriceOverrideRequest) Validate() error {
+	var errs validationError
+	checkPrice(&errs, "price", &req.Price)
+	if req.VariantID != nil && *req.VariantID <= 0 {
+		errs.add("variant_id", "must be a variant ID")
+	}
+	return errs.err()
+}
+
+// slugify lowercases s and joins its runs of ASCII letters and digits with
+// hyphens, so "Home & Office" becomes "home-office".
+func slugify(s string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, c := range strings.ToLower(s) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(c)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	return b.String()
+}
+
+func checkVariant(errs *validationError, sku, name string, price *Money, quantity int, attributes map[string]string, sortOrder int) {
+	if checkText(errs, "sku", sku, true, maxSKULength, false) && !skuPattern.MatchString(sku) {
+		errs.add("sku", "may contain only letters, digits, '.', '_' and '-', starting with a letter or digit")
+	}
+	checkText(errs, "name", name, true, maxNameLength, false)
+	checkPrice(errs, "price", price)
+	checkQuantity(errs, "quantity", quantity)
+	if sortOrder < 0 {
+		errs.add("sort_order", "must be non-negative")
+	}
+
+	if len(attributes) > maxAttributes {
+		errs.add("attributes", fmt.Sprintf("must have at most %d entries", maxAttributes))
+		return
+	}
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := attributes[key]
+		field := "attributes." + key
+		if checkText(errs, field, key, true, maxAttributeKeyLength, false) && !attributeKeyPattern.MatchString(key) {
+			errs.add(field, "key may contain only lowercase letters, digits, '_' and '-'")
+		}
+		checkText(errs, field, value, true, maxAttributeValueLength, false)
+	}
+}
+
+// checkText validates a text field and reports whether it passed. Multiline
+// fields may contain newlines and tabs; no field may contain other control
+// characters.
+func checkText(errs *validationError, field, value string, required bool, maxLen int, multiline bool) bool {
+	if !utf8.ValidString(value) {
+		errs.add(field, "must be valid UTF-8")
+		return false
+	}
+	if value == "" {
+		if required {
+			errs.add(field, "is required")
+			return false
+		}
+		return true
+	}
+	if n := utf8.RuneCountInString(value); n > maxLen {
+		errs.add(field, fmt.Sprintf("must be at most %d characters (got %d)", maxLen, n))
+		return false
+	}
+	for _, c := range value {
+		if unicode.IsControl(c) && !(multiline && (c == '\n' || c == '\r' || c == '\t')) {
+			errs.add(field, "must not contain control characters")
+			return false
+		}
+	}
+	return true
+}
+
+// checkPrice checks a price and normalizes the currency it names, if any.
+func checkPrice(errs *validationError, field string, price *Money) {
+	if !checkMoneyCurrency(errs, field, price) {
+		return
+	}
+	switch {
+	case price.Cents < 0:
+		errs.add(field, "must be non-negative")
+	case price.Cents > maxPrice*100:
+		errs.add(field, fmt.Sprintf("must be at most %d", maxPrice))
+	case price.inexact:
+		errs.add(field, "must have at most two decimal places")
+	}
+}
+
+// checkMoneyCurrency normalizes the currency an amount names, if any, and
+// reports whether it is supported.
+func checkMoneyCurrency(errs *validationError, field string, m *Money) bool {
+	if m.Currency == "" {
+		return true
+	}
+	code, ok := normalizeCurrency(m.Currency)
+	if !ok {
+		errs.add(field, "currency must be one of "+strings.Join(supportedCurrencies, ", "))
+		return false
+	}
+	m.Currency = code
+	return true
+}
+
+// checkCurrency normalizes a currency code in place and checks it is supported.
+func checkCurrency(errs *validationError, field string, currency *string) {
+	code, ok := normalizeCurrency(*currency)
+	if !ok {
+		errs.add(field, "must be one of "+strings.Join(supportedCurrencies, ", "))
+		return
+	}
+	*currency = code
+}
+
+func checkQuantity(errs *validationError, field string, quantity int) {
+	switch {
+	case quantity < 0:
+		errs.add(field, "must be non-negative")
+	case quantity > maxQuantity:
+		errs.add(field, fmt.Sprintf("must be at most %d", maxQuantity))
+	}
+}